@@ -0,0 +1,103 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+)
+
+// registered accounts and their primary currency, guarded by mu like the balances.
+// balances can still be kept for accounts that were never registered, e.g. the billing default account
+var accounts = make(map[string]currency.Currency)
+
+// how far below zero registered accounts can go in their primary currency, guarded by mu.
+// accounts without a limit and the other currencies of an account can't go negative
+var creditLimits = make(map[string]int64)
+
+// the lowest balance the account can be brought down to in cur, mu must be held
+func minBalance(accountID string, cur currency.Currency) int64 {
+	if c, ok := accounts[accountID]; !ok || c != cur {
+		return 0
+	}
+	return -creditLimits[accountID]
+}
+
+type CreateAccountParams struct {
+	ID       string `json:"id"`
+	Currency string `json:"currency"`
+}
+
+type AccountResponse struct {
+	ID       string            `json:"id"`
+	Currency currency.Currency `json:"currency"`
+	// available balance in the account currency, funds on hold are not included.
+	// negative when the account draws on its credit limit
+	Balance int64 `json:"balance"`
+	// how far below zero the balance can go
+	CreditLimit int64 `json:"credit_limit"`
+}
+
+// the account's response, mu must be held
+func accountResponse(id string, cur currency.Currency) *AccountResponse {
+	return &AccountResponse{ID: id, Currency: cur, Balance: balances[id][cur], CreditLimit: creditLimits[id]}
+}
+
+//encore:api public method=POST path=/accounts
+func CreateAccount(ctx context.Context, p *CreateAccountParams) (*AccountResponse, error) {
+	id := strings.TrimSpace(p.ID)
+	if id == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'id' is required"}
+	}
+	cur, err := currency.Parse(p.Currency)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := accounts[id]; ok {
+		return nil, &errs.Error{Code: errs.AlreadyExists, Message: fmt.Sprintf("account %q already exists", id)}
+	}
+	accounts[id] = cur
+	return accountResponse(id, cur), nil
+}
+
+//encore:api public method=GET path=/accounts/:accountID
+func GetAccount(ctx context.Context, accountID string) (*AccountResponse, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	cur, ok := accounts[accountID]
+	if !ok {
+		return nil, &errs.Error{Code: errs.NotFound, Message: fmt.Sprintf("account %q not found", accountID)}
+	}
+	return accountResponse(accountID, cur), nil
+}
+
+type CreditLimitParams struct {
+	// minor units of the account currency, zero keeps the balance from going negative
+	CreditLimit int64 `json:"credit_limit"`
+}
+
+// lets the account's balance in its currency go down to -credit_limit. lowering the limit below
+// what the account already owes doesn't change the balance, it only blocks further withdrawals
+//
+//encore:api public method=PUT path=/accounts/:accountID/credit-limit
+func SetCreditLimit(ctx context.Context, accountID string, p *CreditLimitParams) (*AccountResponse, error) {
+	if p.CreditLimit < 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'credit_limit' must not be negative"}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	cur, ok := accounts[accountID]
+	if !ok {
+		return nil, &errs.Error{Code: errs.NotFound, Message: fmt.Sprintf("account %q not found", accountID)}
+	}
+	creditLimits[accountID] = p.CreditLimit
+	return accountResponse(accountID, cur), nil
+}
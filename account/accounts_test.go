@@ -0,0 +1,119 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+)
+
+func TestCreateAccount(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	resp, err := CreateAccount(ctx, &CreateAccountParams{ID: "acc-1", Currency: "eur"})
+	if err != nil {
+		t.Fatalf("expected account, got %v", err)
+	}
+	if resp.ID != "acc-1" || resp.Currency != currency.EUR || resp.Balance != 0 {
+		t.Errorf("created %+v, want acc-1 in EUR with no balance", resp)
+	}
+
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.EUR, Amount: 500})
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 300})
+	got, err := GetAccount(ctx, "acc-1")
+	if err != nil {
+		t.Fatalf("expected lookup to succeed, got %v", err)
+	}
+	if got.Currency != currency.EUR || got.Balance != 500 {
+		t.Errorf("looked up %+v, want EUR balance 500", got)
+	}
+}
+
+func TestCreateAccount_Invalid(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_, _ = CreateAccount(ctx, &CreateAccountParams{ID: "acc-1", Currency: "USD"})
+
+	cases := []struct {
+		name     string
+		params   CreateAccountParams
+		wantCode errs.ErrCode
+	}{
+		{"duplicate", CreateAccountParams{ID: "acc-1", Currency: "EUR"}, errs.AlreadyExists},
+		{"unsupported currency", CreateAccountParams{ID: "acc-2", Currency: "GBP"}, errs.InvalidArgument},
+		{"missing id", CreateAccountParams{ID: " ", Currency: "USD"}, errs.InvalidArgument},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := CreateAccount(ctx, &tc.params)
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != tc.wantCode {
+				t.Errorf("expected %s error, got %v", tc.wantCode, err)
+			}
+		})
+	}
+	// the duplicate keeps the original currency
+	if got, _ := GetAccount(ctx, "acc-1"); got.Currency != currency.USD {
+		t.Errorf("acc-1 currency = %s, want USD", got.Currency)
+	}
+}
+
+func TestGetAccount_Missing(t *testing.T) {
+	resetBalances()
+
+	// a balance alone doesn't register the account
+	_ = AddBalance(context.Background(), &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 100})
+	_, err := GetAccount(context.Background(), "acc-1")
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.NotFound {
+		t.Errorf("expected NotFound error, got %v", err)
+	}
+}
+
+func TestSetCreditLimit(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_, _ = CreateAccount(ctx, &CreateAccountParams{ID: "acc-1", Currency: "USD"})
+	_ = Deduct(ctx, &DeductParams{AccountID: "acc-1", Currency: currency.USD, Amount: 100})
+
+	resp, err := SetCreditLimit(ctx, "acc-1", &CreditLimitParams{CreditLimit: 1000})
+	if err != nil {
+		t.Fatalf("expected limit to be set, got %v", err)
+	}
+	if resp.CreditLimit != 1000 || resp.Balance != 0 {
+		t.Errorf("set %+v, want credit limit 1000 and no balance", resp)
+	}
+	// the earlier deduct failed without a limit, now the account can go negative
+	if err := Deduct(ctx, &DeductParams{AccountID: "acc-1", Currency: currency.USD, Amount: 100}); err != nil {
+		t.Fatalf("expected deduct within the limit, got %v", err)
+	}
+	if got, _ := GetAccount(ctx, "acc-1"); got.Balance != -100 || got.CreditLimit != 1000 {
+		t.Errorf("looked up %+v, want balance -100 and credit limit 1000", got)
+	}
+
+	cases := []struct {
+		name      string
+		accountID string
+		limit     int64
+		wantCode  errs.ErrCode
+	}{
+		{"negative limit", "acc-1", -1, errs.InvalidArgument},
+		{"unknown account", "acc-2", 100, errs.NotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := SetCreditLimit(ctx, tc.accountID, &CreditLimitParams{CreditLimit: tc.limit})
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != tc.wantCode {
+				t.Errorf("expected %s error, got %v", tc.wantCode, err)
+			}
+		})
+	}
+}
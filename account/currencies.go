@@ -0,0 +1,24 @@
+package account
+
+import (
+	"context"
+
+	"pave-fees-api/internal/data"
+)
+
+type CurrenciesResponse struct {
+	Currencies []data.CurrencyInfo `json:"currencies"`
+}
+
+// lists the currencies bills and balances can use, with the number of decimal places of their minor unit
+//
+//encore:api public method=GET path=/currencies
+func ListCurrencies(ctx context.Context) (CurrenciesResponse, error) {
+	out := make([]data.CurrencyInfo, 0)
+	for _, info := range data.ListCurrencies() {
+		if info.Enabled {
+			out = append(out, info)
+		}
+	}
+	return CurrenciesResponse{Currencies: out}, nil
+}
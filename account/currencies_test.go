@@ -0,0 +1,38 @@
+package account
+
+import (
+	"context"
+	"testing"
+)
+
+func TestListCurrencies(t *testing.T) {
+	resp, err := ListCurrencies(context.Background())
+	if err != nil {
+		t.Fatalf("ListCurrencies returned error: %v", err)
+	}
+	got := make(map[string]int, len(resp.Currencies))
+	for _, c := range resp.Currencies {
+		if !c.Enabled {
+			t.Errorf("%s is listed but not enabled", c.Code)
+		}
+		if c.MinChargeAmount <= 0 {
+			t.Errorf("%s min charge amount = %d, want it set", c.Code, c.MinChargeAmount)
+		}
+		got[c.Code] = c.DecimalPlaces
+	}
+
+	for code, places := range map[string]int{"USD": 2, "EUR": 2, "GEL": 2, "JPY": 0} {
+		p, ok := got[code]
+		if !ok {
+			t.Errorf("%s isn't listed", code)
+			continue
+		}
+		if p != places {
+			t.Errorf("%s decimal places = %d, want %d", code, p, places)
+		}
+	}
+	// registered but not offered yet
+	if _, ok := got["GBP"]; ok {
+		t.Error("GBP is listed before it is enabled")
+	}
+}
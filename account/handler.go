@@ -1,6 +1,6 @@
 // Package account provides an in-memory simulation of an account ledger DB,
-// supporting crediting, withdrawing, and viewing balances for supported currencies.
-// It is used by the billing service to add to the balance after successful bill charges.
+// supporting crediting, withdrawing, and viewing balances and transactions for supported currencies.
+// It is used by the billing service to hold funds while a bill is charged and capture them when it settles.
 //
 // The in-memory storage is meant for demonstration and testing purposes only, we'd have a DB in a real app
 package account
@@ -8,40 +8,106 @@ package account
 import (
 	"context"
 	"sync"
+	"time"
 
 	"pave-fees-api/internal/currency"
 
 	"encore.dev/beta/errs"
 )
 
-// balances holds the in-memory ledger: currency code -> balance.
-// protected by mu for concurrent safety
+type TransactionKind string
+
+const (
+	TxnCredit TransactionKind = "CREDIT"
+	TxnDebit  TransactionKind = "DEBIT"
+)
+
+// a ledger entry, Ref points at what caused it, e.g. the ID of the bill that was debited
+type Transaction struct {
+	AccountID string            `json:"account_id"`
+	Currency  currency.Currency `json:"currency"`
+	Amount    int64             `json:"amount"`
+	Kind      TransactionKind   `json:"kind"`
+	Timestamp time.Time         `json:"timestamp"`
+	Ref       string            `json:"ref,omitempty"`
+}
+
+// balances holds the in-memory ledger: account ID -> currency code -> balance,
+// transactions is the append-only audit trail of balance changes and
+// appliedTxns the IDs of balance changes already applied, so retried calls are no-ops.
+// all protected by mu for concurrent safety, read-only endpoints only take its read lock
 var (
-	mu       sync.Mutex
-	balances = make(map[currency.Currency]int64)
+	mu           sync.RWMutex
+	balances     = make(map[string]map[currency.Currency]int64)
+	transactions []Transaction
+	appliedTxns  = make(map[string]struct{})
 )
 
 type AddBalanceParams struct {
-	Currency currency.Currency `json:"currency"`
-	Amount   int64             `json:"amount"`
+	AccountID string            `json:"account_id"`
+	Currency  currency.Currency `json:"currency"`
+	Amount    int64             `json:"amount"`
+	Ref       string            `json:"ref,omitempty"`
+	// optional, a repeated call with an already applied ID succeeds without changing the balance
+	TxnID string `json:"txn_id,omitempty"`
 }
 
 // called from billing service after a successfull bill workflow to add to the account balance
 //
 //encore:api private
 func AddBalance(ctx context.Context, p *AddBalanceParams) error {
+	if p.AccountID == "" {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "'account_id' is required"}
+	}
 	if p.Amount == 0 {
 		return &errs.Error{Code: errs.InvalidArgument, Message: "amount cannot be zero"}
 	}
 	mu.Lock()
 	defer mu.Unlock()
 
-	balances[p.Currency] += p.Amount
+	if applied(p.TxnID) {
+		return nil
+	}
+	if balances[p.AccountID] == nil {
+		balances[p.AccountID] = make(map[currency.Currency]int64)
+	}
+	balances[p.AccountID][p.Currency] += p.Amount
+	record(p.AccountID, p.Currency, p.Amount, TxnCredit, p.Ref)
+	markApplied(p.TxnID)
 	return nil
 }
 
+// reports whether a balance change with the transaction ID was already applied, mu must be held
+func applied(txnID string) bool {
+	if txnID == "" {
+		return false
+	}
+	_, ok := appliedTxns[txnID]
+	return ok
+}
+
+// remembers an applied transaction ID, mu must be held
+func markApplied(txnID string) {
+	if txnID != "" {
+		appliedTxns[txnID] = struct{}{}
+	}
+}
+
+// appends a ledger entry, mu must be held
+func record(accountID string, cur currency.Currency, amount int64, kind TransactionKind, ref string) {
+	transactions = append(transactions, Transaction{
+		AccountID: accountID,
+		Currency:  cur,
+		Amount:    amount,
+		Kind:      kind,
+		Timestamp: time.Now().UTC(),
+		Ref:       ref,
+	})
+}
+
 type WithdrawRequest struct {
-	Amount int64 `json:"amount"`
+	AccountID string `json:"account_id"`
+	Amount    int64  `json:"amount"`
 }
 
 //encore:api public method=POST path=/balances/:curr/withdraw
@@ -51,32 +117,160 @@ func Withdraw(ctx context.Context, curr string, req WithdrawRequest) error {
 		return &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
 	}
 
-	if req.Amount <= 0 {
+	return deduct(req.AccountID, reqCur, req.Amount, "", "")
+}
+
+type SweepRequest struct {
+	AccountID string `json:"account_id"`
+}
+
+type SweepResponse struct {
+	// withdrawn amount, zero when there was nothing available
+	Swept int64 `json:"swept"`
+}
+
+// withdraws the whole available balance in one step, funds reserved by holds are not part of it and stay held
+//
+//encore:api public method=POST path=/balances/:curr/sweep
+func Sweep(ctx context.Context, curr string, req SweepRequest) (*SweepResponse, error) {
+	reqCur, err := currency.Parse(curr)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	}
+	if req.AccountID == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'account_id' is required"}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	swept := balances[req.AccountID][reqCur]
+	if swept > 0 {
+		balances[req.AccountID][reqCur] = 0
+		record(req.AccountID, reqCur, swept, TxnDebit, "sweep")
+	}
+	return &SweepResponse{Swept: swept}, nil
+}
+
+type DeductParams struct {
+	AccountID string            `json:"account_id"`
+	Currency  currency.Currency `json:"currency"`
+	Amount    int64             `json:"amount"`
+	Ref       string            `json:"ref,omitempty"`
+	// optional, a repeated call with an already applied ID succeeds without changing the balance
+	TxnID string `json:"txn_id,omitempty"`
+}
+
+// called from billing service to debit the account when a bill settles
+//
+//encore:api private
+func Deduct(ctx context.Context, p *DeductParams) error {
+	return deduct(p.AccountID, p.Currency, p.Amount, p.Ref, p.TxnID)
+}
+
+// subtracts the amount from the account balance, failing with FailedPrecondition when the balance
+// would fall below zero or below the account's credit limit
+func deduct(accountID string, cur currency.Currency, amount int64, ref, txnID string) error {
+	if accountID == "" {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "'account_id' is required"}
+	}
+	if amount <= 0 {
 		return &errs.Error{Code: errs.InvalidArgument, Message: "amount must be > 0"}
 	}
 	mu.Lock()
 	defer mu.Unlock()
-	if balances[reqCur] < req.Amount {
+	if applied(txnID) {
+		return nil
+	}
+	// a missing account has no funds
+	if amount > balances[accountID][cur]-minBalance(accountID, cur) {
 		return &errs.Error{Code: errs.FailedPrecondition, Message: "insufficient funds"}
 	}
-	balances[reqCur] -= req.Amount
+	if balances[accountID] == nil {
+		balances[accountID] = make(map[currency.Currency]int64)
+	}
+	balances[accountID][cur] -= amount
+	record(accountID, cur, amount, TxnDebit, ref)
+	markApplied(txnID)
 	return nil
 }
 
 type BalancesResponse struct {
 	Balances map[currency.Currency]int64 `json:"balances"`
+	// funds reserved by active holds, not part of Balances
+	Held map[currency.Currency]int64 `json:"held"`
 }
 
-//encore:api public method=GET path=/balances
-func GetBalances(ctx context.Context) (BalancesResponse, error) {
-	mu.Lock()
-	defer mu.Unlock()
+//encore:api public method=GET path=/accounts/:accountID/balances
+func GetBalances(ctx context.Context, accountID string) (BalancesResponse, error) {
+	mu.RLock()
+	defer mu.RUnlock()
 
 	out := make(map[currency.Currency]int64, len(currency.SupportedCurrencies))
+	outHeld := make(map[currency.Currency]int64, len(currency.SupportedCurrencies))
 	for _, cur := range currency.SupportedCurrencies {
-		// balances[cur] will be 0 if cur is missing
-		out[cur] = balances[cur]
+		// balances[accountID][cur] will be 0 if the account or cur is missing
+		out[cur] = balances[accountID][cur]
+		outHeld[cur] = held[accountID][cur]
 	}
 
-	return BalancesResponse{Balances: out}, nil
+	return BalancesResponse{Balances: out, Held: outHeld}, nil
+}
+
+type BalanceParams struct {
+	AccountID string `query:"account_id"`
+}
+
+type BalanceResponse struct {
+	Currency currency.Currency `json:"currency"`
+	Balance  int64             `json:"balance"`
+	// funds reserved by active holds, not part of Balance
+	Held int64 `json:"held"`
+}
+
+// the balance of an account in one currency, for clients that only poll that one
+//
+//encore:api public method=GET path=/balances/:curr
+func GetBalance(ctx context.Context, curr string, p *BalanceParams) (BalanceResponse, error) {
+	reqCur, err := currency.Parse(curr)
+	if err != nil {
+		return BalanceResponse{}, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	}
+	if p.AccountID == "" {
+		return BalanceResponse{}, &errs.Error{Code: errs.InvalidArgument, Message: "'account_id' is required"}
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+
+	// zero if the account or currency is missing
+	return BalanceResponse{Currency: reqCur, Balance: balances[p.AccountID][reqCur], Held: held[p.AccountID][reqCur]}, nil
+}
+
+type TransactionsParams struct {
+	// optional filter, all accounts are listed when empty
+	AccountID string `query:"account_id"`
+}
+
+type TransactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+}
+
+// lists the ledger entries for a currency in the order they were recorded
+//
+//encore:api public method=GET path=/balances/:curr/transactions
+func GetTransactions(ctx context.Context, curr string, p *TransactionsParams) (TransactionsResponse, error) {
+	reqCur, err := currency.Parse(curr)
+	if err != nil {
+		return TransactionsResponse{}, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+
+	out := make([]Transaction, 0)
+	for _, txn := range transactions {
+		if txn.Currency != reqCur || (p.AccountID != "" && txn.AccountID != p.AccountID) {
+			continue
+		}
+		out = append(out, txn)
+	}
+	return TransactionsResponse{Transactions: out}, nil
 }
@@ -3,6 +3,7 @@ package account
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
 
 	"pave-fees-api/internal/currency"
@@ -16,6 +17,25 @@ func resetBalances() {
 	for k := range balances {
 		delete(balances, k)
 	}
+	transactions = nil
+	for k := range accounts {
+		delete(accounts, k)
+	}
+	for k := range creditLimits {
+		delete(creditLimits, k)
+	}
+	for k := range appliedTxns {
+		delete(appliedTxns, k)
+	}
+	for k := range holds {
+		delete(holds, k)
+	}
+	for k := range held {
+		delete(held, k)
+	}
+	for k := range holdsByTxn {
+		delete(holdsByTxn, k)
+	}
 }
 
 func TestAddBalanceAndGetBalances(t *testing.T) {
@@ -23,14 +43,15 @@ func TestAddBalanceAndGetBalances(t *testing.T) {
 
 	ctx := context.Background()
 	err := AddBalance(ctx, &AddBalanceParams{
-		Currency: currency.USD,
-		Amount:   500,
+		AccountID: "acc-1",
+		Currency:  currency.USD,
+		Amount:    500,
 	})
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
 
-	resp, err := GetBalances(ctx)
+	resp, err := GetBalances(ctx, "acc-1")
 	if err != nil {
 		t.Fatalf("expected no error from GetBalances, got %v", err)
 	}
@@ -46,16 +67,17 @@ func TestWithdraw_Success(t *testing.T) {
 
 	ctx := context.Background()
 	_ = AddBalance(ctx, &AddBalanceParams{
-		Currency: currency.GEL,
-		Amount:   200,
+		AccountID: "acc-1",
+		Currency:  currency.GEL,
+		Amount:    200,
 	})
 
-	err := Withdraw(ctx, "GEL", WithdrawRequest{Amount: 100})
+	err := Withdraw(ctx, "GEL", WithdrawRequest{AccountID: "acc-1", Amount: 100})
 	if err != nil {
 		t.Fatalf("expected successful withdrawal, got %v", err)
 	}
 
-	resp, _ := GetBalances(ctx)
+	resp, _ := GetBalances(ctx, "acc-1")
 	if resp.Balances[currency.GEL] != 100 {
 		t.Errorf("expected GEL balance to be 100 after withdraw, got %d", resp.Balances[currency.GEL])
 	}
@@ -65,9 +87,9 @@ func TestWithdraw_InsufficientFunds(t *testing.T) {
 	resetBalances()
 
 	ctx := context.Background()
-	_ = AddBalance(ctx, &AddBalanceParams{Currency: currency.EUR, Amount: 50})
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.EUR, Amount: 50})
 
-	err := Withdraw(ctx, "EUR", WithdrawRequest{Amount: 100})
+	err := Withdraw(ctx, "EUR", WithdrawRequest{AccountID: "acc-1", Amount: 100})
 	if err == nil {
 		t.Fatal("expected error due to insufficient funds, got nil")
 	}
@@ -83,10 +105,387 @@ func TestAddBalance_InvalidAmount(t *testing.T) {
 
 	ctx := context.Background()
 	err := AddBalance(ctx, &AddBalanceParams{
-		Currency: currency.USD,
-		Amount:   0,
+		AccountID: "acc-1",
+		Currency:  currency.USD,
+		Amount:    0,
 	})
 	if err == nil {
 		t.Fatal("expected error for zero amount, got nil")
 	}
 }
+
+func TestDeduct(t *testing.T) {
+	tests := []struct {
+		name     string
+		balance  int64
+		amount   int64
+		wantCode errs.ErrCode
+		want     int64
+	}{
+		{"sufficient funds", 300, 200, 0, 100},
+		{"exact balance", 200, 200, 0, 0},
+		{"insufficient funds", 100, 200, errs.FailedPrecondition, 100},
+		{"zero amount", 100, 0, errs.InvalidArgument, 100},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resetBalances()
+			ctx := context.Background()
+			_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: tc.balance})
+
+			err := Deduct(ctx, &DeductParams{AccountID: "acc-1", Currency: currency.USD, Amount: tc.amount})
+			var e *errs.Error
+			switch {
+			case tc.wantCode == 0 && err != nil:
+				t.Fatalf("expected no error, got %v", err)
+			case tc.wantCode != 0 && (!errors.As(err, &e) || e.Code != tc.wantCode):
+				t.Fatalf("error = %v, want code %v", err, tc.wantCode)
+			}
+			resp, _ := GetBalances(ctx, "acc-1")
+			if got := resp.Balances[currency.USD]; got != tc.want {
+				t.Errorf("USD balance = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWithdraw_CreditLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		cur      string
+		amount   int64
+		wantCode errs.ErrCode
+		want     int64
+	}{
+		{"within the limit", "USD", 400, 0, -100},
+		{"at the limit", "USD", 800, 0, -500},
+		{"over the limit", "USD", 801, errs.FailedPrecondition, 300},
+		// the limit only covers the account currency
+		{"other currency", "EUR", 1, errs.FailedPrecondition, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resetBalances()
+			ctx := context.Background()
+			_, _ = CreateAccount(ctx, &CreateAccountParams{ID: "acc-1", Currency: "USD"})
+			_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 300})
+			if _, err := SetCreditLimit(ctx, "acc-1", &CreditLimitParams{CreditLimit: 500}); err != nil {
+				t.Fatalf("set credit limit: %v", err)
+			}
+
+			err := Withdraw(ctx, tc.cur, WithdrawRequest{AccountID: "acc-1", Amount: tc.amount})
+			var e *errs.Error
+			switch {
+			case tc.wantCode == 0 && err != nil:
+				t.Fatalf("expected no error, got %v", err)
+			case tc.wantCode != 0 && (!errors.As(err, &e) || e.Code != tc.wantCode):
+				t.Fatalf("error = %v, want code %v", err, tc.wantCode)
+			}
+			resp, _ := GetBalance(ctx, tc.cur, &BalanceParams{AccountID: "acc-1"})
+			if resp.Balance != tc.want {
+				t.Errorf("%s balance = %d, want %d", tc.cur, resp.Balance, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetBalances_PerAccount(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-2", Currency: currency.USD, Amount: 300})
+
+	if err := Withdraw(ctx, "USD", WithdrawRequest{AccountID: "acc-2", Amount: 400}); err == nil {
+		t.Fatal("expected acc-2 withdrawal to fail, it can't draw from acc-1")
+	}
+
+	tests := []struct {
+		accountID string
+		want      int64
+	}{
+		{"acc-1", 500},
+		{"acc-2", 300},
+		{"acc-unknown", 0},
+	}
+	for _, tc := range tests {
+		resp, err := GetBalances(ctx, tc.accountID)
+		if err != nil {
+			t.Fatalf("GetBalances(%s): %v", tc.accountID, err)
+		}
+		if got := resp.Balances[currency.USD]; got != tc.want {
+			t.Errorf("%s USD balance = %d, want %d", tc.accountID, got, tc.want)
+		}
+		// supported currencies are zero-filled
+		if len(resp.Balances) != len(currency.SupportedCurrencies) {
+			t.Errorf("%s has %d currencies, want %d", tc.accountID, len(resp.Balances), len(currency.SupportedCurrencies))
+		}
+	}
+}
+
+func TestGetBalance(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+
+	tests := []struct {
+		name      string
+		curr      string
+		accountID string
+		want      int64
+		wantCode  errs.ErrCode
+	}{
+		{"known currency", "USD", "acc-1", 500, errs.OK},
+		{"zero balance currency", "EUR", "acc-1", 0, errs.OK},
+		{"unknown account", "USD", "acc-unknown", 0, errs.OK},
+		{"invalid code", "XYZ", "acc-1", 0, errs.InvalidArgument},
+		{"missing account", "USD", "", 0, errs.InvalidArgument},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := GetBalance(ctx, tc.curr, &BalanceParams{AccountID: tc.accountID})
+			if tc.wantCode != errs.OK {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != tc.wantCode {
+					t.Errorf("expected %s error, got %v", tc.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(resp.Currency) != tc.curr || resp.Balance != tc.want {
+				t.Errorf("balance = %s %d, want %s %d", resp.Currency, resp.Balance, tc.curr, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddBalance_MissingAccountID(t *testing.T) {
+	resetBalances()
+
+	err := AddBalance(context.Background(), &AddBalanceParams{Currency: currency.USD, Amount: 100})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+		t.Errorf("expected InvalidArgument error, got %v", err)
+	}
+}
+
+func TestGetTransactions_Ordered(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500, Ref: "topup-1"})
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.EUR, Amount: 100})
+	_ = Deduct(ctx, &DeductParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, Ref: "bill-1"})
+	_ = Withdraw(ctx, "USD", WithdrawRequest{AccountID: "acc-1", Amount: 50})
+
+	resp, err := GetTransactions(ctx, "USD", &TransactionsParams{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []struct {
+		kind   TransactionKind
+		amount int64
+		ref    string
+	}{
+		{TxnCredit, 500, "topup-1"},
+		{TxnDebit, 200, "bill-1"},
+		{TxnDebit, 50, ""},
+	}
+	if len(resp.Transactions) != len(want) {
+		t.Fatalf("got %d transactions, want %d", len(resp.Transactions), len(want))
+	}
+	for i, w := range want {
+		got := resp.Transactions[i]
+		if got.Kind != w.kind || got.Amount != w.amount || got.Ref != w.ref {
+			t.Errorf("transaction %d = %s %d %q, want %s %d %q", i, got.Kind, got.Amount, got.Ref, w.kind, w.amount, w.ref)
+		}
+	}
+}
+
+func TestGetTransactions_FailedWithdrawNotRecorded(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.GEL, Amount: 50})
+	if err := Withdraw(ctx, "GEL", WithdrawRequest{AccountID: "acc-1", Amount: 100}); err == nil {
+		t.Fatal("expected error due to insufficient funds, got nil")
+	}
+
+	resp, _ := GetTransactions(ctx, "GEL", &TransactionsParams{AccountID: "acc-1"})
+	if len(resp.Transactions) != 1 || resp.Transactions[0].Kind != TxnCredit {
+		t.Errorf("transactions = %+v, want only the credit", resp.Transactions)
+	}
+}
+
+func TestGetTransactions_InvalidCurrency(t *testing.T) {
+	_, err := GetTransactions(context.Background(), "XYZ", &TransactionsParams{})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+		t.Errorf("expected InvalidArgument error, got %v", err)
+	}
+}
+
+func TestAddBalance_IdempotentTxnID(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		err := AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 300, TxnID: "txn-1"})
+		if err != nil {
+			t.Fatalf("call %d: expected no error, got %v", i+1, err)
+		}
+	}
+
+	resp, _ := GetBalances(ctx, "acc-1")
+	if got := resp.Balances[currency.USD]; got != 300 {
+		t.Errorf("expected USD balance to be 300, got %d", got)
+	}
+	txns, _ := GetTransactions(ctx, "USD", &TransactionsParams{})
+	if len(txns.Transactions) != 1 {
+		t.Errorf("expected 1 transaction, got %d", len(txns.Transactions))
+	}
+}
+
+func TestDeduct_IdempotentTxnID(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 300})
+	for i := 0; i < 2; i++ {
+		err := Deduct(ctx, &DeductParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, TxnID: "bill-1/debit"})
+		if err != nil {
+			t.Fatalf("call %d: expected no error, got %v", i+1, err)
+		}
+	}
+
+	resp, _ := GetBalances(ctx, "acc-1")
+	if got := resp.Balances[currency.USD]; got != 100 {
+		t.Errorf("expected USD balance to be 100, got %d", got)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	tests := []struct {
+		name      string
+		balance   int64
+		hold      int64
+		wantSwept int64
+		wantHeld  int64
+		// a sweep of nothing leaves no ledger entry
+		wantDebits int
+	}{
+		{"no holds", 500, 0, 500, 0, 1},
+		{"active hold stays", 500, 200, 300, 200, 1},
+		{"everything held", 500, 500, 0, 500, 0},
+		{"empty account", 0, 0, 0, 0, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resetBalances()
+			ctx := context.Background()
+			if tc.balance > 0 {
+				_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: tc.balance})
+			}
+			if tc.hold > 0 {
+				if _, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: tc.hold}); err != nil {
+					t.Fatalf("expected hold, got %v", err)
+				}
+			}
+
+			resp, err := Sweep(ctx, "USD", SweepRequest{AccountID: "acc-1"})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if resp.Swept != tc.wantSwept {
+				t.Errorf("swept %d, want %d", resp.Swept, tc.wantSwept)
+			}
+			bal, _ := GetBalances(ctx, "acc-1")
+			if bal.Balances[currency.USD] != 0 || bal.Held[currency.USD] != tc.wantHeld {
+				t.Errorf("after sweep: balance %d held %d, want 0 and %d", bal.Balances[currency.USD], bal.Held[currency.USD], tc.wantHeld)
+			}
+
+			txns, _ := GetTransactions(ctx, "USD", &TransactionsParams{AccountID: "acc-1"})
+			debits := 0
+			for _, txn := range txns.Transactions {
+				if txn.Kind == TxnDebit {
+					debits++
+				}
+			}
+			if debits != tc.wantDebits {
+				t.Errorf("got %d debits, want %d", debits, tc.wantDebits)
+			}
+		})
+	}
+}
+
+func TestSweep_InvalidInput(t *testing.T) {
+	tests := []struct {
+		name string
+		curr string
+		req  SweepRequest
+	}{
+		{"unknown currency", "XYZ", SweepRequest{AccountID: "acc-1"}},
+		{"missing account", "USD", SweepRequest{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Sweep(context.Background(), tc.curr, tc.req)
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+				t.Errorf("expected InvalidArgument error, got %v", err)
+			}
+		})
+	}
+}
+
+// run with -race, reads share the read lock while credits and debits take the write lock
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	const writers, readers, rounds = 8, 8, 200
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: writers * rounds})
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 2})
+				if err := Withdraw(ctx, "USD", WithdrawRequest{AccountID: "acc-1", Amount: 3}); err != nil {
+					t.Errorf("withdraw: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				bal, _ := GetBalances(ctx, "acc-1")
+				if bal.Balances[currency.USD] < 0 {
+					t.Errorf("negative balance %d", bal.Balances[currency.USD])
+					return
+				}
+				_, _ = GetTransactions(ctx, "USD", &TransactionsParams{AccountID: "acc-1"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every round nets a debit of 1
+	bal, _ := GetBalances(ctx, "acc-1")
+	if got := bal.Balances[currency.USD]; got != 0 {
+		t.Errorf("USD balance = %d, want 0", got)
+	}
+	txns, _ := GetTransactions(ctx, "USD", &TransactionsParams{AccountID: "acc-1"})
+	if want := 1 + 2*writers*rounds; len(txns.Transactions) != want {
+		t.Errorf("got %d transactions, want %d", len(txns.Transactions), want)
+	}
+}
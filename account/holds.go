@@ -0,0 +1,246 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+)
+
+type HoldStatus string
+
+const (
+	HoldActive   HoldStatus = "ACTIVE"
+	HoldCaptured HoldStatus = "CAPTURED"
+	HoldReleased HoldStatus = "RELEASED"
+	// released by the reaper because it was neither captured nor released before it expired
+	HoldExpired HoldStatus = "EXPIRED"
+)
+
+// how long a hold lasts unless its caller asks for another TTL, and how often expired holds are reaped.
+// a bill whose workflow dies while charging doesn't keep the funds from the account for longer than that
+const (
+	defaultHoldTTL   = 24 * time.Hour
+	holdReapInterval = time.Minute
+)
+
+// funds reserved from an account balance until they are captured, released, or they expire
+type hold struct {
+	AccountID string
+	Currency  currency.Currency
+	Amount    int64
+	Ref       string
+	Status    HoldStatus
+	PlacedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// holds and the held bucket they move funds into, guarded by mu like the balances.
+// holdsByTxn maps a hold transaction ID to the hold it created, so a retried hold returns the same one
+var (
+	holds      = make(map[string]*hold)
+	held       = make(map[string]map[currency.Currency]int64)
+	holdsByTxn = make(map[string]string)
+)
+
+type HoldParams struct {
+	AccountID string            `json:"account_id"`
+	Currency  currency.Currency `json:"currency"`
+	Amount    int64             `json:"amount"`
+	Ref       string            `json:"ref,omitempty"`
+	// optional, a repeated call with the same ID returns the hold it already created
+	TxnID string `json:"txn_id,omitempty"`
+	// optional time after which an active hold is released on its own, defaults to a day
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+}
+
+type HoldResponse struct {
+	HoldID string `json:"hold_id"`
+}
+
+// called from billing service when a bill starts charging, moves the amount from the balance into the held bucket
+// so concurrent bills can't draw the same funds. fails with FailedPrecondition on insufficient funds,
+// the account's credit limit counts as funds
+//
+//encore:api private
+func Hold(ctx context.Context, p *HoldParams) (*HoldResponse, error) {
+	if p.AccountID == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'account_id' is required"}
+	}
+	if p.Amount <= 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "amount must be > 0"}
+	}
+	if p.TTLSeconds < 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'ttl_seconds' must not be negative"}
+	}
+	ttl := defaultHoldTTL
+	if p.TTLSeconds > 0 {
+		ttl = time.Duration(p.TTLSeconds) * time.Second
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	if id, ok := holdsByTxn[p.TxnID]; ok && p.TxnID != "" {
+		return &HoldResponse{HoldID: id}, nil
+	}
+	// a missing account has no funds
+	if p.Amount > balances[p.AccountID][p.Currency]-minBalance(p.AccountID, p.Currency) {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "insufficient funds"}
+	}
+	if balances[p.AccountID] == nil {
+		balances[p.AccountID] = make(map[currency.Currency]int64)
+	}
+	balances[p.AccountID][p.Currency] -= p.Amount
+	if held[p.AccountID] == nil {
+		held[p.AccountID] = make(map[currency.Currency]int64)
+	}
+	held[p.AccountID][p.Currency] += p.Amount
+
+	id := fmt.Sprintf("hold-%d", len(holds)+1)
+	now := time.Now().UTC()
+	holds[id] = &hold{AccountID: p.AccountID, Currency: p.Currency, Amount: p.Amount, Ref: p.Ref, Status: HoldActive,
+		PlacedAt: now, ExpiresAt: now.Add(ttl)}
+	if p.TxnID != "" {
+		holdsByTxn[p.TxnID] = id
+	}
+	return &HoldResponse{HoldID: id}, nil
+}
+
+type HoldRefParams struct {
+	HoldID string `json:"hold_id"`
+}
+
+type CaptureParams struct {
+	HoldID string `json:"hold_id"`
+	// optional, captures only part of the hold and returns the rest to the balance. zero captures all of it
+	Amount int64 `json:"amount,omitempty"`
+}
+
+// called from billing service when a bill settles, the held funds leave the account.
+// capturing an already captured hold is a no-op
+//
+//encore:api private
+func Capture(ctx context.Context, p *CaptureParams) error {
+	if p.Amount < 0 {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "amount must be >= 0"}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	h, err := activeHold(p.HoldID, HoldCaptured)
+	if h == nil {
+		return err
+	}
+	amount := p.Amount
+	if amount == 0 {
+		amount = h.Amount
+	}
+	if amount > h.Amount {
+		return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("cannot capture %d of a %d hold", amount, h.Amount)}
+	}
+	held[h.AccountID][h.Currency] -= h.Amount
+	balances[h.AccountID][h.Currency] += h.Amount - amount
+	h.Status = HoldCaptured
+	record(h.AccountID, h.Currency, amount, TxnDebit, h.Ref)
+	return nil
+}
+
+// called from billing service when a bill can't settle, the held funds go back to the balance.
+// releasing an already released or expired hold is a no-op
+//
+//encore:api private
+func Release(ctx context.Context, p *HoldRefParams) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	h, err := activeHold(p.HoldID, HoldReleased)
+	if h == nil {
+		return err
+	}
+	held[h.AccountID][h.Currency] -= h.Amount
+	balances[h.AccountID][h.Currency] += h.Amount
+	h.Status = HoldReleased
+	return nil
+}
+
+// looks up a hold that is about to move to the target status, mu must be held.
+// returns a nil hold when there is nothing to do, with an error unless the hold already has the target status
+func activeHold(id string, target HoldStatus) (*hold, error) {
+	h, ok := holds[id]
+	if !ok {
+		return nil, &errs.Error{Code: errs.NotFound, Message: fmt.Sprintf("hold %q not found", id)}
+	}
+	switch h.Status {
+	case HoldActive:
+		return h, nil
+	case target:
+		return nil, nil
+	case HoldExpired:
+		// the reaper already returned the funds
+		if target == HoldReleased {
+			return nil, nil
+		}
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: fmt.Sprintf("hold %q is already %s", id, h.Status)}
+	default:
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: fmt.Sprintf("hold %q is already %s", id, h.Status)}
+	}
+}
+
+func init() {
+	go func() {
+		for range time.Tick(holdReapInterval) {
+			reapExpiredHolds(time.Now())
+		}
+	}()
+}
+
+// releases the active holds that expired by now back to their balance, reports how many it released
+func reapExpiredHolds(now time.Time) int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	n := 0
+	for _, h := range holds {
+		if h.Status != HoldActive || now.Before(h.ExpiresAt) {
+			continue
+		}
+		held[h.AccountID][h.Currency] -= h.Amount
+		balances[h.AccountID][h.Currency] += h.Amount
+		h.Status = HoldExpired
+		n++
+	}
+	return n
+}
+
+type HoldStatusResponse struct {
+	HoldID    string            `json:"hold_id"`
+	AccountID string            `json:"account_id"`
+	Currency  currency.Currency `json:"currency"`
+	Amount    int64             `json:"amount"`
+	Status    HoldStatus        `json:"status"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	// seconds until an active hold expires, zero once it is no longer active
+	TTLSeconds int64 `json:"ttl_seconds"`
+}
+
+// the status of a hold and how long it has left before it is released on its own
+//
+//encore:api public method=GET path=/holds/:holdID
+func GetHold(ctx context.Context, holdID string) (*HoldStatusResponse, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	h, ok := holds[holdID]
+	if !ok {
+		return nil, &errs.Error{Code: errs.NotFound, Message: fmt.Sprintf("hold %q not found", holdID)}
+	}
+	resp := &HoldStatusResponse{HoldID: holdID, AccountID: h.AccountID, Currency: h.Currency, Amount: h.Amount,
+		Status: h.Status, ExpiresAt: h.ExpiresAt}
+	if h.Status == HoldActive {
+		resp.TTLSeconds = max(int64(time.Until(h.ExpiresAt).Seconds()), 0)
+	}
+	return resp, nil
+}
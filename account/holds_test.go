@@ -0,0 +1,259 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+)
+
+func TestHold_Capture(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+
+	resp, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, Ref: "bill-1"})
+	if err != nil {
+		t.Fatalf("expected hold, got %v", err)
+	}
+	bal, _ := GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.USD] != 300 || bal.Held[currency.USD] != 200 {
+		t.Fatalf("after hold: balance %d held %d, want 300 and 200", bal.Balances[currency.USD], bal.Held[currency.USD])
+	}
+
+	// capturing twice moves the funds once
+	for i := 0; i < 2; i++ {
+		if err := Capture(ctx, &CaptureParams{HoldID: resp.HoldID}); err != nil {
+			t.Fatalf("capture %d: expected no error, got %v", i+1, err)
+		}
+	}
+	bal, _ = GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.USD] != 300 || bal.Held[currency.USD] != 0 {
+		t.Errorf("after capture: balance %d held %d, want 300 and 0", bal.Balances[currency.USD], bal.Held[currency.USD])
+	}
+	txns, _ := GetTransactions(ctx, "USD", &TransactionsParams{AccountID: "acc-1"})
+	if n := len(txns.Transactions); n != 2 || txns.Transactions[1].Kind != TxnDebit || txns.Transactions[1].Ref != "bill-1" {
+		t.Errorf("transactions = %+v, want the credit and a debit for bill-1", txns.Transactions)
+	}
+
+	var e *errs.Error
+	if err := Release(ctx, &HoldRefParams{HoldID: resp.HoldID}); !errors.As(err, &e) || e.Code != errs.FailedPrecondition {
+		t.Errorf("release after capture: expected FailedPrecondition error, got %v", err)
+	}
+}
+
+func TestHold_Release(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.EUR, Amount: 500})
+
+	resp, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.EUR, Amount: 500})
+	if err != nil {
+		t.Fatalf("expected hold, got %v", err)
+	}
+	// the held funds can't be withdrawn
+	if err := Withdraw(ctx, "EUR", WithdrawRequest{AccountID: "acc-1", Amount: 100}); err == nil {
+		t.Fatal("expected withdrawal of held funds to fail, got nil")
+	}
+
+	if err := Release(ctx, &HoldRefParams{HoldID: resp.HoldID}); err != nil {
+		t.Fatalf("expected release, got %v", err)
+	}
+	bal, _ := GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.EUR] != 500 || bal.Held[currency.EUR] != 0 {
+		t.Errorf("after release: balance %d held %d, want 500 and 0", bal.Balances[currency.EUR], bal.Held[currency.EUR])
+	}
+	txns, _ := GetTransactions(ctx, "EUR", &TransactionsParams{})
+	if len(txns.Transactions) != 1 {
+		t.Errorf("expected only the credit transaction, got %d", len(txns.Transactions))
+	}
+}
+
+func TestHold_InsufficientFunds(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 100})
+
+	_, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition error, got %v", err)
+	}
+	bal, _ := GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.USD] != 100 || bal.Held[currency.USD] != 0 {
+		t.Errorf("balance %d held %d, want 100 and 0", bal.Balances[currency.USD], bal.Held[currency.USD])
+	}
+}
+
+func TestHold_CreditLimit(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_, _ = CreateAccount(ctx, &CreateAccountParams{ID: "acc-1", Currency: "USD"})
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 100})
+	_, _ = SetCreditLimit(ctx, "acc-1", &CreditLimitParams{CreditLimit: 200})
+
+	if _, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 301}); err == nil {
+		t.Fatal("expected a hold over the credit limit to fail")
+	}
+	resp, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 300})
+	if err != nil {
+		t.Fatalf("expected a hold up to the credit limit, got %v", err)
+	}
+	bal, _ := GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.USD] != -200 || bal.Held[currency.USD] != 300 {
+		t.Errorf("balance %d held %d, want -200 and 300", bal.Balances[currency.USD], bal.Held[currency.USD])
+	}
+	_ = Release(ctx, &HoldRefParams{HoldID: resp.HoldID})
+	if bal, _ := GetBalances(ctx, "acc-1"); bal.Balances[currency.USD] != 100 {
+		t.Errorf("balance %d after release, want 100", bal.Balances[currency.USD])
+	}
+}
+
+func TestHold_IdempotentTxnID(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+
+	first, _ := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, TxnID: "txn-1"})
+	second, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, TxnID: "txn-1"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if first.HoldID != second.HoldID {
+		t.Errorf("hold IDs %q and %q, want the same hold", first.HoldID, second.HoldID)
+	}
+	bal, _ := GetBalances(ctx, "acc-1")
+	if bal.Held[currency.USD] != 200 {
+		t.Errorf("held %d, want 200", bal.Held[currency.USD])
+	}
+}
+
+func TestCapture_UnknownHold(t *testing.T) {
+	resetBalances()
+
+	err := Capture(context.Background(), &CaptureParams{HoldID: "hold-404"})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.NotFound {
+		t.Errorf("expected NotFound error, got %v", err)
+	}
+}
+
+func TestHold_PartialCapture(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+	resp, _ := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 300})
+
+	var e *errs.Error
+	if err := Capture(ctx, &CaptureParams{HoldID: resp.HoldID, Amount: 400}); !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+		t.Fatalf("capture above the hold: expected InvalidArgument error, got %v", err)
+	}
+	if err := Capture(ctx, &CaptureParams{HoldID: resp.HoldID, Amount: 100}); err != nil {
+		t.Fatalf("expected partial capture, got %v", err)
+	}
+	bal, _ := GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.USD] != 400 || bal.Held[currency.USD] != 0 {
+		t.Errorf("balance %d held %d, want 400 and 0", bal.Balances[currency.USD], bal.Held[currency.USD])
+	}
+	txns, _ := GetTransactions(ctx, "USD", &TransactionsParams{})
+	if last := txns.Transactions[len(txns.Transactions)-1]; last.Kind != TxnDebit || last.Amount != 100 {
+		t.Errorf("last transaction = %s %d, want DEBIT 100", last.Kind, last.Amount)
+	}
+}
+
+func TestHold_AutoReleasedAfterTTL(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+	resp, _ := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, TTLSeconds: 60})
+
+	st, err := GetHold(ctx, resp.HoldID)
+	if err != nil {
+		t.Fatalf("expected hold status, got %v", err)
+	}
+	if st.Status != HoldActive || st.TTLSeconds < 55 || st.TTLSeconds > 60 {
+		t.Errorf("status %s ttl %ds, want ACTIVE with about 60s left", st.Status, st.TTLSeconds)
+	}
+
+	// not expired yet
+	if n := reapExpiredHolds(time.Now().Add(30 * time.Second)); n != 0 {
+		t.Fatalf("reaped %d holds before their TTL, want 0", n)
+	}
+	if n := reapExpiredHolds(time.Now().Add(61 * time.Second)); n != 1 {
+		t.Fatalf("reaped %d holds after their TTL, want 1", n)
+	}
+	bal, _ := GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.USD] != 500 || bal.Held[currency.USD] != 0 {
+		t.Errorf("after expiry: balance %d held %d, want 500 and 0", bal.Balances[currency.USD], bal.Held[currency.USD])
+	}
+	st, _ = GetHold(ctx, resp.HoldID)
+	if st.Status != HoldExpired || st.TTLSeconds != 0 {
+		t.Errorf("status %s ttl %ds, want EXPIRED with no TTL left", st.Status, st.TTLSeconds)
+	}
+
+	// a late release finds the funds already back, a late capture is refused
+	if err := Release(ctx, &HoldRefParams{HoldID: resp.HoldID}); err != nil {
+		t.Errorf("release after expiry: expected no error, got %v", err)
+	}
+	var e *errs.Error
+	if err := Capture(ctx, &CaptureParams{HoldID: resp.HoldID}); !errors.As(err, &e) || e.Code != errs.FailedPrecondition {
+		t.Errorf("capture after expiry: expected FailedPrecondition error, got %v", err)
+	}
+	bal, _ = GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.USD] != 500 {
+		t.Errorf("balance %d after the late release and capture, want 500", bal.Balances[currency.USD])
+	}
+}
+
+func TestHold_CapturedBeforeTTL(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+	resp, _ := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, TTLSeconds: 60})
+
+	if err := Capture(ctx, &CaptureParams{HoldID: resp.HoldID}); err != nil {
+		t.Fatalf("expected capture, got %v", err)
+	}
+	if n := reapExpiredHolds(time.Now().Add(time.Hour)); n != 0 {
+		t.Fatalf("reaped %d holds, want the captured hold left alone", n)
+	}
+	bal, _ := GetBalances(ctx, "acc-1")
+	if bal.Balances[currency.USD] != 300 || bal.Held[currency.USD] != 0 {
+		t.Errorf("balance %d held %d, want 300 and 0", bal.Balances[currency.USD], bal.Held[currency.USD])
+	}
+	if st, _ := GetHold(ctx, resp.HoldID); st.Status != HoldCaptured {
+		t.Errorf("status %s, want CAPTURED", st.Status)
+	}
+}
+
+func TestHold_DefaultTTL(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+
+	var e *errs.Error
+	if _, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, TTLSeconds: -1}); !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+		t.Fatalf("negative TTL: expected InvalidArgument error, got %v", err)
+	}
+	resp, _ := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200})
+	if st, _ := GetHold(ctx, resp.HoldID); time.Until(st.ExpiresAt).Round(time.Hour) != defaultHoldTTL {
+		t.Errorf("hold expires at %s, want a day from now", st.ExpiresAt)
+	}
+	var nf *errs.Error
+	if _, err := GetHold(ctx, "hold-404"); !errors.As(err, &nf) || nf.Code != errs.NotFound {
+		t.Errorf("unknown hold: expected NotFound error, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+)
+
+// the window a statement covers unless it is given one, the longest it can cover and how many entries it lists
+const (
+	defaultStatementWindow = 30 * 24 * time.Hour
+	maxStatementWindow     = 366 * 24 * time.Hour
+	defaultStatementLimit  = 100
+	maxStatementLimit      = 500
+)
+
+// a hold placed on the account. holds move funds without a ledger entry, so they are only listed on statements
+const TxnHold TransactionKind = "HOLD"
+
+type StatementParams struct {
+	// RFC3339, the statement covers [from, to). to defaults to now and from to 30 days before to
+	From string `query:"from"`
+	To   string `query:"to"`
+	// defaults to the currency of a registered account, required for other accounts
+	Currency string `query:"currency"`
+	// optional, up to 500 entries, 0 for the default of 100
+	Limit int `query:"limit"`
+}
+
+// a line of a statement, Balance is the running balance after it
+type StatementEntry struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Kind      TransactionKind `json:"kind"`
+	Amount    int64           `json:"amount"`
+	Ref       string          `json:"ref,omitempty"`
+	// set on HOLD entries, what became of the hold. a captured hold shows up again as the debit that captured it
+	HoldID     string     `json:"hold_id,omitempty"`
+	HoldStatus HoldStatus `json:"hold_status,omitempty"`
+	Balance    int64      `json:"balance"`
+}
+
+type StatementResponse struct {
+	AccountID string            `json:"account_id"`
+	Currency  currency.Currency `json:"currency"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	// the ledger balance before and after the window. it counts funds on hold, which only leave
+	// the account when they are captured
+	OpeningBalance int64            `json:"opening_balance"`
+	ClosingBalance int64            `json:"closing_balance"`
+	Entries        []StatementEntry `json:"entries"`
+	// more entries fell in the window than the limit, the oldest are listed and ClosingBalance still covers all of them
+	Truncated bool `json:"truncated"`
+}
+
+// the credits, debits and holds of an account in one currency within a time window, oldest first,
+// each with the running balance
+//
+//encore:api public method=GET path=/accounts/:accountID/statement
+func GetStatement(ctx context.Context, accountID string, p *StatementParams) (*StatementResponse, error) {
+	to := time.Now().UTC()
+	if p.To != "" {
+		parsed, err := time.Parse(time.RFC3339, p.To)
+		if err != nil {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'to' must be RFC3339"}
+		}
+		to = parsed.UTC()
+	}
+	from := to.Add(-defaultStatementWindow)
+	if p.From != "" {
+		parsed, err := time.Parse(time.RFC3339, p.From)
+		if err != nil {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'from' must be RFC3339"}
+		}
+		from = parsed.UTC()
+	}
+	if !from.Before(to) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'from' must be before 'to'"}
+	}
+	if to.Sub(from) > maxStatementWindow {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "a statement covers at most 366 days"}
+	}
+	if p.Limit < 0 || p.Limit > maxStatementLimit {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("'limit' must be between 0 and %d, 0 for the default of %d", maxStatementLimit, defaultStatementLimit)}
+	}
+	limit := defaultStatementLimit
+	if p.Limit > 0 {
+		limit = p.Limit
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+
+	cur, registered := accounts[accountID]
+	if p.Currency != "" {
+		parsed, err := currency.Parse(p.Currency)
+		if err != nil {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+		}
+		cur = parsed
+	} else if !registered {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("'currency' is required, account %q isn't registered", accountID)}
+	}
+
+	resp := &StatementResponse{AccountID: accountID, Currency: cur, From: from, To: to}
+	// the ledger is in the order it was recorded, so the balance runs over it as is
+	var entries []StatementEntry
+	var balance int64
+	for _, txn := range transactions {
+		if txn.AccountID != accountID || txn.Currency != cur || !txn.Timestamp.Before(to) {
+			continue
+		}
+		if txn.Kind == TxnDebit {
+			balance -= txn.Amount
+		} else {
+			balance += txn.Amount
+		}
+		if txn.Timestamp.Before(from) {
+			resp.OpeningBalance = balance
+			continue
+		}
+		entries = append(entries, StatementEntry{Timestamp: txn.Timestamp, Kind: txn.Kind, Amount: txn.Amount, Ref: txn.Ref, Balance: balance})
+	}
+	resp.ClosingBalance = balance
+
+	// in ID order, so holds placed at the same instant are listed the same way on every call
+	for _, id := range slices.Sorted(maps.Keys(holds)) {
+		h := holds[id]
+		if h.AccountID != accountID || h.Currency != cur || h.PlacedAt.Before(from) || !h.PlacedAt.Before(to) {
+			continue
+		}
+		entries = append(entries, StatementEntry{Timestamp: h.PlacedAt, Kind: TxnHold, Amount: h.Amount, Ref: h.Ref, HoldID: id, HoldStatus: h.Status})
+	}
+	// holds go between the ledger entries, ties keep the ledger entry first and the holds in ID order
+	slices.SortStableFunc(entries, func(a, b StatementEntry) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	// a hold doesn't change the ledger balance, it shows the one of the entry before it
+	running := resp.OpeningBalance
+	for i := range entries {
+		if entries[i].Kind == TxnHold {
+			entries[i].Balance = running
+		} else {
+			running = entries[i].Balance
+		}
+	}
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+		resp.Truncated = true
+	}
+	resp.Entries = append([]StatementEntry{}, entries...)
+	return resp, nil
+}
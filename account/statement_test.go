@@ -0,0 +1,173 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+)
+
+func TestGetStatement_EmptyWindow(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 500})
+	from := time.Now()
+
+	resp, err := GetStatement(ctx, "acc-1", &StatementParams{
+		From:     from.Format(time.RFC3339Nano),
+		To:       from.Add(time.Hour).Format(time.RFC3339Nano),
+		Currency: "USD",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// the credit came before the window, so it only shows in the balances
+	if len(resp.Entries) != 0 || resp.Truncated {
+		t.Errorf("entries = %+v, truncated = %v, want none", resp.Entries, resp.Truncated)
+	}
+	if resp.OpeningBalance != 500 || resp.ClosingBalance != 500 {
+		t.Errorf("opening %d closing %d, want 500 and 500", resp.OpeningBalance, resp.ClosingBalance)
+	}
+}
+
+func TestGetStatement_RunningBalance(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	if _, err := CreateAccount(ctx, &CreateAccountParams{ID: "acc-1", Currency: "USD"}); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+	from := time.Now()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 1000, Ref: "topup-1"})
+	_ = Deduct(ctx, &DeductParams{AccountID: "acc-1", Currency: currency.USD, Amount: 300, Ref: "bill-1"})
+	h, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 200, Ref: "bill-2"})
+	if err != nil {
+		t.Fatalf("Hold failed: %v", err)
+	}
+	if err := Capture(ctx, &CaptureParams{HoldID: h.HoldID, Amount: 150}); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	_ = Withdraw(ctx, "USD", WithdrawRequest{AccountID: "acc-1", Amount: 100})
+	// another currency of the account isn't on the statement
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.EUR, Amount: 700})
+
+	// the currency defaults to the account's
+	resp, err := GetStatement(ctx, "acc-1", &StatementParams{From: from.Format(time.RFC3339Nano)})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []struct {
+		kind    TransactionKind
+		amount  int64
+		ref     string
+		balance int64
+	}{
+		{TxnCredit, 1000, "topup-1", 1000},
+		{TxnDebit, 300, "bill-1", 700},
+		{TxnHold, 200, "bill-2", 700},
+		{TxnDebit, 150, "bill-2", 550},
+		{TxnDebit, 100, "", 450},
+	}
+	if len(resp.Entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(resp.Entries), len(want), resp.Entries)
+	}
+	for i, w := range want {
+		got := resp.Entries[i]
+		if got.Kind != w.kind || got.Amount != w.amount || got.Ref != w.ref || got.Balance != w.balance {
+			t.Errorf("entry %d = %s %d %q balance %d, want %s %d %q balance %d",
+				i, got.Kind, got.Amount, got.Ref, got.Balance, w.kind, w.amount, w.ref, w.balance)
+		}
+	}
+	if hold := resp.Entries[2]; hold.HoldID != h.HoldID || hold.HoldStatus != HoldCaptured {
+		t.Errorf("hold entry = %+v, want captured hold %s", hold, h.HoldID)
+	}
+	if resp.Currency != currency.USD || resp.OpeningBalance != 0 || resp.ClosingBalance != 450 {
+		t.Errorf("%s statement from %d to %d, want USD from 0 to 450", resp.Currency, resp.OpeningBalance, resp.ClosingBalance)
+	}
+	if acc, _ := GetAccount(ctx, "acc-1"); acc.Balance != resp.ClosingBalance {
+		t.Errorf("account balance = %d, want the closing balance %d", acc.Balance, resp.ClosingBalance)
+	}
+
+	// capped, the closing balance still covers the whole window
+	resp, err = GetStatement(ctx, "acc-1", &StatementParams{From: from.Format(time.RFC3339Nano), Limit: 2})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(resp.Entries) != 2 || !resp.Truncated || resp.ClosingBalance != 450 {
+		t.Errorf("got %d entries, truncated = %v, closing %d; want 2 truncated entries closing at 450",
+			len(resp.Entries), resp.Truncated, resp.ClosingBalance)
+	}
+}
+
+func TestGetStatement_HoldsAtTheSameInstant(t *testing.T) {
+	resetBalances()
+
+	ctx := context.Background()
+	from := time.Now()
+	_ = AddBalance(ctx, &AddBalanceParams{AccountID: "acc-1", Currency: currency.USD, Amount: 1000})
+	var ids []string
+	for _, ref := range []string{"bill-1", "bill-2", "bill-3"} {
+		h, err := Hold(ctx, &HoldParams{AccountID: "acc-1", Currency: currency.USD, Amount: 100, Ref: ref})
+		if err != nil {
+			t.Fatalf("Hold failed: %v", err)
+		}
+		ids = append(ids, h.HoldID)
+	}
+	placed := time.Now()
+	mu.Lock()
+	for _, id := range ids {
+		holds[id].PlacedAt = placed
+	}
+	mu.Unlock()
+	slices.Sort(ids)
+
+	// the holds map has no order, they are listed by ID on every call
+	for range 5 {
+		resp, err := GetStatement(ctx, "acc-1", &StatementParams{From: from.Format(time.RFC3339Nano), Currency: "USD"})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		var got []string
+		for _, e := range resp.Entries {
+			if e.Kind == TxnHold {
+				got = append(got, e.HoldID)
+			}
+		}
+		if !slices.Equal(got, ids) {
+			t.Fatalf("holds listed as %v, want %v", got, ids)
+		}
+	}
+}
+
+func TestGetStatement_Invalid(t *testing.T) {
+	resetBalances()
+
+	now := time.Now().UTC()
+	cases := []struct {
+		name   string
+		params StatementParams
+	}{
+		{"from not RFC3339", StatementParams{From: "yesterday", Currency: "USD"}},
+		{"to not RFC3339", StatementParams{To: "2024-13-01", Currency: "USD"}},
+		{"from after to", StatementParams{From: now.Format(time.RFC3339), To: now.Add(-time.Hour).Format(time.RFC3339), Currency: "USD"}},
+		{"window too long", StatementParams{From: now.AddDate(-2, 0, 0).Format(time.RFC3339), Currency: "USD"}},
+		{"limit too large", StatementParams{Limit: maxStatementLimit + 1, Currency: "USD"}},
+		{"unknown currency", StatementParams{Currency: "XYZ"}},
+		{"no currency for an unregistered account", StatementParams{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := GetStatement(context.Background(), "acc-1", &tc.params)
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+				t.Errorf("expected InvalidArgument error, got %v", err)
+			}
+		})
+	}
+}
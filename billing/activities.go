@@ -1,33 +1,319 @@
 package billing
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"pave-fees-api/account"
 	"pave-fees-api/internal/currency"
+	"pave-fees-api/internal/data"
+
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// how long the simulated processor takes to charge an item and how often a charge in progress heartbeats,
+// well within the heartbeat timeout of the charge activity
+var (
+	chargeDelay       = 100 * time.Millisecond
+	heartbeatInterval = chargeHeartbeatTimeout / 5
+)
+
+// outcome codes of a charge at the processor
+const (
+	ChargeApproved = "APPROVED"
+	ChargeDeclined = "DECLINED"
+)
+
+// error types of a charge the processor declined, retrying won't change its answer,
+// and of one it failed to answer, which is retried
+const (
+	chargeDeclinedType = "ChargeDeclined"
+	chargeErrorType    = "ChargeError"
+)
+
+// what the processor answered to a charge, ProcessorRef identifies the charge at the processor.
+// a declined or failed charge fails the activity with its result in the error details
+type ChargeResult struct {
+	Code         string `json:"code"`
+	ProcessorRef string `json:"processor_ref"`
+	// the activity attempt that got the answer, starting at 1
+	Attempt int32 `json:"attempt,omitempty"`
+}
+
+// the activity context of workers in simulate mode carries this key, see Config.SimulateCharges
+type simulateModeKey struct{}
+
+func withSimulateMode(ctx context.Context) context.Context {
+	return context.WithValue(ctx, simulateModeKey{}, true)
+}
+
+func simulateMode(ctx context.Context) bool {
+	on, _ := ctx.Value(simulateModeKey{}).(bool)
+	return on
+}
+
+// item name prefixes deciding the outcome of a charge in simulate mode, any other item is approved
+const (
+	simulateFailPrefix    = "FAIL_"
+	simulateDeclinePrefix = "DECLINE_"
+)
+
+// simulates an tiem charge with mocked decline and failure cases. items named "DECLINE" are declined
+// without retries, items named "FAIL" fail like a processor outage on every attempt.
+// it heartbeats while the processor works, so a hung attempt times out on the heartbeat instead of
+// the whole attempt, and stops once its context is canceled, e.g. after the workflow was canceled
+// and the cancellation was delivered with a heartbeat.
+// in simulate mode the outcome is decided right away by the item name's prefix instead, see simulateCharge
+func ChargeLineItemActivity(ctx context.Context, li LineItem) (ChargeResult, error) {
+	attempt := int32(1)
+	if activity.IsActivity(ctx) {
+		attempt = activity.GetInfo(ctx).Attempt
+	}
+	if simulateMode(ctx) {
+		return simulateCharge(li, attempt)
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	done := time.After(chargeDelay)
+	for {
+		select {
+		case <-ctx.Done():
+			return ChargeResult{}, ctx.Err()
+		case <-ticker.C:
+			if activity.IsActivity(ctx) {
+				activity.RecordHeartbeat(ctx, li.ID)
+			}
+		case <-done:
+			ref := "ch_" + newID()
+			switch li.Name {
+			case "DECLINE":
+				msg := fmt.Sprintf("charge for %s declined", li.ID)
+				return ChargeResult{}, temporal.NewNonRetryableApplicationError(msg, chargeDeclinedType, nil, ChargeResult{Code: ChargeDeclined, ProcessorRef: ref, Attempt: attempt})
+			case "FAIL":
+				msg := fmt.Sprintf("simulated failure for %s", li.ID)
+				return ChargeResult{}, temporal.NewApplicationError(msg, chargeErrorType, ChargeResult{Attempt: attempt})
+			}
+			return ChargeResult{Code: ChargeApproved, ProcessorRef: ref, Attempt: attempt}, nil
+		}
+	}
+}
+
+// the charge of a staging worker, without waiting on the processor. "DECLINE_" items are declined without retries,
+// "FAIL_" items fail on every attempt and the rest are approved. the processor ref is derived from the item ID,
+// so every run of the same bill gets the same answers
+func simulateCharge(li LineItem, attempt int32) (ChargeResult, error) {
+	ref := "ch_sim_" + li.ID
+	switch {
+	case strings.HasPrefix(li.Name, simulateDeclinePrefix):
+		msg := fmt.Sprintf("charge for %s declined", li.ID)
+		return ChargeResult{}, temporal.NewNonRetryableApplicationError(msg, chargeDeclinedType, nil, ChargeResult{Code: ChargeDeclined, ProcessorRef: ref, Attempt: attempt})
+	case strings.HasPrefix(li.Name, simulateFailPrefix):
+		msg := fmt.Sprintf("simulated failure for %s", li.ID)
+		return ChargeResult{}, temporal.NewApplicationError(msg, chargeErrorType, ChargeResult{Attempt: attempt})
+	}
+	return ChargeResult{Code: ChargeApproved, ProcessorRef: ref, Attempt: attempt}, nil
+}
+
+// refunds the simulated processor already made, keyed by refund reference
+var (
+	refundsMu    sync.Mutex
+	refundedRefs = make(map[string]struct{})
 )
 
-// simulates an tiem charge with a mocked fail case
-func ChargeLineItemActivity(_ context.Context, li LineItem) error {
+// the reference of an item's refund, the same for every attempt so the processor and the account
+// service can tell a repeated refund from a new one
+func refundRef(billID, itemID string) string {
+	return "refund/" + billID + "/" + itemID
+}
+
+// the reference of the credit of a whole bill's refund, see refundRef
+func refundAllRef(billID string) string {
+	return "refund/" + billID
+}
+
+// simulates an item refund, a reference that was already refunded succeeds without refunding again
+func RefundLineItemActivity(_ context.Context, li LineItem, ref string) error {
+	refundsMu.Lock()
+	defer refundsMu.Unlock()
+	if _, ok := refundedRefs[ref]; ok {
+		return nil
+	}
 	time.Sleep(100 * time.Millisecond)
-	if li.Name == "FAIL" {
-		return fmt.Errorf("simulated failure for %s", li.ID)
+	refundedRefs[ref] = struct{}{}
+	return nil
+}
+
+// POSTs the bill as JSON to its webhook, any non-2xx response is retried
+func NotifyWebhookActivity(ctx context.Context, url string, payload Bill) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "InvalidPayload", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "InvalidWebhook", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
 	}
 	return nil
 }
 
-// simulates an item refund
-func RefundLineItemActivity(_ context.Context, li LineItem) error {
-	time.Sleep(100 * time.Millisecond)
+// error type of an item that isn't in the product catalog, retrying won't add it
+const unknownProductType = "UnknownProduct"
+
+// checks the item's name against the product catalog, discounts aren't products and always pass.
+// an unknown product fails without retries
+func ValidateItemActivity(_ context.Context, li LineItem) error {
+	if li.IsDiscount() {
+		return nil
+	}
+	if _, ok := data.LookupProduct(li.Name); !ok {
+		msg := fmt.Sprintf("item %s: %q is not in the product catalog", li.ID, li.Name)
+		return temporal.NewNonRetryableApplicationError(msg, unknownProductType, nil)
+	}
 	return nil
 }
 
-// calls account service to add balance to the account after bill settlement
-func CreditAccountActivity(ctx context.Context, amount int64, cur currency.Currency) error {
-	return account.AddBalance(ctx, &account.AddBalanceParams{
-		Currency: cur,
-		Amount:   amount,
+// converts a settled amount from the bill currency to the account currency, rounded by the bill's mode.
+// a missing rate won't fix itself with retries so it is non-retryable
+func ConvertCurrencyActivity(_ context.Context, amount int64, from, to currency.Currency, mode currency.RoundingMode) (int64, error) {
+	converted, err := currency.Convert(amount, from, to, mode)
+	if err != nil {
+		return 0, temporal.NewNonRetryableApplicationError(err.Error(), "UnsupportedConversion", err)
+	}
+	return converted, nil
+}
+
+// calls account service to make sure a registered account is held in the currency the bill debits, failing
+// with a non-retryable error when it isn't. unregistered accounts get their ledger on first use and take any currency
+func CheckAccountActivity(ctx context.Context, accountID string, cur currency.Currency) error {
+	return verifyAccountCurrency(ctx, accountID, cur)
+}
+
+// looks the account up again before its funds move, it may have been registered in another currency
+// since the bill started
+func verifyAccountCurrency(ctx context.Context, accountID string, cur currency.Currency) error {
+	acc, err := account.GetAccount(ctx, accountID)
+	var e *errs.Error
+	if errors.As(err, &e) && e.Code == errs.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return accountMismatch(accountID, acc.Currency, cur)
+}
+
+// fails when the account is held in another currency than the bill debits
+func accountMismatch(accountID string, held, cur currency.Currency) error {
+	if held == cur {
+		return nil
+	}
+	msg := fmt.Sprintf("account %s is held in %s, the bill debits %s", accountID, held, cur)
+	return temporal.NewNonRetryableApplicationError(msg, ErrTypeAccountCurrencyMismatch, nil)
+}
+
+// calls account service to reserve the amount a bill settles for before its items are charged, returns the hold ID.
+// the bill ID is recorded as the ref of the captured transaction, and the activity ID makes retries return the same hold
+func HoldFundsActivity(ctx context.Context, accountID string, amount int64, cur currency.Currency, billID string) (string, error) {
+	info := activity.GetInfo(ctx)
+	resp, err := account.Hold(ctx, &account.HoldParams{
+		AccountID: accountID,
+		Currency:  cur,
+		Amount:    amount,
+		Ref:       billID,
+		TxnID:     info.WorkflowExecution.RunID + "/" + info.ActivityID,
 	})
+	if err != nil {
+		return "", accountError(err)
+	}
+	return resp.HoldID, nil
+}
+
+// calls account service to take the held funds once the bill settles,
+// a partially settled bill captures only the amount it settled for and the rest goes back to the balance.
+// a hold whose account is now held in another currency isn't captured and fails with a non-retryable
+// mismatch, so the bill is compensated
+func CaptureHoldActivity(ctx context.Context, holdID string, amount int64) error {
+	h, err := account.GetHold(ctx, holdID)
+	if err != nil {
+		return accountError(err)
+	}
+	if err := verifyAccountCurrency(ctx, h.AccountID, h.Currency); err != nil {
+		return err
+	}
+	return accountError(account.Capture(ctx, &account.CaptureParams{HoldID: holdID, Amount: amount}))
+}
+
+// calls account service to return the held funds when the bill can't settle
+func ReleaseHoldActivity(ctx context.Context, holdID string) error {
+	return accountError(account.Release(ctx, &account.HoldRefParams{HoldID: holdID}))
+}
+
+// calls account service to credit back an item refunded after the bill settled, the bill ID is recorded as the ref
+// and the refund reference makes retries and repeated refunds of the item credit the account once.
+// an account held in another currency is never credited
+func CreditRefundActivity(ctx context.Context, accountID string, amount int64, cur currency.Currency, billID, ref string) error {
+	if err := verifyAccountCurrency(ctx, accountID, cur); err != nil {
+		return err
+	}
+	return accountError(account.AddBalance(ctx, &account.AddBalanceParams{
+		AccountID: accountID,
+		Currency:  cur,
+		Amount:    amount,
+		Ref:       billID,
+		TxnID:     ref,
+	}))
+}
+
+// calls account service to settle an adjustment of a settled bill, in the account currency. a positive amount
+// is debited and fails on insufficient funds, a negative one is credited back. the adjustment's reference makes
+// retries move the funds once
+func AdjustAccountActivity(ctx context.Context, accountID string, amount int64, cur currency.Currency, billID, ref string) error {
+	if amount > 0 {
+		return accountError(account.Deduct(ctx, &account.DeductParams{
+			AccountID: accountID,
+			Currency:  cur,
+			Amount:    amount,
+			Ref:       billID,
+			TxnID:     ref,
+		}))
+	}
+	return accountError(account.AddBalance(ctx, &account.AddBalanceParams{
+		AccountID: accountID,
+		Currency:  cur,
+		Amount:    -amount,
+		Ref:       billID,
+		TxnID:     ref,
+	}))
+}
+
+// account errors that won't change between retries, like insufficient funds, are made non-retryable
+func accountError(err error) error {
+	var e *errs.Error
+	if !errors.As(err, &e) {
+		return err
+	}
+	switch e.Code {
+	case errs.InvalidArgument, errs.NotFound, errs.FailedPrecondition:
+		return temporal.NewNonRetryableApplicationError(e.Message, e.Code.String(), err)
+	}
+	return err
 }
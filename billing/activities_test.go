@@ -0,0 +1,279 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pave-fees-api/account"
+	"pave-fees-api/internal/currency"
+
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/worker"
+)
+
+func TestChargeLineItemActivity_SlowChargeHeartbeats(t *testing.T) {
+	defer func(delay, interval time.Duration) { chargeDelay, heartbeatInterval = delay, interval }(chargeDelay, heartbeatInterval)
+	chargeDelay, heartbeatInterval = 300*time.Millisecond, 20*time.Millisecond
+
+	var ts testsuite.WorkflowTestSuite
+	env := ts.NewTestActivityEnvironment()
+	env.RegisterActivity(ChargeLineItemActivity)
+	var heartbeats []string
+	env.SetOnActivityHeartbeatListener(func(_ *activity.Info, details converter.EncodedValues) {
+		var itemID string
+		details.Get(&itemID)
+		heartbeats = append(heartbeats, itemID)
+	})
+
+	if _, err := env.ExecuteActivity(ChargeLineItemActivity, LineItem{ID: "a1", Name: "Book", Amount: 100}); err != nil {
+		t.Fatalf("expected charge to succeed, got %v", err)
+	}
+	// heartbeats after the first one are throttled by the sdk, at least one has to get through
+	if len(heartbeats) == 0 || heartbeats[0] != "a1" {
+		t.Errorf("heartbeats = %v, want at least one for a1", heartbeats)
+	}
+}
+
+func TestChargeLineItemActivity_Outcome(t *testing.T) {
+	defer func(delay time.Duration) { chargeDelay = delay }(chargeDelay)
+	chargeDelay = time.Millisecond
+
+	tests := []struct {
+		name      string
+		item      LineItem
+		wantCode  string
+		wantRetry bool
+	}{
+		{"approved", LineItem{ID: "a1", Name: "Book", Amount: 100}, ChargeApproved, false},
+		{"declined", LineItem{ID: "d1", Name: "DECLINE", Amount: 100}, ChargeDeclined, false},
+		{"transient failure", LineItem{ID: "f1", Name: "FAIL", Amount: 100}, "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var ts testsuite.WorkflowTestSuite
+			env := ts.NewTestActivityEnvironment()
+			env.RegisterActivity(ChargeLineItemActivity)
+
+			val, err := env.ExecuteActivity(ChargeLineItemActivity, tc.item)
+			var res ChargeResult
+			var appErr *temporal.ApplicationError
+			switch {
+			case err == nil:
+				val.Get(&res)
+			case errors.As(err, &appErr) && appErr.HasDetails():
+				appErr.Details(&res)
+			}
+			// every outcome reports the attempt it came from
+			if res.Attempt != 1 {
+				t.Errorf("attempt = %d, want 1", res.Attempt)
+			}
+			// only transient failures are left to the retry policy
+			if retry := err != nil && !(errors.As(err, &appErr) && appErr.NonRetryable()); retry != tc.wantRetry {
+				t.Errorf("retryable = %v, want %v (err %v)", retry, tc.wantRetry, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Errorf("code = %q, want %q", res.Code, tc.wantCode)
+			}
+			if tc.wantCode != "" && res.ProcessorRef == "" {
+				t.Error("expected a processor ref")
+			}
+		})
+	}
+}
+
+func TestChargeLineItemActivity_SimulateMode(t *testing.T) {
+	// a real charge would outlast the test, simulated ones don't wait for the processor
+	defer func(delay time.Duration) { chargeDelay = delay }(chargeDelay)
+	chargeDelay = time.Minute
+
+	tests := []struct {
+		name      string
+		item      LineItem
+		wantCode  string
+		wantRef   string
+		wantRetry bool
+	}{
+		{"approved", LineItem{ID: "a1", Name: "Book", Amount: 100}, ChargeApproved, "ch_sim_a1", false},
+		{"declined by prefix", LineItem{ID: "d1", Name: "DECLINE_card", Amount: 100}, ChargeDeclined, "ch_sim_d1", false},
+		{"failed by prefix", LineItem{ID: "f1", Name: "FAIL_outage", Amount: 100}, "", "", true},
+		// only the prefixes count in simulate mode
+		{"bare decline name", LineItem{ID: "d2", Name: "DECLINE", Amount: 100}, ChargeApproved, "ch_sim_d2", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// the same item gets the same answer every time
+			for range 2 {
+				var ts testsuite.WorkflowTestSuite
+				env := ts.NewTestActivityEnvironment()
+				env.SetWorkerOptions(worker.Options{BackgroundActivityContext: withSimulateMode(context.Background())})
+				env.RegisterActivity(ChargeLineItemActivity)
+
+				start := time.Now()
+				val, err := env.ExecuteActivity(ChargeLineItemActivity, tc.item)
+				if elapsed := time.Since(start); elapsed > 5*time.Second {
+					t.Fatalf("simulated charge took %s", elapsed)
+				}
+				var res ChargeResult
+				var appErr *temporal.ApplicationError
+				switch {
+				case err == nil:
+					val.Get(&res)
+				case errors.As(err, &appErr) && appErr.HasDetails():
+					appErr.Details(&res)
+				}
+				if retry := err != nil && !(errors.As(err, &appErr) && appErr.NonRetryable()); retry != tc.wantRetry {
+					t.Errorf("retryable = %v, want %v (err %v)", retry, tc.wantRetry, err)
+				}
+				if res.Code != tc.wantCode || res.ProcessorRef != tc.wantRef || res.Attempt != 1 {
+					t.Errorf("result = %+v, want code %q ref %q on attempt 1", res, tc.wantCode, tc.wantRef)
+				}
+			}
+		})
+	}
+}
+
+func TestChargeLineItemActivity_Canceled(t *testing.T) {
+	defer func(delay time.Duration) { chargeDelay = delay }(chargeDelay)
+	chargeDelay = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := ChargeLineItemActivity(ctx, LineItem{ID: "a1", Name: "Book", Amount: 100})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("charge returned after %v, want it to stop once canceled", elapsed)
+	}
+}
+
+func TestCheckAccountActivity(t *testing.T) {
+	// accounts live for the whole test binary, an earlier run may have registered it already
+	_, _ = account.CreateAccount(context.Background(), &account.CreateAccountParams{ID: "acc-check-eur", Currency: "EUR"})
+
+	tests := []struct {
+		name         string
+		accountID    string
+		cur          currency.Currency
+		wantMismatch bool
+	}{
+		{"unregistered account", "acc-check-unknown", currency.USD, false},
+		{"same currency", "acc-check-eur", currency.EUR, false},
+		{"other currency", "acc-check-eur", currency.USD, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var ts testsuite.WorkflowTestSuite
+			env := ts.NewTestActivityEnvironment()
+			env.RegisterActivity(CheckAccountActivity)
+
+			_, err := env.ExecuteActivity(CheckAccountActivity, tc.accountID, tc.cur)
+			var appErr *temporal.ApplicationError
+			switch {
+			case !tc.wantMismatch && err != nil:
+				t.Fatalf("expected no error, got %v", err)
+			case tc.wantMismatch && (!errors.As(err, &appErr) || appErr.Type() != "AccountCurrencyMismatch" || !appErr.NonRetryable()):
+				t.Fatalf("expected non-retryable AccountCurrencyMismatch error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateItemActivity(t *testing.T) {
+	tests := []struct {
+		name        string
+		item        LineItem
+		wantUnknown bool
+	}{
+		{"known product", LineItem{ID: "a1", Name: "Book", Amount: 1500}, false},
+		{"unknown product", LineItem{ID: "a2", Name: "Mystery box", Amount: 1500}, true},
+		{"discount", LineItem{ID: "d1", Name: "Promo", Amount: 100, Kind: KindDiscount}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var ts testsuite.WorkflowTestSuite
+			env := ts.NewTestActivityEnvironment()
+			env.RegisterActivity(ValidateItemActivity)
+
+			_, err := env.ExecuteActivity(ValidateItemActivity, tc.item)
+			var appErr *temporal.ApplicationError
+			switch {
+			case !tc.wantUnknown && err != nil:
+				t.Fatalf("expected no error, got %v", err)
+			case tc.wantUnknown && (!errors.As(err, &appErr) || appErr.Type() != unknownProductType || !appErr.NonRetryable()):
+				t.Fatalf("expected non-retryable %s error, got %v", unknownProductType, err)
+			}
+		})
+	}
+}
+
+func TestRefundActivities_RepeatedRefund(t *testing.T) {
+	const accountID = "acc-refund-once"
+	balance := func() int64 {
+		res, err := account.GetBalances(context.Background(), accountID)
+		if err != nil {
+			t.Fatalf("GetBalances() error = %v", err)
+		}
+		return res.Balances[currency.USD]
+	}
+	start := balance()
+	item := LineItem{ID: "a1", Name: "Book", Amount: 700, Status: ItemCharged}
+	ref := refundRef("bill-refund-once", item.ID)
+
+	// a repeated refund of the item runs as a new activity with its own ID, only the reference stays the same
+	for range 2 {
+		if err := RefundLineItemActivity(context.Background(), item, ref); err != nil {
+			t.Fatalf("RefundLineItemActivity() error = %v", err)
+		}
+		if err := CreditRefundActivity(context.Background(), accountID, item.Amount, currency.USD, "bill-refund-once", ref); err != nil {
+			t.Fatalf("CreditRefundActivity() error = %v", err)
+		}
+	}
+
+	if got := balance() - start; got != item.Amount {
+		t.Errorf("account credited %d, want %d once", got, item.Amount)
+	}
+	refundsMu.Lock()
+	_, refunded := refundedRefs[ref]
+	refundsMu.Unlock()
+	if !refunded {
+		t.Errorf("refund %s not recorded", ref)
+	}
+}
+
+func TestAccountActivities_CurrencyChangedSinceHold(t *testing.T) {
+	ctx := context.Background()
+	const accountID = "acc-registered-late"
+	if err := account.AddBalance(ctx, &account.AddBalanceParams{AccountID: accountID, Currency: currency.USD, Amount: 5000}); err != nil {
+		t.Fatalf("AddBalance() error = %v", err)
+	}
+	hold, err := account.Hold(ctx, &account.HoldParams{AccountID: accountID, Currency: currency.USD, Amount: 2000, Ref: "bill-late"})
+	if err != nil {
+		t.Fatalf("Hold() error = %v", err)
+	}
+	// registered in GEL after the bill held USD
+	if _, err := account.CreateAccount(ctx, &account.CreateAccountParams{ID: accountID, Currency: "GEL"}); err != nil {
+		t.Fatalf("CreateAccount() error = %v", err)
+	}
+
+	var appErr *temporal.ApplicationError
+	err = CaptureHoldActivity(ctx, hold.HoldID, 0)
+	if !errors.As(err, &appErr) || appErr.Type() != ErrTypeAccountCurrencyMismatch || !appErr.NonRetryable() {
+		t.Fatalf("CaptureHoldActivity() = %v, want a non-retryable AccountCurrencyMismatch error", err)
+	}
+	if h, err := account.GetHold(ctx, hold.HoldID); err != nil || h.Status != account.HoldActive {
+		t.Errorf("hold = %+v (%v), want it still active", h, err)
+	}
+
+	err = CreditRefundActivity(ctx, accountID, 500, currency.USD, "bill-late", refundRef("bill-late", "a1"))
+	if !errors.As(err, &appErr) || appErr.Type() != ErrTypeAccountCurrencyMismatch || !appErr.NonRetryable() {
+		t.Fatalf("CreditRefundActivity() = %v, want a non-retryable AccountCurrencyMismatch error", err)
+	}
+}
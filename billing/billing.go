@@ -3,87 +3,776 @@ package billing
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"time"
+
 	"pave-fees-api/internal/currency"
 )
 
 type LineItemStatus string
+type LineItemKind string
 type BillStatus string
 
 const (
 	ItemPending  LineItemStatus = "PENDING"
+	ItemCharging LineItemStatus = "CHARGING"
 	ItemCharged  LineItemStatus = "CHARGED"
 	ItemFailed   LineItemStatus = "FAILED"
 	ItemCanceled LineItemStatus = "CANCELED"
 	ItemRefunded LineItemStatus = "REFUNDED"
 )
 
+// an empty kind is treated as a charge
 const (
-	BillOpen        BillStatus = "OPEN"
+	KindCharge   LineItemKind = "CHARGE"
+	KindDiscount LineItemKind = "DISCOUNT"
+)
+
+const (
+	BillOpen BillStatus = "OPEN"
+	// past its period end but not expired yet, items can still be added but not removed or updated
+	BillGrace       BillStatus = "GRACE"
 	BillCharging    BillStatus = "CHARGING"
 	BillSettled     BillStatus = "SETTLED"
 	BillCanceled    BillStatus = "CANCELED"
 	BillExpired     BillStatus = "EXPIRED"
 	BillFailed      BillStatus = "FAILED"
 	BillCompensated BillStatus = "COMPENSATED"
+	// closed with some items charged and some failed, the charged ones are kept
+	BillPartiallySettled BillStatus = "PARTIALLY_SETTLED"
+	// settled and then fully reversed, every charged item refunded and the net total credited back
+	BillRefunded BillStatus = "REFUNDED"
+	// settled with a refund credit the account didn't take, the workflow keeps retrying it, see PendingCredit
+	BillSettledCreditPending BillStatus = "SETTLED_CREDIT_PENDING"
 )
 
+// reports whether the bill reached an outcome, failed, compensated and expired bills can still
+// be retried or reopened but are final until they are
+func (s BillStatus) Terminal() bool {
+	switch s {
+	case BillSettled, BillCanceled, BillExpired, BillFailed, BillCompensated, BillPartiallySettled, BillRefunded,
+		BillSettledCreditPending:
+		return true
+	default:
+		return false
+	}
+}
+
+// reports whether s is one of the known item statuses
+func (s LineItemStatus) Valid() bool {
+	switch s {
+	case ItemPending, ItemCharging, ItemCharged, ItemFailed, ItemCanceled, ItemRefunded:
+		return true
+	default:
+		return false
+	}
+}
+
+// reports whether s is one of the known bill statuses
+func (s BillStatus) Valid() bool {
+	switch s {
+	case BillOpen, BillGrace, BillCharging, BillSettled, BillCanceled, BillExpired, BillFailed, BillCompensated, BillPartiallySettled, BillRefunded,
+		BillSettledCreditPending:
+		return true
+	default:
+		return false
+	}
+}
+
+// reports whether the bill still takes new items, charges and cancels, an open bill or one in its grace period
+func (s BillStatus) Active() bool {
+	return s == BillOpen || s == BillGrace
+}
+
 type LineItem struct {
-	ID     string         `json:"id"`
-	Name   string         `json:"name"`
-	Amount int64          `json:"amount"`
-	Status LineItemStatus `json:"status"`
+	ID             string         `json:"id"`
+	Name           string         `json:"name"`
+	Amount         int64          `json:"amount"`
+	Status         LineItemStatus `json:"status"`
+	Kind           LineItemKind   `json:"kind,omitempty"`
+	IdempotencyKey string         `json:"idempotency_key,omitempty"`
+	// Amount is Quantity * UnitAmount when they are set, a flat amount is a single unit
+	Quantity   int64 `json:"quantity,omitempty"`
+	UnitAmount int64 `json:"unit_amount,omitempty"`
+	// set on pending items canceled because the bill expired, reopening the bill makes them pending again
+	CanceledByExpiry bool `json:"canceled_by_expiry,omitempty"`
+	// the processor's reference of the item's last charge, also set when the charge was declined
+	ProcessorRef string `json:"processor_ref,omitempty"`
+	// how many times the item's last charge was attempted, more than one when the processor was flaky
+	Attempts int32 `json:"attempts,omitempty"`
+	// references of the caller, e.g. an order ID or SKU, stored and returned as they are
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// kept by the account when the settled bill is refunded, e.g. the tip line
+	NonRefundable bool `json:"non_refundable,omitempty"`
+	// optional, a pending item is canceled once it is past its expiry even while the bill stays open
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// set on items canceled because they expired, see Bill.ExpireItems
+	Expired bool `json:"expired,omitempty"`
+}
+
+// limits on an item's metadata, so integrations can't bloat the workflow history with it
+const (
+	maxMetadataEntries  = 20
+	maxMetadataKeyLen   = 40
+	maxMetadataValueLen = 500
+)
+
+func (li LineItem) validateMetadata() error {
+	if len(li.Metadata) > maxMetadataEntries {
+		return fmt.Errorf("%w: at most %d entries", ErrBadMetadata, maxMetadataEntries)
+	}
+	for k, v := range li.Metadata {
+		if k == "" || len(k) > maxMetadataKeyLen {
+			return fmt.Errorf("%w: keys must be 1 to %d bytes", ErrBadMetadata, maxMetadataKeyLen)
+		}
+		if len(v) > maxMetadataValueLen {
+			return fmt.Errorf("%w: value of %s is longer than %d bytes", ErrBadMetadata, k, maxMetadataValueLen)
+		}
+	}
+	return nil
+}
+
+// copy of the item that does not share its metadata or expiry
+func (li LineItem) clone() LineItem {
+	li.Metadata = maps.Clone(li.Metadata)
+	if li.ExpiresAt != nil {
+		at := *li.ExpiresAt
+		li.ExpiresAt = &at
+	}
+	return li
+}
+
+// discounts are accounting adjustments that reduce the total and are never sent to the processor
+func (li LineItem) IsDiscount() bool {
+	return li.Kind == KindDiscount
+}
+
+// derive the amount from quantity and unit amount, or treat a flat amount as a single unit
+func (li *LineItem) normalizeAmount() error {
+	if li.Quantity == 0 && li.UnitAmount == 0 {
+		if li.Amount <= 0 {
+			return ErrInvalidAmount
+		}
+		li.Quantity, li.UnitAmount = 1, li.Amount
+		return nil
+	}
+	if li.Quantity < 1 {
+		return ErrBadQuantity
+	}
+	if li.UnitAmount <= 0 {
+		return ErrInvalidAmount
+	}
+	if li.UnitAmount > math.MaxInt64/li.Quantity {
+		return ErrAmountOverflow
+	}
+	li.Amount = li.Quantity * li.UnitAmount
+	return nil
+}
+
+// amount the item contributes to the bill total, negative for discounts
+func (li LineItem) signedAmount() int64 {
+	if li.IsDiscount() {
+		return -li.Amount
+	}
+	return li.Amount
+}
+
+// IDs of the synthetic tax and tip lines appended when charging begins
+const (
+	TaxItemID = "tax"
+	TipItemID = "tip"
+)
+
+// reports whether id belongs to a synthetic line and can't be used for items
+func reservedItemID(id string) bool {
+	return id == TaxItemID || id == TipItemID
 }
 
 type Bill struct {
-	ID       string            `json:"id"`
-	Status   BillStatus        `json:"status"`
-	Currency currency.Currency `json:"currency"`
-	Items    []LineItem        `json:"items"`
-	Total    int64             `json:"total"`
+	ID         string            `json:"id"`
+	Status     BillStatus        `json:"status"`
+	Currency   currency.Currency `json:"currency"`
+	Items      []LineItem        `json:"items"`
+	Total      int64             `json:"total"`
+	TaxRateBps float64           `json:"tax_rate_bps,omitempty"`
+	// total rendered in the bill currency, e.g. "$12.34", only set on query snapshots
+	FormattedTotal string `json:"formatted_total,omitempty"`
+	// pending items left to charge and whether the charge endpoint accepts the bill, only set on query snapshots
+	Pending    int  `json:"pending_count"`
+	Chargeable bool `json:"chargeable"`
+	// the debited account and its currency, the settled amount is converted to it when it differs
+	AccountID       string            `json:"account_id,omitempty"`
+	AccountCurrency currency.Currency `json:"account_currency,omitempty"`
+	// settled amount in the bill currency and the amount held and captured in the account currency
+	SettledAmount   int64 `json:"settled_amount,omitempty"`
+	ConvertedAmount int64 `json:"converted_amount,omitempty"`
+	// how amounts are rounded when they are converted to the account currency, empty rounds half up
+	RoundingMode currency.RoundingMode `json:"rounding_mode,omitempty"`
+	// sum of the items refunded after settlement, in the bill currency
+	RefundedTotal int64 `json:"refunded_total,omitempty"`
+	// charges and credits made after settlement that don't map to an item, in the order they were made
+	Adjustments []Adjustment `json:"adjustments,omitempty"`
+	// what the account paid for the bill in the end: settled, less refunds, plus adjustments. only set on query snapshots
+	NetTotal int64 `json:"net_total,omitempty"`
+	// funds reserved in the account while the bill is charged, cleared when they are released
+	HoldID string `json:"hold_id,omitempty"`
+	// notified with the bill whenever it reaches a terminal status
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// idempotency key -> item that was added with it, kept for the workflow's lifetime
+	SeenKeys map[string]LineItem `json:"seen_keys,omitempty"`
+	// overrides the currency's cap on the total the bill can charge, see currency.MaxBillTotal
+	MaxTotal int64 `json:"max_total,omitempty"`
+	// why the bill was canceled, as given by whoever canceled it
+	CancelReason string `json:"cancel_reason,omitempty"`
+	// group key -> bill the pending items of the group moved to, set on a bill canceled by a split
+	SplitInto map[string]string `json:"split_into,omitempty"`
+	// item ID -> group key the split moved it to
+	SplitGroups map[string]string `json:"split_groups,omitempty"`
+	// the bill this one was split from
+	SplitFrom string `json:"split_from,omitempty"`
+	// set once the bill can no longer change and its workflow completes
+	Archived bool `json:"archived,omitempty"`
+	// given when the bill was created to group it, e.g. by cost center, and indexed as BillLabels
+	Labels map[string]string `json:"labels,omitempty"`
+	// items added while the bill was charging, in the order they came in
+	StagedItems []StagedItem `json:"staged_items,omitempty"`
+	// append-only timeline of the bill, only served by the QueryEvents query
+	Events []BillEvent `json:"events,omitempty"`
+	// items the workflow refused after they were signalled or that aren't in the catalog of a catalog-only bill,
+	// only served by the QueryRejectedItems query
+	RejectedItems []RejectedItem `json:"rejected_items,omitempty"`
+	// notes support agents attached to the bill, oldest first
+	Notes []Note `json:"notes,omitempty"`
+	// the refund credit the workflow is retrying while the bill is SETTLED_CREDIT_PENDING
+	PendingCredit *PendingCredit `json:"pending_credit,omitempty"`
+	// workflow times of the bill's start, its last recorded event and the first time it settled,
+	// SettledAt stays nil until the bill settles or partially settles
+	CreatedAt      time.Time  `json:"created_at"`
+	LastModifiedAt time.Time  `json:"last_modified_at"`
+	SettledAt      *time.Time `json:"settled_at,omitempty"`
+
+	// item ID -> position in Items, so lookups don't scan large bills. it isn't serialized and is
+	// rebuilt from Items when it is missing or stale, e.g. after continue-as-new. the workflow's
+	// coroutines run one at a time, so it needs no lock
+	itemPos map[string]int
+}
+
+type StagedStatus string
+
+const (
+	StagedPending  StagedStatus = "STAGED"
+	StagedAdded    StagedStatus = "ADDED"
+	StagedRejected StagedStatus = "REJECTED"
+)
+
+// an item added while the bill was charging, it waits for the charge to be over
+// and is then added to the bill if it is open again, or rejected
+type StagedItem struct {
+	Item   LineItem     `json:"item"`
+	Status StagedStatus `json:"status"`
+	// why a rejected item wasn't added, e.g. "bill is SETTLED"
+	Reason string `json:"reason,omitempty"`
+}
+
+type BillEventType string
+
+const (
+	EventCreated        BillEventType = "CREATED"
+	EventItemAdded      BillEventType = "ITEM_ADDED"
+	EventItemStaged     BillEventType = "ITEM_STAGED"
+	EventItemRemoved    BillEventType = "ITEM_REMOVED"
+	EventItemVoided     BillEventType = "ITEM_VOIDED"
+	EventItemExpired    BillEventType = "ITEM_EXPIRED"
+	EventItemUpdated    BillEventType = "ITEM_UPDATED"
+	EventItemRefunded   BillEventType = "ITEM_REFUNDED"
+	EventAdjusted       BillEventType = "ADJUSTED"
+	EventPeriodExtended BillEventType = "PERIOD_EXTENDED"
+	EventChargeStarted  BillEventType = "CHARGE_STARTED"
+	EventStatusChanged  BillEventType = "STATUS_CHANGED"
+	EventReopened       BillEventType = "REOPENED"
+	EventArchived       BillEventType = "ARCHIVED"
+	EventReassigned     BillEventType = "REASSIGNED"
+	EventNoteAdded      BillEventType = "NOTE_ADDED"
+	EventSplit          BillEventType = "SPLIT"
+)
+
+// an entry of the bill timeline, Detail is a human-readable description for support tooling
+type BillEvent struct {
+	Type   BillEventType `json:"type"`
+	Detail string        `json:"detail"`
+	At     time.Time     `json:"at"`
+}
+
+// a refund credit that failed after its activity's retries, in the account currency.
+// Ref is the refund reference, so the retries credit the account once
+type PendingCredit struct {
+	Ref           string    `json:"ref"`
+	Amount        int64     `json:"amount"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// an add-item signal the workflow refused, e.g. a duplicate that raced past the handler's check
+type RejectedItem struct {
+	ID     string    `json:"id"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// how many rejected items a bill keeps, the oldest are dropped first so a flood of bad signals
+// can't grow the bill without bound
+const maxRejectedItems = 100
+
+// remembers a refused add-item signal
+func (b *Bill) recordRejection(r RejectedItem) {
+	if len(b.RejectedItems) >= maxRejectedItems {
+		b.RejectedItems = slices.Delete(b.RejectedItems, 0, len(b.RejectedItems)-maxRejectedItems+1)
+	}
+	b.RejectedItems = append(b.RejectedItems, r)
 }
 
 var (
 	ErrBillNotOpen    = errors.New("bill is not open")
 	ErrCannotCancel   = errors.New("cannot cancel bill in current state")
+	ErrNotCharging    = errors.New("bill is not charging")
 	ErrNoPendingItems = errors.New("no pending items to charge")
-	ErrDuplicateItem  = func(id string) error { return fmt.Errorf("item %s already exists", id) }
+	ErrInvalidAmount  = errors.New("amount must be greater than 0")
+	ErrCannotRetry    = errors.New("only failed or compensated bills can be retried")
+	ErrCannotReopen   = errors.New("only expired bills can be reopened")
+	ErrCannotRefund   = errors.New("only settled bills can be refunded")
+	ErrNoFailedItems  = errors.New("no failed items to retry")
+	ErrCannotAdjust   = errors.New("only settled bills can be adjusted")
+	ErrZeroAdjustment = errors.New("adjustment amount cannot be zero")
+	ErrOverCredit     = errors.New("credit exceeds the bill's net total")
+	ErrOverDiscount   = errors.New("discount exceeds the charge subtotal")
+	ErrBadQuantity    = errors.New("quantity must be at least 1")
+	ErrAmountOverflow = errors.New("amount overflows")
+	ErrBadMetadata    = errors.New("invalid metadata")
+	ErrNoAccount      = errors.New("account id is required")
+	ErrUnknownProduct = errors.New("unknown product")
+	ErrDuplicateItem  = func(id string) error { return fmt.Errorf("item %s %w", id, errDuplicate) }
+	ErrItemNotFound   = func(id string) error { return fmt.Errorf("item %s not found", id) }
+	ErrItemNotPending = func(id string) error { return fmt.Errorf("item %s is not pending", id) }
+	ErrReservedItem   = func(id string) error { return fmt.Errorf("item id %s is reserved", id) }
+	ErrNotChargeable  = func(id string) error { return fmt.Errorf("item %s is a discount and cannot be charged", id) }
+	ErrNotRefundable  = func(id string) error { return fmt.Errorf("item %s is not a charged item", id) }
+	ErrItemNotSplit   = func(id string) error { return fmt.Errorf("pending item %s is in no group", id) }
+	ErrKeyConflict    = func(key string) error {
+		return fmt.Errorf("idempotency key %s was already used with a different item", key)
+	}
 )
 
-// adds item to bill only when the bill is open and the same item is not already added
+// a split moves the items to at least two bills, one group would only move them to another bill
+var ErrTooFewGroups = errors.New("a split needs at least two groups")
+
+// wrapped by ErrDuplicateItem so callers can tell a duplicate apart with errors.Is
+var errDuplicate = errors.New("already exists")
+
+// processors reject tiny charges, see currency.MinChargeAmount
+var ErrBelowMinimumCharge = errors.New("bill total is below the minimum charge amount")
+
+// risk caps what a single bill can charge, see Bill.maxTotal
+var ErrExceedsMaxTotal = errors.New("bill total exceeds the maximum bill total")
+
+// adds item to bill only when the bill is open and the same item is not already added,
+// a repeat of an idempotency key with the same payload is a no-op and a discount can't exceed the running subtotal
 func (b *Bill) AddItem(li LineItem) error {
-	if b.Status != BillOpen {
+	if err := li.normalizeAmount(); err != nil {
+		return err
+	}
+	if err := li.validateMetadata(); err != nil {
+		return err
+	}
+	if li.IdempotencyKey != "" {
+		if seen, ok := b.SeenKeys[li.IdempotencyKey]; ok {
+			if seen.ID == li.ID && seen.Name == li.Name && seen.Amount == li.Amount && seen.Kind == li.Kind {
+				return nil
+			}
+			return ErrKeyConflict(li.IdempotencyKey)
+		}
+	}
+	if !b.Status.Active() {
 		return ErrBillNotOpen
 	}
-	for _, it := range b.Items {
-		if it.ID == li.ID {
+	if reservedItemID(li.ID) {
+		return ErrReservedItem(li.ID)
+	}
+	if b.itemIndex(li.ID) >= 0 {
+		return ErrDuplicateItem(li.ID)
+	}
+	if li.IsDiscount() && li.Amount > b.Total {
+		return ErrOverDiscount
+	}
+	if !li.IsDiscount() && b.Total > math.MaxInt64-li.Amount {
+		return ErrAmountOverflow
+	}
+	li = li.clone()
+	li.Status = ItemPending
+	b.appendItem(li)
+	b.Total += li.signedAmount()
+	if li.IdempotencyKey != "" {
+		if b.SeenKeys == nil {
+			b.SeenKeys = make(map[string]LineItem)
+		}
+		b.SeenKeys[li.IdempotencyKey] = li
+	}
+	return nil
+}
+
+// holds an item added while the bill is charging, the same checks as AddItem that don't depend on
+// the bill being open apply. resolveStaged decides what happens to it once the charge is over
+func (b *Bill) StageItem(li LineItem) error {
+	if b.Status != BillCharging {
+		return ErrNotCharging
+	}
+	if err := li.normalizeAmount(); err != nil {
+		return err
+	}
+	if err := li.validateMetadata(); err != nil {
+		return err
+	}
+	if reservedItemID(li.ID) {
+		return ErrReservedItem(li.ID)
+	}
+	if b.itemIndex(li.ID) >= 0 {
+		return ErrDuplicateItem(li.ID)
+	}
+	for _, st := range b.StagedItems {
+		if st.Item.ID == li.ID && st.Status != StagedRejected {
 			return ErrDuplicateItem(li.ID)
 		}
 	}
+	li = li.clone()
 	li.Status = ItemPending
-	b.Items = append(b.Items, li)
-	b.Total += li.Amount
+	b.StagedItems = append(b.StagedItems, StagedItem{Item: li, Status: StagedPending})
+	return nil
+}
+
+// settles the staged items once a charge is over: a bill that is open again takes them as if they were
+// added now, any other bill rejects them. returns how many were added and rejected
+func (b *Bill) resolveStaged() (added, rejected int) {
+	for i := range b.StagedItems {
+		st := &b.StagedItems[i]
+		if st.Status != StagedPending {
+			continue
+		}
+		var err error
+		if !b.Status.Active() {
+			err = fmt.Errorf("bill is %s", b.Status)
+		} else {
+			err = b.AddItem(st.Item)
+		}
+		if err != nil {
+			st.Status = StagedRejected
+			st.Reason = err.Error()
+			rejected++
+			continue
+		}
+		st.Status = StagedAdded
+		added++
+	}
+	return added, rejected
+}
+
+// removes a pending item from bill only when the bill is open and the item exists,
+// a charge can't be removed while the discounts would exceed the charges left without it
+func (b *Bill) RemoveItem(id string) error {
+	if b.Status != BillOpen {
+		return ErrBillNotOpen
+	}
+	i := b.itemIndex(id)
+	if i < 0 {
+		return ErrItemNotFound(id)
+	}
+	it := b.Items[i]
+	if it.Status != ItemPending {
+		return ErrItemNotPending(id)
+	}
+	total := b.Total - it.signedAmount()
+	if total < 0 {
+		return ErrOverDiscount
+	}
+	b.deleteItem(i)
+	b.Total = total
+	return nil
+}
+
+// voids a pending item of an open bill, unlike a removed item it stays on the bill as CANCELED.
+// its amount comes off the total and the bill stays open. like a removed one, a charge the discounts
+// still need can't be voided
+func (b *Bill) VoidItem(id string) error {
+	if b.Status != BillOpen {
+		return ErrBillNotOpen
+	}
+	i := b.itemIndex(id)
+	if i < 0 {
+		return ErrItemNotFound(id)
+	}
+	it := &b.Items[i]
+	if it.Status != ItemPending {
+		return ErrItemNotPending(id)
+	}
+	total := b.Total - it.signedAmount()
+	if total < 0 {
+		return ErrOverDiscount
+	}
+	it.Status = ItemCanceled
+	b.Total = total
+	return nil
+}
+
+// cancels the pending items of an open bill that are past their expiry at now and returns their IDs.
+// unlike items canceled by the bill expiring, reopening the bill doesn't bring them back.
+// the charges can't be kept from expiring, so pending discounts they leave exceeding the rest of the bill
+// expire with them, the newest first, and are returned too
+func (b *Bill) ExpireItems(now time.Time) []string {
+	if !b.Status.Active() {
+		return nil
+	}
+	var expired []string
+	for i := range b.Items {
+		it := &b.Items[i]
+		if it.Status != ItemPending || it.ExpiresAt == nil || now.Before(*it.ExpiresAt) {
+			continue
+		}
+		it.Status = ItemCanceled
+		it.Expired = true
+		b.Total -= it.signedAmount()
+		expired = append(expired, it.ID)
+	}
+	for i := len(b.Items) - 1; i >= 0 && b.Total < 0; i-- {
+		it := &b.Items[i]
+		if it.Status != ItemPending || !it.IsDiscount() {
+			continue
+		}
+		it.Status = ItemCanceled
+		it.Expired = true
+		b.Total -= it.signedAmount()
+		expired = append(expired, it.ID)
+	}
+	return expired
+}
+
+// the earliest expiry of the bill's pending items, false when none of them expires
+func (b *Bill) nextItemExpiry() (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, it := range b.Items {
+		if it.Status != ItemPending || it.ExpiresAt == nil {
+			continue
+		}
+		if !found || it.ExpiresAt.Before(next) {
+			next, found = *it.ExpiresAt, true
+		}
+	}
+	return next, found
+}
+
+// updates the amount and name of a pending item in an open bill and adjusts the total by the delta,
+// an empty name keeps the current one
+func (b *Bill) UpdateItem(id string, amount int64, name string) error {
+	if b.Status != BillOpen {
+		return ErrBillNotOpen
+	}
+	if amount <= 0 {
+		return ErrInvalidAmount
+	}
+	i := b.itemIndex(id)
+	if i < 0 {
+		return ErrItemNotFound(id)
+	}
+	it := &b.Items[i]
+	if it.Status != ItemPending {
+		return ErrItemNotPending(id)
+	}
+	updated := *it
+	updated.Amount = amount
+	total := b.Total - it.signedAmount() + updated.signedAmount()
+	if total < 0 {
+		// discounts would exceed the charge subtotal
+		return ErrOverDiscount
+	}
+	b.Total = total
+	// an updated amount replaces the quantity breakdown with a single unit
+	it.Amount, it.Quantity, it.UnitAmount = amount, 1, amount
+	if name != "" {
+		it.Name = name
+	}
 	return nil
 }
 
 // begin charging items in the bill, set the appropriate state to indicate that
-// and charge only when we have pending items in the bill
+// and charge only when we have pending items in the bill, or items charged separately that still have to settle
 func (b *Bill) BeginCharge() error {
-	if b.Status != BillOpen {
+	return b.BeginChargeWithTip(0)
+}
+
+// begins the charge like BeginCharge with a tip of tipBps basis points of the subtotal, appended as a
+// non-refundable tip line. the tip isn't taxed
+func (b *Bill) BeginChargeWithTip(tipBps float64) error {
+	if !b.Status.Active() {
 		return ErrBillNotOpen
 	}
-	if b.PendingCount() == 0 {
+	if b.PendingCount() == 0 && b.countItems(ItemCharged) == 0 {
 		return ErrNoPendingItems
 	}
+	// checked on the subtotal, the tax only adds to it. items charged separately already went through
+	// the processor, with none left pending nothing else is sent to it
+	if b.PendingCount() > 0 && b.Total < currency.MinChargeAmount(b.Currency) {
+		return ErrBelowMinimumCharge
+	}
+	// the cap covers the tax and the tip, they are charged like any other item
+	tip := b.tipDue(tipBps)
+	if maxTotal := b.maxTotal(); maxTotal > 0 && b.totalWithTax()+tip > maxTotal {
+		return ErrExceedsMaxTotal
+	}
+	if tip > 0 {
+		b.appendItem(LineItem{ID: TipItemID, Name: "Tip", Amount: tip, Status: ItemPending, NonRefundable: true})
+		b.Total += tip
+	}
+	b.ApplyTax()
 	b.Status = BillCharging
 	return nil
 }
 
-// cancel/close an open bill and its pending items
-func (b *Bill) Cancel() error {
+// the tip of bps on the subtotal, nothing when the bill already has a tip line, e.g. on a retry
+func (b *Bill) tipDue(bps float64) int64 {
+	if bps <= 0 || b.itemIndex(TipItemID) >= 0 {
+		return 0
+	}
+	return bpsOf(b.subtotal(), bps)
+}
+
+// the bill total without its tax and tip lines
+func (b *Bill) subtotal() int64 {
+	subtotal := b.Total
+	for _, id := range []string{TaxItemID, TipItemID} {
+		if i := b.itemIndex(id); i >= 0 {
+			subtotal -= b.Items[i].Amount
+		}
+	}
+	return subtotal
+}
+
+// bps basis points of amount, the rate is scaled to integer thousandths of a basis point
+// so the result is rounded half up deterministically. nothing of a zero or negative amount
+func bpsOf(amount int64, bps float64) int64 {
+	if amount <= 0 {
+		return 0
+	}
+	rate := int64(math.Round(bps * 1000))
+	return (amount*rate + 5_000_000) / 10_000_000
+}
+
+// append the tax line for the current subtotal, or refresh it while it is still pending
+func (b *Bill) ApplyTax() {
+	tax, i, ok := b.taxDue()
+	if !ok {
+		return
+	}
+
+	switch {
+	case i >= 0:
+		b.Total += tax - b.Items[i].Amount
+		b.Items[i].Amount = tax
+	case tax > 0:
+		b.appendItem(LineItem{ID: TaxItemID, Name: "Tax", Amount: tax, Status: ItemPending})
+		b.Total += tax
+	}
+}
+
+// the tax for the current subtotal and the index of the tax line, -1 when there is none yet.
+// ok is false when the tax can't change, the bill has no tax rate or its tax line is no longer pending
+func (b *Bill) taxDue() (tax int64, i int, ok bool) {
+	if b.TaxRateBps <= 0 {
+		return 0, -1, false
+	}
+	i = b.itemIndex(TaxItemID)
+	if i >= 0 && b.Items[i].Status != ItemPending {
+		return 0, i, false
+	}
+	return bpsOf(b.subtotal(), b.TaxRateBps), i, true
+}
+
+// the total the bill would have after ApplyTax, without changing it
+func (b *Bill) totalWithTax() int64 {
+	tax, i, ok := b.taxDue()
+	switch {
+	case !ok:
+		return b.Total
+	case i >= 0:
+		return b.Total + tax - b.Items[i].Amount
+	default:
+		return b.Total + tax
+	}
+}
+
+// the most the bill can charge, its own override or the currency's cap, zero when there is none
+func (b *Bill) maxTotal() int64 {
+	if b.MaxTotal > 0 {
+		return b.MaxTotal
+	}
+	return currency.MaxBillTotal(b.Currency)
+}
+
+// begin charging only the selected pending items, the bill stays open for the remaining ones
+func (b *Bill) BeginPartialCharge(ids []string) error {
 	if b.Status != BillOpen {
+		return ErrBillNotOpen
+	}
+	if len(ids) == 0 {
+		return ErrNoPendingItems
+	}
+	// validate every id before moving any item, so a bad id leaves the bill untouched
+	idx := make([]int, 0, len(ids))
+	for _, id := range ids {
+		i := b.itemIndex(id)
+		if i < 0 {
+			return ErrItemNotFound(id)
+		}
+		if b.Items[i].Status != ItemPending {
+			return ErrItemNotPending(id)
+		}
+		if b.Items[i].IsDiscount() {
+			return ErrNotChargeable(id)
+		}
+		idx = append(idx, i)
+	}
+	for _, i := range idx {
+		b.Items[i].Status = ItemCharging
+	}
+	return nil
+}
+
+// move the failed items of a failed or compensated bill back to pending and begin charging them again,
+// refunded items stay refunded so they are never charged twice
+func (b *Bill) BeginRetry() error {
+	if b.Status != BillFailed && b.Status != BillCompensated {
+		return ErrCannotRetry
+	}
+	if b.countItems(ItemFailed) == 0 {
+		return ErrNoFailedItems
+	}
+	for i := range b.Items {
+		if b.Items[i].Status == ItemFailed {
+			b.Items[i].Status = ItemPending
+		}
+	}
+	b.Status = BillCharging
+	return nil
+}
+
+// cancel/close an open bill and its pending items,
+// not allowed while a partial charge is still in flight. items charged separately stay charged,
+// the workflow refunds them since the bill never settles
+func (b *Bill) Cancel(reason string) error {
+	if !b.Status.Active() || b.countItems(ItemCharging) > 0 {
 		return ErrCannotCancel
 	}
 	b.Status = BillCanceled
+	b.CancelReason = reason
 	for i := range b.Items {
 		if b.Items[i].Status == ItemPending {
 			b.Items[i].Status = ItemCanceled
@@ -92,24 +781,354 @@ func (b *Bill) Cancel() error {
 	return nil
 }
 
+// cancel reason of bills whose items were split into other bills
+const splitCancelReason = "split"
+
+// cancels an open bill whose pending items move to other bills. groups maps every pending item to the key of its
+// group and children every group to the ID of its bill. each group has to make a valid bill on its own,
+// e.g. its discounts can't exceed its charges, so the totals of the groups add up to the bill's total.
+// returns the items of each group as pending, in the bill's order
+func (b *Bill) Split(groups, children map[string]string) (map[string][]LineItem, error) {
+	if !b.Status.Active() || b.countItems(ItemCharging) > 0 {
+		return nil, ErrBillNotOpen
+	}
+	for id := range groups {
+		i := b.itemIndex(id)
+		if i < 0 {
+			return nil, ErrItemNotFound(id)
+		}
+		if b.Items[i].Status != ItemPending {
+			return nil, ErrItemNotPending(id)
+		}
+	}
+
+	split := make(map[string][]LineItem)
+	for _, it := range b.Items {
+		if it.Status != ItemPending {
+			continue
+		}
+		g, ok := groups[it.ID]
+		if !ok {
+			return nil, ErrItemNotSplit(it.ID)
+		}
+		split[g] = append(split[g], it.clone())
+	}
+	if len(split) < 2 {
+		return nil, ErrTooFewGroups
+	}
+	var total int64
+	for g, items := range split {
+		if children[g] == "" {
+			return nil, fmt.Errorf("group %s has no bill", g)
+		}
+		child := newBill(children[g], b.Currency, BillOptions{})
+		for _, li := range items {
+			if err := child.AddItem(li); err != nil {
+				return nil, fmt.Errorf("group %s: %w", g, err)
+			}
+		}
+		total += child.Total
+	}
+	if total != b.Total {
+		return nil, fmt.Errorf("groups total %d, the bill %d", total, b.Total)
+	}
+
+	if err := b.Cancel(splitCancelReason); err != nil {
+		return nil, err
+	}
+	b.SplitInto = maps.Clone(children)
+	b.SplitGroups = maps.Clone(groups)
+	return split, nil
+}
+
 // expire a bill and its items
 // no need to check bill status because the way our workflow is set up, expire will fire only on an open bill
+// or one in its grace period
 func (b *Bill) Expire() {
 	b.Status = BillExpired
 	for i := range b.Items {
 		if b.Items[i].Status == ItemPending {
 			b.Items[i].Status = ItemCanceled
+			b.Items[i].CanceledByExpiry = true
+		}
+	}
+}
+
+// returns how much refunding the item gives back, only charged items of a settled bill can be refunded.
+// discounts lowered what was settled, so refunds are capped at the settled amount not yet refunded
+func (b *Bill) RefundAmount(id string) (int64, error) {
+	if b.Status != BillSettled {
+		return 0, ErrCannotRefund
+	}
+	i := b.itemIndex(id)
+	if i < 0 {
+		return 0, ErrItemNotFound(id)
+	}
+	it := b.Items[i]
+	if it.Status != ItemCharged || it.IsDiscount() || it.NonRefundable {
+		return 0, ErrNotRefundable(id)
+	}
+	return min(it.Amount, b.SettledAmount-b.RefundedTotal), nil
+}
+
+// marks a charged item of a settled bill refunded and adds its refund amount to the refunded total
+func (b *Bill) RefundItem(id string) error {
+	amount, err := b.RefundAmount(id)
+	if err != nil {
+		return err
+	}
+	b.Items[b.itemIndex(id)].Status = ItemRefunded
+	b.RefundedTotal += amount
+	return nil
+}
+
+// returns how much refunding the whole settled bill gives back, its net total so earlier refunds
+// and adjustments are accounted for, less the non-refundable lines the account keeps
+func (b *Bill) RefundAllAmount() (int64, error) {
+	if b.Status != BillSettled {
+		return 0, ErrCannotRefund
+	}
+	var kept int64
+	for _, it := range b.Items {
+		if it.Status == ItemCharged && it.NonRefundable {
+			kept += it.Amount
+		}
+	}
+	return max(b.netTotal()-kept, 0), nil
+}
+
+// marks every refundable charged item of a settled bill refunded, adds the refund amount to the
+// refunded total and moves the bill to BillRefunded
+func (b *Bill) RefundAll() error {
+	amount, err := b.RefundAllAmount()
+	if err != nil {
+		return err
+	}
+	for i := range b.Items {
+		if it := &b.Items[i]; it.Status == ItemCharged && !it.IsDiscount() && !it.NonRefundable {
+			it.Status = ItemRefunded
+		}
+	}
+	b.RefundedTotal += amount
+	b.Status = BillRefunded
+	return nil
+}
+
+// a charge or credit to a settled bill, e.g. a goodwill credit. positive amounts debit the account
+// and negative ones credit it, in minor units of the bill currency
+type Adjustment struct {
+	ID     string    `json:"id"`
+	Amount int64     `json:"amount"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// settled amount less refunds plus adjustments
+func (b *Bill) netTotal() int64 {
+	net := b.SettledAmount - b.RefundedTotal
+	for _, adj := range b.Adjustments {
+		net += adj.Amount
+	}
+	return net
+}
+
+// checks that an adjustment of amount can be made, only settled bills are adjusted
+// and a credit can't give back more than the net total
+func (b *Bill) CheckAdjustment(amount int64) error {
+	if b.Status != BillSettled {
+		return ErrCannotAdjust
+	}
+	if amount == 0 {
+		return ErrZeroAdjustment
+	}
+	if amount < 0 && (amount == math.MinInt64 || -amount > b.netTotal()) {
+		return ErrOverCredit
+	}
+	if amount > 0 && b.netTotal() > math.MaxInt64-amount {
+		return ErrAmountOverflow
+	}
+	return nil
+}
+
+// the adjustment already applied with the ID, false when there is none
+func (b *Bill) adjustment(id string) (Adjustment, bool) {
+	for _, adj := range b.Adjustments {
+		if adj.ID == id {
+			return adj, true
 		}
 	}
+	return Adjustment{}, false
 }
 
-// get the pending item count of a bill
+// appends the adjustment to a settled bill
+func (b *Bill) Adjust(adj Adjustment) error {
+	if err := b.CheckAdjustment(adj.Amount); err != nil {
+		return err
+	}
+	b.Adjustments = append(b.Adjustments, adj)
+	return nil
+}
+
+// moves an open bill to another account, nothing is held before the bill charges so only the ID changes
+func (b *Bill) Reassign(accountID string) error {
+	if b.Status != BillOpen {
+		return ErrBillNotOpen
+	}
+	if accountID == "" {
+		return ErrNoAccount
+	}
+	b.AccountID = accountID
+	return nil
+}
+
+// returns an expired bill to open, items canceled by the expiry become pending again
+func (b *Bill) Reopen() error {
+	if b.Status != BillExpired {
+		return ErrCannotReopen
+	}
+	b.Status = BillOpen
+	for i := range b.Items {
+		if b.Items[i].CanceledByExpiry {
+			b.Items[i].Status = ItemPending
+			b.Items[i].CanceledByExpiry = false
+		}
+	}
+	return nil
+}
+
+// get the count of pending items of a bill that still need charging, discounts are not counted
 func (b *Bill) PendingCount() int {
 	cnt := 0
 	for _, it := range b.Items {
-		if it.Status == ItemPending {
+		if it.Status == ItemPending && !it.IsDiscount() {
 			cnt++
 		}
 	}
 	return cnt
 }
+
+// how far charging a bill got, counted in items. discounts are never charged and canceled
+// items never will be, so neither counts. Remaining are the items still pending or charging
+type ChargeProgress struct {
+	Total     int `json:"total"`
+	Charged   int `json:"charged"`
+	Failed    int `json:"failed"`
+	Refunded  int `json:"refunded"`
+	Remaining int `json:"remaining"`
+	// the earliest expiry of the pending items, unset when none of them expires
+	NextItemExpiry *time.Time `json:"next_item_expiry,omitempty"`
+}
+
+// the bill's charge progress from its current item statuses
+func (b *Bill) progress() ChargeProgress {
+	var p ChargeProgress
+	for _, it := range b.Items {
+		if it.IsDiscount() {
+			continue
+		}
+		switch it.Status {
+		case ItemCharged:
+			p.Charged++
+		case ItemFailed:
+			p.Failed++
+		case ItemRefunded:
+			p.Refunded++
+		case ItemPending, ItemCharging:
+			p.Remaining++
+		default:
+			continue
+		}
+		p.Total++
+	}
+	if next, ok := b.nextItemExpiry(); ok {
+		p.NextItemExpiry = &next
+	}
+	return p
+}
+
+// count the items of a bill in the given status
+func (b *Bill) countItems(st LineItemStatus) int {
+	cnt := 0
+	for _, it := range b.Items {
+		if it.Status == st {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// position of the item with the given id in the items slice, -1 when missing
+func (b *Bill) itemIndex(id string) int {
+	b.indexItems()
+	i, ok := b.itemPos[id]
+	if ok && b.Items[i].ID != id {
+		// the items were replaced behind the index's back
+		b.reindexItems()
+		i, ok = b.itemPos[id]
+	}
+	if !ok {
+		return -1
+	}
+	return i
+}
+
+// builds the item index when it is missing or doesn't cover the items, e.g. when the items were set directly
+func (b *Bill) indexItems() {
+	if b.itemPos == nil || len(b.itemPos) != len(b.Items) {
+		b.reindexItems()
+	}
+}
+
+// rebuilds the item index from the items slice, the first item with an ID wins like it did for the scan
+func (b *Bill) reindexItems() {
+	b.itemPos = make(map[string]int, len(b.Items))
+	for i := len(b.Items) - 1; i >= 0; i-- {
+		b.itemPos[b.Items[i].ID] = i
+	}
+}
+
+// appends the item and indexes it
+func (b *Bill) appendItem(li LineItem) {
+	b.indexItems()
+	b.Items = append(b.Items, li)
+	b.itemPos[li.ID] = len(b.Items) - 1
+}
+
+// removes the item at i and moves the positions of the items after it down by one
+func (b *Bill) deleteItem(i int) {
+	b.indexItems()
+	delete(b.itemPos, b.Items[i].ID)
+	b.Items = slices.Delete(b.Items, i, i+1)
+	for j := i; j < len(b.Items); j++ {
+		b.itemPos[b.Items[j].ID] = j
+	}
+}
+
+// copy of the bill that does not share the items or their metadata, so charge coroutines can't mutate
+// what we return, seen idempotency keys are internal and left out
+func (b *Bill) snapshot() Bill {
+	cp := *b
+	cp.Items = nil
+	for _, it := range b.Items {
+		cp.Items = append(cp.Items, it.clone())
+	}
+	cp.StagedItems = append([]StagedItem(nil), b.StagedItems...)
+	for i := range cp.StagedItems {
+		cp.StagedItems[i].Item = cp.StagedItems[i].Item.clone()
+	}
+	cp.SeenKeys = nil
+	cp.itemPos = nil
+	cp.Events = nil
+	cp.RejectedItems = nil
+	cp.Adjustments = append([]Adjustment(nil), b.Adjustments...)
+	cp.Notes = append([]Note(nil), b.Notes...)
+	if b.PendingCredit != nil {
+		pc := *b.PendingCredit
+		cp.PendingCredit = &pc
+	}
+	cp.FormattedTotal = b.Currency.Format(b.Total)
+	cp.NetTotal = b.netTotal()
+	cp.Pending = b.PendingCount()
+	cp.Chargeable = b.Status.Active() && cp.Pending > 0
+	return cp
+}
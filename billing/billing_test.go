@@ -1,9 +1,18 @@
 package billing
 
 import (
+	"cmp"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"pave-fees-api/internal/currency"
 )
 
 func TestAddItem(t *testing.T) {
@@ -23,7 +32,7 @@ func TestAddItem(t *testing.T) {
 			startItems:  nil, startTotal: 0,
 			add:        LineItem{ID: "x", Name: "Test", Amount: 100},
 			wantErrMsg: "",
-			wantItems:  []LineItem{{ID: "x", Name: "Test", Amount: 100, Status: ItemPending}},
+			wantItems:  []LineItem{{ID: "x", Name: "Test", Amount: 100, Status: ItemPending, Quantity: 1, UnitAmount: 100}},
 			wantTotal:  100,
 		},
 		{
@@ -37,6 +46,92 @@ func TestAddItem(t *testing.T) {
 			wantItems:  []LineItem{{ID: "x", Name: "T", Amount: 50, Status: ItemPending}},
 			wantTotal:  50,
 		},
+		{
+			name:        "discount",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "T", Amount: 100, Status: ItemPending}},
+			startTotal:  100,
+			add:         LineItem{ID: "d", Name: "Promo", Amount: 30, Kind: KindDiscount},
+			wantErrMsg:  "",
+			wantItems: []LineItem{
+				{ID: "x", Name: "T", Amount: 100, Status: ItemPending},
+				{ID: "d", Name: "Promo", Amount: 30, Status: ItemPending, Kind: KindDiscount, Quantity: 1, UnitAmount: 30},
+			},
+			wantTotal: 70,
+		},
+		{
+			name:        "over discount",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "T", Amount: 100, Status: ItemPending}},
+			startTotal:  100,
+			add:         LineItem{ID: "d", Name: "Promo", Amount: 101, Kind: KindDiscount},
+			wantErrMsg:  ErrOverDiscount.Error(),
+			wantItems:   []LineItem{{ID: "x", Name: "T", Amount: 100, Status: ItemPending}},
+			wantTotal:   100,
+		},
+		{
+			name:        "reserved tax id",
+			startStatus: BillOpen,
+			startItems:  nil,
+			startTotal:  0,
+			add:         LineItem{ID: TaxItemID, Name: "Tax", Amount: 10},
+			wantErrMsg:  ErrReservedItem(TaxItemID).Error(),
+			wantItems:   nil,
+			wantTotal:   0,
+		},
+		{
+			name:        "quantity",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "T", Amount: 100, Status: ItemPending}},
+			startTotal:  100,
+			add:         LineItem{ID: "seats", Name: "Seats", Quantity: 3, UnitAmount: 250},
+			wantErrMsg:  "",
+			wantItems: []LineItem{
+				{ID: "x", Name: "T", Amount: 100, Status: ItemPending},
+				{ID: "seats", Name: "Seats", Amount: 750, Status: ItemPending, Quantity: 3, UnitAmount: 250},
+			},
+			wantTotal: 850,
+		},
+		{
+			name:        "quantity below one",
+			startStatus: BillOpen,
+			startItems:  nil,
+			startTotal:  0,
+			add:         LineItem{ID: "seats", Name: "Seats", Quantity: -1, UnitAmount: 250},
+			wantErrMsg:  ErrBadQuantity.Error(),
+			wantItems:   nil,
+			wantTotal:   0,
+		},
+		{
+			name:        "zero amount",
+			startStatus: BillOpen,
+			startItems:  nil,
+			startTotal:  0,
+			add:         LineItem{ID: "y", Name: "Y"},
+			wantErrMsg:  ErrInvalidAmount.Error(),
+			wantItems:   nil,
+			wantTotal:   0,
+		},
+		{
+			name:        "quantity overflow",
+			startStatus: BillOpen,
+			startItems:  nil,
+			startTotal:  0,
+			add:         LineItem{ID: "seats", Name: "Seats", Quantity: 2, UnitAmount: math.MaxInt64/2 + 1},
+			wantErrMsg:  ErrAmountOverflow.Error(),
+			wantItems:   nil,
+			wantTotal:   0,
+		},
+		{
+			name:        "total overflow",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "T", Amount: math.MaxInt64, Status: ItemPending}},
+			startTotal:  math.MaxInt64,
+			add:         LineItem{ID: "y", Name: "Y", Amount: 1},
+			wantErrMsg:  ErrAmountOverflow.Error(),
+			wantItems:   []LineItem{{ID: "x", Name: "T", Amount: math.MaxInt64, Status: ItemPending}},
+			wantTotal:   math.MaxInt64,
+		},
 		{
 			name:        "closed",
 			startStatus: BillCanceled,
@@ -76,7 +171,7 @@ func TestAddItem(t *testing.T) {
 				t.Fatalf("items len = %d, want %d", len(b.Items), len(tc.wantItems))
 			}
 			for i := range b.Items {
-				if b.Items[i] != tc.wantItems[i] {
+				if !reflect.DeepEqual(b.Items[i], tc.wantItems[i]) {
 					t.Errorf("item[%d] = %+v, want %+v", i, b.Items[i], tc.wantItems[i])
 				}
 			}
@@ -110,6 +205,20 @@ func TestBeginCharge(t *testing.T) {
 			wantErr:     ErrNoPendingItems,
 			wantStatus:  BillOpen,
 		},
+		{
+			name:        "open with only items charged separately -> BillCharging",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Status: ItemCharged}, {ID: "y", Status: ItemFailed}},
+			wantErr:     nil,
+			wantStatus:  BillCharging,
+		},
+		{
+			name:        "open with only failed items -> ErrNoPendingItems",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "y", Status: ItemFailed}},
+			wantErr:     ErrNoPendingItems,
+			wantStatus:  BillOpen,
+		},
 		{
 			name:        "charging -> ErrBillNotOpen",
 			startStatus: BillCharging,
@@ -146,6 +255,335 @@ func TestBeginCharge(t *testing.T) {
 	}
 }
 
+func TestBeginCharge_MinimumCharge(t *testing.T) {
+	// the USD minimum is 50 cents
+	cases := []struct {
+		name       string
+		total      int64
+		wantErr    error
+		wantStatus BillStatus
+	}{
+		{"just below", 49, ErrBelowMinimumCharge, BillOpen},
+		{"at the minimum", 50, nil, BillCharging},
+		{"above", 51, nil, BillCharging},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{
+				Status:   BillOpen,
+				Currency: currency.USD,
+				Items:    []LineItem{{ID: "x", Amount: tc.total, Status: ItemPending}},
+				Total:    tc.total,
+			}
+
+			err := b.BeginCharge()
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("BeginCharge() error = %v; want %v", err, tc.wantErr)
+			}
+			if b.Status != tc.wantStatus {
+				t.Errorf("Status = %s; want %s", b.Status, tc.wantStatus)
+			}
+		})
+	}
+
+	// the items were charged on their own, only the discount left brings the total down
+	b := &Bill{
+		Status:   BillOpen,
+		Currency: currency.USD,
+		Items:    []LineItem{{ID: "x", Amount: 1000, Status: ItemCharged}, {ID: "d", Amount: 980, Kind: KindDiscount, Status: ItemPending}},
+		Total:    20,
+	}
+	if err := b.BeginCharge(); err != nil || b.Status != BillCharging {
+		t.Errorf("BeginCharge() = %v with status %s; want nil and CHARGING when nothing is left for the processor", err, b.Status)
+	}
+}
+
+func TestBeginCharge_MaxTotal(t *testing.T) {
+	// USD and EUR are both capped at 100,000.00
+	cases := []struct {
+		name       string
+		cur        currency.Currency
+		total      int64
+		taxRateBps float64
+		maxTotal   int64
+		wantErr    error
+		wantStatus BillStatus
+	}{
+		{"USD at the cap", currency.USD, 10_000_000, 0, 0, nil, BillCharging},
+		{"USD above the cap", currency.USD, 10_000_001, 0, 0, ErrExceedsMaxTotal, BillOpen},
+		{"EUR at the cap", currency.EUR, 10_000_000, 0, 0, nil, BillCharging},
+		{"EUR above the cap", currency.EUR, 10_000_001, 0, 0, ErrExceedsMaxTotal, BillOpen},
+		{"tax pushes it above", currency.USD, 9_600_000, 500, 0, ErrExceedsMaxTotal, BillOpen},
+		{"approved override", currency.USD, 50_000_000, 0, 50_000_000, nil, BillCharging},
+		{"above the override", currency.EUR, 50_000_001, 0, 50_000_000, ErrExceedsMaxTotal, BillOpen},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{
+				Status:     BillOpen,
+				Currency:   tc.cur,
+				Items:      []LineItem{{ID: "x", Amount: tc.total, Status: ItemPending}},
+				Total:      tc.total,
+				TaxRateBps: tc.taxRateBps,
+				MaxTotal:   tc.maxTotal,
+			}
+
+			err := b.BeginCharge()
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("BeginCharge() error = %v; want %v", err, tc.wantErr)
+			}
+			if b.Status != tc.wantStatus {
+				t.Errorf("Status = %s; want %s", b.Status, tc.wantStatus)
+			}
+			// a rejected charge leaves the bill as it was, without a tax line
+			if tc.wantErr != nil && (len(b.Items) != 1 || b.Total != tc.total) {
+				t.Errorf("rejected bill changed to %d items totaling %d", len(b.Items), b.Total)
+			}
+		})
+	}
+}
+
+func TestBeginChargeWithTip(t *testing.T) {
+	cases := []struct {
+		name       string
+		tipBps     float64
+		taxRateBps float64
+		startItems []LineItem
+		startTotal int64
+		wantTip    int64
+		wantTax    int64
+		wantTotal  int64
+	}{
+		{
+			name:       "no tip adds no tip line",
+			tipBps:     0,
+			startItems: []LineItem{{ID: "x", Amount: 1000, Status: ItemPending}},
+			startTotal: 1000,
+			wantTip:    -1,
+			wantTax:    -1,
+			wantTotal:  1000,
+		},
+		{
+			name:       "15% of the subtotal",
+			tipBps:     1500,
+			startItems: []LineItem{{ID: "x", Amount: 1000, Status: ItemPending}},
+			startTotal: 1000,
+			wantTip:    150,
+			wantTax:    -1,
+			wantTotal:  1150,
+		},
+		{
+			name:       "exact half rounds up",
+			tipBps:     1000,
+			startItems: []LineItem{{ID: "x", Amount: 1005, Status: ItemPending}},
+			startTotal: 1005,
+			wantTip:    101, // 100.5
+			wantTax:    -1,
+			wantTotal:  1106,
+		},
+		{
+			name:       "rounds down below half",
+			tipBps:     1250,
+			startItems: []LineItem{{ID: "x", Amount: 1003, Status: ItemPending}},
+			startTotal: 1003,
+			wantTip:    125, // 125.375
+			wantTax:    -1,
+			wantTotal:  1128,
+		},
+		{
+			name:   "tips the discounted subtotal",
+			tipBps: 2000,
+			startItems: []LineItem{
+				{ID: "x", Amount: 1000, Status: ItemPending},
+				{ID: "d", Amount: 200, Status: ItemPending, Kind: KindDiscount},
+			},
+			startTotal: 800,
+			wantTip:    160,
+			wantTax:    -1,
+			wantTotal:  960,
+		},
+		{
+			name:       "the tip isn't taxed",
+			tipBps:     2000,
+			taxRateBps: 1000,
+			startItems: []LineItem{{ID: "x", Amount: 1000, Status: ItemPending}},
+			startTotal: 1000,
+			wantTip:    200,
+			wantTax:    100,
+			wantTotal:  1300,
+		},
+		{
+			name:   "a retry keeps the first tip",
+			tipBps: 2000,
+			startItems: []LineItem{
+				{ID: "x", Amount: 1000, Status: ItemFailed},
+				{ID: TipItemID, Amount: 150, Status: ItemPending, NonRefundable: true},
+			},
+			startTotal: 1150,
+			wantTip:    150,
+			wantTax:    -1,
+			wantTotal:  1150,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{
+				Status:     BillOpen,
+				Currency:   currency.USD,
+				Items:      append([]LineItem(nil), tc.startItems...),
+				Total:      tc.startTotal,
+				TaxRateBps: tc.taxRateBps,
+			}
+
+			if err := b.BeginChargeWithTip(tc.tipBps); err != nil {
+				t.Fatalf("BeginChargeWithTip() error = %v", err)
+			}
+
+			for _, line := range []struct {
+				id   string
+				want int64
+			}{{TipItemID, tc.wantTip}, {TaxItemID, tc.wantTax}} {
+				i := b.itemIndex(line.id)
+				if line.want < 0 {
+					if i >= 0 {
+						t.Errorf("unexpected %s line %+v", line.id, b.Items[i])
+					}
+					continue
+				}
+				if i < 0 {
+					t.Fatalf("expected a %s line", line.id)
+				}
+				if b.Items[i].Amount != line.want {
+					t.Errorf("%s = %d; want %d", line.id, b.Items[i].Amount, line.want)
+				}
+			}
+			if i := b.itemIndex(TipItemID); i >= 0 && !b.Items[i].NonRefundable {
+				t.Error("tip line is refundable")
+			}
+			if b.Total != tc.wantTotal {
+				t.Errorf("total = %d; want %d", b.Total, tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestBeginChargeWithTip_MaxTotal(t *testing.T) {
+	// 9,000,000 plus a 12% tip is above the 10,000,000 USD cap
+	b := &Bill{Status: BillOpen, Currency: currency.USD,
+		Items: []LineItem{{ID: "x", Amount: 9_000_000, Status: ItemPending}}, Total: 9_000_000}
+
+	if err := b.BeginChargeWithTip(1200); !errors.Is(err, ErrExceedsMaxTotal) {
+		t.Fatalf("BeginChargeWithTip() error = %v; want %v", err, ErrExceedsMaxTotal)
+	}
+	if b.Status != BillOpen || len(b.Items) != 1 || b.Total != 9_000_000 {
+		t.Errorf("rejected bill changed to %s with %d items totaling %d", b.Status, len(b.Items), b.Total)
+	}
+}
+
+func TestApplyTax(t *testing.T) {
+	cases := []struct {
+		name       string
+		rateBps    float64
+		startItems []LineItem
+		startTotal int64
+		wantTax    int64
+		wantTotal  int64
+	}{
+		{
+			name:       "0% adds no tax line",
+			rateBps:    0,
+			startItems: []LineItem{{ID: "x", Amount: 1000, Status: ItemPending}},
+			startTotal: 1000,
+			wantTax:    -1,
+			wantTotal:  1000,
+		},
+		{
+			name:       "8.875% rounds half up",
+			rateBps:    887.5,
+			startItems: []LineItem{{ID: "x", Amount: 10000, Status: ItemPending}},
+			startTotal: 10000,
+			wantTax:    888, // 887.5
+			wantTotal:  10888,
+		},
+		{
+			name:       "rounds down below half",
+			rateBps:    875,
+			startItems: []LineItem{{ID: "x", Amount: 1001, Status: ItemPending}},
+			startTotal: 1001,
+			wantTax:    88, // 87.5875
+			wantTotal:  1089,
+		},
+		{
+			name:       "exact half rounds up",
+			rateBps:    1000,
+			startItems: []LineItem{{ID: "x", Amount: 1005, Status: ItemPending}},
+			startTotal: 1005,
+			wantTax:    101, // 100.5
+			wantTotal:  1106,
+		},
+		{
+			name:    "taxes the discounted subtotal",
+			rateBps: 1000,
+			startItems: []LineItem{
+				{ID: "x", Amount: 1000, Status: ItemPending},
+				{ID: "d", Amount: 200, Status: ItemPending, Kind: KindDiscount},
+			},
+			startTotal: 800,
+			wantTax:    80,
+			wantTotal:  880,
+		},
+		{
+			name:    "refreshes a pending tax line",
+			rateBps: 1000,
+			startItems: []LineItem{
+				{ID: "x", Amount: 2000, Status: ItemPending},
+				{ID: TaxItemID, Amount: 100, Status: ItemPending},
+			},
+			startTotal: 2100,
+			wantTax:    200,
+			wantTotal:  2200,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{
+				Status:     BillOpen,
+				Items:      append([]LineItem(nil), tc.startItems...),
+				Total:      tc.startTotal,
+				TaxRateBps: tc.rateBps,
+			}
+
+			b.ApplyTax()
+
+			i := b.itemIndex(TaxItemID)
+			if tc.wantTax < 0 {
+				if i >= 0 {
+					t.Fatalf("unexpected tax line %+v", b.Items[i])
+				}
+			} else {
+				if i < 0 {
+					t.Fatal("expected a tax line")
+				}
+				if b.Items[i].Amount != tc.wantTax {
+					t.Errorf("tax = %d; want %d", b.Items[i].Amount, tc.wantTax)
+				}
+				if b.Items[i].Status != ItemPending {
+					t.Errorf("tax status = %s; want %s", b.Items[i].Status, ItemPending)
+				}
+			}
+			if b.Total != tc.wantTotal {
+				t.Errorf("total = %d; want %d", b.Total, tc.wantTotal)
+			}
+		})
+	}
+}
+
 func TestCancel(t *testing.T) {
 	initial := []LineItem{
 		{ID: "p", Status: ItemPending},
@@ -188,11 +626,19 @@ func TestCancel(t *testing.T) {
 			copy(items, initial)
 			b := &Bill{Status: tc.startStatus, Items: items}
 
-			err := b.Cancel()
+			err := b.Cancel("duplicate order")
 
 			if !errors.Is(err, tc.wantErr) {
 				t.Fatalf("Cancel() error = %v; want %v", err, tc.wantErr)
 			}
+			// the reason is only kept when the bill was actually canceled
+			wantReason := ""
+			if tc.wantErr == nil {
+				wantReason = "duplicate order"
+			}
+			if b.CancelReason != wantReason {
+				t.Errorf("CancelReason = %q; want %q", b.CancelReason, wantReason)
+			}
 			if b.Status != tc.wantStatus {
 				t.Errorf("Status = %s; want %s", b.Status, tc.wantStatus)
 			}
@@ -205,35 +651,197 @@ func TestCancel(t *testing.T) {
 	}
 }
 
-func TestExpire(t *testing.T) {
+func TestCancel_PartialChargeInFlight(t *testing.T) {
+	b := &Bill{
+		Status: BillOpen,
+		Items: []LineItem{
+			{ID: "a", Status: ItemCharging},
+			{ID: "b", Status: ItemPending},
+		},
+	}
+
+	if err := b.Cancel(""); !errors.Is(err, ErrCannotCancel) {
+		t.Fatalf("Cancel() error = %v; want %v", err, ErrCannotCancel)
+	}
+	if b.Status != BillOpen {
+		t.Errorf("Status = %s; want %s", b.Status, BillOpen)
+	}
+	if b.Items[1].Status != ItemPending {
+		t.Errorf("item[1].Status = %s; want %s", b.Items[1].Status, ItemPending)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	newParent := func() *Bill {
+		b := newBill("b1", currency.USD, BillOptions{})
+		for _, li := range []LineItem{
+			{ID: "a", Amount: 1500},
+			{ID: "b", Amount: 4900},
+			{ID: "c", Amount: 250},
+		} {
+			if err := b.AddItem(li); err != nil {
+				t.Fatalf("AddItem failed: %v", err)
+			}
+		}
+		return b
+	}
+	children := map[string]string{"eng": "b2", "sales": "b3"}
+
+	cases := []struct {
+		name    string
+		groups  map[string]string
+		prepare func(b *Bill)
+		wantErr error
+	}{
+		{"two groups", map[string]string{"a": "eng", "b": "sales", "c": "eng"}, nil, nil},
+		{"item left out", map[string]string{"a": "eng", "b": "sales"}, nil, ErrItemNotSplit("c")},
+		{"one group", map[string]string{"a": "eng", "b": "eng", "c": "eng"}, nil, ErrTooFewGroups},
+		{"unknown item", map[string]string{"a": "eng", "b": "sales", "c": "eng", "x": "eng"}, nil, ErrItemNotFound("x")},
+		{"charging", map[string]string{"a": "eng", "b": "sales", "c": "eng"}, func(b *Bill) { b.Status = BillCharging }, ErrBillNotOpen},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newParent()
+			if tc.prepare != nil {
+				tc.prepare(b)
+			}
+			before := b.Status
+
+			split, err := b.Split(tc.groups, children)
+
+			if tc.wantErr != nil {
+				if err == nil || err.Error() != tc.wantErr.Error() {
+					t.Fatalf("Split() error = %v; want %v", err, tc.wantErr)
+				}
+				// a rejected split leaves the bill as it was
+				if b.Status != before || b.SplitInto != nil || b.countItems(ItemPending) != 3 {
+					t.Errorf("bill changed by a rejected split: %+v", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Split() error = %v", err)
+			}
+			if len(split["eng"]) != 2 || len(split["sales"]) != 1 {
+				t.Errorf("split = %+v, want a and c in eng and b in sales", split)
+			}
+			if b.Status != BillCanceled || b.CancelReason != splitCancelReason || b.SplitInto["sales"] != "b3" {
+				t.Errorf("bill is %s (%q) split into %v; want canceled for the split", b.Status, b.CancelReason, b.SplitInto)
+			}
+		})
+	}
+}
+
+func TestExpireItems(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		v := now.Add(d)
+		return &v
+	}
+	b := newBill("b1", currency.USD, BillOptions{})
+	for _, li := range []LineItem{
+		{ID: "due", Amount: 1000, ExpiresAt: at(-time.Minute)},
+		{ID: "later", Amount: 500, ExpiresAt: at(time.Hour)},
+		{ID: "never", Amount: 250},
+		{ID: "now", Amount: 100, ExpiresAt: at(0)},
+	} {
+		if err := b.AddItem(li); err != nil {
+			t.Fatalf("AddItem failed: %v", err)
+		}
+	}
+	if next, ok := b.nextItemExpiry(); !ok || !next.Equal(now.Add(-time.Minute)) {
+		t.Errorf("nextItemExpiry() = %v, %v; want the expiry of due", next, ok)
+	}
+
+	expired := b.ExpireItems(now)
+
+	if !slices.Equal(expired, []string{"due", "now"}) {
+		t.Errorf("ExpireItems() = %v; want [due now]", expired)
+	}
+	if b.Status != BillOpen || b.Total != 750 {
+		t.Errorf("bill is %s with total %d; want OPEN with 750", b.Status, b.Total)
+	}
+	if it := b.Items[0]; it.Status != ItemCanceled || !it.Expired || it.CanceledByExpiry {
+		t.Errorf("expired item = %+v; want canceled by its own expiry", it)
+	}
+	if p := b.progress(); p.NextItemExpiry == nil || !p.NextItemExpiry.Equal(now.Add(time.Hour)) || p.Remaining != 2 {
+		t.Errorf("progress = %+v; want 2 remaining and the expiry of later next", p)
+	}
+
+	// a discount the charges left can't cover expires with them, the newest one first
+	d := newBill("b2", currency.USD, BillOptions{})
+	for _, li := range []LineItem{
+		{ID: "quote", Amount: 1000, ExpiresAt: at(-time.Minute)},
+		{ID: "kept", Amount: 300},
+		{ID: "promo", Amount: 200, Kind: KindDiscount},
+		{ID: "loyalty", Amount: 250, Kind: KindDiscount},
+	} {
+		if err := d.AddItem(li); err != nil {
+			t.Fatalf("AddItem failed: %v", err)
+		}
+	}
+	if expired := d.ExpireItems(now); !slices.Equal(expired, []string{"quote", "loyalty"}) {
+		t.Errorf("ExpireItems() = %v; want [quote loyalty]", expired)
+	}
+	if d.Total != 100 || d.Items[2].Status != ItemPending || d.Items[3].Status != ItemCanceled || !d.Items[3].Expired {
+		t.Errorf("total %d items %+v; want 100 with promo pending and loyalty expired", d.Total, d.Items)
+	}
+
+	// only open bills expire items
+	b.Status = BillCharging
+	if expired := b.ExpireItems(now.Add(2 * time.Hour)); expired != nil {
+		t.Errorf("charging bill expired %v; want none", expired)
+	}
+}
+
+func TestBeginPartialCharge(t *testing.T) {
 	initial := []LineItem{
-		{ID: "p", Status: ItemPending},
-		{ID: "c", Status: ItemPending},
+		{ID: "a", Status: ItemPending},
+		{ID: "b", Status: ItemPending},
+		{ID: "c", Status: ItemCharged},
 	}
 
 	cases := []struct {
 		name        string
 		startStatus BillStatus
-		wantStatus  BillStatus
+		ids         []string
+		wantErrMsg  string
 		wantItems   []LineItemStatus
 	}{
 		{
-			name:        "open -> expire",
+			name:        "selected items -> charging",
 			startStatus: BillOpen,
-			wantStatus:  BillExpired,
-			wantItems:   []LineItemStatus{ItemCanceled, ItemCanceled},
+			ids:         []string{"a"},
+			wantErrMsg:  "",
+			wantItems:   []LineItemStatus{ItemCharging, ItemPending, ItemCharged},
 		},
 		{
-			name:        "charging -> expire",
-			startStatus: BillCharging,
-			wantStatus:  BillExpired,
-			wantItems:   []LineItemStatus{ItemCanceled, ItemCanceled},
+			name:        "no ids",
+			startStatus: BillOpen,
+			ids:         nil,
+			wantErrMsg:  ErrNoPendingItems.Error(),
+			wantItems:   []LineItemStatus{ItemPending, ItemPending, ItemCharged},
 		},
 		{
-			name:        "settled -> expire",
-			startStatus: BillSettled,
-			wantStatus:  BillExpired,
-			wantItems:   []LineItemStatus{ItemCanceled, ItemCanceled},
+			name:        "missing id leaves bill untouched",
+			startStatus: BillOpen,
+			ids:         []string{"a", "nope"},
+			wantErrMsg:  ErrItemNotFound("nope").Error(),
+			wantItems:   []LineItemStatus{ItemPending, ItemPending, ItemCharged},
+		},
+		{
+			name:        "non-pending id",
+			startStatus: BillOpen,
+			ids:         []string{"b", "c"},
+			wantErrMsg:  ErrItemNotPending("c").Error(),
+			wantItems:   []LineItemStatus{ItemPending, ItemPending, ItemCharged},
+		},
+		{
+			name:        "closed",
+			startStatus: BillCharging,
+			ids:         []string{"a"},
+			wantErrMsg:  ErrBillNotOpen.Error(),
+			wantItems:   []LineItemStatus{ItemPending, ItemPending, ItemCharged},
 		},
 	}
 
@@ -243,15 +851,263 @@ func TestExpire(t *testing.T) {
 			copy(items, initial)
 			b := &Bill{Status: tc.startStatus, Items: items}
 
-			b.Expire()
+			err := b.BeginPartialCharge(tc.ids)
 
-			if b.Status != tc.wantStatus {
-				t.Errorf("Expire() status = %s; want %s", b.Status, tc.wantStatus)
-			}
-			for i, it := range b.Items {
-				if it.Status != tc.wantItems[i] {
-					t.Errorf("item[%d].Status = %s; want %s", i, it.Status, tc.wantItems[i])
+			if tc.wantErrMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
 				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected error %q, got nil", tc.wantErrMsg)
+				}
+				if err.Error() != tc.wantErrMsg {
+					t.Fatalf("error = %q, want %q", err.Error(), tc.wantErrMsg)
+				}
+			}
+			if b.Status != tc.startStatus {
+				t.Errorf("Status = %s; want %s", b.Status, tc.startStatus)
+			}
+			for i, it := range b.Items {
+				if it.Status != tc.wantItems[i] {
+					t.Errorf("item[%d].Status = %s; want %s", i, it.Status, tc.wantItems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBeginRetry(t *testing.T) {
+	initial := []LineItem{
+		{ID: "f", Status: ItemFailed},
+		{ID: "r", Status: ItemRefunded},
+	}
+
+	cases := []struct {
+		name        string
+		startStatus BillStatus
+		startItems  []LineItem
+		wantErr     error
+		wantStatus  BillStatus
+		wantItems   []LineItemStatus
+	}{
+		{
+			name:        "compensated -> charging",
+			startStatus: BillCompensated,
+			startItems:  initial,
+			wantErr:     nil,
+			wantStatus:  BillCharging,
+			wantItems:   []LineItemStatus{ItemPending, ItemRefunded},
+		},
+		{
+			name:        "failed -> charging",
+			startStatus: BillFailed,
+			startItems:  initial[:1],
+			wantErr:     nil,
+			wantStatus:  BillCharging,
+			wantItems:   []LineItemStatus{ItemPending},
+		},
+		{
+			name:        "nothing failed -> ErrNoFailedItems",
+			startStatus: BillCompensated,
+			startItems:  initial[1:],
+			wantErr:     ErrNoFailedItems,
+			wantStatus:  BillCompensated,
+			wantItems:   []LineItemStatus{ItemRefunded},
+		},
+		{
+			name:        "settled -> ErrCannotRetry",
+			startStatus: BillSettled,
+			startItems:  initial,
+			wantErr:     ErrCannotRetry,
+			wantStatus:  BillSettled,
+			wantItems:   []LineItemStatus{ItemFailed, ItemRefunded},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{Status: tc.startStatus, Items: append([]LineItem(nil), tc.startItems...)}
+
+			err := b.BeginRetry()
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("BeginRetry() error = %v; want %v", err, tc.wantErr)
+			}
+			if b.Status != tc.wantStatus {
+				t.Errorf("Status = %s; want %s", b.Status, tc.wantStatus)
+			}
+			for i, it := range b.Items {
+				if it.Status != tc.wantItems[i] {
+					t.Errorf("item[%d].Status = %s; want %s", i, it.Status, tc.wantItems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPendingCount_SkipsDiscounts(t *testing.T) {
+	b := &Bill{Items: []LineItem{
+		{ID: "x", Status: ItemPending},
+		{ID: "d", Status: ItemPending, Kind: KindDiscount},
+	}}
+	if got := b.PendingCount(); got != 1 {
+		t.Errorf("PendingCount() = %d; want 1", got)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	initial := []LineItem{
+		{ID: "p", Status: ItemPending},
+		{ID: "c", Status: ItemPending},
+	}
+
+	cases := []struct {
+		name        string
+		startStatus BillStatus
+		wantStatus  BillStatus
+		wantItems   []LineItemStatus
+	}{
+		{
+			name:        "open -> expire",
+			startStatus: BillOpen,
+			wantStatus:  BillExpired,
+			wantItems:   []LineItemStatus{ItemCanceled, ItemCanceled},
+		},
+		{
+			name:        "charging -> expire",
+			startStatus: BillCharging,
+			wantStatus:  BillExpired,
+			wantItems:   []LineItemStatus{ItemCanceled, ItemCanceled},
+		},
+		{
+			name:        "settled -> expire",
+			startStatus: BillSettled,
+			wantStatus:  BillExpired,
+			wantItems:   []LineItemStatus{ItemCanceled, ItemCanceled},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			items := make([]LineItem, len(initial))
+			copy(items, initial)
+			b := &Bill{Status: tc.startStatus, Items: items}
+
+			b.Expire()
+
+			if b.Status != tc.wantStatus {
+				t.Errorf("Expire() status = %s; want %s", b.Status, tc.wantStatus)
+			}
+			for i, it := range b.Items {
+				if it.Status != tc.wantItems[i] {
+					t.Errorf("item[%d].Status = %s; want %s", i, it.Status, tc.wantItems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReopen(t *testing.T) {
+	cases := []struct {
+		name        string
+		startStatus BillStatus
+		wantErr     error
+		wantStatus  BillStatus
+		wantItems   []LineItemStatus
+	}{
+		{
+			name:        "expired -> open",
+			startStatus: BillOpen,
+			wantErr:     nil,
+			wantStatus:  BillOpen,
+			wantItems:   []LineItemStatus{ItemPending, ItemCharged, ItemCanceled},
+		},
+		{
+			name:        "canceled stays canceled",
+			startStatus: BillCanceled,
+			wantErr:     ErrCannotReopen,
+			wantStatus:  BillCanceled,
+			wantItems:   []LineItemStatus{ItemCanceled, ItemCharged, ItemCanceled},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{Status: tc.startStatus, Items: []LineItem{
+				{ID: "p", Status: ItemPending},
+				{ID: "c", Status: ItemCharged},
+				{ID: "x", Status: ItemCanceled},
+			}}
+			// an open bill expires first, a canceled one keeps its canceled items
+			if b.Status == BillOpen {
+				b.Expire()
+			} else {
+				b.Items[0].Status = ItemCanceled
+			}
+
+			err := b.Reopen()
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Reopen() error = %v; want %v", err, tc.wantErr)
+			}
+			if b.Status != tc.wantStatus {
+				t.Errorf("Reopen() status = %s; want %s", b.Status, tc.wantStatus)
+			}
+			for i, it := range b.Items {
+				if it.Status != tc.wantItems[i] {
+					t.Errorf("item[%d].Status = %s; want %s", i, it.Status, tc.wantItems[i])
+				}
+				if it.CanceledByExpiry {
+					t.Errorf("item[%d] still marked as canceled by expiry", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRefundItem(t *testing.T) {
+	cases := []struct {
+		name          string
+		startStatus   BillStatus
+		startRefunded int64
+		id            string
+		wantErr       error
+		wantRefunded  int64
+	}{
+		{"charged item", BillSettled, 0, "x", nil, 100},
+		{"capped at the settled amount", BillSettled, 150, "x", nil, 200},
+		{"not settled", BillFailed, 0, "x", ErrCannotRefund, 0},
+		{"discount", BillSettled, 0, "d", ErrNotRefundable("d"), 0},
+		{"already refunded", BillSettled, 0, "r", ErrNotRefundable("r"), 0},
+		{"missing", BillSettled, 0, "nope", ErrItemNotFound("nope"), 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{
+				Status: tc.startStatus,
+				Items: []LineItem{
+					{ID: "x", Amount: 100, Status: ItemCharged},
+					{ID: "y", Amount: 80, Status: ItemCharged},
+					{ID: "d", Amount: 30, Status: ItemCharged, Kind: KindDiscount},
+					{ID: "r", Amount: 50, Status: ItemRefunded},
+				},
+				// 100 + 80 + 50 - 30
+				SettledAmount: 200,
+				RefundedTotal: tc.startRefunded,
+			}
+
+			err := b.RefundItem(tc.id)
+
+			if fmt.Sprint(err) != fmt.Sprint(tc.wantErr) {
+				t.Fatalf("RefundItem() error = %v; want %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil && b.Items[b.itemIndex(tc.id)].Status != ItemRefunded {
+				t.Errorf("item %s status = %s; want REFUNDED", tc.id, b.Items[b.itemIndex(tc.id)].Status)
+			}
+			if b.RefundedTotal != tc.wantRefunded {
+				t.Errorf("refunded total = %d; want %d", b.RefundedTotal, tc.wantRefunded)
 			}
 		})
 	}
@@ -282,3 +1138,916 @@ func TestPendingCount(t *testing.T) {
 		})
 	}
 }
+
+func TestRemoveItem(t *testing.T) {
+	cases := []struct {
+		name        string
+		startStatus BillStatus
+		startItems  []LineItem
+		startTotal  int64
+		remove      string
+		wantErrMsg  string
+		wantItems   []LineItem
+		wantTotal   int64
+		wantStatus  BillStatus
+	}{
+		{
+			name:        "success",
+			startStatus: BillOpen,
+			startItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "y", Name: "Y", Amount: 50, Status: ItemPending},
+			},
+			startTotal: 150,
+			remove:     "x",
+			wantErrMsg: "",
+			wantItems:  []LineItem{{ID: "y", Name: "Y", Amount: 50, Status: ItemPending}},
+			wantTotal:  50,
+			wantStatus: BillOpen,
+		},
+		{
+			name:        "last item keeps bill open",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			startTotal:  100,
+			remove:      "x",
+			wantErrMsg:  "",
+			wantItems:   nil,
+			wantTotal:   0,
+			wantStatus:  BillOpen,
+		},
+		{
+			name:        "discounts still need it",
+			startStatus: BillOpen,
+			startItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "y", Name: "Y", Amount: 50, Status: ItemPending},
+				{ID: "d", Name: "D", Amount: 80, Kind: KindDiscount, Status: ItemPending},
+			},
+			startTotal: 70,
+			remove:     "x",
+			wantErrMsg: ErrOverDiscount.Error(),
+			wantItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "y", Name: "Y", Amount: 50, Status: ItemPending},
+				{ID: "d", Name: "D", Amount: 80, Kind: KindDiscount, Status: ItemPending},
+			},
+			wantTotal:  70,
+			wantStatus: BillOpen,
+		},
+		{
+			name:        "missing",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			startTotal:  100,
+			remove:      "nope",
+			wantErrMsg:  ErrItemNotFound("nope").Error(),
+			wantItems:   []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			wantTotal:   100,
+			wantStatus:  BillOpen,
+		},
+		{
+			name:        "not pending",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemCharged}},
+			startTotal:  100,
+			remove:      "x",
+			wantErrMsg:  ErrItemNotPending("x").Error(),
+			wantItems:   []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemCharged}},
+			wantTotal:   100,
+			wantStatus:  BillOpen,
+		},
+		{
+			name:        "closed",
+			startStatus: BillCharging,
+			startItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			startTotal:  100,
+			remove:      "x",
+			wantErrMsg:  ErrBillNotOpen.Error(),
+			wantItems:   []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			wantTotal:   100,
+			wantStatus:  BillCharging,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{
+				Status: tc.startStatus,
+				Items:  append([]LineItem(nil), tc.startItems...),
+				Total:  tc.startTotal,
+			}
+
+			err := b.RemoveItem(tc.remove)
+
+			if tc.wantErrMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected error %q, got nil", tc.wantErrMsg)
+				}
+				if err.Error() != tc.wantErrMsg {
+					t.Fatalf("error = %q, want %q", err.Error(), tc.wantErrMsg)
+				}
+			}
+
+			if len(b.Items) != len(tc.wantItems) {
+				t.Fatalf("items len = %d, want %d", len(b.Items), len(tc.wantItems))
+			}
+			for i := range b.Items {
+				if !reflect.DeepEqual(b.Items[i], tc.wantItems[i]) {
+					t.Errorf("item[%d] = %+v, want %+v", i, b.Items[i], tc.wantItems[i])
+				}
+			}
+
+			if b.Total != tc.wantTotal {
+				t.Errorf("total = %d, want %d", b.Total, tc.wantTotal)
+			}
+			if b.Status != tc.wantStatus {
+				t.Errorf("Status = %s; want %s", b.Status, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUpdateItem(t *testing.T) {
+	cases := []struct {
+		name        string
+		startStatus BillStatus
+		startItems  []LineItem
+		startTotal  int64
+		id          string
+		amount      int64
+		itemName    string
+		wantErrMsg  string
+		wantItems   []LineItem
+		wantTotal   int64
+	}{
+		{
+			name:        "increase amount",
+			startStatus: BillOpen,
+			startItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "y", Name: "Y", Amount: 50, Status: ItemPending},
+			},
+			startTotal: 150,
+			id:         "x", amount: 250, itemName: "",
+			wantErrMsg: "",
+			wantItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 250, Status: ItemPending, Quantity: 1, UnitAmount: 250},
+				{ID: "y", Name: "Y", Amount: 50, Status: ItemPending},
+			},
+			wantTotal: 300,
+		},
+		{
+			name:        "decrease amount and rename",
+			startStatus: BillOpen,
+			startItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "y", Name: "Y", Amount: 50, Status: ItemPending},
+			},
+			startTotal: 150,
+			id:         "y", amount: 20, itemName: "Why",
+			wantErrMsg: "",
+			wantItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "y", Name: "Why", Amount: 20, Status: ItemPending, Quantity: 1, UnitAmount: 20},
+			},
+			wantTotal: 120,
+		},
+		{
+			name:        "discount increase",
+			startStatus: BillOpen,
+			startItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "d", Name: "D", Amount: 20, Status: ItemPending, Kind: KindDiscount},
+			},
+			startTotal: 80,
+			id:         "d", amount: 50,
+			wantErrMsg: "",
+			wantItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "d", Name: "D", Amount: 50, Status: ItemPending, Kind: KindDiscount, Quantity: 1, UnitAmount: 50},
+			},
+			wantTotal: 50,
+		},
+		{
+			name:        "charge below discounts",
+			startStatus: BillOpen,
+			startItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "d", Name: "D", Amount: 20, Status: ItemPending, Kind: KindDiscount},
+			},
+			startTotal: 80,
+			id:         "x", amount: 10,
+			wantErrMsg: ErrOverDiscount.Error(),
+			wantItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "d", Name: "D", Amount: 20, Status: ItemPending, Kind: KindDiscount},
+			},
+			wantTotal: 80,
+		},
+		{
+			name:        "non-positive amount",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			startTotal:  100,
+			id:          "x", amount: 0,
+			wantErrMsg: ErrInvalidAmount.Error(),
+			wantItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			wantTotal:  100,
+		},
+		{
+			name:        "not pending",
+			startStatus: BillOpen,
+			startItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemCharged}},
+			startTotal:  100,
+			id:          "x", amount: 10,
+			wantErrMsg: ErrItemNotPending("x").Error(),
+			wantItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemCharged}},
+			wantTotal:  100,
+		},
+		{
+			name:        "missing",
+			startStatus: BillOpen,
+			startItems:  nil,
+			startTotal:  0,
+			id:          "x", amount: 10,
+			wantErrMsg: ErrItemNotFound("x").Error(),
+			wantItems:  nil,
+			wantTotal:  0,
+		},
+		{
+			name:        "closed",
+			startStatus: BillSettled,
+			startItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			startTotal:  100,
+			id:          "x", amount: 10,
+			wantErrMsg: ErrBillNotOpen.Error(),
+			wantItems:  []LineItem{{ID: "x", Name: "X", Amount: 100, Status: ItemPending}},
+			wantTotal:  100,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{
+				Status: tc.startStatus,
+				Items:  append([]LineItem(nil), tc.startItems...),
+				Total:  tc.startTotal,
+			}
+
+			err := b.UpdateItem(tc.id, tc.amount, tc.itemName)
+
+			if tc.wantErrMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected error %q, got nil", tc.wantErrMsg)
+				}
+				if err.Error() != tc.wantErrMsg {
+					t.Fatalf("error = %q, want %q", err.Error(), tc.wantErrMsg)
+				}
+			}
+
+			if len(b.Items) != len(tc.wantItems) {
+				t.Fatalf("items len = %d, want %d", len(b.Items), len(tc.wantItems))
+			}
+			for i := range b.Items {
+				if !reflect.DeepEqual(b.Items[i], tc.wantItems[i]) {
+					t.Errorf("item[%d] = %+v, want %+v", i, b.Items[i], tc.wantItems[i])
+				}
+			}
+
+			if b.Total != tc.wantTotal {
+				t.Errorf("total = %d, want %d", b.Total, tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestAddItem_IdempotencyKey(t *testing.T) {
+	first := LineItem{ID: "x", Name: "Test", Amount: 100, IdempotencyKey: "k1"}
+
+	cases := []struct {
+		name       string
+		retry      LineItem
+		wantErrMsg string
+		wantItems  int
+		wantTotal  int64
+	}{
+		{
+			name:       "retried identical",
+			retry:      LineItem{ID: "x", Name: "Test", Amount: 100, IdempotencyKey: "k1"},
+			wantErrMsg: "",
+			wantItems:  1,
+			wantTotal:  100,
+		},
+		{
+			name:       "retried conflicting",
+			retry:      LineItem{ID: "x", Name: "Test", Amount: 999, IdempotencyKey: "k1"},
+			wantErrMsg: ErrKeyConflict("k1").Error(),
+			wantItems:  1,
+			wantTotal:  100,
+		},
+		{
+			name:       "distinct keys",
+			retry:      LineItem{ID: "y", Name: "Other", Amount: 50, IdempotencyKey: "k2"},
+			wantErrMsg: "",
+			wantItems:  2,
+			wantTotal:  150,
+		},
+		{
+			name:       "distinct key same id",
+			retry:      LineItem{ID: "x", Name: "Test", Amount: 100, IdempotencyKey: "k2"},
+			wantErrMsg: ErrDuplicateItem("x").Error(),
+			wantItems:  1,
+			wantTotal:  100,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{Status: BillOpen}
+			if err := b.AddItem(first); err != nil {
+				t.Fatalf("first add: unexpected error: %v", err)
+			}
+
+			err := b.AddItem(tc.retry)
+
+			if tc.wantErrMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected error %q, got nil", tc.wantErrMsg)
+				}
+				if err.Error() != tc.wantErrMsg {
+					t.Fatalf("error = %q, want %q", err.Error(), tc.wantErrMsg)
+				}
+			}
+
+			if len(b.Items) != tc.wantItems {
+				t.Fatalf("items len = %d, want %d", len(b.Items), tc.wantItems)
+			}
+			if b.Total != tc.wantTotal {
+				t.Errorf("total = %d, want %d", b.Total, tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestStageItem(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  BillStatus
+		item    LineItem
+		wantErr error
+	}{
+		{"charging bill stages", BillCharging, LineItem{ID: "late", Amount: 700}, nil},
+		{"open bill adds instead", BillOpen, LineItem{ID: "late", Amount: 700}, ErrNotCharging},
+		{"item already on the bill", BillCharging, LineItem{ID: "a1", Amount: 700}, ErrDuplicateItem("a1")},
+		{"item already staged", BillCharging, LineItem{ID: "s1", Amount: 700}, ErrDuplicateItem("s1")},
+		{"reserved id", BillCharging, LineItem{ID: TaxItemID, Amount: 700}, ErrReservedItem(TaxItemID)},
+		{"invalid amount", BillCharging, LineItem{ID: "late"}, ErrInvalidAmount},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{Status: tc.status, Total: 1500,
+				Items:       []LineItem{{ID: "a1", Amount: 1500, Status: ItemCharging}},
+				StagedItems: []StagedItem{{Item: LineItem{ID: "s1", Amount: 100}, Status: StagedPending}},
+			}
+
+			err := b.StageItem(tc.item)
+
+			if fmt.Sprint(err) != fmt.Sprint(tc.wantErr) {
+				t.Fatalf("StageItem() error = %v; want %v", err, tc.wantErr)
+			}
+			wantStaged := 1
+			if tc.wantErr == nil {
+				wantStaged = 2
+			}
+			if len(b.StagedItems) != wantStaged || len(b.Items) != 1 || b.Total != 1500 {
+				t.Errorf("got %d staged, %d items totaling %d; want %d staged and the bill untouched",
+					len(b.StagedItems), len(b.Items), b.Total, wantStaged)
+			}
+		})
+	}
+}
+
+func TestResolveStaged(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      BillStatus
+		wantStaged  []StagedStatus
+		wantReasons []string
+		wantTotal   int64
+	}{
+		{
+			name:        "settled bill rejects",
+			status:      BillSettled,
+			wantStaged:  []StagedStatus{StagedRejected, StagedRejected, StagedRejected},
+			wantReasons: []string{"bill is SETTLED", "bill is SETTLED", "already rejected"},
+			wantTotal:   1500,
+		},
+		{
+			name:        "open bill adds what it can",
+			status:      BillOpen,
+			wantStaged:  []StagedStatus{StagedAdded, StagedRejected, StagedRejected},
+			wantReasons: []string{"", "item a1 already exists", "already rejected"},
+			wantTotal:   2200,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{Status: tc.status, Total: 1500,
+				Items: []LineItem{{ID: "a1", Amount: 1500, Status: ItemCharged}},
+				StagedItems: []StagedItem{
+					{Item: LineItem{ID: "late", Amount: 700}, Status: StagedPending},
+					// clashes with an item already on the bill
+					{Item: LineItem{ID: "a1", Amount: 200}, Status: StagedPending},
+					{Item: LineItem{ID: "old", Amount: 100}, Status: StagedRejected, Reason: "already rejected"},
+				},
+			}
+
+			b.resolveStaged()
+
+			for i, st := range b.StagedItems {
+				if st.Status != tc.wantStaged[i] || st.Reason != tc.wantReasons[i] {
+					t.Errorf("staged[%d] = %s %q; want %s %q", i, st.Status, st.Reason, tc.wantStaged[i], tc.wantReasons[i])
+				}
+			}
+			if b.Total != tc.wantTotal {
+				t.Errorf("total = %d; want %d", b.Total, tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestAddItem_Metadata(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := 0; i <= maxMetadataEntries; i++ {
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		wantErr  bool
+	}{
+		{"none", nil, false},
+		{"order and sku", map[string]string{"order_id": "o-42", "sku": "BK-1"}, false},
+		{"value at the limit", map[string]string{"note": strings.Repeat("x", maxMetadataValueLen)}, false},
+		{"oversized value", map[string]string{"note": strings.Repeat("x", maxMetadataValueLen+1)}, true},
+		{"oversized key", map[string]string{strings.Repeat("k", maxMetadataKeyLen+1): "v"}, true},
+		{"empty key", map[string]string{"": "v"}, true},
+		{"too many entries", tooMany, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{Status: BillOpen}
+
+			err := b.AddItem(LineItem{ID: "a1", Amount: 100, Metadata: tc.metadata})
+
+			if tc.wantErr {
+				if !errors.Is(err, ErrBadMetadata) {
+					t.Fatalf("AddItem() error = %v; want ErrBadMetadata", err)
+				}
+				if len(b.Items) != 0 {
+					t.Errorf("item added despite invalid metadata")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddItem() error = %v", err)
+			}
+			if got := b.snapshot().Items[0].Metadata; fmt.Sprint(got) != fmt.Sprint(tc.metadata) {
+				t.Errorf("metadata = %v; want %v", got, tc.metadata)
+			}
+		})
+	}
+}
+
+func TestSnapshot_CopiesMetadata(t *testing.T) {
+	md := map[string]string{"order_id": "o-42"}
+	b := &Bill{Status: BillOpen}
+	if err := b.AddItem(LineItem{ID: "a1", Amount: 100, Metadata: md}); err != nil {
+		t.Fatalf("AddItem() error = %v", err)
+	}
+
+	// neither the caller's map nor a returned snapshot share the bill's metadata
+	md["order_id"] = "changed"
+	snap := b.snapshot()
+	snap.Items[0].Metadata["sku"] = "added"
+
+	if got := b.Items[0].Metadata; len(got) != 1 || got["order_id"] != "o-42" {
+		t.Errorf("bill metadata = %v; want the original order_id only", got)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	cases := []struct {
+		name    string
+		op      func(b *Bill) error
+		wantErr error
+	}{
+		{"add item", func(b *Bill) error { return b.AddItem(LineItem{ID: "g1", Name: "Late fee", Amount: 500}) }, nil},
+		{"remove item", func(b *Bill) error { return b.RemoveItem("a1") }, ErrBillNotOpen},
+		{"update item", func(b *Bill) error { return b.UpdateItem("a1", 2000, "") }, ErrBillNotOpen},
+		{"partial charge", func(b *Bill) error { return b.BeginPartialCharge([]string{"a1"}) }, ErrBillNotOpen},
+		{"charge", func(b *Bill) error { return b.BeginCharge() }, nil},
+		{"cancel", func(b *Bill) error { return b.Cancel("late") }, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{Status: BillGrace, Currency: currency.USD, Total: 1500,
+				Items: []LineItem{{ID: "a1", Amount: 1500, Status: ItemPending}},
+			}
+
+			if err := tc.op(b); !errors.Is(err, tc.wantErr) {
+				t.Errorf("error = %v; want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckAdjustment(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  BillStatus
+		amount  int64
+		wantErr error
+	}{
+		{"charge", BillSettled, 300, nil},
+		{"credit", BillSettled, -500, nil},
+		{"credit of the whole net total", BillSettled, -1200, nil},
+		{"credit above the net total", BillSettled, -1201, ErrOverCredit},
+		{"lowest amount", BillSettled, math.MinInt64, ErrOverCredit},
+		{"zero", BillSettled, 0, ErrZeroAdjustment},
+		{"overflow", BillSettled, math.MaxInt64, ErrAmountOverflow},
+		{"open bill", BillOpen, 300, ErrCannotAdjust},
+		{"failed bill", BillFailed, -100, ErrCannotAdjust},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// paid 1500, 500 refunded and 200 charged on top
+			b := &Bill{Status: tc.status, SettledAmount: 1500, RefundedTotal: 500, Adjustments: []Adjustment{{ID: "adj-0", Amount: 200}}}
+
+			err := b.Adjust(Adjustment{ID: "adj-1", Amount: tc.amount})
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Adjust() error = %v; want %v", err, tc.wantErr)
+			}
+			want := int64(1200)
+			if tc.wantErr == nil {
+				want += tc.amount
+			}
+			if got := b.netTotal(); got != want {
+				t.Errorf("net total = %d; want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestRefundAll(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     BillStatus
+		wantErr    error
+		wantStatus BillStatus
+		wantItems  []LineItemStatus
+	}{
+		{"settled bill", BillSettled, nil, BillRefunded, []LineItemStatus{ItemRefunded, ItemRefunded, ItemCharged}},
+		{"open bill", BillOpen, ErrCannotRefund, BillOpen, []LineItemStatus{ItemCharged, ItemRefunded, ItemCharged}},
+		{"compensated bill", BillCompensated, ErrCannotRefund, BillCompensated, []LineItemStatus{ItemCharged, ItemRefunded, ItemCharged}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// paid 1500, b2 refunded for 500 and 200 charged on top
+			b := &Bill{Status: tc.status, SettledAmount: 1500, RefundedTotal: 500,
+				Items: []LineItem{
+					{ID: "a1", Amount: 1100, Status: ItemCharged},
+					{ID: "b2", Amount: 500, Status: ItemRefunded},
+					{ID: "d1", Amount: 100, Status: ItemCharged, Kind: KindDiscount},
+				},
+				Adjustments: []Adjustment{{ID: "adj-0", Amount: 200}},
+			}
+
+			amount, err := b.RefundAllAmount()
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("RefundAllAmount() error = %v; want %v", err, tc.wantErr)
+			}
+			if err == nil && amount != 1200 {
+				t.Errorf("refund amount = %d; want the net total 1200", amount)
+			}
+			if err := b.RefundAll(); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("RefundAll() error = %v; want %v", err, tc.wantErr)
+			}
+			if b.Status != tc.wantStatus {
+				t.Errorf("status = %s; want %s", b.Status, tc.wantStatus)
+			}
+			for i, it := range b.Items {
+				if it.Status != tc.wantItems[i] {
+					t.Errorf("item %s status = %s; want %s", it.ID, it.Status, tc.wantItems[i])
+				}
+			}
+			if tc.wantErr == nil && b.netTotal() != 0 {
+				t.Errorf("net total = %d; want 0", b.netTotal())
+			}
+		})
+	}
+}
+
+func TestRefund_KeepsTip(t *testing.T) {
+	// paid 1150, 1000 for the item and a 150 tip
+	newBill := func() *Bill {
+		return &Bill{Status: BillSettled, SettledAmount: 1150,
+			Items: []LineItem{
+				{ID: "a1", Amount: 1000, Status: ItemCharged},
+				{ID: TipItemID, Amount: 150, Status: ItemCharged, NonRefundable: true},
+			},
+		}
+	}
+
+	b := newBill()
+	if _, err := b.RefundAmount(TipItemID); err == nil {
+		t.Error("RefundAmount(tip) succeeded; want the tip not refundable")
+	}
+
+	amount, err := b.RefundAllAmount()
+	if err != nil {
+		t.Fatalf("RefundAllAmount() error = %v", err)
+	}
+	if amount != 1000 {
+		t.Errorf("refund amount = %d; want 1000 without the tip", amount)
+	}
+	if err := b.RefundAll(); err != nil {
+		t.Fatalf("RefundAll() error = %v", err)
+	}
+	if b.Items[0].Status != ItemRefunded || b.Items[1].Status != ItemCharged {
+		t.Errorf("item statuses = %s, %s; want the tip kept charged", b.Items[0].Status, b.Items[1].Status)
+	}
+	if b.netTotal() != 150 {
+		t.Errorf("net total = %d; want the 150 tip", b.netTotal())
+	}
+}
+
+func TestRecordRejection_KeepsNewest(t *testing.T) {
+	b := &Bill{}
+	for i := range maxRejectedItems + 5 {
+		b.recordRejection(RejectedItem{ID: fmt.Sprintf("i%d", i), Reason: "duplicate"})
+	}
+
+	if len(b.RejectedItems) != maxRejectedItems {
+		t.Fatalf("kept %d rejected items; want %d", len(b.RejectedItems), maxRejectedItems)
+	}
+	if first, last := b.RejectedItems[0].ID, b.RejectedItems[maxRejectedItems-1].ID; first != "i5" || last != fmt.Sprintf("i%d", maxRejectedItems+4) {
+		t.Errorf("kept %s to %s; want the newest %d", first, last, maxRejectedItems)
+	}
+}
+
+func TestReassign_OnlyOpen(t *testing.T) {
+	b := &Bill{Status: BillOpen, AccountID: DefaultAccountID}
+	if err := b.Reassign(""); !errors.Is(err, ErrNoAccount) {
+		t.Errorf("Reassign(\"\") = %v, want %v", err, ErrNoAccount)
+	}
+	if err := b.Reassign("acc-2"); err != nil || b.AccountID != "acc-2" {
+		t.Fatalf("Reassign() = %v, account %s; want acc-2", err, b.AccountID)
+	}
+	b.Status = BillCharging
+	if err := b.Reassign("acc-3"); !errors.Is(err, ErrBillNotOpen) || b.AccountID != "acc-2" {
+		t.Errorf("Reassign() on a charging bill = %v, account %s; want %v and acc-2", err, b.AccountID, ErrBillNotOpen)
+	}
+}
+
+func TestVoidItem(t *testing.T) {
+	items := func(statuses ...LineItemStatus) []LineItem {
+		return []LineItem{
+			{ID: "x", Name: "X", Amount: 100, Status: statuses[0]},
+			{ID: "y", Name: "Y", Amount: 50, Status: statuses[1]},
+			{ID: "z", Name: "Z", Amount: 25, Status: statuses[2]},
+		}
+	}
+	cases := []struct {
+		name   string
+		status BillStatus
+		items  []LineItem
+		// 175 when unset, the total of the items helper's
+		total      int64
+		void       string
+		wantErr    error
+		wantItems  []LineItem
+		wantTotal  int64
+		wantStatus BillStatus
+	}{
+		{
+			name:       "one of several pending",
+			status:     BillOpen,
+			items:      items(ItemPending, ItemPending, ItemPending),
+			void:       "y",
+			wantItems:  items(ItemPending, ItemCanceled, ItemPending),
+			wantTotal:  125,
+			wantStatus: BillOpen,
+		},
+		{
+			name:       "charged",
+			status:     BillOpen,
+			items:      items(ItemCharged, ItemPending, ItemPending),
+			void:       "x",
+			wantErr:    ErrItemNotPending("x"),
+			wantItems:  items(ItemCharged, ItemPending, ItemPending),
+			wantTotal:  175,
+			wantStatus: BillOpen,
+		},
+		{
+			name:       "already voided",
+			status:     BillOpen,
+			items:      items(ItemPending, ItemCanceled, ItemPending),
+			void:       "y",
+			wantErr:    ErrItemNotPending("y"),
+			wantItems:  items(ItemPending, ItemCanceled, ItemPending),
+			wantTotal:  175,
+			wantStatus: BillOpen,
+		},
+		{
+			name:       "missing",
+			status:     BillOpen,
+			items:      items(ItemPending, ItemPending, ItemPending),
+			void:       "nope",
+			wantErr:    ErrItemNotFound("nope"),
+			wantItems:  items(ItemPending, ItemPending, ItemPending),
+			wantTotal:  175,
+			wantStatus: BillOpen,
+		},
+		{
+			name:   "discounts still need it",
+			status: BillOpen,
+			items: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "d", Name: "D", Amount: 90, Kind: KindDiscount, Status: ItemPending},
+				{ID: "y", Name: "Y", Amount: 50, Status: ItemPending},
+			},
+			total:   60,
+			void:    "x",
+			wantErr: ErrOverDiscount,
+			wantItems: []LineItem{
+				{ID: "x", Name: "X", Amount: 100, Status: ItemPending},
+				{ID: "d", Name: "D", Amount: 90, Kind: KindDiscount, Status: ItemPending},
+				{ID: "y", Name: "Y", Amount: 50, Status: ItemPending},
+			},
+			wantTotal:  60,
+			wantStatus: BillOpen,
+		},
+		{
+			name:       "grace",
+			status:     BillGrace,
+			items:      items(ItemPending, ItemPending, ItemPending),
+			void:       "y",
+			wantErr:    ErrBillNotOpen,
+			wantItems:  items(ItemPending, ItemPending, ItemPending),
+			wantTotal:  175,
+			wantStatus: BillGrace,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bill{Status: tc.status, Items: tc.items, Total: cmp.Or(tc.total, 175)}
+
+			err := b.VoidItem(tc.void)
+
+			if tc.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.wantErr != nil && (err == nil || err.Error() != tc.wantErr.Error()) {
+				t.Fatalf("error = %v, want %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(b.Items, tc.wantItems) {
+				t.Errorf("items = %+v, want %+v", b.Items, tc.wantItems)
+			}
+			if b.Total != tc.wantTotal {
+				t.Errorf("total = %d, want %d", b.Total, tc.wantTotal)
+			}
+			if b.Status != tc.wantStatus {
+				t.Errorf("status = %s, want %s", b.Status, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestItemIndex_ConsistentAcrossAddRemove(t *testing.T) {
+	b := &Bill{Status: BillOpen, Currency: currency.USD}
+	for i := 0; i < 6; i++ {
+		if err := b.AddItem(LineItem{ID: fmt.Sprint("i", i), Amount: 100}); err != nil {
+			t.Fatalf("AddItem(i%d) error = %v", i, err)
+		}
+	}
+	for _, id := range []string{"i0", "i3", "i5"} {
+		if err := b.RemoveItem(id); err != nil {
+			t.Fatalf("RemoveItem(%s) error = %v", id, err)
+		}
+	}
+	if err := b.AddItem(LineItem{ID: "i3", Amount: 100}); err != nil {
+		t.Fatalf("re-adding a removed ID: %v", err)
+	}
+	if err := b.AddItem(LineItem{ID: "i1", Amount: 100}); !errors.Is(err, errDuplicate) {
+		t.Errorf("AddItem(i1) error = %v; want a duplicate", err)
+	}
+	if err := b.UpdateItem("i4", 250, ""); err != nil {
+		t.Fatalf("UpdateItem(i4) error = %v", err)
+	}
+
+	assertIndexed := func(t *testing.T, b *Bill) {
+		t.Helper()
+		if len(b.itemPos) != len(b.Items) {
+			t.Fatalf("index has %d entries for %d items", len(b.itemPos), len(b.Items))
+		}
+		for i, it := range b.Items {
+			if got := b.itemIndex(it.ID); got != i {
+				t.Errorf("itemIndex(%s) = %d; want %d", it.ID, got, i)
+			}
+		}
+		for _, id := range []string{"i0", "i5"} {
+			if got := b.itemIndex(id); got != -1 {
+				t.Errorf("itemIndex(%s) = %d for a removed item", id, got)
+			}
+		}
+	}
+	assertIndexed(t, b)
+	if got := []string{b.Items[0].ID, b.Items[1].ID, b.Items[2].ID, b.Items[3].ID}; !reflect.DeepEqual(got, []string{"i1", "i2", "i4", "i3"}) {
+		t.Errorf("item order = %v; want the order they were added in", got)
+	}
+
+	// a bill carried into a new run is decoded without its index
+	raw, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var carried Bill
+	if err := json.Unmarshal(raw, &carried); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	carried.reindexItems()
+	assertIndexed(t, &carried)
+	if err := carried.RemoveItem("i2"); err != nil {
+		t.Fatalf("RemoveItem(i2) on the carried bill: %v", err)
+	}
+	if got := carried.itemIndex("i3"); got != 2 {
+		t.Errorf("carried itemIndex(i3) = %d; want 2", got)
+	}
+
+	// snapshots don't share the index, removing from one leaves the bill's alone
+	snap := b.snapshot()
+	if err := snap.RemoveItem("i2"); err != nil {
+		t.Fatalf("RemoveItem(i2) on the snapshot: %v", err)
+	}
+	if got := b.itemIndex("i2"); got != 1 {
+		t.Errorf("itemIndex(i2) = %d after removing it from a snapshot; want 1", got)
+	}
+}
+
+func BenchmarkAddItem(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprint(n, "_items"), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bill := &Bill{Status: BillOpen, Currency: currency.USD}
+				for j := 0; j < n; j++ {
+					if err := bill.AddItem(LineItem{ID: fmt.Sprint("item-", j), Amount: 100}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRejectCommand_AfterValidation(t *testing.T) {
+	b := newBill("b1", currency.USD, BillOptions{})
+	if err := b.AddItem(LineItem{ID: "a1", Name: "Book", Amount: 1500}); err != nil {
+		t.Fatalf("add item: %v", err)
+	}
+	charge := Command{Type: CommandCharge}
+	if err := b.validateCommand(charge); err != nil {
+		t.Fatalf("charge rejected by the validator: %v", err)
+	}
+
+	// a cancel handled between the charge's validator and its handler
+	if err := b.Cancel("duplicate order"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	err := b.apply(charge)
+	if err == nil {
+		t.Fatal("expected the charge to fail on the canceled bill")
+	}
+	if d := rejection(t, b.rejectCommand(charge, err)); d.Reason != ReasonBillNotOpen || d.Status != BillCanceled {
+		t.Errorf("charge rejected with %+v; want BILL_NOT_OPEN while CANCELED", d)
+	}
+}
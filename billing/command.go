@@ -0,0 +1,119 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+
+	"pave-fees-api/internal/currency"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+// name of the update every add, charge, cancel and split of the HTTP API goes through.
+// the validator checks a command against the bill it sees, but update handlers run as coroutines, so
+// another command can change the bill before the handler does. the handler applies the command through
+// the same Bill methods and a command that no longer holds is rejected the way the validator would have
+const UpdateCommand = "Command"
+
+type CommandType string
+
+const (
+	CommandAddItem CommandType = "ADD_ITEM"
+	CommandCharge  CommandType = "CHARGE"
+	CommandCancel  CommandType = "CANCEL"
+	CommandSplit   CommandType = "SPLIT"
+)
+
+// a change to an open bill, Item is set for ADD_ITEM, Reason for CANCEL, the optional TipBps for CHARGE
+// and Groups and Children for SPLIT, see Bill.Split.
+// an item added while the bill is charging is staged, see Bill.StageItem
+type Command struct {
+	Type     CommandType       `json:"type"`
+	Item     LineItem          `json:"item,omitempty"`
+	Reason   string            `json:"reason,omitempty"`
+	TipBps   float64           `json:"tip_bps,omitempty"`
+	Groups   map[string]string `json:"groups,omitempty"`
+	Children map[string]string `json:"children,omitempty"`
+}
+
+// the bill once the command was applied, a charge returns it after the charge finished
+type CommandResult struct {
+	Status BillStatus `json:"status"`
+	Bill   Bill       `json:"bill"`
+}
+
+// applies cmd to the bill's state, side effects like timers and events are left to the workflow
+func (b *Bill) apply(cmd Command) error {
+	switch cmd.Type {
+	case CommandAddItem:
+		// held back until the charge is over
+		if b.Status == BillCharging {
+			return b.StageItem(cmd.Item)
+		}
+		return b.AddItem(cmd.Item)
+	case CommandCharge:
+		return b.BeginChargeWithTip(cmd.TipBps)
+	case CommandCancel:
+		return b.Cancel(cmd.Reason)
+	case CommandSplit:
+		_, err := b.Split(cmd.Groups, cmd.Children)
+		return err
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Type)
+	}
+}
+
+// dry-runs cmd on a copy of the bill, a command that would fail is rejected
+// with an application error typed by its ErrorReason and carrying ErrorDetails
+func (b *Bill) validateCommand(cmd Command) error {
+	if cmd.Type == CommandAddItem {
+		if err := currency.ValidateAmount(b.Currency, cmd.Item.Amount); err != nil {
+			return commandRejected(err.Error(), ErrorDetails{Reason: ReasonInvalidArgument, Field: "amount"})
+		}
+	}
+	if cmd.Type == CommandCharge && (cmd.TipBps < 0 || cmd.TipBps > 10000) {
+		return commandRejected("tip must be between 0 and 10000 basis points", ErrorDetails{Reason: ReasonInvalidArgument, Field: "tip_bps"})
+	}
+
+	cp := b.snapshot()
+	cp.SeenKeys = maps.Clone(b.SeenKeys)
+	if err := cp.apply(cmd); err != nil {
+		return b.rejectCommand(cmd, err)
+	}
+	return nil
+}
+
+// maps the error cmd failed with against the bill to the rejection the Command update returns
+func (b *Bill) rejectCommand(cmd Command, err error) error {
+	_, keySeen := b.SeenKeys[cmd.Item.IdempotencyKey]
+	switch {
+	case errors.Is(err, ErrBillNotOpen), errors.Is(err, ErrCannotCancel):
+		return commandRejected(err.Error(), ErrorDetails{Reason: ReasonBillNotOpen, Status: b.Status})
+	case errors.Is(err, ErrNoPendingItems):
+		return commandRejected(err.Error(), ErrorDetails{Reason: ReasonNoPendingItems})
+	case errors.Is(err, ErrBelowMinimumCharge):
+		minCharge := currency.MinChargeAmount(b.Currency)
+		return commandRejected(fmt.Sprintf("%s, at least %s", err, b.Currency.Format(minCharge)),
+			ErrorDetails{Reason: ReasonBelowMinimumCharge, Limit: minCharge})
+	case errors.Is(err, ErrExceedsMaxTotal):
+		return commandRejected(fmt.Sprintf("%s, at most %s", err, b.Currency.Format(b.maxTotal())),
+			ErrorDetails{Reason: ReasonExceedsMaxTotal, Limit: b.maxTotal()})
+	case errors.Is(err, errDuplicate):
+		return commandRejected(err.Error(), ErrorDetails{Reason: ReasonItemExists, ItemID: cmd.Item.ID})
+	case cmd.Type == CommandAddItem && cmd.Item.IdempotencyKey != "" && keySeen:
+		return commandRejected(err.Error(), ErrorDetails{Reason: ReasonInvalidArgument, Field: "idempotency_key"})
+	case errors.Is(err, ErrBadMetadata):
+		return commandRejected(err.Error(), ErrorDetails{Reason: ReasonInvalidArgument, Field: "metadata"})
+	case errors.Is(err, ErrOverDiscount), errors.Is(err, ErrAmountOverflow):
+		return commandRejected(err.Error(), ErrorDetails{Reason: ReasonInvalidArgument, Field: "amount"})
+	case cmd.Type == CommandSplit:
+		return commandRejected(err.Error(), ErrorDetails{Reason: ReasonInvalidArgument, Field: "groups"})
+	default:
+		return commandRejected(err.Error(), ErrorDetails{Reason: ReasonInvalidArgument})
+	}
+}
+
+func commandRejected(msg string, d ErrorDetails) error {
+	return temporal.NewApplicationError(msg, string(d.Reason), d)
+}
@@ -0,0 +1,8 @@
+// how long bills created or reopened without a period_end stay open, 1 to 8760 hours
+DefaultPeriodHours: 720
+
+// how many bills an account can have open, in grace or charging at once, 0 for no limit
+MaxOpenBillsPerAccount: 50
+
+// staging deployments turn this on to get deterministic charges, see the README
+SimulateCharges: false
@@ -0,0 +1,67 @@
+package billing
+
+import (
+	"fmt"
+	"time"
+
+	"encore.dev/config"
+)
+
+// the billing service's configuration, set per deployment in config.cue
+type Config struct {
+	// how long a bill created or reopened without a period_end stays open, 1 to 8760 hours (365 days)
+	DefaultPeriodHours config.Int
+	// how many bills an account can have open, in grace or charging at once, 0 for no limit
+	MaxOpenBillsPerAccount config.Int
+	// decides charges by item name prefix without waiting on the processor, for staging, see simulateCharge
+	SimulateCharges config.Bool
+}
+
+var cfg = config.Load[*Config]()
+
+// bounds of the configured default period, and the period bills get when nothing is configured
+const (
+	minDefaultPeriod      = time.Hour
+	maxDefaultPeriod      = 365 * 24 * time.Hour
+	fallbackDefaultPeriod = 30 * 24 * time.Hour
+)
+
+// the default period of the configuration, an out of range period fails the service's start
+func defaultPeriod(c *Config) (time.Duration, error) {
+	// not loaded outside of an Encore run, e.g. in tests
+	if c == nil || c.DefaultPeriodHours == nil {
+		return fallbackDefaultPeriod, nil
+	}
+	hours := c.DefaultPeriodHours()
+	if hours < int(minDefaultPeriod/time.Hour) || hours > int(maxDefaultPeriod/time.Hour) {
+		return 0, fmt.Errorf("DefaultPeriodHours must be between %d and %d, got %d",
+			int(minDefaultPeriod/time.Hour), int(maxDefaultPeriod/time.Hour), hours)
+	}
+	return time.Duration(hours) * time.Hour, nil
+}
+
+// the period end of a bill created or reopened now without a period_end
+func (s *Service) defaultPeriodEnd() time.Time {
+	period := s.defaultPeriod
+	if period == 0 {
+		period = fallbackDefaultPeriod
+	}
+	return time.Now().UTC().Add(period)
+}
+
+// the open bill limit of the configuration, zero when there is none. a negative limit fails the service's start
+func maxOpenBills(c *Config) (int, error) {
+	if c == nil || c.MaxOpenBillsPerAccount == nil {
+		return 0, nil
+	}
+	limit := c.MaxOpenBillsPerAccount()
+	if limit < 0 {
+		return 0, fmt.Errorf("MaxOpenBillsPerAccount must not be negative, got %d", limit)
+	}
+	return limit, nil
+}
+
+// whether the workers charge in simulate mode, off unless a deployment turns it on
+func simulateCharges(c *Config) bool {
+	return c != nil && c.SimulateCharges != nil && c.SimulateCharges()
+}
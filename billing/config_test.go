@@ -0,0 +1,90 @@
+package billing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/mocks"
+)
+
+func TestDefaultPeriod(t *testing.T) {
+	hours := func(h int) *Config { return &Config{DefaultPeriodHours: func() int { return h }} }
+	tests := []struct {
+		name    string
+		cfg     *Config
+		want    time.Duration
+		wantErr bool
+	}{
+		{"not configured", nil, 30 * 24 * time.Hour, false},
+		{"one hour", hours(1), time.Hour, false},
+		{"a week", hours(168), 7 * 24 * time.Hour, false},
+		{"365 days", hours(8760), 365 * 24 * time.Hour, false},
+		{"zero", hours(0), 0, true},
+		{"negative", hours(-24), 0, true},
+		{"over 365 days", hours(8761), 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := defaultPeriod(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("defaultPeriod() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("defaultPeriod() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMaxOpenBills(t *testing.T) {
+	limit := func(n int) *Config { return &Config{MaxOpenBillsPerAccount: func() int { return n }} }
+	tests := []struct {
+		name    string
+		cfg     *Config
+		want    int
+		wantErr bool
+	}{
+		{"not configured", nil, 0, false},
+		{"no limit", limit(0), 0, false},
+		{"fifty", limit(50), 50, false},
+		{"negative", limit(-1), 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := maxOpenBills(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("maxOpenBills() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("maxOpenBills() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCreateBill_ConfiguredDefaultPeriod(t *testing.T) {
+	period, err := defaultPeriod(&Config{DefaultPeriodHours: func() int { return 6 }})
+	if err != nil {
+		t.Fatalf("defaultPeriod() error = %v", err)
+	}
+	c := mocks.NewClient(t)
+	var periodEnd time.Time
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			periodEnd = args.Get(5).(time.Time)
+		}).
+		Return(mocks.NewWorkflowRun(t), nil)
+
+	svc := &Service{temporalClient: c, defaultPeriod: period}
+	before := time.Now()
+	if _, err := svc.CreateBill(context.Background(), CreateBillRequest{Currency: "USD"}); err != nil {
+		t.Fatalf("CreateBill returned error: %v", err)
+	}
+	after := time.Now()
+	if periodEnd.Before(before.Add(6*time.Hour)) || periodEnd.After(after.Add(6*time.Hour)) {
+		t.Errorf("period end = %v, want 6h after %v", periodEnd, before)
+	}
+}
@@ -0,0 +1,64 @@
+package billing
+
+import (
+	"context"
+	"strings"
+
+	"pave-fees-api/internal/currency"
+)
+
+type ConvertParams struct {
+	From string `query:"from"`
+	To   string `query:"to"`
+	// in minor units of the source currency
+	Amount int64 `query:"amount"`
+	// optional, HALF_UP (default), HALF_EVEN or FLOOR
+	RoundingMode string `query:"rounding_mode"`
+}
+
+// an amount converted with the rate bills use, amounts are in minor units of their currency
+type ConvertResponse struct {
+	From               currency.Currency `json:"from"`
+	To                 currency.Currency `json:"to"`
+	Amount             int64             `json:"amount"`
+	Converted          int64             `json:"converted"`
+	FormattedAmount    string            `json:"formatted_amount"`
+	FormattedConverted string            `json:"formatted_converted"`
+}
+
+// previews what an amount comes to in another currency, e.g. the total of a bill debiting an account
+// held in a different currency. it is rounded to the target currency's minor unit, half up unless another
+// rounding mode is given, like the charge of a bill created with that mode
+//
+//encore:api public method=GET path=/bills/convert
+func (s *Service) ConvertAmount(ctx context.Context, p ConvertParams) (*ConvertResponse, error) {
+	from, err := currency.Parse(p.From)
+	if err != nil {
+		return nil, errInvalid("from", err.Error())
+	}
+	to, err := currency.Parse(p.To)
+	if err != nil {
+		return nil, errInvalid("to", err.Error())
+	}
+	if p.Amount <= 0 {
+		return nil, errInvalid("amount", "'amount' must be greater than 0")
+	}
+
+	mode := currency.RoundingMode(strings.ToUpper(strings.TrimSpace(p.RoundingMode)))
+	if !mode.Valid() {
+		return nil, errInvalid("rounding_mode", "'rounding_mode' must be HALF_UP, HALF_EVEN or FLOOR")
+	}
+
+	converted, err := currency.Convert(p.Amount, from, to, mode)
+	if err != nil {
+		return nil, errUnsupportedConversion(from, to)
+	}
+	return &ConvertResponse{
+		From:               from,
+		To:                 to,
+		Amount:             p.Amount,
+		Converted:          converted,
+		FormattedAmount:    from.Format(p.Amount),
+		FormattedConverted: to.Format(converted),
+	}, nil
+}
@@ -0,0 +1,57 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+)
+
+func TestConvertAmount(t *testing.T) {
+	// 1.4955 yen per cent, so whole yen only come out after rounding
+	currency.SetRate(currency.USD, currency.Currency("JPY"), 1_495_500)
+
+	tests := []struct {
+		name          string
+		params        ConvertParams
+		wantConverted int64
+		wantFormatted string
+		wantCode      errs.ErrCode
+		wantReason    ErrorReason
+	}{
+		{"usd to eur", ConvertParams{From: "usd", To: "EUR", Amount: 1000}, 920, "€9.20", errs.OK, ""},
+		{"usd to jpy rounds half up to whole yen", ConvertParams{From: "USD", To: "JPY", Amount: 1000}, 1496, "¥1496", errs.OK, ""},
+		{"same currency", ConvertParams{From: "GEL", To: "GEL", Amount: 250}, 250, "₾2.50", errs.OK, ""},
+		{"usd to gel rounds half up by default", ConvertParams{From: "USD", To: "GEL", Amount: 15}, 41, "₾0.41", errs.OK, ""},
+		{"usd to gel rounds half to even", ConvertParams{From: "USD", To: "GEL", Amount: 15, RoundingMode: "half_even"}, 40, "₾0.40", errs.OK, ""},
+		{"usd to gel rounds down", ConvertParams{From: "USD", To: "GEL", Amount: 15, RoundingMode: "FLOOR"}, 40, "₾0.40", errs.OK, ""},
+		{"unknown rounding mode", ConvertParams{From: "USD", To: "GEL", Amount: 15, RoundingMode: "CEIL"}, 0, "", errs.InvalidArgument, ReasonInvalidArgument},
+		{"unsupported pair", ConvertParams{From: "EUR", To: "JPY", Amount: 1000}, 0, "", errs.InvalidArgument, ReasonNoConversionRate},
+		{"unknown currency", ConvertParams{From: "USD", To: "XYZ", Amount: 1000}, 0, "", errs.InvalidArgument, ReasonInvalidArgument},
+		{"no amount", ConvertParams{From: "USD", To: "EUR"}, 0, "", errs.InvalidArgument, ReasonInvalidArgument},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := (&Service{}).ConvertAmount(context.Background(), tc.params)
+			if tc.wantCode != errs.OK {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != tc.wantCode {
+					t.Fatalf("expected %s error, got %v", tc.wantCode, err)
+				}
+				if d, ok := e.Details.(ErrorDetails); !ok || d.Reason != tc.wantReason {
+					t.Errorf("details = %+v, want reason %s", e.Details, tc.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ConvertAmount returned error: %v", err)
+			}
+			if resp.Converted != tc.wantConverted || resp.FormattedConverted != tc.wantFormatted {
+				t.Errorf("converted = %d (%s), want %d (%s)", resp.Converted, resp.FormattedConverted, tc.wantConverted, tc.wantFormatted)
+			}
+		})
+	}
+}
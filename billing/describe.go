@@ -0,0 +1,60 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.temporal.io/api/serviceerror"
+)
+
+// where the bill's workflow stands in temporal, for debugging stuck bills
+type ExecutionInfo struct {
+	// the workflow execution status, e.g. "Running" or "ContinuedAsNew"
+	Status    string    `json:"status"`
+	RunID     string    `json:"run_id"`
+	TaskQueue string    `json:"task_queue"`
+	StartTime time.Time `json:"start_time"`
+	// activities scheduled or running, e.g. item charges in flight
+	PendingActivities int `json:"pending_activities"`
+}
+
+type DescribeBillResponse struct {
+	Bill      *Bill         `json:"bill"`
+	Execution ExecutionInfo `json:"execution"`
+}
+
+// the bill next to the execution of its workflow, so operators see both the business and the orchestration view
+//
+//encore:api public method=GET path=/bills/:id/describe
+func (s *Service) DescribeBill(ctx context.Context, id string) (*DescribeBillResponse, error) {
+	desc, err := s.temporalClient.DescribeWorkflowExecution(ctx, id, "")
+	if err != nil {
+		var notFound *serviceerror.NotFound
+		if errors.As(err, &notFound) {
+			return nil, errNotFound(id)
+		}
+		return nil, errInternal("failed to describe billing workflow", err)
+	}
+	info := desc.GetWorkflowExecutionInfo()
+	exec := ExecutionInfo{
+		Status:            info.GetStatus().String(),
+		RunID:             info.GetExecution().GetRunId(),
+		TaskQueue:         info.GetTaskQueue(),
+		PendingActivities: len(desc.GetPendingActivities()),
+	}
+	if st := info.GetStartTime(); st != nil {
+		exec.StartTime = st.AsTime().UTC()
+	}
+
+	// query the run just described, so both views are of the same run
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, exec.RunID, QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	return &DescribeBillResponse{Bill: &bill, Execution: exec}, nil
+}
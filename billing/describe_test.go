@@ -0,0 +1,77 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+
+	"github.com/stretchr/testify/mock"
+	commonpb "go.temporal.io/api/common/v1"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	workflowpb "go.temporal.io/api/workflow/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"go.temporal.io/sdk/mocks"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestDescribeBill_Running(t *testing.T) {
+	started := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := mocks.NewClient(t)
+	c.On("DescribeWorkflowExecution", mock.Anything, "b1", "").Return(&workflowservice.DescribeWorkflowExecutionResponse{
+		WorkflowExecutionInfo: &workflowpb.WorkflowExecutionInfo{
+			Execution: &commonpb.WorkflowExecution{WorkflowId: "b1", RunId: "run-1"},
+			Status:    enums.WORKFLOW_EXECUTION_STATUS_RUNNING,
+			TaskQueue: standardTaskQueue,
+			StartTime: timestamppb.New(started),
+		},
+		PendingActivities: []*workflowpb.PendingActivityInfo{{ActivityId: "1"}, {ActivityId: "2"}},
+	}, nil)
+	billVal := mocks.NewEncodedValue(t)
+	billVal.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*Bill) = Bill{ID: "b1", Status: BillCharging, Currency: currency.USD, Total: 1500}
+	}).Return(nil)
+	c.On("QueryWorkflow", mock.Anything, "b1", "run-1", QueryBill).Return(billVal, nil)
+	svc := &Service{temporalClient: c}
+
+	resp, err := svc.DescribeBill(context.Background(), "b1")
+	if err != nil {
+		t.Fatalf("DescribeBill returned error: %v", err)
+	}
+	want := ExecutionInfo{Status: "Running", RunID: "run-1", TaskQueue: standardTaskQueue, StartTime: started, PendingActivities: 2}
+	if resp.Execution != want {
+		t.Errorf("execution = %+v, want %+v", resp.Execution, want)
+	}
+	if resp.Bill == nil || resp.Bill.ID != "b1" || resp.Bill.Status != BillCharging || resp.Bill.Total != 1500 {
+		t.Errorf("bill = %+v, want the charging bill", resp.Bill)
+	}
+}
+
+func TestDescribeBill_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode errs.ErrCode
+	}{
+		{"unknown bill", serviceerror.NewNotFound("workflow not found"), errs.NotFound},
+		{"temporal down", serviceerror.NewUnavailable("connection refused"), errs.Internal},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := mocks.NewClient(t)
+			c.On("DescribeWorkflowExecution", mock.Anything, "b1", "").Return(nil, tc.err)
+			svc := &Service{temporalClient: c}
+
+			_, err := svc.DescribeBill(context.Background(), "b1")
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != tc.wantCode {
+				t.Fatalf("expected %v error, got %v", tc.wantCode, err)
+			}
+		})
+	}
+}
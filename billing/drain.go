@@ -0,0 +1,56 @@
+package billing
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.temporal.io/sdk/interceptor"
+	"go.temporal.io/sdk/worker"
+)
+
+// how long the worker waits for in-flight activities on shutdown before canceling them,
+// BILLING_DRAIN_TIMEOUT overrides it with a Go duration, e.g. "1m"
+const defaultDrainTimeout = 30 * time.Second
+
+func drainTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("BILLING_DRAIN_TIMEOUT")); err == nil && d >= 0 {
+		return d
+	}
+	return defaultDrainTimeout
+}
+
+func workerOptions(counter *activityCounter) worker.Options {
+	return worker.Options{
+		WorkerStopTimeout: drainTimeout(),
+		Interceptors:      []interceptor.WorkerInterceptor{counter},
+	}
+}
+
+// counts the activity executions in flight on the worker, so shutdown can report what it drains
+type activityCounter struct {
+	interceptor.WorkerInterceptorBase
+	n atomic.Int64
+}
+
+func (c *activityCounter) InterceptActivity(ctx context.Context, next interceptor.ActivityInboundInterceptor) interceptor.ActivityInboundInterceptor {
+	i := &countingActivityInbound{counter: c}
+	i.Next = next
+	return i
+}
+
+func (c *activityCounter) inFlight() int64 {
+	return c.n.Load()
+}
+
+type countingActivityInbound struct {
+	interceptor.ActivityInboundInterceptorBase
+	counter *activityCounter
+}
+
+func (i *countingActivityInbound) ExecuteActivity(ctx context.Context, in *interceptor.ExecuteActivityInput) (interface{}, error) {
+	i.counter.n.Add(1)
+	defer i.counter.n.Add(-1)
+	return i.Next.ExecuteActivity(ctx, in)
+}
@@ -0,0 +1,103 @@
+package billing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.temporal.io/sdk/mocks"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/worker"
+)
+
+// stands in for a worker whose Stop drains one slow activity, like WorkerStopTimeout does
+type drainingWorker struct {
+	worker.Worker
+	activityDone chan struct{}
+}
+
+func (w *drainingWorker) Stop() {
+	<-w.activityDone
+}
+
+func TestShutdown_WaitsForInFlightActivity(t *testing.T) {
+	tests := []struct {
+		name         string
+		activityTime time.Duration
+		deadline     time.Duration
+		wantMin      time.Duration
+		wantMax      time.Duration
+	}{
+		{"activity finishes before the deadline", 200 * time.Millisecond, 2 * time.Second, 200 * time.Millisecond, time.Second},
+		{"deadline cuts the drain short", 2 * time.Second, 200 * time.Millisecond, 200 * time.Millisecond, time.Second},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := mocks.NewClient(t)
+			c.On("Close").Return()
+
+			w := &drainingWorker{activityDone: make(chan struct{})}
+			time.AfterFunc(tc.activityTime, func() { close(w.activityDone) })
+			svc := &Service{temporalClient: c, temporalWorkers: []worker.Worker{w}, activities: &activityCounter{}}
+
+			force, cancel := context.WithTimeout(context.Background(), tc.deadline)
+			defer cancel()
+			start := time.Now()
+			svc.Shutdown(force)
+			if took := time.Since(start); took < tc.wantMin || took > tc.wantMax {
+				t.Errorf("shutdown took %s, want between %s and %s", took, tc.wantMin, tc.wantMax)
+			}
+		})
+	}
+}
+
+func TestActivityCounter_CountsInFlight(t *testing.T) {
+	var suite testsuite.WorkflowTestSuite
+	env := suite.NewTestActivityEnvironment()
+	counter := &activityCounter{}
+	env.SetWorkerOptions(workerOptions(counter))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	}
+	env.RegisterActivity(slow)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := env.ExecuteActivity(slow)
+		done <- err
+	}()
+
+	<-started
+	if got := counter.inFlight(); got != 1 {
+		t.Errorf("in flight while running = %d, want 1", got)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("activity error: %v", err)
+	}
+	if got := counter.inFlight(); got != 0 {
+		t.Errorf("in flight after completion = %d, want 0", got)
+	}
+}
+
+func TestWorkerOptions_DrainTimeout(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", defaultDrainTimeout},
+		{"1m", time.Minute},
+		{"not-a-duration", defaultDrainTimeout},
+		{"-5s", defaultDrainTimeout},
+	}
+	for _, tc := range tests {
+		t.Setenv("BILLING_DRAIN_TIMEOUT", tc.env)
+		if got := workerOptions(&activityCounter{}).WorkerStopTimeout; got != tc.want {
+			t.Errorf("BILLING_DRAIN_TIMEOUT=%q: stop timeout = %s, want %s", tc.env, got, tc.want)
+		}
+	}
+}
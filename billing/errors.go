@@ -0,0 +1,326 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/temporal"
+)
+
+// stable, machine-readable cause of a handler error, returned in its details.
+// messages are meant for people and can change, clients should match on the reason
+type ErrorReason string
+
+const (
+	ReasonInvalidArgument    ErrorReason = "INVALID_ARGUMENT"
+	ReasonBillNotFound       ErrorReason = "BILL_NOT_FOUND"
+	ReasonTemplateNotFound   ErrorReason = "TEMPLATE_NOT_FOUND"
+	ReasonScheduleNotFound   ErrorReason = "SCHEDULE_NOT_FOUND"
+	ReasonBillNotOpen        ErrorReason = "BILL_NOT_OPEN"
+	ReasonBillNotFinal       ErrorReason = "BILL_NOT_FINAL"
+	ReasonBillNotSettled     ErrorReason = "BILL_NOT_SETTLED"
+	ReasonWrongBillStatus    ErrorReason = "WRONG_BILL_STATUS"
+	ReasonItemExists         ErrorReason = "ITEM_EXISTS"
+	ReasonItemNotFound       ErrorReason = "ITEM_NOT_FOUND"
+	ReasonItemNotPending     ErrorReason = "ITEM_NOT_PENDING"
+	ReasonItemNotRefundable  ErrorReason = "ITEM_NOT_REFUNDABLE"
+	ReasonItemNotChargeable  ErrorReason = "ITEM_NOT_CHARGEABLE"
+	ReasonItemDiscounted     ErrorReason = "ITEM_DISCOUNTED"
+	ReasonUnknownProduct     ErrorReason = "UNKNOWN_PRODUCT"
+	ReasonCurrencyMismatch   ErrorReason = "CURRENCY_MISMATCH"
+	ReasonNoConversionRate   ErrorReason = "NO_CONVERSION_RATE"
+	ReasonNoPendingItems     ErrorReason = "NO_PENDING_ITEMS"
+	ReasonBelowMinimumCharge ErrorReason = "BELOW_MINIMUM_CHARGE"
+	ReasonExceedsMaxTotal    ErrorReason = "EXCEEDS_MAX_TOTAL"
+	ReasonExceedsNetTotal    ErrorReason = "EXCEEDS_NET_TOTAL"
+	ReasonTooManyOpenBills   ErrorReason = "TOO_MANY_OPEN_BILLS"
+	ReasonTooManyNotes       ErrorReason = "TOO_MANY_NOTES"
+	ReasonInternal           ErrorReason = "INTERNAL"
+	ReasonUnavailable        ErrorReason = "UNAVAILABLE"
+)
+
+// details of the handler errors built below, fields that don't apply to the reason are left empty
+type ErrorDetails struct {
+	Reason     ErrorReason       `json:"reason"`
+	Field      string            `json:"field,omitempty"`
+	BillID     string            `json:"bill_id,omitempty"`
+	TemplateID string            `json:"template_id,omitempty"`
+	ScheduleID string            `json:"schedule_id,omitempty"`
+	ItemID     string            `json:"item_id,omitempty"`
+	Status     BillStatus        `json:"status,omitempty"`
+	AccountID  string            `json:"account_id,omitempty"`
+	Want       currency.Currency `json:"want,omitempty"`
+	Got        currency.Currency `json:"got,omitempty"`
+	// the minimum or maximum amount that was crossed, in minor units of the bill currency,
+	// or the number of open bills an account or notes a bill can have
+	Limit int64 `json:"limit,omitempty"`
+	// every invalid field of a request validated as a whole, Field is the first of them
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+func (ErrorDetails) ErrDetails() {}
+
+// one invalid field of a request and what is wrong with it
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// collects the invalid fields of a request, so clients can fix them all at once instead of one per request
+type fieldErrors []FieldError
+
+func (fe *fieldErrors) add(field, msg string) {
+	*fe = append(*fe, FieldError{Field: field, Message: msg})
+}
+
+// nil when every field was valid, otherwise an invalid argument error listing all of them
+func (fe fieldErrors) err() error {
+	if len(fe) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(fe))
+	for i, f := range fe {
+		msgs[i] = f.Message
+	}
+	return &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: strings.Join(msgs, "; "),
+		Details: ErrorDetails{Reason: ReasonInvalidArgument, Field: fe[0].Field, Fields: fe},
+	}
+}
+
+// a request field that failed validation
+func errInvalid(field, msg string) error {
+	return &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: msg,
+		Details: ErrorDetails{Reason: ReasonInvalidArgument, Field: field},
+	}
+}
+
+func errNotFound(id string) error {
+	return &errs.Error{
+		Code:    errs.NotFound,
+		Message: "bill not found",
+		Details: ErrorDetails{Reason: ReasonBillNotFound, BillID: id},
+	}
+}
+
+func errTemplateNotFound(id string) error {
+	return &errs.Error{
+		Code:    errs.NotFound,
+		Message: "bill template not found",
+		Details: ErrorDetails{Reason: ReasonTemplateNotFound, TemplateID: id},
+	}
+}
+
+func errScheduleNotFound(id string) error {
+	return &errs.Error{
+		Code:    errs.NotFound,
+		Message: "schedule not found",
+		Details: ErrorDetails{Reason: ReasonScheduleNotFound, ScheduleID: id},
+	}
+}
+
+func errItemNotFound(itemID string) error {
+	return &errs.Error{
+		Code:    errs.NotFound,
+		Message: "item not found in the bill",
+		Details: ErrorDetails{Reason: ReasonItemNotFound, ItemID: itemID},
+	}
+}
+
+// the item was already charged, failed or voided, only pending items can be changed
+func errItemNotPending(itemID string) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: "item is not pending",
+		Details: ErrorDetails{Reason: ReasonItemNotPending, ItemID: itemID},
+	}
+}
+
+// the item wasn't charged, is a discount or was sold as non-refundable
+func errItemNotRefundable(itemID string) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: ErrNotRefundable(itemID).Error(),
+		Details: ErrorDetails{Reason: ReasonItemNotRefundable, ItemID: itemID},
+	}
+}
+
+// discounts only lower the charge of the other items
+func errItemNotChargeable(itemID string) error {
+	return &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: ErrNotChargeable(itemID).Error(),
+		Details: ErrorDetails{Reason: ReasonItemNotChargeable, ItemID: itemID},
+	}
+}
+
+// the bill only takes catalog products and the item isn't one
+func errUnknownProduct(itemID string) error {
+	return &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: fmt.Sprintf("item %s: %s", itemID, ErrUnknownProduct),
+		Details: ErrorDetails{Reason: ReasonUnknownProduct, ItemID: itemID},
+	}
+}
+
+// the bill's discounts need the item, without it they would exceed what is left to charge
+func errItemDiscounted(itemID string) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: fmt.Sprintf("item %s: %s", itemID, ErrOverDiscount),
+		Details: ErrorDetails{Reason: ReasonItemDiscounted, ItemID: itemID},
+	}
+}
+
+func errBillNotOpen(status BillStatus) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: fmt.Sprintf("bill not open, it is %s", status),
+		Details: ErrorDetails{Reason: ReasonBillNotOpen, Status: status},
+	}
+}
+
+// the operator action can't be taken in the bill's status, e.g. closing a bill that is already charging
+func errWrongStatus(action string, status BillStatus) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: fmt.Sprintf("cannot %s bill in status %s", action, status),
+		Details: ErrorDetails{Reason: ReasonWrongBillStatus, Status: status},
+	}
+}
+
+// the reopen signal didn't reach the bill, its workflow completed once the reopen grace was over
+func errReopenGraceOver(err error) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: "bill can no longer be reopened: " + err.Error(),
+		Details: ErrorDetails{Reason: ReasonWrongBillStatus, Status: BillExpired},
+	}
+}
+
+// refunds and adjustments only apply to what a settled bill debited
+func errBillNotSettled(status BillStatus) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: fmt.Sprintf("bill not settled, it is %s", status),
+		Details: ErrorDetails{Reason: ReasonBillNotSettled, Status: status},
+	}
+}
+
+// a credit can give back at most the bill's net total
+func errOverCredit(netTotal int64) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: ErrOverCredit.Error(),
+		Details: ErrorDetails{Reason: ReasonExceedsNetTotal, Limit: netTotal},
+	}
+}
+
+// the bill has nothing left to charge, msg says what couldn't be done
+func errNoPendingItems(msg string) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: msg,
+		Details: ErrorDetails{Reason: ReasonNoPendingItems},
+	}
+}
+
+// the bill has no outcome yet, served as a conflict since it resolves once the bill finishes
+func errBillNotFinal(status BillStatus) error {
+	return &errs.Error{
+		Code:    errs.Aborted,
+		Message: fmt.Sprintf("bill has no outcome yet, it is %s", status),
+		Details: ErrorDetails{Reason: ReasonBillNotFinal, Status: status},
+	}
+}
+
+// the account is held in got, but the bill would debit it in want
+func errCurrencyMismatch(accountID string, want, got currency.Currency) error {
+	return &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: fmt.Sprintf("account %q is held in %s, not %s", accountID, got, want),
+		Details: ErrorDetails{Reason: ReasonCurrencyMismatch, AccountID: accountID, Want: want, Got: got},
+	}
+}
+
+// the account has as many unfinished bills as it is allowed, it can have more once some of them finish
+func errTooManyOpenBills(accountID string, open int64, limit int) error {
+	return &errs.Error{
+		Code:    errs.ResourceExhausted,
+		Message: fmt.Sprintf("account %q already has %d open bills, at most %d are allowed", accountID, open, limit),
+		Details: ErrorDetails{Reason: ReasonTooManyOpenBills, AccountID: accountID, Limit: int64(limit)},
+	}
+}
+
+// the bill holds as many notes as it can keep
+func errTooManyNotes(limit int) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: ErrTooManyNotes.Error(),
+		Details: ErrorDetails{Reason: ReasonTooManyNotes, Limit: int64(limit)},
+	}
+}
+
+// there is no rate to convert between the two currencies
+func errUnsupportedConversion(from, to currency.Currency) error {
+	return &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: fmt.Sprintf("no conversion rate from %s to %s", from, to),
+		Details: ErrorDetails{Reason: ReasonNoConversionRate, Want: to, Got: from},
+	}
+}
+
+// maps the failure of a Command update: a rejection carries the ErrorDetails built by the workflow,
+// an update to an unknown bill fails with NotFound
+func commandError(id string, err error) error {
+	var notFound *serviceerror.NotFound
+	if errors.As(err, &notFound) {
+		return errNotFound(id)
+	}
+	var appErr *temporal.ApplicationError
+	var d ErrorDetails
+	if !errors.As(err, &appErr) || appErr.Details(&d) != nil {
+		return errInternal("failed to update billing workflow", err)
+	}
+	code := errs.InvalidArgument
+	switch d.Reason {
+	case ReasonBillNotOpen, ReasonNoPendingItems, ReasonBelowMinimumCharge, ReasonExceedsMaxTotal:
+		code = errs.FailedPrecondition
+	case ReasonItemExists:
+		code = errs.AlreadyExists
+	}
+	return &errs.Error{Code: code, Message: appErr.Message(), Details: d}
+}
+
+// the service can't serve bills right now, e.g. temporal is unreachable or the workers are stopping
+func errUnavailable(msg string, err error) error {
+	if err != nil {
+		msg += ": " + err.Error()
+	}
+	return &errs.Error{
+		Code:    errs.Unavailable,
+		Message: msg,
+		Details: ErrorDetails{Reason: ReasonUnavailable},
+	}
+}
+
+// msg says what failed, temporal errors are appended as they are
+func errInternal(msg string, err error) error {
+	if err != nil {
+		msg += ": " + err.Error()
+	}
+	return &errs.Error{
+		Code:    errs.Internal,
+		Message: msg,
+		Details: ErrorDetails{Reason: ReasonInternal},
+	}
+}
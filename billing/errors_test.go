@@ -0,0 +1,302 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pave-fees-api/account"
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/mocks"
+)
+
+func TestHandlerErrors(t *testing.T) {
+	ctx := context.Background()
+	if _, err := account.CreateAccount(ctx, &account.CreateAccountParams{ID: "errors-eur", Currency: "EUR"}); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+
+	settled := &Bill{ID: "b1", Status: BillSettled, Currency: currency.USD}
+	open := &Bill{ID: "b1", Status: BillOpen, Currency: currency.USD, Total: 1,
+		Items: []LineItem{{ID: "a1", Name: "Sticker", Amount: 1, Status: ItemPending}}}
+	charging := &Bill{ID: "b1", Status: BillCharging, Currency: currency.USD}
+	discounted := &Bill{ID: "b1", Status: BillOpen, Currency: currency.USD, Total: 50, Items: []LineItem{
+		{ID: "a1", Name: "Sticker", Amount: 100, Status: ItemPending},
+		{ID: "d1", Name: "Promo", Amount: 50, Kind: KindDiscount, Status: ItemPending},
+	}}
+	partlyCharged := &Bill{ID: "b1", Status: BillOpen, Currency: currency.USD,
+		Items: []LineItem{{ID: "a1", Name: "Sticker", Amount: 1, Status: ItemCharged}}}
+	item := AddItemRequest{ID: "a1", Name: "Sticker", Amount: 1}
+
+	tests := []struct {
+		name string
+		// the bill the workflow query and commands run against, nil when there is no such bill
+		bill     *Bill
+		call     func(s *Service) error
+		wantCode errs.ErrCode
+		want     ErrorDetails
+	}{
+		{"create with invalid currency", nil, func(s *Service) error {
+			_, err := s.CreateBill(ctx, CreateBillRequest{Currency: "XYZ"})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "currency",
+			Fields: []FieldError{{"currency", "unsupported currency 'XYZ'"}}}},
+		{"create with several invalid fields", nil, func(s *Service) error {
+			_, err := s.CreateBill(ctx, CreateBillRequest{Currency: "", AccountCurrency: "XYZ", PeriodEnd: "tomorrow", TaxRateBps: -1})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "currency", Fields: []FieldError{
+			{"currency", "'currency' is required, e.g. USD"},
+			{"tax_rate_bps", "'tax_rate_bps' must be between 0 and 10000"},
+			{"account_currency", "unsupported currency 'XYZ'"},
+			{"period_end", "'period_end' must be RFC3339"},
+		}}},
+		{"create with unknown rounding mode", nil, func(s *Service) error {
+			_, err := s.CreateBill(ctx, CreateBillRequest{Currency: "USD", RoundingMode: "CEIL"})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "rounding_mode",
+			Fields: []FieldError{{"rounding_mode", "'rounding_mode' must be HALF_UP, HALF_EVEN or FLOOR"}}}},
+		{"create against an account in another currency", nil, func(s *Service) error {
+			_, err := s.CreateBill(ctx, CreateBillRequest{Currency: "USD", AccountID: "errors-eur"})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonCurrencyMismatch, AccountID: "errors-eur", Want: currency.USD, Got: currency.EUR}},
+		{"schedule an unknown product", nil, func(s *Service) error {
+			_, err := s.ScheduleBill(ctx, ScheduleBillRequest{Bill: CreateBillRequest{Currency: "USD", CatalogOnly: true},
+				Items: []AddItemRequest{{ID: "x", Name: "Mystery box", Amount: 1000}}, IntervalSeconds: 3600})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonUnknownProduct, ItemID: "x"}},
+		{"schedule with several invalid fields", nil, func(s *Service) error {
+			_, err := s.ScheduleBill(ctx, ScheduleBillRequest{Bill: CreateBillRequest{Currency: "USD", PeriodEnd: "2030-01-01T00:00:00Z", RequestID: "order-42"},
+				Items: []AddItemRequest{item}, IntervalSeconds: 60})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "interval_seconds", Fields: []FieldError{
+			{"interval_seconds", "'interval_seconds' must be at least an hour"},
+			{"period_end", "'period_end' can't be set on scheduled bills"},
+			{"request_id", "'request_id' can't be set on scheduled bills"},
+		}}},
+		{"delete another schedule", nil, func(s *Service) error {
+			return s.DeleteBillSchedule(ctx, "someone-elses-schedule")
+		}, errs.NotFound, ErrorDetails{Reason: ReasonScheduleNotFound, ScheduleID: "someone-elses-schedule"}},
+		{"get missing bill", nil, func(s *Service) error {
+			_, err := s.GetBill(ctx, "b1")
+			return err
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"add invalid item", nil, func(s *Service) error {
+			return s.AddItem(ctx, "b1", AddItemRequest{Name: "Sticker", Amount: 1})
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "id",
+			Fields: []FieldError{{"id", "'id' is required and must be non-empty"}}}},
+		{"add item with several invalid fields", nil, func(s *Service) error {
+			return s.AddItem(ctx, "b1", AddItemRequest{ID: " ", Name: "", Amount: -5})
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "id", Fields: []FieldError{
+			{"id", "'id' is required and must be non-empty"},
+			{"amount", "'amount' and 'unit_amount' must be greater than 0"},
+			{"name", "'name' is required and must be non-empty"},
+		}}},
+		{"add item with oversized metadata", nil, func(s *Service) error {
+			return s.AddItem(ctx, "b1", AddItemRequest{ID: "a1", Name: "Sticker", Amount: 1,
+				Metadata: map[string]string{"note": strings.Repeat("x", maxMetadataValueLen+1)}})
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "metadata",
+			Fields: []FieldError{{"metadata", fmt.Sprintf("invalid metadata: value of note is longer than %d bytes", maxMetadataValueLen)}}}},
+		{"add item that already expired", nil, func(s *Service) error {
+			return s.AddItem(ctx, "b1", AddItemRequest{ID: "a1", Name: "Sticker", Amount: 1,
+				ExpiresAt: time.Now().Add(-time.Minute).Format(time.RFC3339)})
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "expires_at",
+			Fields: []FieldError{{"expires_at", "'expires_at' must be in the future"}}}},
+		{"add item to missing bill", nil, func(s *Service) error {
+			return s.AddItem(ctx, "b1", item)
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"add item to settled bill", settled, func(s *Service) error {
+			return s.AddItem(ctx, "b1", item)
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotOpen, Status: BillSettled}},
+		{"add existing item", open, func(s *Service) error {
+			return s.AddItem(ctx, "b1", item)
+		}, errs.AlreadyExists, ErrorDetails{Reason: ReasonItemExists, ItemID: "a1"}},
+		{"add item over the currency maximum", open, func(s *Service) error {
+			return s.AddItem(ctx, "b1", AddItemRequest{ID: "big", Name: "Yacht", Amount: 5_000_001})
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "amount"}},
+		{"status of missing bill", nil, func(s *Service) error {
+			_, err := s.GetBillStatus(ctx, "b1")
+			return err
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"progress of missing bill", nil, func(s *Service) error {
+			_, err := s.GetBillProgress(ctx, "b1")
+			return err
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"rejected items of missing bill", nil, func(s *Service) error {
+			_, err := s.GetRejectedItems(ctx, "b1")
+			return err
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"reassign missing bill", nil, func(s *Service) error {
+			_, err := s.ReassignBill(ctx, "b1", ReassignBillRequest{AccountID: "acc-2"})
+			return err
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"reassign settled bill", settled, func(s *Service) error {
+			_, err := s.ReassignBill(ctx, "b1", ReassignBillRequest{AccountID: "acc-2"})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotOpen, Status: BillSettled}},
+		{"reassign to an account in another currency", &Bill{ID: "b1", Status: BillOpen, Currency: currency.USD, AccountCurrency: currency.USD}, func(s *Service) error {
+			_, err := s.ReassignBill(ctx, "b1", ReassignBillRequest{AccountID: "errors-eur"})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonCurrencyMismatch, AccountID: "errors-eur", Want: currency.USD, Got: currency.EUR}},
+		{"note without author", nil, func(s *Service) error {
+			_, err := s.AddBillNote(ctx, "b1", AddNoteRequest{Text: "called the customer"})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "author"}},
+		{"note too long", nil, func(s *Service) error {
+			_, err := s.AddBillNote(ctx, "b1", AddNoteRequest{Author: "agent-7", Text: strings.Repeat("x", maxNoteLen+1)})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "text"}},
+		{"note on missing bill", nil, func(s *Service) error {
+			_, err := s.AddBillNote(ctx, "b1", AddNoteRequest{Author: "agent-7", Text: "called the customer"})
+			return err
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"note on settled bill", settled, func(s *Service) error {
+			_, err := s.AddBillNote(ctx, "b1", AddNoteRequest{Author: "agent-7", Text: "called the customer"})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotOpen, Status: BillSettled}},
+		{"note on a bill with every note it can keep", &Bill{ID: "b1", Status: BillOpen, Currency: currency.USD, Notes: make([]Note, maxNotes)}, func(s *Service) error {
+			_, err := s.AddBillNote(ctx, "b1", AddNoteRequest{Author: "agent-7", Text: "called the customer"})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonTooManyNotes, Limit: maxNotes}},
+		{"void item of missing bill", nil, func(s *Service) error {
+			return s.VoidItem(ctx, "b1", "a1")
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"void item of charging bill", charging, func(s *Service) error {
+			return s.VoidItem(ctx, "b1", "a1")
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotOpen, Status: BillCharging}},
+		{"update missing item", open, func(s *Service) error {
+			return s.UpdateItem(ctx, "b1", "zz", UpdateItemRequest{Amount: 2})
+		}, errs.NotFound, ErrorDetails{Reason: ReasonItemNotFound, ItemID: "zz"}},
+		{"update charged item", partlyCharged, func(s *Service) error {
+			return s.UpdateItem(ctx, "b1", "a1", UpdateItemRequest{Amount: 2})
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonItemNotPending, ItemID: "a1"}},
+		{"adjust open bill", open, func(s *Service) error {
+			_, err := s.AdjustBill(ctx, "b1", AdjustBillRequest{Amount: 300, Reason: "fee"})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotSettled, Status: BillOpen}},
+		{"credit above the net total", &Bill{ID: "b1", Status: BillSettled, Currency: currency.USD, SettledAmount: 1500}, func(s *Service) error {
+			_, err := s.AdjustBill(ctx, "b1", AdjustBillRequest{Amount: -1501, Reason: "too generous"})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonExceedsNetTotal, Limit: 1500}},
+		{"refund open bill", open, func(s *Service) error {
+			return s.RefundBill(ctx, "b1")
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotSettled, Status: BillOpen}},
+		{"refund item of open bill", open, func(s *Service) error {
+			return s.RefundItem(ctx, "b1", "a1")
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotSettled, Status: BillOpen}},
+		{"refund missing item", settled, func(s *Service) error {
+			return s.RefundItem(ctx, "b1", "zz")
+		}, errs.NotFound, ErrorDetails{Reason: ReasonItemNotFound, ItemID: "zz"}},
+		{"refund item that wasn't charged", &Bill{ID: "b1", Status: BillSettled, Currency: currency.USD,
+			Items: []LineItem{{ID: "a1", Name: "Sticker", Amount: 1, Status: ItemFailed}}}, func(s *Service) error {
+			return s.RefundItem(ctx, "b1", "a1")
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonItemNotRefundable, ItemID: "a1"}},
+		{"partial charge of a missing item", open, func(s *Service) error {
+			_, err := s.ChargePartial(ctx, "b1", ChargePartialRequest{ItemIDs: []string{"zz"}})
+			return err
+		}, errs.NotFound, ErrorDetails{Reason: ReasonItemNotFound, ItemID: "zz"}},
+		{"partial charge of a discount", &Bill{ID: "b1", Status: BillOpen, Currency: currency.USD,
+			Items: []LineItem{{ID: "d1", Name: "Promo", Amount: 1, Kind: KindDiscount, Status: ItemPending}}}, func(s *Service) error {
+			_, err := s.ChargePartial(ctx, "b1", ChargePartialRequest{ItemIDs: []string{"d1"}})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonItemNotChargeable, ItemID: "d1"}},
+		{"force-expire settled bill", settled, func(s *Service) error {
+			_, err := s.ForceExpireBill(ctx, "b1")
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonWrongBillStatus, Status: BillSettled}},
+		{"close charging bill", charging, func(s *Service) error {
+			_, err := s.CloseBill(ctx, "b1")
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonWrongBillStatus, Status: BillCharging}},
+		{"close bill with no pending items", partlyCharged, func(s *Service) error {
+			_, err := s.CloseBill(ctx, "b1")
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonNoPendingItems}},
+		{"remove item the discounts need", discounted, func(s *Service) error {
+			return s.RemoveItem(ctx, "b1", "a1")
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonItemDiscounted, ItemID: "a1"}},
+		{"void missing item", open, func(s *Service) error {
+			return s.VoidItem(ctx, "b1", "zz")
+		}, errs.NotFound, ErrorDetails{Reason: ReasonItemNotFound, ItemID: "zz"}},
+		{"void charged item", partlyCharged, func(s *Service) error {
+			return s.VoidItem(ctx, "b1", "a1")
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonItemNotPending, ItemID: "a1"}},
+		{"void item the discounts need", discounted, func(s *Service) error {
+			return s.VoidItem(ctx, "b1", "a1")
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonItemDiscounted, ItemID: "a1"}},
+		{"extend charging bill", charging, func(s *Service) error {
+			_, err := s.ExtendBill(ctx, "b1", ExtendBillRequest{PeriodEnd: time.Now().Add(time.Hour).Format(time.RFC3339)})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonWrongBillStatus, Status: BillCharging}},
+		{"reopen open bill", open, func(s *Service) error {
+			_, err := s.ReopenBill(ctx, "b1", ReopenBillRequest{})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonWrongBillStatus, Status: BillOpen}},
+		{"retry settled bill", settled, func(s *Service) error {
+			_, err := s.RetryBill(ctx, "b1")
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonWrongBillStatus, Status: BillSettled}},
+		{"charge missing bill", nil, func(s *Service) error {
+			_, err := s.ChargeBill(ctx, "b1", ChargeBillRequest{})
+			return err
+		}, errs.NotFound, ErrorDetails{Reason: ReasonBillNotFound, BillID: "b1"}},
+		{"charge settled bill", settled, func(s *Service) error {
+			_, err := s.ChargeBill(ctx, "b1", ChargeBillRequest{})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotOpen, Status: BillSettled}},
+		{"charge below the minimum", open, func(s *Service) error {
+			_, err := s.ChargeBill(ctx, "b1", ChargeBillRequest{})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBelowMinimumCharge, Limit: currency.MinChargeAmount(currency.USD)}},
+		{"cancel without reason", nil, func(s *Service) error {
+			_, err := s.CancelBill(ctx, "b1", CancelBillRequest{})
+			return err
+		}, errs.InvalidArgument, ErrorDetails{Reason: ReasonInvalidArgument, Field: "reason"}},
+		{"cancel charging bill", charging, func(s *Service) error {
+			_, err := s.CancelBill(ctx, "b1", CancelBillRequest{Reason: "duplicate order"})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotOpen, Status: BillCharging}},
+		{"cancel settled bill", settled, func(s *Service) error {
+			_, err := s.CancelBill(ctx, "b1", CancelBillRequest{Reason: "duplicate order"})
+			return err
+		}, errs.FailedPrecondition, ErrorDetails{Reason: ReasonBillNotOpen, Status: BillSettled}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := mocks.NewClient(t)
+			if tc.bill == nil {
+				c.On("QueryWorkflow", mock.Anything, "b1", "", mock.Anything).Return(nil, errors.New("workflow not found")).Maybe()
+				c.On("UpdateWorkflow", mock.Anything, mock.Anything).Return(nil, serviceerror.NewNotFound("workflow not found")).Maybe()
+			} else {
+				v := mocks.NewEncodedValue(t)
+				v.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+					*args.Get(0).(*Bill) = *tc.bill
+				}).Return(nil).Maybe()
+				c.On("QueryWorkflow", mock.Anything, "b1", "", QueryBill).Return(v, nil).Maybe()
+				// the rejection the workflow's validator would send back
+				c.On("UpdateWorkflow", mock.Anything, mock.Anything).Return(
+					func(_ context.Context, o client.UpdateWorkflowOptions) (client.WorkflowUpdateHandle, error) {
+						return nil, tc.bill.validateCommand(o.Args[0].(Command))
+					}).Maybe()
+			}
+
+			err := tc.call(&Service{temporalClient: c})
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != tc.wantCode {
+				t.Fatalf("expected %s error, got %v", tc.wantCode, err)
+			}
+			if got, ok := e.Details.(ErrorDetails); !ok || !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("details = %+v, want %+v", e.Details, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+type ExportRecordType string
+
+const (
+	ExportBill         ExportRecordType = "bill"
+	ExportItem         ExportRecordType = "item"
+	ExportEvent        ExportRecordType = "event"
+	ExportRejectedItem ExportRecordType = "rejected_item"
+)
+
+// a line of a bill export, the field named by Type is set. Seq numbers the lines from 1
+// so a consumer can tell a cut off export from a complete one
+type ExportRecord struct {
+	Type         ExportRecordType `json:"type"`
+	Seq          int              `json:"seq"`
+	Bill         *Bill            `json:"bill,omitempty"`
+	Item         *LineItem        `json:"item,omitempty"`
+	Event        *BillEvent       `json:"event,omitempty"`
+	RejectedItem *RejectedItem    `json:"rejected_item,omitempty"`
+}
+
+// the bill's history for audits, as newline-delimited JSON
+//
+//encore:api public raw method=GET path=/bills/:id/export
+func (s *Service) ExportBill(w http.ResponseWriter, req *http.Request) {
+	id := encore.CurrentRequest().PathParams.Get("id")
+	bill, events, rejected, err := s.billHistory(req.Context(), id)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := writeExport(w, bill, events, rejected); err != nil {
+		// the status is already sent, the client sees a short export
+		rlog.Warn("bill export cut short", "bill_id", id, "error", err)
+	}
+}
+
+// the bill with its timeline and rejected items, the three queries a full export is made of
+func (s *Service) billHistory(ctx context.Context, id string) (Bill, []BillEvent, []RejectedItem, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return Bill{}, nil, nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return Bill{}, nil, nil, errInternal("failed to query bill", err)
+	}
+
+	qr, err = s.temporalClient.QueryWorkflow(ctx, id, "", QueryEvents)
+	if err != nil {
+		return Bill{}, nil, nil, errInternal("failed to query bill events", err)
+	}
+	var events []BillEvent
+	if err := qr.Get(&events); err != nil {
+		return Bill{}, nil, nil, errInternal("failed to query bill events", err)
+	}
+
+	qr, err = s.temporalClient.QueryWorkflow(ctx, id, "", QueryRejectedItems)
+	if err != nil {
+		return Bill{}, nil, nil, errInternal("failed to query rejected items", err)
+	}
+	var rejected []RejectedItem
+	if err := qr.Get(&rejected); err != nil {
+		return Bill{}, nil, nil, errInternal("failed to query rejected items", err)
+	}
+	return bill, events, rejected, nil
+}
+
+// writes the bill without its items first, then the items in the order they were added, the events
+// oldest first and the rejected items oldest first. maps are encoded with sorted keys, so the
+// same bill always exports to the same bytes
+func writeExport(w io.Writer, bill Bill, events []BillEvent, rejected []RejectedItem) error {
+	enc := json.NewEncoder(w)
+	seq := 0
+	write := func(rec ExportRecord) error {
+		seq++
+		rec.Seq = seq
+		return enc.Encode(rec)
+	}
+
+	items := bill.Items
+	bill.Items = nil
+	if err := write(ExportRecord{Type: ExportBill, Bill: &bill}); err != nil {
+		return err
+	}
+	for i := range items {
+		if err := write(ExportRecord{Type: ExportItem, Item: &items[i]}); err != nil {
+			return err
+		}
+	}
+	for i := range events {
+		if err := write(ExportRecord{Type: ExportEvent, Event: &events[i]}); err != nil {
+			return err
+		}
+	}
+	for i := range rejected {
+		if err := write(ExportRecord{Type: ExportRejectedItem, RejectedItem: &rejected[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
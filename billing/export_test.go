@@ -0,0 +1,112 @@
+package billing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/mocks"
+)
+
+func TestExport_RoundTrip(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	bill := Bill{ID: "b1", Status: BillSettled, Currency: currency.USD, Total: 2000,
+		Labels: map[string]string{"team": "core", "cost_center": "cc-1"},
+		Items: []LineItem{
+			{ID: "a1", Name: "Book", Amount: 1500, Status: ItemCharged, Metadata: map[string]string{"sku": "BK-1", "order_id": "o-42"}},
+			{ID: "b2", Name: "Pen", Amount: 500, Status: ItemCharged},
+		}}
+	events := []BillEvent{
+		{Type: EventCreated, At: at},
+		{Type: EventItemAdded, Detail: "a1", At: at.Add(time.Minute)},
+		{Type: EventItemAdded, Detail: "b2", At: at.Add(2 * time.Minute)},
+		{Type: EventStatusChanged, Detail: string(BillSettled), At: at.Add(time.Hour)},
+	}
+	rejected := []RejectedItem{{ID: "a1", Reason: "item already exists", At: at.Add(3 * time.Minute)}}
+
+	c := receiptClient(t, bill, events)
+	rejectedVal := mocks.NewEncodedValue(t)
+	rejectedVal.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]RejectedItem) = rejected
+	}).Return(nil)
+	c.On("QueryWorkflow", mock.Anything, "b1", "", QueryRejectedItems).Return(rejectedVal, nil)
+	svc := &Service{temporalClient: c}
+
+	gotBill, gotEvents, gotRejected, err := svc.billHistory(context.Background(), "b1")
+	if err != nil {
+		t.Fatalf("billHistory returned error: %v", err)
+	}
+	var first, second bytes.Buffer
+	if err := writeExport(&first, gotBill, gotEvents, gotRejected); err != nil {
+		t.Fatalf("writeExport returned error: %v", err)
+	}
+	if err := writeExport(&second, gotBill, gotEvents, gotRejected); err != nil {
+		t.Fatalf("writeExport returned error: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("two exports of the same bill differ:\n%s\n%s", first.String(), second.String())
+	}
+
+	var recs []ExportRecord
+	sc := bufio.NewScanner(&first)
+	for sc.Scan() {
+		var rec ExportRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("line %d isn't JSON: %v\n%s", len(recs)+1, err, sc.Text())
+		}
+		recs = append(recs, rec)
+	}
+
+	wantTypes := []ExportRecordType{ExportBill, ExportItem, ExportItem, ExportEvent, ExportEvent, ExportEvent, ExportEvent, ExportRejectedItem}
+	if len(recs) != len(wantTypes) {
+		t.Fatalf("export has %d lines, want %d", len(recs), len(wantTypes))
+	}
+	for i, rec := range recs {
+		if rec.Type != wantTypes[i] || rec.Seq != i+1 {
+			t.Errorf("line %d = %s seq %d, want %s seq %d", i+1, rec.Type, rec.Seq, wantTypes[i], i+1)
+		}
+	}
+
+	if b := recs[0].Bill; b == nil || b.ID != "b1" || b.Status != BillSettled || b.Total != 2000 || b.Labels["team"] != "core" || len(b.Items) != 0 {
+		t.Errorf("bill line = %+v, want the settled bill without its items", b)
+	}
+	for i, it := range bill.Items {
+		got := recs[1+i].Item
+		if got == nil || got.ID != it.ID || got.Amount != it.Amount || got.Status != it.Status {
+			t.Errorf("item line %d = %+v, want %s", i+1, got, it.ID)
+		}
+	}
+	if got := recs[1].Item.Metadata["order_id"]; got != "o-42" {
+		t.Errorf("item metadata order_id = %q, want o-42", got)
+	}
+	for i, e := range events {
+		got := recs[3+i].Event
+		if got == nil || got.Type != e.Type || got.Detail != e.Detail || !got.At.Equal(e.At) {
+			t.Errorf("event line %d = %+v, want %+v", i+1, got, e)
+		}
+	}
+	if got := recs[7].RejectedItem; got == nil || got.ID != "a1" || got.Reason != rejected[0].Reason {
+		t.Errorf("rejected item line = %+v, want %+v", got, rejected[0])
+	}
+}
+
+func TestExport_MissingBill(t *testing.T) {
+	c := mocks.NewClient(t)
+	c.On("QueryWorkflow", mock.Anything, "b1", "", QueryBill).Return(nil, errors.New("workflow not found"))
+	svc := &Service{temporalClient: c}
+
+	_, _, _, err := svc.billHistory(context.Background(), "b1")
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.NotFound {
+		t.Fatalf("expected NotFound error, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package billing
+
+import (
+	"errors"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+// types of the application errors a bill workflow fails with, clients match on these
+const (
+	ErrTypeChargeFailed      = "ChargeFailed"
+	ErrTypeChargeCompensated = "ChargeCompensated"
+	ErrTypeHoldFailed        = "HoldFailed"
+	ErrTypeCaptureFailed     = "CaptureFailed"
+	ErrTypeConversionFailed  = "ConversionFailed"
+	// returned by the account activities, the account holds another currency than the bill
+	ErrTypeAccountCurrencyMismatch = "AccountCurrencyMismatch"
+	ErrTypeInvalidTemplate         = "InvalidTemplate"
+	ErrTypeInvalidState            = "InvalidState"
+)
+
+// coarse cause of a failed charge, stable numbers for consumers that group failures
+type FailureCategory int
+
+const (
+	// the processor declined or failed item charges
+	FailureCategoryCharge FailureCategory = 1
+	// the account couldn't hold or capture the funds
+	FailureCategoryAccount FailureCategory = 2
+	// the bill amount couldn't be converted to the account currency
+	FailureCategoryConversion FailureCategory = 3
+)
+
+func failureCategory(errType string) FailureCategory {
+	switch errType {
+	case ErrTypeHoldFailed, ErrTypeCaptureFailed, ErrTypeAccountCurrencyMismatch:
+		return FailureCategoryAccount
+	case ErrTypeConversionFailed:
+		return FailureCategoryConversion
+	default:
+		return FailureCategoryCharge
+	}
+}
+
+// the details of every charge failure the workflow returns, decoded with ApplicationError.Details
+type ChargeFailureDetail struct {
+	Category    FailureCategory `json:"category"`
+	FailedIDs   []string        `json:"failed_ids"`
+	RefundedIDs []string        `json:"refunded_ids"`
+	// the bill total when the charge failed, in minor units of the bill currency
+	Total int64 `json:"total"`
+}
+
+// the application error a charge of the bill fails with, typed by errType and detailed by the bill's items
+func chargeFailure(bill *Bill, errType, msg string, cause error) error {
+	d := ChargeFailureDetail{
+		Category:    failureCategory(errType),
+		FailedIDs:   make([]string, 0),
+		RefundedIDs: make([]string, 0),
+		Total:       bill.Total,
+	}
+	for _, it := range bill.Items {
+		switch it.Status {
+		case ItemFailed:
+			d.FailedIDs = append(d.FailedIDs, it.ID)
+		case ItemRefunded:
+			d.RefundedIDs = append(d.RefundedIDs, it.ID)
+		}
+	}
+	return temporal.NewApplicationErrorWithOptions(msg, errType, temporal.ApplicationErrorOptions{
+		Cause:   cause,
+		Details: []interface{}{d},
+	})
+}
+
+// the type a bill is compensated with after its hold couldn't be captured, a capture refused because
+// the account is held in another currency keeps the mismatch type
+func captureFailureType(err error) string {
+	if accountMismatched(err) {
+		return ErrTypeAccountCurrencyMismatch
+	}
+	return ErrTypeCaptureFailed
+}
+
+// reports whether an account activity failed because the account is held in another currency
+func accountMismatched(err error) bool {
+	var appErr *temporal.ApplicationError
+	return errors.As(err, &appErr) && appErr.Type() == ErrTypeAccountCurrencyMismatch
+}
@@ -6,20 +6,47 @@ package billing
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"maps"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"pave-fees-api/account"
 	"pave-fees-api/internal/currency"
+	"pave-fees-api/internal/data"
 
+	"encore.dev"
 	"encore.dev/beta/errs"
+	"encore.dev/rlog"
 
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/operatorservice/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/api/workflowservice/v1"
 	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/worker"
 )
 
-var taskQueue = "billing"
+// bills run on the standard queue unless created with priority. each queue has its own worker,
+// so bulk traffic can't starve high-value bills
+const (
+	standardTaskQueue = "billing-standard"
+	priorityTaskQueue = "billing-priority"
+	// the queue every bill ran on before the split, new bills never start on it. its worker stays
+	// until the bills started there have finished, otherwise they would be left without one
+	legacyTaskQueue = "billing"
+)
+
+var taskQueues = []string{standardTaskQueue, priorityTaskQueue, legacyTaskQueue}
 
 // Service encapsulates the Temporal client and worker used by the billing service
 // to orchestrate billing workflows and activities.
@@ -27,42 +54,226 @@ var taskQueue = "billing"
 //encore:service
 type Service struct {
 	temporalClient client.Client
-	temporalWorker worker.Worker
+	activities     *activityCounter
+	// one worker per task queue
+	temporalWorkers []worker.Worker
+	// set once Shutdown begins, the workers no longer take new tasks
+	stopping atomic.Bool
+	// period of bills created or reopened without a period_end, see Config
+	defaultPeriod time.Duration
+	// how many unfinished bills an account can have, zero for no limit, see Config
+	maxOpenBills int
 }
 
-// initService initializes the Temporal client and worker for the billing service.
-// It registers the workflow and activities and starts the worker.
+// initService initializes the Temporal client and workers for the billing service.
+// It starts a worker per task queue with the workflows and activities registered.
 // This function is called automatically by Encore when the service starts.
 func initService() (*Service, error) {
+	period, err := defaultPeriod(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid billing config: %w", err)
+	}
+	openLimit, err := maxOpenBills(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid billing config: %w", err)
+	}
+
 	c, err := client.Dial(client.Options{})
 	if err != nil {
 		return nil, fmt.Errorf("error creating temporal client: %w", err)
 	}
 
-	w := worker.New(c, taskQueue, worker.Options{})
+	if err := registerSearchAttributes(context.Background(), c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error registering search attributes: %w", err)
+	}
+
+	counter := &activityCounter{}
+	svc := &Service{temporalClient: c, activities: counter, defaultPeriod: period, maxOpenBills: openLimit}
+	for _, queue := range taskQueues {
+		opts := workerOptions(counter)
+		if simulateCharges(cfg) {
+			opts.BackgroundActivityContext = withSimulateMode(context.Background())
+		}
+		w := worker.New(c, queue, opts)
 
-	w.RegisterWorkflow(BillWorkflow)
-	w.RegisterActivity(ChargeLineItemActivity)
-	w.RegisterActivity(RefundLineItemActivity)
-	w.RegisterActivity(CreditAccountActivity)
+		w.RegisterWorkflow(BillWorkflow)
+		w.RegisterWorkflow(ScheduledBillWorkflow)
+		w.RegisterActivity(ChargeLineItemActivity)
+		w.RegisterActivity(RefundLineItemActivity)
+		w.RegisterActivity(ConvertCurrencyActivity)
+		w.RegisterActivity(HoldFundsActivity)
+		w.RegisterActivity(CaptureHoldActivity)
+		w.RegisterActivity(ReleaseHoldActivity)
+		w.RegisterActivity(NotifyWebhookActivity)
+		w.RegisterActivity(RecordOutcomeActivity)
+		w.RegisterActivity(CreditRefundActivity)
+		w.RegisterActivity(AdjustAccountActivity)
+		w.RegisterActivity(CheckAccountActivity)
+		w.RegisterActivity(ValidateItemActivity)
 
-	if err := w.Start(); err != nil {
-		c.Close()
-		return nil, fmt.Errorf("error starting termporal worker: %w", err)
+		if err := w.Start(); err != nil {
+			for _, started := range svc.temporalWorkers {
+				started.Stop()
+			}
+			c.Close()
+			return nil, fmt.Errorf("error starting termporal worker for %s: %w", queue, err)
+		}
+		svc.temporalWorkers = append(svc.temporalWorkers, w)
+	}
+	return svc, nil
+}
+
+// adds the bill search attributes to the namespace if they are missing, workflow tasks upserting
+// an unregistered attribute fail. namespaces that don't allow it need them registered by hand (see README)
+func registerSearchAttributes(ctx context.Context, c client.Client) error {
+	want := map[string]enums.IndexedValueType{
+		billStatusKey.GetName():   enums.INDEXED_VALUE_TYPE_KEYWORD,
+		billTotalKey.GetName():    enums.INDEXED_VALUE_TYPE_INT,
+		billArchivedKey.GetName(): enums.INDEXED_VALUE_TYPE_BOOL,
+		billAccountKey.GetName():  enums.INDEXED_VALUE_TYPE_KEYWORD,
+		billLabelsKey.GetName():   enums.INDEXED_VALUE_TYPE_KEYWORD_LIST,
 	}
-	return &Service{temporalClient: c, temporalWorker: w}, nil
+	resp, err := c.OperatorService().ListSearchAttributes(ctx, &operatorservice.ListSearchAttributesRequest{
+		Namespace: client.DefaultNamespace,
+	})
+	if err != nil {
+		return err
+	}
+	for name := range resp.GetCustomAttributes() {
+		delete(want, name)
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	_, err = c.OperatorService().AddSearchAttributes(ctx, &operatorservice.AddSearchAttributesRequest{
+		Namespace:        client.DefaultNamespace,
+		SearchAttributes: want,
+	})
+	return err
 }
 
-// Shutdown gracefully stops the Temporal worker and closes the client connection.
+// Shutdown gracefully stops the Temporal workers and closes the client connection.
 // This is called automatically when the Encore service is shut down.
-func (s *Service) Shutdown(ctx context.Context) {
-	s.temporalWorker.Stop()
+// The workers drain in-flight activities for up to the drain timeout, unless force is done first.
+func (s *Service) Shutdown(force context.Context) {
+	s.stopping.Store(true)
+	rlog.Info("draining billing worker", "in_flight_activities", s.activities.inFlight())
+
+	// the workers drain side by side, so the drain timeout bounds the whole shutdown
+	stopped := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, w := range s.temporalWorkers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.Stop()
+			}()
+		}
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-force.Done():
+		rlog.Warn("billing worker drain cut short", "in_flight_activities", s.activities.inFlight())
+	}
 	s.temporalClient.Close()
 }
 
+// how many fresh IDs CreateBill tries before giving up
+const billIDAttempts = 3
+
+// a random URL-safe ID for bills and bill schedules
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// longest request ID CreateBill takes
+const maxRequestIDLen = 128
+
+// the ID of the bill created for a client request ID, shaped like newID so it can't be told apart
+// from a random one. the same request ID always maps to the same bill of the account, request IDs of
+// different accounts never share one. the account ID is length-prefixed, so no two pairs hash the same input
+func requestBillID(accountID, requestID string) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d:%s%s", len(accountID), accountID, requestID))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// memo key holding the correlation ID of the request that created a bill
+const correlationMemoKey = "correlation_id"
+
+// ties a request to the bill it touches in the logs: the caller's correlation ID when it sent one,
+// otherwise the request's trace ID, or a fresh ID outside of a traced request
+func correlationID() string {
+	if req := encore.CurrentRequest(); req != nil && req.Trace != nil {
+		if req.Trace.ExtCorrelationID != "" {
+			return req.Trace.ExtCorrelationID
+		}
+		if req.Trace.TraceID != "" {
+			return req.Trace.TraceID
+		}
+	}
+	return newID()
+}
+
+// a logger for one operation on a bill, its fields match the bill workflow's logs
+func billLogger(billID, op, correlationID string) rlog.Ctx {
+	return rlog.With("bill_id", billID, "operation", op, "correlation_id", correlationID)
+}
+
 type CreateBillRequest struct {
 	Currency  string `json:"currency"`
 	PeriodEnd string `json:"period_end,omitempty"`
+	// optional tax rate in basis points, fractions are allowed, e.g. 887.5 for 8.875%
+	TaxRateBps float64 `json:"tax_rate_bps,omitempty"`
+	// optional account the bill is debited from, defaults to DefaultAccountID
+	AccountID string `json:"account_id,omitempty"`
+	// optional currency of the debited account, defaults to the bill currency
+	AccountCurrency string `json:"account_currency,omitempty"`
+	// optional http(s) URL the final bill is POSTed to when it reaches a terminal status
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// optional charge retry policy, 1-10 attempts with a 1-300s timeout per attempt
+	MaxChargeAttempts    int32 `json:"max_charge_attempts,omitempty"`
+	ChargeTimeoutSeconds int   `json:"charge_timeout_seconds,omitempty"`
+	// optional number of items charged at once, 1-100, defaults to 20
+	MaxConcurrentCharges int `json:"max_concurrent_charges,omitempty"`
+	// optional order items are charged in, PARALLEL (default), LARGEST_FIRST or SMALLEST_FIRST.
+	// the sorted strategies charge one item at a time, with stop_on_failure the rest fail uncharged after a failure
+	ChargeStrategy string `json:"charge_strategy,omitempty"`
+	StopOnFailure  bool   `json:"stop_on_failure,omitempty"`
+	// optional time an expired bill can still be reopened, up to 7 days, defaults to a day
+	ReopenGraceSeconds int `json:"reopen_grace_seconds,omitempty"`
+	// optional time after which the bill is canceled with reason "empty" if it still has no items
+	AutoCancelEmptySeconds int `json:"auto_cancel_empty_seconds,omitempty"`
+	// optional time after the period end during which items can still be added before the bill expires
+	GracePeriodSeconds int `json:"grace_period_seconds,omitempty"`
+	// optional cap in minor units on what the bill can charge, replacing the currency's cap
+	// for accounts risk approved for larger bills
+	MaxTotal int64 `json:"max_total,omitempty"`
+	// runs the bill on the priority task queue, for high-value bills
+	Priority bool `json:"priority,omitempty"`
+	// optional labels to group bills by, e.g. {"team": "payments"}, at most 10
+	Labels map[string]string `json:"labels,omitempty"`
+	// only takes items named after a product of the catalog, others are rejected as unknown products
+	CatalogOnly bool `json:"catalog_only,omitempty"`
+	// charges the bill when its period ends instead of expiring it, a bill without pending items still expires
+	AutoChargeOnExpiry bool `json:"auto_charge_on_expiry,omitempty"`
+	// optional rounding of amounts converted to the account currency, HALF_UP (default), HALF_EVEN or FLOOR
+	RoundingMode string `json:"rounding_mode,omitempty"`
+	// optional client ID of the request, up to 128 bytes. retries with the same ID return the bill
+	// the first attempt created instead of creating another one
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (req CreateBillRequest) taskQueue() string {
+	if req.Priority {
+		return priorityTaskQueue
+	}
+	return standardTaskQueue
 }
 
 type CreateBillResponse struct {
@@ -71,188 +282,1601 @@ type CreateBillResponse struct {
 
 //encore:api public method=POST path=/bills
 func (s *Service) CreateBill(ctx context.Context, req CreateBillRequest) (*CreateBillResponse, error) {
+	return s.createBill(ctx, req, nil)
+}
+
+// creates a bill that starts with the items of a template of the data package. the body takes the options
+// of CreateBill, 'currency' defaults to the template's and can't be another one
+//
+//encore:api public method=POST path=/bills/from-template/:templateID
+func (s *Service) CreateBillFromTemplate(ctx context.Context, templateID string, req CreateBillRequest) (*CreateBillResponse, error) {
+	tmpl, ok := data.LookupTemplate(templateID)
+	if !ok {
+		return nil, errTemplateNotFound(templateID)
+	}
 	if strings.TrimSpace(req.Currency) == "" {
-		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'currency' is required and must be non-empty"}
+		req.Currency = tmpl.Currency
+	} else if cur, err := currency.Parse(req.Currency); err == nil && string(cur) != tmpl.Currency {
+		return nil, errInvalid("currency", fmt.Sprintf("template %s bills in %s, not %s", templateID, tmpl.Currency, cur))
 	}
 
-	reqCur, err := currency.Parse(req.Currency)
-	if err != nil {
-		return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	items := make([]LineItem, 0, len(tmpl.Items))
+	for _, it := range tmpl.Items {
+		li, err := AddItemRequest{ID: it.ID, Name: it.Name, Amount: it.Amount}.lineItem()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, li)
 	}
+	return s.createBill(ctx, req, items)
+}
 
-	var periodEnd time.Time
-	if strings.TrimSpace(req.PeriodEnd) == "" {
-		periodEnd = time.Now().UTC().Add(30 * 24 * time.Hour) // default +30 days
-	} else {
+// starts the workflow of a bill with the items it starts with, none for an empty bill
+func (s *Service) createBill(ctx context.Context, req CreateBillRequest, items []LineItem) (*CreateBillResponse, error) {
+	var invalid fieldErrors
+	reqCur, opts := req.options(&invalid)
+	if len(req.RequestID) > maxRequestIDLen {
+		invalid.add("request_id", fmt.Sprintf("'request_id' must be at most %d bytes", maxRequestIDLen))
+	}
+	periodEnd := s.defaultPeriodEnd()
+	if strings.TrimSpace(req.PeriodEnd) != "" {
 		parsed, err := time.Parse(time.RFC3339, req.PeriodEnd)
+		switch {
+		case err != nil:
+			invalid.add("period_end", "'period_end' must be RFC3339")
+		case !parsed.After(time.Now()):
+			invalid.add("period_end", "period_end must be a future date")
+		default:
+			periodEnd = parsed.UTC()
+		}
+	}
+	if err := invalid.err(); err != nil {
+		return nil, err
+	}
+	if err := checkAccountCurrency(ctx, opts); err != nil {
+		return nil, err
+	}
+	// the workflow adds the items before anything else, build the bill here so they fail the request instead
+	check := newBill("", reqCur, opts)
+	for _, li := range items {
+		if err := currency.ValidateAmount(reqCur, li.Amount); err != nil {
+			return nil, errInvalid("items", fmt.Sprintf("item %s: %v", li.ID, err))
+		}
+		if err := check.AddItem(li); err != nil {
+			return nil, errInvalid("items", fmt.Sprintf("item %s: %v", li.ID, err))
+		}
+		if _, ok := data.LookupProduct(li.Name); opts.CatalogOnly && !li.IsDiscount() && !ok {
+			return nil, errUnknownProduct(li.ID)
+		}
+	}
+	opts.Items = items
+	accountID := opts.AccountID
+	if accountID == "" {
+		accountID = DefaultAccountID
+	}
+	// a retried request's own bill isn't counted, so the retry still finds it
+	var ownID string
+	if req.RequestID != "" {
+		ownID = requestBillID(accountID, req.RequestID)
+	}
+	if err := s.checkOpenBills(ctx, accountID, ownID, 1); err != nil {
+		return nil, err
+	}
+
+	// the workflow logs the correlation ID from its memo, so the bill's logs can be traced back to this request
+	corrID := correlationID()
+
+	start := func(billID string) error {
+		return s.startBill(ctx, billID, req.taskQueue(), corrID, reqCur, periodEnd, opts)
+	}
+
+	var started *serviceerror.WorkflowExecutionAlreadyStarted
+	// a retried request finds the bill it started before, running or not, since bill IDs are never reused
+	if req.RequestID != "" {
+		billID := requestBillID(accountID, req.RequestID)
+		logger := billLogger(billID, "create_bill", corrID)
+		err := start(billID)
+		if errors.As(err, &started) {
+			logger.Info("bill already created for this request", "request_id", req.RequestID)
+			return &CreateBillResponse{BillID: billID}, nil
+		}
 		if err != nil {
-			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "'period_end' must be RFC3339"}
+			logger.Error("failed to start bill workflow", "err", err)
+			return nil, errInternal("failed to start workflow", err)
 		}
-		if !parsed.After(time.Now()) {
-			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "period_end must be a future date"}
+		logger.Info("bill created", "currency", reqCur, "task_queue", req.taskQueue(), "period_end", periodEnd, "request_id", req.RequestID)
+		return &CreateBillResponse{BillID: billID}, nil
+	}
+
+	// a colliding ID is astronomically unlikely, but it would otherwise surface as an opaque start error
+	for attempt := 0; attempt < billIDAttempts; attempt++ {
+		billID := newID()
+		logger := billLogger(billID, "create_bill", corrID)
+		err := start(billID)
+		if errors.As(err, &started) {
+			logger.Warn("bill ID already in use, retrying with a new one")
+			continue
 		}
-		periodEnd = parsed.UTC()
+		if err != nil {
+			logger.Error("failed to start bill workflow", "err", err)
+			return nil, errInternal("failed to start workflow", err)
+		}
+		logger.Info("bill created", "currency", reqCur, "task_queue", req.taskQueue(), "period_end", periodEnd, "items", len(items))
+		return &CreateBillResponse{BillID: billID}, nil
 	}
 
-	b := make([]byte, 8)
-	rand.Read(b)
-	billID := base64.RawURLEncoding.EncodeToString(b)
+	return nil, errInternal("failed to start workflow: no unused bill ID found", nil)
+}
 
-	_, err = s.temporalClient.ExecuteWorkflow(ctx,
+// starts the workflow of a new bill, failing with WorkflowExecutionAlreadyStarted when the ID was ever used
+func (s *Service) startBill(ctx context.Context, billID, taskQueue, corrID string, cur currency.Currency, periodEnd time.Time, opts BillOptions) error {
+	accountID := opts.AccountID
+	if accountID == "" {
+		accountID = DefaultAccountID
+	}
+	_, err := s.temporalClient.ExecuteWorkflow(ctx,
 		client.StartWorkflowOptions{
 			ID:        billID,
 			TaskQueue: taskQueue,
+			Memo:      map[string]interface{}{correlationMemoKey: corrID},
+			// bill IDs are never reused, not even after the bill completed
+			WorkflowIDReusePolicy:                    enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+			WorkflowExecutionErrorWhenAlreadyStarted: true,
+			// counted against the account's open bills before its first workflow task runs
+			TypedSearchAttributes: temporal.NewSearchAttributes(billAccountKey.ValueSet(accountID)),
 		},
 		BillWorkflow,
 		billID,
-		reqCur,
+		cur,
 		periodEnd,
+		opts,
+		(*Bill)(nil),
 	)
+	return err
+}
+
+// rejects adding bills to an account when its unfinished bills, except skipID, would go over what the service allows.
+// visibility lags behind the workflows, so a burst of creates can go a little over the limit
+func (s *Service) checkOpenBills(ctx context.Context, accountID, skipID string, adding int) error {
+	if s.maxOpenBills <= 0 {
+		return nil
+	}
+	// account IDs can't hold quotes, so the ID is safe to put in the query
+	query := fmt.Sprintf("WorkflowType IN ('BillWorkflow', 'ScheduledBillWorkflow') AND ExecutionStatus = 'Running' AND %s = '%s' AND %s IN ('%s', '%s', '%s')",
+		billAccountKey.GetName(), accountID, billStatusKey.GetName(), BillOpen, BillGrace, BillCharging)
+	if skipID != "" {
+		query += fmt.Sprintf(" AND WorkflowId != '%s'", skipID)
+	}
+	resp, err := s.temporalClient.CountWorkflow(ctx, &workflowservice.CountWorkflowExecutionsRequest{Query: query})
+	if err != nil {
+		return errInternal("failed to count open bills", err)
+	}
+	if resp.GetCount()+int64(adding) > int64(s.maxOpenBills) {
+		return errTooManyOpenBills(accountID, resp.GetCount(), s.maxOpenBills)
+	}
+	return nil
+}
+
+// fails early what the bill's account check would fail, a registered account has to be held in the currency
+// the bill debits. unregistered accounts get their ledger on first use and take any currency
+func checkAccountCurrency(ctx context.Context, opts BillOptions) error {
+	if opts.AccountID == "" {
+		return nil
+	}
+	acc, err := account.GetAccount(ctx, opts.AccountID)
+	var e *errs.Error
+	if errors.As(err, &e) && e.Code == errs.NotFound {
+		return nil
+	}
+	if err != nil {
+		return errInternal("failed to look up account", err)
+	}
+	if acc.Currency != opts.AccountCurrency {
+		return errCurrencyMismatch(opts.AccountID, opts.AccountCurrency, acc.Currency)
+	}
+	return nil
+}
+
+// validates everything but the period end, which bill schedules derive from their interval.
+// every invalid field is added to invalid, the options are only meant to be used when there is none
+func (req CreateBillRequest) options(invalid *fieldErrors) (currency.Currency, BillOptions) {
+	reqCur, err := currency.Parse(req.Currency)
+	if errors.Is(err, currency.ErrEmptyCurrency) {
+		invalid.add("currency", "'currency' is required, e.g. USD")
+	} else if err != nil {
+		invalid.add("currency", err.Error())
+	}
+
+	if req.TaxRateBps < 0 || req.TaxRateBps > 10000 {
+		invalid.add("tax_rate_bps", "'tax_rate_bps' must be between 0 and 10000")
+	}
+	// zero keeps the default
+	if req.MaxChargeAttempts < 0 || req.MaxChargeAttempts > 10 {
+		invalid.add("max_charge_attempts", "'max_charge_attempts' must be between 1 and 10")
+	}
+	if req.ChargeTimeoutSeconds < 0 || req.ChargeTimeoutSeconds > 300 {
+		invalid.add("charge_timeout_seconds", "'charge_timeout_seconds' must be between 1 and 300")
+	}
+	if req.MaxConcurrentCharges < 0 || req.MaxConcurrentCharges > 100 {
+		invalid.add("max_concurrent_charges", "'max_concurrent_charges' must be between 1 and 100")
+	}
+	strategy := ChargeParallel
+	if strings.TrimSpace(req.ChargeStrategy) != "" {
+		strategy = ChargeStrategy(strings.ToUpper(strings.TrimSpace(req.ChargeStrategy)))
+		if !strategy.Valid() {
+			invalid.add("charge_strategy", fmt.Sprintf("unknown charge strategy '%s'", req.ChargeStrategy))
+		}
+	}
+	if req.StopOnFailure && strategy == ChargeParallel {
+		invalid.add("stop_on_failure", "'stop_on_failure' needs a sequential 'charge_strategy'")
+	}
+	if req.ReopenGraceSeconds < 0 || time.Duration(req.ReopenGraceSeconds)*time.Second > retryWindow {
+		invalid.add("reopen_grace_seconds", "'reopen_grace_seconds' must be at most 7 days")
+	}
+	if req.AutoCancelEmptySeconds < 0 {
+		invalid.add("auto_cancel_empty_seconds", "'auto_cancel_empty_seconds' must not be negative")
+	}
+	if req.GracePeriodSeconds < 0 {
+		invalid.add("grace_period_seconds", "'grace_period_seconds' must not be negative")
+	}
+	if req.MaxTotal < 0 {
+		invalid.add("max_total", "'max_total' must not be negative")
+	}
+	// it is put in the visibility query of the open bill limit
+	if strings.ContainsAny(req.AccountID, `'"`) {
+		invalid.add("account_id", "'account_id' can't hold quotes")
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		invalid.add("labels", err.Error())
+	}
+	rounding := currency.RoundingMode(strings.ToUpper(strings.TrimSpace(req.RoundingMode)))
+	if !rounding.Valid() {
+		invalid.add("rounding_mode", "'rounding_mode' must be HALF_UP, HALF_EVEN or FLOOR")
+	}
+	webhookURL := strings.TrimSpace(req.WebhookURL)
+	if webhookURL != "" {
+		u, err := url.Parse(webhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid.add("webhook_url", "'webhook_url' must be an absolute http(s) URL")
+		}
+	}
+
+	accCur := reqCur
+	if strings.TrimSpace(req.AccountCurrency) != "" {
+		accCur, err = currency.Parse(req.AccountCurrency)
+		if err != nil {
+			invalid.add("account_currency", err.Error())
+		} else if reqCur != "" {
+			// only checked against a valid bill currency
+			if _, err := currency.Convert(0, reqCur, accCur, ""); err != nil {
+				invalid.add("account_currency", err.Error())
+			}
+		}
+	}
+
+	return reqCur, BillOptions{
+		TaxRateBps:           req.TaxRateBps,
+		AccountID:            strings.TrimSpace(req.AccountID),
+		AccountCurrency:      accCur,
+		WebhookURL:           webhookURL,
+		MaxChargeAttempts:    req.MaxChargeAttempts,
+		ChargeTimeoutSeconds: req.ChargeTimeoutSeconds,
+		MaxConcurrentCharges: req.MaxConcurrentCharges,
+		ChargeStrategy:       strategy,
+		StopOnFailure:        req.StopOnFailure,
+		ReopenGraceSeconds:   req.ReopenGraceSeconds,
+		// zero never cancels
+		AutoCancelEmptySeconds: req.AutoCancelEmptySeconds,
+		GracePeriodSeconds:     req.GracePeriodSeconds,
+		MaxTotal:               req.MaxTotal,
+		Labels:                 req.Labels,
+		CatalogOnly:            req.CatalogOnly,
+		AutoChargeOnExpiry:     req.AutoChargeOnExpiry,
+		RoundingMode:           rounding,
+	}
+}
+
+// prefix of the IDs of bill schedules, keeps DeleteBillSchedule away from other schedules in the namespace
+const billSchedulePrefix = "bill-schedule-"
+
+type ScheduleBillRequest struct {
+	// options of every scheduled bill, 'period_end' can't be set since each bill runs for the interval
+	Bill  CreateBillRequest `json:"bill"`
+	Items []AddItemRequest  `json:"items"`
+	// how often a bill is created, at least an hour
+	IntervalSeconds int `json:"interval_seconds"`
+}
+
+type ScheduleBillResponse struct {
+	ScheduleID string `json:"schedule_id"`
+}
+
+// creates a temporal schedule starting a bill with the template's items every interval, the schedule ID
+// is kept by temporal and is what DeleteBillSchedule takes
+//
+//encore:api public method=POST path=/bills/schedule
+func (s *Service) ScheduleBill(ctx context.Context, req ScheduleBillRequest) (*ScheduleBillResponse, error) {
+	var invalid fieldErrors
+	interval := time.Duration(req.IntervalSeconds) * time.Second
+	if interval < time.Hour {
+		invalid.add("interval_seconds", "'interval_seconds' must be at least an hour")
+	}
+	if strings.TrimSpace(req.Bill.PeriodEnd) != "" {
+		invalid.add("period_end", "'period_end' can't be set on scheduled bills")
+	}
+	if req.Bill.RequestID != "" {
+		invalid.add("request_id", "'request_id' can't be set on scheduled bills")
+	}
+	cur, opts := req.Bill.options(&invalid)
+	if err := invalid.err(); err != nil {
+		return nil, err
+	}
+	// every run debits the account in the account currency, which defaults to the bill currency
+	if err := checkAccountCurrency(ctx, opts); err != nil {
+		return nil, err
+	}
+
+	if len(req.Items) == 0 {
+		return nil, errInvalid("items", "'items' must not be empty")
+	}
+	// build the bill once, so duplicates and oversized discounts fail here rather than in every run
+	tmpl := BillTemplate{Currency: cur, Options: opts, PeriodSeconds: req.IntervalSeconds}
+	check := newBill("", cur, opts)
+	for _, itemReq := range req.Items {
+		li, err := itemReq.lineItem()
+		if err != nil {
+			return nil, err
+		}
+		// an expiry is a point in time, every bill of the schedule would carry the same one
+		if li.ExpiresAt != nil {
+			return nil, errInvalid("expires_at", fmt.Sprintf("item %s: scheduled items can't expire", li.ID))
+		}
+		if err := check.AddItem(li); err != nil {
+			return nil, errInvalid("items", fmt.Sprintf("item %s: %v", li.ID, err))
+		}
+		// template items are carried into every run without going through the catalog check
+		if _, ok := data.LookupProduct(li.Name); opts.CatalogOnly && !li.IsDiscount() && !ok {
+			return nil, errUnknownProduct(li.ID)
+		}
+		tmpl.Items = append(tmpl.Items, li)
+	}
+
+	scheduleID := billSchedulePrefix + newID()
+
+	_, err := s.temporalClient.ScheduleClient().Create(ctx, client.ScheduleOptions{
+		ID: scheduleID,
+		Spec: client.ScheduleSpec{
+			Intervals: []client.ScheduleIntervalSpec{{Every: interval}},
+		},
+		Action: &client.ScheduleWorkflowAction{
+			// temporal appends the scheduled time, so every bill gets its own ID
+			ID:        scheduleID,
+			Workflow:  ScheduledBillWorkflow,
+			Args:      []interface{}{tmpl},
+			TaskQueue: req.Bill.taskQueue(),
+		},
+	})
+	if err != nil {
+		return nil, errInternal("failed to create schedule", err)
+	}
+
+	return &ScheduleBillResponse{ScheduleID: scheduleID}, nil
+}
+
+// deletes a bill schedule, bills it already started are left running
+//
+//encore:api public method=DELETE path=/bills/schedule/:id
+func (s *Service) DeleteBillSchedule(ctx context.Context, id string) error {
+	if !strings.HasPrefix(id, billSchedulePrefix) {
+		return errScheduleNotFound(id)
+	}
 
+	err := s.temporalClient.ScheduleClient().GetHandle(ctx, id).Delete(ctx)
+	var notFound *serviceerror.NotFound
+	if errors.As(err, &notFound) {
+		return errScheduleNotFound(id)
+	}
 	if err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: "failed to start workflow: " + err.Error()}
+		return errInternal("failed to delete schedule", err)
 	}
 
-	return &CreateBillResponse{BillID: billID}, nil
+	return nil
 }
 
 type AddItemRequest struct {
 	ID     string `json:"id"`
 	Name   string `json:"name"`
 	Amount int64  `json:"amount"`
+	// optional, CHARGE (default) or DISCOUNT
+	Kind LineItemKind `json:"kind,omitempty"`
+	// optional, a retry with the same key and payload succeeds without adding the item twice
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// optional, when set the amount is quantity * unit_amount and 'amount' can be omitted
+	Quantity   int64 `json:"quantity,omitempty"`
+	UnitAmount int64 `json:"unit_amount,omitempty"`
+	// optional references of the caller, e.g. {"order_id": "o-42"}, returned with the item and on the receipt
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// optional RFC3339 time the item is canceled at when it is still pending, the bill stays open
+	ExpiresAt string `json:"expires_at,omitempty"`
 }
 
 //encore:api public method=POST path=/bills/:id/items
 func (s *Service) AddItem(ctx context.Context, id string, req AddItemRequest) error {
-	if strings.TrimSpace(req.ID) == "" {
-		return &errs.Error{Code: errs.InvalidArgument, Message: "'id' is required and must be non-empty"}
+	li, err := req.lineItem()
+	if err != nil {
+		return err
 	}
 
-	if req.Amount <= 0 {
-		return &errs.Error{Code: errs.InvalidArgument, Message: "'amount' must be greater than 0"}
+	logger := billLogger(id, "add_item", correlationID())
+	res, err := s.command(ctx, id, Command{Type: CommandAddItem, Item: li})
+	if err != nil {
+		logger.Warn("add item failed", "item_id", li.ID, "err", err)
+		return err
 	}
+	logger.Info("item added", "item_id", li.ID, "amount", li.Amount, "status", res.Status)
 
-	if strings.TrimSpace(req.Name) == "" {
-		return &errs.Error{Code: errs.InvalidArgument, Message: "'name' is required and must be non-empty"}
+	return nil
+}
+
+// validates the item on its own, checks against the bill are left to the caller. every invalid field is reported
+func (req AddItemRequest) lineItem() (LineItem, error) {
+	var invalid fieldErrors
+	if strings.TrimSpace(req.ID) == "" {
+		invalid.add("id", "'id' is required and must be non-empty")
+	} else if reservedItemID(req.ID) {
+		invalid.add("id", fmt.Sprintf("'id' %s is reserved for the %s line", req.ID, req.ID))
 	}
 
-	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
-	if err != nil {
-		return &errs.Error{Code: errs.NotFound, Message: "bill not found"}
+	li := LineItem{
+		ID:             req.ID,
+		Name:           req.Name,
+		Amount:         req.Amount,
+		Status:         ItemPending,
+		Kind:           req.Kind,
+		IdempotencyKey: req.IdempotencyKey,
+		Quantity:       req.Quantity,
+		UnitAmount:     req.UnitAmount,
+		Metadata:       req.Metadata,
+	}
+	if err := li.normalizeAmount(); err != nil {
+		switch err {
+		case ErrInvalidAmount:
+			invalid.add("amount", "'amount' and 'unit_amount' must be greater than 0")
+		case ErrBadQuantity:
+			invalid.add("quantity", "'quantity' must be at least 1")
+		default:
+			invalid.add("quantity", "'quantity' * 'unit_amount' overflows")
+		}
 	}
 
-	var snap Bill
-	if err := qr.Get(&snap); err != nil {
-		return err
+	if strings.TrimSpace(req.Name) == "" {
+		invalid.add("name", "'name' is required and must be non-empty")
 	}
 
-	if snap.Status != BillOpen {
-		return &errs.Error{Code: errs.FailedPrecondition, Message: "bill not open"}
+	if req.Kind != "" && req.Kind != KindCharge && req.Kind != KindDiscount {
+		invalid.add("kind", "'kind' must be CHARGE or DISCOUNT")
 	}
 
-	for _, item := range snap.Items {
-		if item.ID == req.ID {
-			return &errs.Error{Code: errs.AlreadyExists, Message: "item already exists in the bill"}
-		}
+	if err := li.validateMetadata(); err != nil {
+		invalid.add("metadata", err.Error())
 	}
 
-	li := LineItem{
-		ID:     req.ID,
-		Name:   req.Name,
-		Amount: req.Amount,
-		Status: ItemPending,
+	if strings.TrimSpace(req.ExpiresAt) != "" {
+		expiresAt, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		switch {
+		case err != nil:
+			invalid.add("expires_at", "'expires_at' must be RFC3339")
+		case !expiresAt.After(time.Now()):
+			invalid.add("expires_at", "'expires_at' must be in the future")
+		default:
+			expiresAt = expiresAt.UTC()
+			li.ExpiresAt = &expiresAt
+		}
 	}
 
-	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalAddLineItem, li); err != nil {
-		return &errs.Error{Code: errs.Internal, Message: "failed to signal billing workflow: " + err.Error()}
+	if err := invalid.err(); err != nil {
+		return LineItem{}, err
 	}
+	return li, nil
+}
 
-	return nil
+type BillEventsResponse struct {
+	Events []BillEvent `json:"events"`
 }
 
-//encore:api public method=POST path=/bills/:id/charge
-func (s *Service) ChargeBill(ctx context.Context, id string) (*Bill, error) {
-	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+// returns the bill timeline, oldest event first
+//
+//encore:api public method=GET path=/bills/:id/events
+func (s *Service) GetBillEvents(ctx context.Context, id string) (*BillEventsResponse, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryEvents)
 	if err != nil {
-		return nil, &errs.Error{Code: errs.NotFound, Message: "bill not found"}
+		return nil, errNotFound(id)
 	}
-	var summary Bill
-	if err := qr.Get(&summary); err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: err.Error()}
+	var events []BillEvent
+	if err := qr.Get(&events); err != nil {
+		return nil, errInternal("failed to query bill events", err)
 	}
+	return &BillEventsResponse{Events: events}, nil
+}
 
-	if summary.Status != BillOpen {
-		return nil, &errs.Error{
-			Code:    errs.FailedPrecondition,
-			Message: fmt.Sprintf("cannot charge bill in status %s", summary.Status),
-		}
-	}
+type RejectedItemsResponse struct {
+	RejectedItems []RejectedItem `json:"rejected_items"`
+}
 
-	if summary.PendingCount() == 0 {
-		return nil, &errs.Error{
-			Code:    errs.FailedPrecondition,
-			Message: "cannot charge bill with no pending items",
-		}
+// returns the add-item signals the bill refused, oldest first. items added through the API are rejected
+// in the response, so this only holds items signalled to the workflow directly, e.g. by other services
+//
+//encore:api public method=GET path=/bills/:id/rejected-items
+func (s *Service) GetRejectedItems(ctx context.Context, id string) (*RejectedItemsResponse, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryRejectedItems)
+	if err != nil {
+		return nil, errNotFound(id)
 	}
-
-	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalChargeBill, nil); err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: "failed to signal workflow for charge: " + err.Error()}
+	var rejected []RejectedItem
+	if err := qr.Get(&rejected); err != nil {
+		return nil, errInternal("failed to query rejected items", err)
 	}
+	return &RejectedItemsResponse{RejectedItems: rejected}, nil
+}
 
-	qr2, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+//encore:api public method=GET path=/bills/:id/items/:itemID
+func (s *Service) GetItem(ctx context.Context, id string, itemID string) (*LineItem, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryItem, itemID)
 	if err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: err.Error()}
+		return nil, errNotFound(id)
 	}
-	if err := qr2.Get(&summary); err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: err.Error()}
+	var res ItemQueryResult
+	if err := qr.Get(&res); err != nil {
+		return nil, errInternal("failed to query item", err)
 	}
+	if !res.Found {
+		return nil, errItemNotFound(itemID)
+	}
+	return &res.Item, nil
+}
 
-	return &summary, nil
+// page size of ListItems when no limit is given, and the largest one it accepts
+const (
+	defaultItemsLimit = 50
+	maxItemsLimit     = 200
+)
+
+type ListItemsParams struct {
+	// optional, only items in this status, e.g. PENDING
+	Status string `query:"status"`
+	Limit  int    `query:"limit"`
+	Offset int    `query:"offset"`
 }
 
-//encore:api public method=POST path=/bills/:id/cancel
-func (s *Service) CancelBill(ctx context.Context, id string) (*Bill, error) {
+type ListItemsResponse struct {
+	Items []LineItem `json:"items"`
+	// items matching the filter across all pages
+	Total int `json:"total"`
+}
+
+// a page of the bill's items in the order they were added, optionally filtered by status.
+// an offset past the last matching item returns an empty page
+//
+//encore:api public method=GET path=/bills/:id/items
+func (s *Service) ListItems(ctx context.Context, id string, p ListItemsParams) (*ListItemsResponse, error) {
+	var status LineItemStatus
+	if strings.TrimSpace(p.Status) != "" {
+		status = LineItemStatus(strings.ToUpper(strings.TrimSpace(p.Status)))
+		if !status.Valid() {
+			return nil, errInvalid("status", fmt.Sprintf("unknown item status '%s'", p.Status))
+		}
+	}
+	limit := p.Limit
+	if limit == 0 {
+		limit = defaultItemsLimit
+	}
+	if limit < 0 || limit > maxItemsLimit {
+		return nil, errInvalid("limit", fmt.Sprintf("'limit' must be between 1 and %d", maxItemsLimit))
+	}
+	if p.Offset < 0 {
+		return nil, errInvalid("offset", "'offset' must not be negative")
+	}
+
 	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
 	if err != nil {
-		return nil, &errs.Error{Code: errs.NotFound, Message: "bill not found"}
+		return nil, errNotFound(id)
 	}
 	var bill Bill
 	if err := qr.Get(&bill); err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: err.Error()}
+		return nil, errInternal("failed to query bill", err)
 	}
 
-	if bill.Status != BillOpen {
-		return nil, &errs.Error{
-			Code:    errs.FailedPrecondition,
-			Message: fmt.Sprintf("cannot cancel bill in status %s", bill.Status),
+	matching := make([]LineItem, 0, len(bill.Items))
+	for _, it := range bill.Items {
+		if status == "" || it.Status == status {
+			matching = append(matching, it)
 		}
 	}
+	resp := &ListItemsResponse{Items: []LineItem{}, Total: len(matching)}
+	if p.Offset < len(matching) {
+		resp.Items = matching[p.Offset:min(p.Offset+limit, len(matching))]
+	}
+	return resp, nil
+}
 
-	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalCancelBill, nil); err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: "failed to signal workflow for cancel: " + err.Error()}
+//encore:api public method=DELETE path=/bills/:id/items/:itemID
+func (s *Service) RemoveItem(ctx context.Context, id string, itemID string) error {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return errNotFound(id)
 	}
 
-	qr2, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	var snap Bill
+	if err := qr.Get(&snap); err != nil {
+		return errInternal("failed to query bill", err)
+	}
+
+	if snap.Status != BillOpen {
+		return errBillNotOpen(snap.Status)
+	}
+
+	i := snap.itemIndex(itemID)
+	if i < 0 {
+		return errItemNotFound(itemID)
+	}
+	if snap.Items[i].Status != ItemPending {
+		return errItemNotPending(itemID)
+	}
+	if err := snap.RemoveItem(itemID); errors.Is(err, ErrOverDiscount) {
+		return errItemDiscounted(itemID)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalRemoveLineItem, itemID); err != nil {
+		return errInternal("failed to signal billing workflow", err)
+	}
+
+	return nil
+}
+
+// voids a single pending item, it stays on the bill as CANCELED and the bill stays open
+//
+//encore:api public method=POST path=/bills/:id/items/:itemID/void
+func (s *Service) VoidItem(ctx context.Context, id string, itemID string) error {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
 	if err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: err.Error()}
+		return errNotFound(id)
 	}
-	if err := qr2.Get(&bill); err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: err.Error()}
+
+	var snap Bill
+	if err := qr.Get(&snap); err != nil {
+		return errInternal("failed to query bill", err)
 	}
 
-	return &bill, nil
+	if snap.Status != BillOpen {
+		return errBillNotOpen(snap.Status)
+	}
+
+	i := snap.itemIndex(itemID)
+	if i < 0 {
+		return errItemNotFound(itemID)
+	}
+	if snap.Items[i].Status != ItemPending {
+		return errItemNotPending(itemID)
+	}
+	// voided on the handler's copy of the bill, so a void the discounts still need fails here instead of in the workflow
+	if err := snap.VoidItem(itemID); errors.Is(err, ErrOverDiscount) {
+		return errItemDiscounted(itemID)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalVoidItem, itemID); err != nil {
+		return errInternal("failed to signal billing workflow", err)
+	}
+
+	return nil
 }
 
-//encore:api public method=GET path=/bills/:id
-func (s *Service) GetBill(ctx context.Context, id string) (*Bill, error) {
+type UpdateItemRequest struct {
+	Name   string `json:"name,omitempty"`
+	Amount int64  `json:"amount"`
+}
+
+//encore:api public method=PATCH path=/bills/:id/items/:itemID
+func (s *Service) UpdateItem(ctx context.Context, id string, itemID string, req UpdateItemRequest) error {
+	if req.Amount <= 0 {
+		return errInvalid("amount", "'amount' must be greater than 0")
+	}
 
 	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
 	if err != nil {
-		return nil, &errs.Error{Code: errs.NotFound, Message: "bill not found"}
+		return errNotFound(id)
+	}
+
+	var snap Bill
+	if err := qr.Get(&snap); err != nil {
+		return errInternal("failed to query bill", err)
+	}
+
+	if snap.Status != BillOpen {
+		return errBillNotOpen(snap.Status)
+	}
+
+	i := snap.itemIndex(itemID)
+	if i < 0 {
+		return errItemNotFound(itemID)
+	}
+	if snap.Items[i].Status != ItemPending {
+		return errItemNotPending(itemID)
+	}
+	if err := currency.ValidateAmount(snap.Currency, req.Amount); err != nil {
+		return errInvalid("amount", err.Error())
+	}
+
+	li := LineItem{
+		ID:     itemID,
+		Name:   strings.TrimSpace(req.Name),
+		Amount: req.Amount,
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalUpdateLineItem, li); err != nil {
+		return errInternal("failed to signal billing workflow", err)
+	}
+
+	return nil
+}
+
+// refunds a single charged item of a settled bill and credits the debited account back
+//
+//encore:api public method=POST path=/bills/:id/items/:itemID/refund
+func (s *Service) RefundItem(ctx context.Context, id string, itemID string) error {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return errNotFound(id)
+	}
+
+	var snap Bill
+	if err := qr.Get(&snap); err != nil {
+		return errInternal("failed to query bill", err)
+	}
+
+	if snap.Status != BillSettled {
+		return errBillNotSettled(snap.Status)
+	}
+
+	i := snap.itemIndex(itemID)
+	if i < 0 {
+		return errItemNotFound(itemID)
+	}
+	if _, err := snap.RefundAmount(itemID); err != nil {
+		return errItemNotRefundable(itemID)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalRefundItem, itemID); err != nil {
+		return errInternal("failed to signal billing workflow", err)
+	}
+
+	return nil
+}
+
+// reverses a whole settled bill, every charged item is refunded and its net total credited back to the account.
+// the refund runs in the background, the bill shows as REFUNDED once it went through
+//
+//encore:api public method=POST path=/bills/:id/refund
+func (s *Service) RefundBill(ctx context.Context, id string) error {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return errNotFound(id)
+	}
+
+	var snap Bill
+	if err := qr.Get(&snap); err != nil {
+		return errInternal("failed to query bill", err)
+	}
+	if _, err := snap.RefundAllAmount(); err != nil {
+		return errBillNotSettled(snap.Status)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalRefundAll, nil); err != nil {
+		return errInternal("failed to signal billing workflow", err)
+	}
+	billLogger(id, "refund_bill", correlationID()).Info("full refund requested")
+	return nil
+}
+
+type AdjustBillRequest struct {
+	// minor units of the bill currency, positive to charge the account more and negative to credit it
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+	// optional, a retry with the same key and payload moves the funds only once
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// the ID of the adjustment made for an idempotency key of the bill, shaped like newID
+func adjustmentID(billID, key string) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "adjust:%d:%s%s", len(billID), billID, key))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+type AdjustBillResponse struct {
+	AdjustmentID string `json:"adjustment_id"`
+}
+
+// charges or credits a settled bill by an amount that doesn't map to an item, e.g. a goodwill credit.
+// the account is debited or credited in the background, the adjustment shows on the bill once it went through.
+// with an idempotency key the adjustment ID is derived from it, and the workflow applies an ID only once
+//
+//encore:api public method=POST path=/bills/:id/adjust
+func (s *Service) AdjustBill(ctx context.Context, id string, req AdjustBillRequest) (*AdjustBillResponse, error) {
+	if req.Amount == 0 {
+		return nil, errInvalid("amount", ErrZeroAdjustment.Error())
+	}
+	reason, err := trimReason(req.Reason)
+	if err != nil {
+		return nil, err
+	}
+
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var snap Bill
+	if err := qr.Get(&snap); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	adj := Adjustment{ID: newID(), Amount: req.Amount, Reason: reason}
+	if key := strings.TrimSpace(req.IdempotencyKey); key != "" {
+		adj.ID = adjustmentID(id, key)
+		if seen, ok := snap.adjustment(adj.ID); ok {
+			if seen.Amount != adj.Amount || seen.Reason != adj.Reason {
+				return nil, errInvalid("idempotency_key", ErrKeyConflict(key).Error())
+			}
+			// applied by an earlier attempt, the net total it was checked against already counts it
+			return &AdjustBillResponse{AdjustmentID: adj.ID}, nil
+		}
+	}
+	if err := snap.CheckAdjustment(req.Amount); err != nil {
+		switch {
+		case errors.Is(err, ErrCannotAdjust):
+			return nil, errBillNotSettled(snap.Status)
+		case errors.Is(err, ErrOverCredit):
+			return nil, errOverCredit(snap.netTotal())
+		}
+		return nil, errInvalid("amount", err.Error())
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalAdjust, adj); err != nil {
+		return nil, errInternal("failed to signal billing workflow", err)
+	}
+	billLogger(id, "adjust_bill", correlationID()).Info("adjustment requested", "adjustment_id", adj.ID, "amount", req.Amount)
+	return &AdjustBillResponse{AdjustmentID: adj.ID}, nil
+}
+
+type ChargeBillRequest struct {
+	// optional tip in basis points of the subtotal, e.g. 1500 for 15%. it is charged as a "tip" line
+	// that isn't taxed and isn't given back when the bill is refunded
+	TipBps float64 `json:"tip_bps,omitempty"`
+}
+
+//encore:api public method=POST path=/bills/:id/charge
+func (s *Service) ChargeBill(ctx context.Context, id string, req ChargeBillRequest) (*Bill, error) {
+	if req.TipBps < 0 || req.TipBps > 10000 {
+		return nil, errInvalid("tip_bps", "'tip_bps' must be between 0 and 10000")
+	}
+	logger := billLogger(id, "charge_bill", correlationID())
+	// the command blocks until the charge settles, so the response reflects the final bill state
+	res, err := s.command(ctx, id, Command{Type: CommandCharge, TipBps: req.TipBps})
+	if err != nil {
+		logger.Warn("charge failed", "err", err)
+		return nil, err
+	}
+	summary := res.Bill
+	logger.Info("bill charged", "status", summary.Status, "total", summary.Total)
+
+	if err := chargeError(summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// details of a charge that didn't settle, returned with the ChargeBill error
+type ChargeFailureDetails struct {
+	Status        BillStatus `json:"status"`
+	FailedItemIDs []string   `json:"failed_item_ids"`
+}
+
+func (ChargeFailureDetails) ErrDetails() {}
+
+// maps a bill that didn't settle to an error carrying its failed items, nil for any other status.
+// a failed bill is FailedPrecondition, a compensated one Aborted, so clients can tell them apart.
+// neither is a status clients retry on their own, charging the same bill again won't succeed
+func chargeError(bill Bill) error {
+	var code errs.ErrCode
+	switch bill.Status {
+	case BillFailed:
+		code = errs.FailedPrecondition
+	case BillCompensated:
+		code = errs.Aborted
+	default:
+		return nil
+	}
+	failed := make([]string, 0)
+	for _, it := range bill.Items {
+		if it.Status == ItemFailed {
+			failed = append(failed, it.ID)
+		}
+	}
+	return &errs.Error{
+		Code:    code,
+		Message: fmt.Sprintf("bill %s with %d failed items", strings.ToLower(string(bill.Status)), len(failed)),
+		Details: ChargeFailureDetails{Status: bill.Status, FailedItemIDs: failed},
+	}
+}
+
+type ChargePartialRequest struct {
+	ItemIDs []string `json:"item_ids"`
+}
+
+//encore:api public method=POST path=/bills/:id/charge-partial
+func (s *Service) ChargePartial(ctx context.Context, id string, req ChargePartialRequest) (*Bill, error) {
+	if len(req.ItemIDs) == 0 {
+		return nil, errInvalid("item_ids", "'item_ids' is required and must be non-empty")
+	}
+
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	if bill.Status != BillOpen {
+		return nil, errBillNotOpen(bill.Status)
+	}
+
+	for _, itemID := range req.ItemIDs {
+		i := bill.itemIndex(itemID)
+		if i < 0 {
+			return nil, errItemNotFound(itemID)
+		}
+		if bill.Items[i].Status != ItemPending {
+			return nil, errItemNotPending(itemID)
+		}
+		if bill.Items[i].IsDiscount() {
+			return nil, errItemNotChargeable(itemID)
+		}
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalChargePartial, req.ItemIDs); err != nil {
+		return nil, errInternal("failed to signal workflow for partial charge", err)
+	}
+
+	qr2, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if err := qr2.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	return &bill, nil
+}
+
+// longer cancel and adjustment reasons are cut to this many characters
+const maxReasonLen = 500
+
+type CancelBillRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (req CancelBillRequest) reason() (string, error) {
+	return trimReason(req.Reason)
+}
+
+// the trimmed reason, cut to maxReasonLen characters
+func trimReason(reason string) (string, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return "", errInvalid("reason", "'reason' is required and must be non-empty")
+	}
+	if r := []rune(reason); len(r) > maxReasonLen {
+		reason = string(r[:maxReasonLen])
+	}
+	return reason, nil
+}
+
+//encore:api public method=POST path=/bills/:id/cancel
+func (s *Service) CancelBill(ctx context.Context, id string, req CancelBillRequest) (*Bill, error) {
+	reason, err := req.reason()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := billLogger(id, "cancel_bill", correlationID())
+	res, err := s.command(ctx, id, Command{Type: CommandCancel, Reason: reason})
+	if err != nil {
+		logger.Warn("cancel failed", "err", err)
+		return nil, err
+	}
+	logger.Info("bill canceled", "reason", reason)
+	return &res.Bill, nil
+}
+
+type SplitBillRequest struct {
+	// item ID -> key of the group it moves to. every pending item has to be in a group, and there have to be
+	// at least two groups
+	Groups map[string]string `json:"groups"`
+	// optional RFC3339 period end of the new bills, defaults to the configured default period
+	PeriodEnd string `json:"period_end,omitempty"`
+}
+
+// a bill made of one group of a split bill, Total is in minor units of the bill currency
+type SplitChild struct {
+	Group  string `json:"group"`
+	BillID string `json:"bill_id"`
+	Total  int64  `json:"total"`
+}
+
+type SplitBillResponse struct {
+	// ordered by group key, their totals add up to the total of the split bill
+	Children []SplitChild `json:"children"`
+}
+
+// the ID of the bill a group of a split bill moves to, shaped like newID. the same bill and group always map
+// to the same ID, so a retried split finds the bills it already started
+func splitBillID(billID, group string) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "split:%d:%s%s", len(billID), billID, group))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// moves the pending items of an open bill into a new bill per group, e.g. per cost center before charging.
+// the bill is canceled with reason "split" and records the groups and their bills, which are started with its
+// options, account and currency on its task queue. a call that fails after the split can be retried with the
+// same groups, it starts the bills that are still missing
+//
+//encore:api public method=POST path=/bills/:id/split
+func (s *Service) SplitBill(ctx context.Context, id string, req SplitBillRequest) (*SplitBillResponse, error) {
+	if len(req.Groups) == 0 {
+		return nil, errInvalid("groups", "'groups' must map the bill's pending items to groups")
+	}
+	for itemID, g := range req.Groups {
+		if strings.TrimSpace(g) == "" {
+			return nil, errInvalid("groups", fmt.Sprintf("item %s has an empty group key", itemID))
+		}
+	}
+	periodEnd := s.defaultPeriodEnd()
+	if strings.TrimSpace(req.PeriodEnd) != "" {
+		parsed, err := time.Parse(time.RFC3339, req.PeriodEnd)
+		if err != nil {
+			return nil, errInvalid("period_end", "'period_end' must be RFC3339")
+		}
+		if !parsed.After(time.Now()) {
+			return nil, errInvalid("period_end", "period_end must be a future date")
+		}
+		periodEnd = parsed.UTC()
+	}
+
+	// the new bills run where the split one does, e.g. on the priority queue
+	desc, err := s.temporalClient.DescribeWorkflowExecution(ctx, id, "")
+	var notFound *serviceerror.NotFound
+	if errors.As(err, &notFound) {
+		return nil, errNotFound(id)
+	}
+	if err != nil {
+		return nil, errInternal("failed to describe billing workflow", err)
+	}
+	taskQueue := desc.GetWorkflowExecutionInfo().GetTaskQueue()
+
+	parent, err := s.GetBill(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// the new bills carry every option of the bill but its items
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryOptions)
+	if err != nil {
+		return nil, errInternal("failed to query bill options", err)
+	}
+	var baseOpts BillOptions
+	if err := qr.Get(&baseOpts); err != nil {
+		return nil, errInternal("failed to decode bill options", err)
+	}
+
+	children := make(map[string]string)
+	for _, g := range req.Groups {
+		children[g] = splitBillID(id, g)
+	}
+
+	corrID := correlationID()
+	logger := billLogger(id, "split_bill", corrID)
+	switch {
+	case parent.SplitInto != nil && maps.Equal(parent.SplitGroups, req.Groups):
+		// an earlier call split the bill, its bills that didn't start are started below
+		logger.Info("bill already split, starting the missing bills")
+	case parent.SplitInto != nil:
+		return nil, errBillNotOpen(parent.Status)
+	default:
+		accountID := parent.AccountID
+		if accountID == "" {
+			accountID = DefaultAccountID
+		}
+		// the split bill stops counting once it is canceled, each new bill counts from its start
+		if err := s.checkOpenBills(ctx, accountID, id, len(children)); err != nil {
+			return nil, err
+		}
+		// the bill checks the groups against its items and gives them up in one step, so nothing can be added
+		// to it or charged between the check and the new bills starting
+		res, err := s.command(ctx, id, Command{Type: CommandSplit, Groups: req.Groups, Children: children})
+		if err != nil {
+			logger.Warn("split failed", "err", err)
+			return nil, err
+		}
+		parent = &res.Bill
+	}
+
+	groupItems := make(map[string][]LineItem)
+	for _, it := range parent.Items {
+		if g, ok := req.Groups[it.ID]; ok {
+			// canceled by the split, they are pending again on their new bill
+			it.Status = ItemPending
+			groupItems[g] = append(groupItems[g], it)
+		}
+	}
+
+	var started *serviceerror.WorkflowExecutionAlreadyStarted
+	resp := &SplitBillResponse{}
+	for _, g := range slices.Sorted(maps.Keys(children)) {
+		opts := baseOpts
+		// a reassigned bill debits its new account
+		opts.AccountID, opts.AccountCurrency = parent.AccountID, parent.AccountCurrency
+		opts.Items = groupItems[g]
+		opts.SplitFrom = id
+		err := s.startBill(ctx, children[g], taskQueue, corrID, parent.Currency, periodEnd, opts)
+		if errors.As(err, &started) {
+			logger.Info("split bill already started", "group", g, "split_bill_id", children[g])
+		} else if err != nil {
+			// the bill is already split, a retry with the same groups starts what is missing
+			logger.Error("failed to start split bill", "group", g, "split_bill_id", children[g], "err", err)
+			return nil, errInternal(fmt.Sprintf("bill was split, but its bill for group %s failed to start, retry to start it", g), err)
+		}
+		var total int64
+		for _, li := range groupItems[g] {
+			total += li.signedAmount()
+		}
+		resp.Children = append(resp.Children, SplitChild{Group: g, BillID: children[g], Total: total})
+	}
+	logger.Info("bill split", "bills", len(resp.Children))
+	return resp, nil
+}
+
+// runs cmd through the bill's Command update. the workflow checks it against the bill as it is
+// when the command runs, so there is no gap between checking the bill and changing it
+func (s *Service) command(ctx context.Context, id string, cmd Command) (CommandResult, error) {
+	handle, err := s.temporalClient.UpdateWorkflow(ctx, client.UpdateWorkflowOptions{
+		WorkflowID:   id,
+		UpdateName:   UpdateCommand,
+		Args:         []interface{}{cmd},
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+	})
+	if err != nil {
+		return CommandResult{}, commandError(id, err)
+	}
+	var res CommandResult
+	if err := handle.Get(ctx, &res); err != nil {
+		return CommandResult{}, commandError(id, err)
+	}
+	return res, nil
+}
+
+// expires an open or charging bill right away, for operators ending stuck bills.
+// a charge in progress is undone, and force-expiring an expired bill again is a no-op
+//
+//encore:api public method=POST path=/bills/:id/force-expire
+func (s *Service) ForceExpireBill(ctx context.Context, id string) (*Bill, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	switch bill.Status {
+	case BillExpired:
+		return &bill, nil
+	case BillOpen, BillGrace, BillCharging:
+	default:
+		return nil, errWrongStatus("force-expire", bill.Status)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalForceExpire, nil); err != nil {
+		return nil, errInternal("failed to signal workflow for force-expire", err)
+	}
+
+	qr2, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if err := qr2.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	return &bill, nil
+}
+
+// finalizes an open bill right away, charged items are kept even if others fail
+//
+//encore:api public method=POST path=/bills/:id/close
+func (s *Service) CloseBill(ctx context.Context, id string) (*Bill, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	if !bill.Status.Active() {
+		return nil, errWrongStatus("close", bill.Status)
+	}
+	if bill.PendingCount() == 0 {
+		return nil, errNoPendingItems("cannot close bill with no pending items")
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalCloseBill, nil); err != nil {
+		return nil, errInternal("failed to signal workflow for close", err)
+	}
+
+	qr2, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if err := qr2.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	return &bill, nil
+}
+
+type ExtendBillRequest struct {
+	// new RFC3339 period end, has to be after the current one
+	PeriodEnd string `json:"period_end"`
+}
+
+// pushes out the expiry of an open bill, the workflow ignores a period end that isn't after the current one
+//
+//encore:api public method=POST path=/bills/:id/extend
+func (s *Service) ExtendBill(ctx context.Context, id string, req ExtendBillRequest) (*Bill, error) {
+	parsed, err := time.Parse(time.RFC3339, req.PeriodEnd)
+	if err != nil {
+		return nil, errInvalid("period_end", "'period_end' must be RFC3339")
+	}
+	if !parsed.After(time.Now()) {
+		return nil, errInvalid("period_end", "period_end must be a future date")
+	}
+
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	if !bill.Status.Active() {
+		return nil, errWrongStatus("extend", bill.Status)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalExtendPeriod, parsed.UTC().Format(time.RFC3339)); err != nil {
+		return nil, errInternal("failed to signal workflow for extend", err)
+	}
+
+	qr2, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if err := qr2.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	return &bill, nil
+}
+
+type ReassignBillRequest struct {
+	AccountID string `json:"account_id"`
+}
+
+// moves an open bill to another account, a registered account has to be held in the currency the bill debits.
+// the workflow checks the account again and keeps the bill's account when the check fails
+//
+//encore:api public method=POST path=/bills/:id/reassign
+func (s *Service) ReassignBill(ctx context.Context, id string, req ReassignBillRequest) (*Bill, error) {
+	accountID := strings.TrimSpace(req.AccountID)
+	if accountID == "" {
+		return nil, errInvalid("account_id", "'account_id' is required")
+	}
+	if strings.ContainsAny(accountID, `'"`) {
+		return nil, errInvalid("account_id", "'account_id' can't hold quotes")
+	}
+
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if bill.Status != BillOpen {
+		return nil, errBillNotOpen(bill.Status)
+	}
+	if err := checkAccountCurrency(ctx, BillOptions{AccountID: accountID, AccountCurrency: bill.AccountCurrency}); err != nil {
+		return nil, err
+	}
+	// the bill counts against the new account's open bills once it moves
+	if accountID != bill.AccountID {
+		if err := s.checkOpenBills(ctx, accountID, id, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalReassign, accountID); err != nil {
+		return nil, errInternal("failed to signal workflow for reassign", err)
+	}
+
+	qr, err = s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
 	}
-	var bill Bill
 	if err := qr.Get(&bill); err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: err.Error()}
+		return nil, errInternal("failed to query bill", err)
 	}
 	return &bill, nil
 }
+
+type AddNoteRequest struct {
+	Author string `json:"author"`
+	Text   string `json:"text"`
+}
+
+// attaches a support note to a bill that has no outcome yet, open, in grace or charging
+//
+//encore:api public method=POST path=/bills/:id/notes
+func (s *Service) AddBillNote(ctx context.Context, id string, req AddNoteRequest) (*Bill, error) {
+	n := Note{Author: strings.TrimSpace(req.Author), Text: strings.TrimSpace(req.Text)}
+	if field, err := validateNote(n.Author, n.Text); err != nil {
+		return nil, errInvalid(field, err.Error())
+	}
+
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if bill.Status.Terminal() {
+		return nil, errBillNotOpen(bill.Status)
+	}
+	if len(bill.Notes) >= maxNotes {
+		return nil, errTooManyNotes(maxNotes)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalAddNote, n); err != nil {
+		return nil, errInternal("failed to signal workflow for note", err)
+	}
+
+	qr, err = s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	return &bill, nil
+}
+
+type ReopenBillRequest struct {
+	// optional RFC3339 period end of the reopened bill, defaults to the configured default period
+	PeriodEnd string `json:"period_end,omitempty"`
+}
+
+// revives an expired bill within its grace period, the items canceled by the expiry become pending again
+//
+//encore:api public method=POST path=/bills/:id/reopen
+func (s *Service) ReopenBill(ctx context.Context, id string, req ReopenBillRequest) (*Bill, error) {
+	periodEnd := s.defaultPeriodEnd()
+	if strings.TrimSpace(req.PeriodEnd) != "" {
+		parsed, err := time.Parse(time.RFC3339, req.PeriodEnd)
+		if err != nil {
+			return nil, errInvalid("period_end", "'period_end' must be RFC3339")
+		}
+		if !parsed.After(time.Now()) {
+			return nil, errInvalid("period_end", "period_end must be a future date")
+		}
+		periodEnd = parsed.UTC()
+	}
+
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	// an expired bill past its grace period has completed and only accepts queries
+	if bill.Status != BillExpired {
+		return nil, errWrongStatus("reopen", bill.Status)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalReopen, periodEnd.Format(time.RFC3339)); err != nil {
+		return nil, errReopenGraceOver(err)
+	}
+
+	qr2, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if err := qr2.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	return &bill, nil
+}
+
+type ListBillsParams struct {
+	Status string `query:"status"`
+	// only lists bills that can no longer change and whose workflow completed
+	Archived bool `query:"archived"`
+	// only lists bills with the label, given as key:value
+	Label string `query:"label"`
+}
+
+type BillSummary struct {
+	ID       string            `json:"id"`
+	Status   BillStatus        `json:"status"`
+	Total    int64             `json:"total"`
+	Archived bool              `json:"archived"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+type ListBillsResponse struct {
+	Bills []BillSummary `json:"bills"`
+}
+
+// lists bills through temporal visibility, optionally filtered by the BillStatus, BillArchived and BillLabels search attributes
+//
+//encore:api public method=GET path=/bills
+func (s *Service) ListBills(ctx context.Context, p ListBillsParams) (*ListBillsResponse, error) {
+	// not filtered by task queue, bills live on whichever queue they were started on
+	query := "WorkflowType IN ('BillWorkflow', 'ScheduledBillWorkflow')"
+	if strings.TrimSpace(p.Status) != "" {
+		status := BillStatus(strings.ToUpper(strings.TrimSpace(p.Status)))
+		if !status.Valid() {
+			return nil, errInvalid("status", fmt.Sprintf("unknown bill status '%s'", p.Status))
+		}
+		query += fmt.Sprintf(" AND %s = '%s'", billStatusKey.GetName(), status)
+	}
+	if p.Archived {
+		query += fmt.Sprintf(" AND %s = true", billArchivedKey.GetName())
+	}
+	if strings.TrimSpace(p.Label) != "" {
+		k, v, err := parseLabel(p.Label)
+		if err != nil {
+			return nil, errInvalid("label", err.Error())
+		}
+		// keys and values can't hold quotes, so the entry is safe to put in the query
+		query += fmt.Sprintf(" AND %s = '%s:%s'", billLabelsKey.GetName(), k, v)
+	}
+
+	bills := []BillSummary{}
+	var pageToken []byte
+	for {
+		resp, err := s.temporalClient.ListWorkflow(ctx, &workflowservice.ListWorkflowExecutionsRequest{
+			Query:         query,
+			NextPageToken: pageToken,
+		})
+		if err != nil {
+			return nil, errInternal("failed to list bills", err)
+		}
+
+		for _, exec := range resp.GetExecutions() {
+			summary := BillSummary{ID: exec.GetExecution().GetWorkflowId()}
+			if payload, ok := exec.GetSearchAttributes().GetIndexedFields()[billStatusKey.GetName()]; ok {
+				_ = converter.GetDefaultDataConverter().FromPayload(payload, &summary.Status)
+			}
+			if payload, ok := exec.GetSearchAttributes().GetIndexedFields()[billArchivedKey.GetName()]; ok {
+				_ = converter.GetDefaultDataConverter().FromPayload(payload, &summary.Archived)
+			}
+			if payload, ok := exec.GetSearchAttributes().GetIndexedFields()[billLabelsKey.GetName()]; ok {
+				var entries []string
+				_ = converter.GetDefaultDataConverter().FromPayload(payload, &entries)
+				summary.Labels = labelsFromEntries(entries)
+			}
+			if payload, ok := exec.GetSearchAttributes().GetIndexedFields()[billTotalKey.GetName()]; ok {
+				_ = converter.GetDefaultDataConverter().FromPayload(payload, &summary.Total)
+			}
+			bills = append(bills, summary)
+		}
+
+		pageToken = resp.GetNextPageToken()
+		if len(pageToken) == 0 {
+			break
+		}
+	}
+
+	return &ListBillsResponse{Bills: bills}, nil
+}
+
+//encore:api public method=POST path=/bills/:id/retry
+func (s *Service) RetryBill(ctx context.Context, id string) (*Bill, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	if bill.Status != BillFailed && bill.Status != BillCompensated {
+		return nil, errWrongStatus("retry", bill.Status)
+	}
+
+	if err := s.temporalClient.SignalWorkflow(ctx, id, "", SignalRetryFailed, nil); err != nil {
+		return nil, errInternal("failed to signal workflow for retry", err)
+	}
+
+	qr2, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if err := qr2.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+
+	return &bill, nil
+}
+
+//encore:api public method=GET path=/bills/:id
+func (s *Service) GetBill(ctx context.Context, id string) (*Bill, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	return &bill, nil
+}
+
+// the bill's status, total and pending item count, a cheap alternative to GetBill for polling
+//
+//encore:api public method=GET path=/bills/:id/status
+func (s *Service) GetBillStatus(ctx context.Context, id string) (*BillStatusResult, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryStatus)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var res BillStatusResult
+	if err := qr.Get(&res); err != nil {
+		return nil, errInternal("failed to query bill status", err)
+	}
+	return &res, nil
+}
+
+// how many of the bill's items are charged, failed, refunded or still to charge, safe to poll while the bill charges
+//
+//encore:api public method=GET path=/bills/:id/progress
+func (s *Service) GetBillProgress(ctx context.Context, id string) (*ChargeProgress, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryProgress)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var res ChargeProgress
+	if err := qr.Get(&res); err != nil {
+		return nil, errInternal("failed to query bill progress", err)
+	}
+	return &res, nil
+}
@@ -2,8 +2,27 @@ package billing
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"pave-fees-api/account"
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+
+	"github.com/stretchr/testify/mock"
+	commonpb "go.temporal.io/api/common/v1"
+	"go.temporal.io/api/serviceerror"
+	workflowpb "go.temporal.io/api/workflow/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/mocks"
 )
 
 func TestCreateBill(t *testing.T) {
@@ -66,6 +85,10 @@ func TestChargeBill_Success(t *testing.T) {
 	defer svc.Shutdown(context.Background())
 
 	ctx := context.Background()
+	// the settled amount is held and captured from the account
+	if err := account.AddBalance(ctx, &account.AddBalanceParams{AccountID: DefaultAccountID, Currency: currency.USD, Amount: 200}); err != nil {
+		t.Fatalf("AddBalance failed: %v", err)
+	}
 	resp, _ := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD"})
 	id := resp.BillID
 
@@ -75,13 +98,18 @@ func TestChargeBill_Success(t *testing.T) {
 		Amount: 200,
 	})
 
-	result, err := svc.ChargeBill(ctx, id)
+	result, err := svc.ChargeBill(ctx, id, ChargeBillRequest{})
 	if err != nil {
 		t.Fatalf("ChargeBill failed: %v", err)
 	}
 
-	if result.Status != BillCharging {
-		t.Errorf("expected bill to be charging, got %s", result.Status)
+	if result.Status != BillSettled {
+		t.Errorf("expected bill to be settled, got %s", result.Status)
+	}
+	for _, it := range result.Items {
+		if it.Status != ItemCharged {
+			t.Errorf("expected item %s to be charged, got %s", it.ID, it.Status)
+		}
 	}
 }
 
@@ -96,13 +124,16 @@ func TestCancelBill_Success(t *testing.T) {
 	resp, _ := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD"})
 	id := resp.BillID
 
-	cancelled, err := svc.CancelBill(ctx, id)
+	cancelled, err := svc.CancelBill(ctx, id, CancelBillRequest{Reason: "customer churned"})
 	if err != nil {
 		t.Fatalf("CancelBill failed: %v", err)
 	}
 	if cancelled.Status != BillCanceled {
 		t.Errorf("expected status to be Canceled, got %s", cancelled.Status)
 	}
+	if cancelled.CancelReason != "customer churned" {
+		t.Errorf("expected cancel reason to round-trip, got %q", cancelled.CancelReason)
+	}
 }
 
 func TestAddItemAfterCharge_Fails(t *testing.T) {
@@ -114,7 +145,7 @@ func TestAddItemAfterCharge_Fails(t *testing.T) {
 	id := resp.BillID
 
 	svc.AddItem(ctx, id, AddItemRequest{ID: "1", Name: "A", Amount: 100})
-	svc.ChargeBill(ctx, id)
+	svc.ChargeBill(ctx, id, ChargeBillRequest{})
 
 	err := svc.AddItem(ctx, id, AddItemRequest{ID: "2", Name: "B", Amount: 50})
 	if err == nil {
@@ -139,15 +170,29 @@ func TestDuplicateItemFails(t *testing.T) {
 }
 
 func TestCreateBill_InvalidCurrency(t *testing.T) {
-	svc, _ := initService()
-	defer svc.Shutdown(context.Background())
+	tests := []struct {
+		name     string
+		currency string
+		wantMsg  string
+	}{
+		{"unknown", "XYZ", "unsupported currency 'XYZ'"},
+		{"empty", "", "'currency' is required, e.g. USD"},
+		{"whitespace", "   ", "'currency' is required, e.g. USD"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// rejected before the workflow is started
+			svc := &Service{temporalClient: mocks.NewClient(t)}
 
-	ctx := context.Background()
-	_, err := svc.CreateBill(ctx, CreateBillRequest{
-		Currency: "XYZ",
-	})
-	if err == nil {
-		t.Fatal("expected error for unsupported currency")
+			_, err := svc.CreateBill(context.Background(), CreateBillRequest{Currency: tc.currency})
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != errs.InvalidArgument || e.Message != tc.wantMsg {
+				t.Fatalf("error = %v; want InvalidArgument %q", err, tc.wantMsg)
+			}
+			if d, ok := e.Details.(ErrorDetails); !ok || d.Field != "currency" {
+				t.Errorf("details = %+v; want field currency", e.Details)
+			}
+		})
 	}
 }
 
@@ -173,3 +218,1086 @@ func TestGetBill_AfterMultipleAdds(t *testing.T) {
 		t.Errorf("expected total to be 150, got %d", bill.Total)
 	}
 }
+
+func TestRemoveItemFromBill(t *testing.T) {
+	svc, err := initService()
+	if err != nil {
+		t.Fatalf("failed to init service: %v", err)
+	}
+	defer svc.Shutdown(context.Background())
+
+	ctx := context.Background()
+	resp, _ := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD"})
+	id := resp.BillID
+
+	svc.AddItem(ctx, id, AddItemRequest{ID: "1", Name: "One", Amount: 100})
+	svc.AddItem(ctx, id, AddItemRequest{ID: "2", Name: "Two", Amount: 50})
+
+	if err := svc.RemoveItem(ctx, id, "1"); err != nil {
+		t.Fatalf("RemoveItem returned error: %v", err)
+	}
+
+	bill, err := svc.GetBill(ctx, id)
+	if err != nil {
+		t.Fatalf("GetBill failed: %v", err)
+	}
+	if len(bill.Items) != 1 {
+		t.Errorf("expected 1 item, got %d", len(bill.Items))
+	}
+	if bill.Total != 50 {
+		t.Errorf("expected total to be 50, got %d", bill.Total)
+	}
+	if bill.Status != BillOpen {
+		t.Errorf("expected bill to stay open, got %s", bill.Status)
+	}
+
+	if err := svc.RemoveItem(ctx, id, "missing"); err == nil {
+		t.Fatal("expected error when removing a missing item")
+	}
+}
+
+func TestVoidItem_RejectsChargedItem(t *testing.T) {
+	c := mocks.NewClient(t)
+	v := mocks.NewEncodedValue(t)
+	v.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*Bill) = Bill{ID: "b1", Status: BillOpen, Currency: currency.USD, Total: 150, Items: []LineItem{
+			{ID: "1", Name: "One", Amount: 100, Status: ItemCharged},
+			{ID: "2", Name: "Two", Amount: 50, Status: ItemPending},
+		}}
+	}).Return(nil)
+	c.On("QueryWorkflow", mock.Anything, "b1", "", QueryBill).Return(v, nil)
+	// the workflow is only signalled for the pending item
+	c.On("SignalWorkflow", mock.Anything, "b1", "", SignalVoidItem, "2").Return(nil).Once()
+	svc := &Service{temporalClient: c}
+
+	err := svc.VoidItem(context.Background(), "b1", "1")
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.FailedPrecondition {
+		t.Fatalf("voiding a charged item: expected FailedPrecondition, got %v", err)
+	}
+	if err := svc.VoidItem(context.Background(), "b1", "2"); err != nil {
+		t.Fatalf("VoidItem returned error: %v", err)
+	}
+	err = svc.VoidItem(context.Background(), "b1", "missing")
+	if !errors.As(err, &e) || e.Code != errs.NotFound {
+		t.Fatalf("voiding a missing item: expected NotFound, got %v", err)
+	}
+}
+
+func TestAddItem_RetryWithIdempotencyKey(t *testing.T) {
+	svc, _ := initService()
+	defer svc.Shutdown(context.Background())
+
+	ctx := context.Background()
+	resp, _ := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD"})
+	id := resp.BillID
+
+	item := AddItemRequest{ID: "item-1", Name: "A", Amount: 100, IdempotencyKey: "retry-1"}
+	if err := svc.AddItem(ctx, id, item); err != nil {
+		t.Fatalf("AddItem returned error: %v", err)
+	}
+	if err := svc.AddItem(ctx, id, item); err != nil {
+		t.Fatalf("expected retried AddItem to succeed, got %v", err)
+	}
+
+	conflicting := item
+	conflicting.Amount = 200
+	if err := svc.AddItem(ctx, id, conflicting); err == nil {
+		t.Fatal("expected error when reusing an idempotency key with a different payload")
+	}
+
+	bill, err := svc.GetBill(ctx, id)
+	if err != nil {
+		t.Fatalf("GetBill failed: %v", err)
+	}
+	if len(bill.Items) != 1 {
+		t.Errorf("expected 1 item, got %d", len(bill.Items))
+	}
+	if bill.Total != 100 {
+		t.Errorf("expected total to be 100, got %d", bill.Total)
+	}
+}
+
+func TestListBills_InvalidStatus(t *testing.T) {
+	svc, _ := initService()
+	defer svc.Shutdown(context.Background())
+
+	_, err := svc.ListBills(context.Background(), ListBillsParams{Status: "BOGUS"})
+	if err == nil {
+		t.Fatal("expected error for unknown status filter")
+	}
+}
+
+func TestListBills_FilterByStatus(t *testing.T) {
+	svc, _ := initService()
+	defer svc.Shutdown(context.Background())
+
+	ctx := context.Background()
+	resp, _ := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD"})
+	svc.AddItem(ctx, resp.BillID, AddItemRequest{ID: "1", Name: "One", Amount: 100})
+
+	// visibility is eventually consistent
+	var found *BillSummary
+	for i := 0; i < 20 && found == nil; i++ {
+		list, err := svc.ListBills(ctx, ListBillsParams{Status: "open"})
+		if err != nil {
+			t.Fatalf("ListBills failed: %v", err)
+		}
+		for j := range list.Bills {
+			if list.Bills[j].ID == resp.BillID {
+				found = &list.Bills[j]
+			}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if found == nil {
+		t.Fatal("expected open bill to be listed")
+	}
+	if found.Status != BillOpen {
+		t.Errorf("expected status OPEN, got %s", found.Status)
+	}
+	if found.Total != 100 {
+		t.Errorf("expected total 100, got %d", found.Total)
+	}
+}
+
+func TestListBills_Archived(t *testing.T) {
+	c := mocks.NewClient(t)
+	dc := converter.GetDefaultDataConverter()
+	status, _ := dc.ToPayload(BillSettled)
+	archived, _ := dc.ToPayload(true)
+	total, _ := dc.ToPayload(int64(2500))
+	var query string
+	c.On("ListWorkflow", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		query = args.Get(1).(*workflowservice.ListWorkflowExecutionsRequest).Query
+	}).Return(&workflowservice.ListWorkflowExecutionsResponse{Executions: []*workflowpb.WorkflowExecutionInfo{{
+		Execution: &commonpb.WorkflowExecution{WorkflowId: "b1", RunId: "r1"},
+		SearchAttributes: &commonpb.SearchAttributes{IndexedFields: map[string]*commonpb.Payload{
+			billStatusKey.GetName():   status,
+			billArchivedKey.GetName(): archived,
+			billTotalKey.GetName():    total,
+		}},
+	}}}, nil)
+	svc := &Service{temporalClient: c}
+
+	list, err := svc.ListBills(context.Background(), ListBillsParams{Archived: true})
+	if err != nil {
+		t.Fatalf("ListBills failed: %v", err)
+	}
+	if !strings.Contains(query, "BillArchived = true") {
+		t.Errorf("query %q doesn't filter on BillArchived", query)
+	}
+	// bills from before the task queues were split run on the legacy queue and have to be listed too
+	if strings.Contains(query, "TaskQueue") {
+		t.Errorf("query %q filters on the task queue", query)
+	}
+	// the total comes from the BillTotal search attribute, the closed bill is never queried
+	if len(list.Bills) != 1 || !list.Bills[0].Archived || list.Bills[0].Status != BillSettled || list.Bills[0].Total != 2500 {
+		t.Errorf("bills = %+v, want the archived SETTLED bill with its total", list.Bills)
+	}
+}
+
+func TestListBills_Label(t *testing.T) {
+	c := mocks.NewClient(t)
+	labels, _ := converter.GetDefaultDataConverter().ToPayload([]string{"cost-center:CC-1042", "team:payments"})
+	var query string
+	c.On("ListWorkflow", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		query = args.Get(1).(*workflowservice.ListWorkflowExecutionsRequest).Query
+	}).Return(&workflowservice.ListWorkflowExecutionsResponse{Executions: []*workflowpb.WorkflowExecutionInfo{{
+		Execution: &commonpb.WorkflowExecution{WorkflowId: "b1", RunId: "r1"},
+		SearchAttributes: &commonpb.SearchAttributes{IndexedFields: map[string]*commonpb.Payload{
+			billLabelsKey.GetName(): labels,
+		}},
+	}}}, nil).Once()
+	svc := &Service{temporalClient: c}
+
+	list, err := svc.ListBills(context.Background(), ListBillsParams{Label: "team:payments"})
+	if err != nil {
+		t.Fatalf("ListBills failed: %v", err)
+	}
+	if !strings.Contains(query, "BillLabels = 'team:payments'") {
+		t.Errorf("query %q doesn't filter on the label", query)
+	}
+	if len(list.Bills) != 1 || list.Bills[0].Labels["team"] != "payments" || list.Bills[0].Labels["cost-center"] != "CC-1042" {
+		t.Errorf("bills = %+v, want b1 with its labels", list.Bills)
+	}
+
+	// malformed filters are rejected before visibility is queried
+	for _, label := range []string{"team", "team:pay'ments", "Team:payments"} {
+		_, err := svc.ListBills(context.Background(), ListBillsParams{Label: label})
+		var e *errs.Error
+		if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+			t.Errorf("label %q: expected InvalidArgument, got %v", label, err)
+		}
+	}
+}
+
+func TestChargePartial_LeavesRestPending(t *testing.T) {
+	svc, _ := initService()
+	defer svc.Shutdown(context.Background())
+
+	ctx := context.Background()
+	resp, _ := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD"})
+	id := resp.BillID
+
+	svc.AddItem(ctx, id, AddItemRequest{ID: "1", Name: "One", Amount: 100})
+	svc.AddItem(ctx, id, AddItemRequest{ID: "2", Name: "Two", Amount: 50})
+
+	bill, err := svc.ChargePartial(ctx, id, ChargePartialRequest{ItemIDs: []string{"1"}})
+	if err != nil {
+		t.Fatalf("ChargePartial failed: %v", err)
+	}
+	if bill.Status != BillOpen {
+		t.Errorf("expected bill to stay open, got %s", bill.Status)
+	}
+
+	if _, err := svc.ChargePartial(ctx, id, ChargePartialRequest{ItemIDs: []string{"missing"}}); err == nil {
+		t.Fatal("expected error when charging a missing item")
+	}
+}
+
+func TestRetryBill_RejectedWhenOpen(t *testing.T) {
+	svc, _ := initService()
+	defer svc.Shutdown(context.Background())
+
+	ctx := context.Background()
+	resp, _ := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD"})
+
+	if _, err := svc.RetryBill(ctx, resp.BillID); err == nil {
+		t.Fatal("expected error when retrying an open bill")
+	}
+}
+
+func TestCreateBill_InvalidTaxRate(t *testing.T) {
+	svc, _ := initService()
+	defer svc.Shutdown(context.Background())
+
+	_, err := svc.CreateBill(context.Background(), CreateBillRequest{Currency: "USD", TaxRateBps: 10001})
+	if err == nil {
+		t.Fatal("expected error for a tax rate above 100%")
+	}
+}
+
+func TestCreateBill_InvalidRetryPolicy(t *testing.T) {
+	svc, err := initService()
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	defer svc.Shutdown(context.Background())
+
+	tests := []struct {
+		name string
+		req  CreateBillRequest
+	}{
+		{"too many attempts", CreateBillRequest{Currency: "USD", MaxChargeAttempts: 11}},
+		{"negative attempts", CreateBillRequest{Currency: "USD", MaxChargeAttempts: -1}},
+		{"timeout too long", CreateBillRequest{Currency: "USD", ChargeTimeoutSeconds: 301}},
+		{"too many concurrent charges", CreateBillRequest{Currency: "USD", MaxConcurrentCharges: 101}},
+		{"negative concurrent charges", CreateBillRequest{Currency: "USD", MaxConcurrentCharges: -1}},
+		{"unknown charge strategy", CreateBillRequest{Currency: "USD", ChargeStrategy: "random"}},
+		{"stop on failure in parallel", CreateBillRequest{Currency: "USD", StopOnFailure: true}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := svc.CreateBill(context.Background(), tc.req); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestChargeBill_CompensatedReturnsFailedItems(t *testing.T) {
+	svc, err := initService()
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	defer svc.Shutdown(context.Background())
+
+	ctx := context.Background()
+	if err := account.AddBalance(ctx, &account.AddBalanceParams{AccountID: DefaultAccountID, Currency: currency.USD, Amount: 300}); err != nil {
+		t.Fatalf("AddBalance failed: %v", err)
+	}
+	resp, _ := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD", MaxChargeAttempts: 1})
+	id := resp.BillID
+	svc.AddItem(ctx, id, AddItemRequest{ID: "ok", Name: "Subscription", Amount: 200})
+	svc.AddItem(ctx, id, AddItemRequest{ID: "bad", Name: "FAIL", Amount: 100})
+
+	_, err = svc.ChargeBill(ctx, id, ChargeBillRequest{})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.Aborted {
+		t.Fatalf("expected Aborted error, got %v", err)
+	}
+	details, ok := e.Details.(ChargeFailureDetails)
+	if !ok || details.Status != BillCompensated || len(details.FailedItemIDs) != 1 || details.FailedItemIDs[0] != "bad" {
+		t.Errorf("details = %+v, want COMPENSATED with failed item bad", e.Details)
+	}
+}
+
+func TestChargeError(t *testing.T) {
+	items := []LineItem{
+		{ID: "a", Status: ItemRefunded},
+		{ID: "b", Status: ItemFailed},
+	}
+	tests := []struct {
+		status   BillStatus
+		wantCode errs.ErrCode
+	}{
+		{BillFailed, errs.FailedPrecondition},
+		{BillCompensated, errs.Aborted},
+		{BillSettled, errs.OK},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.status), func(t *testing.T) {
+			err := chargeError(Bill{Status: tc.status, Items: items})
+			if tc.wantCode == errs.OK {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != tc.wantCode {
+				t.Fatalf("expected %s error, got %v", tc.wantCode, err)
+			}
+			if d := e.Details.(ChargeFailureDetails); d.Status != tc.status || len(d.FailedItemIDs) != 1 || d.FailedItemIDs[0] != "b" {
+				t.Errorf("details = %+v, want %s with failed item b", d, tc.status)
+			}
+		})
+	}
+}
+
+func TestChargeBill_OutcomeStatus(t *testing.T) {
+	items := []LineItem{
+		{ID: "a", Status: ItemCharged},
+		{ID: "b", Status: ItemFailed},
+	}
+	// neither failure may be a status clients retry on their own, e.g. 429 or 503
+	tests := []struct {
+		status     BillStatus
+		wantCode   errs.ErrCode
+		wantStatus int
+	}{
+		{BillSettled, errs.OK, http.StatusOK},
+		{BillPartiallySettled, errs.OK, http.StatusOK},
+		{BillCompensated, errs.Aborted, http.StatusConflict},
+		{BillFailed, errs.FailedPrecondition, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.status), func(t *testing.T) {
+			c := mocks.NewClient(t)
+			handle := mocks.NewWorkflowUpdateHandle(t)
+			handle.On("Get", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				*args.Get(1).(*CommandResult) = CommandResult{Status: tc.status, Bill: Bill{ID: "b1", Status: tc.status, Items: items}}
+			}).Return(nil)
+			c.On("UpdateWorkflow", mock.Anything, mock.Anything).Return(handle, nil)
+			svc := &Service{temporalClient: c}
+
+			bill, err := svc.ChargeBill(context.Background(), "b1", ChargeBillRequest{})
+
+			// the status encore serves the error with
+			got := http.StatusOK
+			var e *errs.Error
+			if errors.As(err, &e) {
+				got = e.Code.HTTPStatus()
+			} else if err != nil {
+				t.Fatalf("expected an encore error, got %v", err)
+			}
+			if tc.wantCode != errs.OK && e.Code != tc.wantCode {
+				t.Errorf("code = %s, want %s", e.Code, tc.wantCode)
+			}
+			if got != tc.wantStatus {
+				t.Fatalf("HTTP status = %d, want %d (err %v)", got, tc.wantStatus, err)
+			}
+			if tc.wantStatus == http.StatusOK {
+				if bill == nil || bill.Status != tc.status {
+					t.Errorf("bill = %+v, want the %s bill", bill, tc.status)
+				}
+				return
+			}
+			if d, ok := e.Details.(ChargeFailureDetails); !ok || d.Status != tc.status || len(d.FailedItemIDs) != 1 || d.FailedItemIDs[0] != "b" {
+				t.Errorf("details = %+v, want %s with failed item b", e.Details, tc.status)
+			}
+		})
+	}
+}
+
+func TestScheduleBill_CreatesSchedule(t *testing.T) {
+	schedules := mocks.NewScheduleClient(t)
+	c := mocks.NewClient(t)
+	c.On("ScheduleClient").Return(schedules)
+
+	var got client.ScheduleOptions
+	schedules.On("Create", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { got = args.Get(1).(client.ScheduleOptions) }).
+		Return(mocks.NewScheduleHandle(t), nil)
+
+	svc := &Service{temporalClient: c}
+	resp, err := svc.ScheduleBill(context.Background(), ScheduleBillRequest{
+		Bill:            CreateBillRequest{Currency: "USD", TaxRateBps: 500},
+		Items:           []AddItemRequest{{ID: "seat", Name: "Seat", Quantity: 3, UnitAmount: 1000}},
+		IntervalSeconds: 24 * 60 * 60,
+	})
+	if err != nil {
+		t.Fatalf("ScheduleBill returned error: %v", err)
+	}
+
+	if got.ID != resp.ScheduleID || !strings.HasPrefix(got.ID, billSchedulePrefix) {
+		t.Errorf("schedule ID = %q, response has %q", got.ID, resp.ScheduleID)
+	}
+	if len(got.Spec.Intervals) != 1 || got.Spec.Intervals[0].Every != 24*time.Hour {
+		t.Errorf("intervals = %+v, want every 24h", got.Spec.Intervals)
+	}
+	action, ok := got.Action.(*client.ScheduleWorkflowAction)
+	if !ok || action.TaskQueue != standardTaskQueue || len(action.Args) != 1 {
+		t.Fatalf("action = %+v, want a workflow action on %s with the template", got.Action, standardTaskQueue)
+	}
+	tmpl := action.Args[0].(BillTemplate)
+	if tmpl.Currency != currency.USD || tmpl.Options.TaxRateBps != 500 || tmpl.PeriodSeconds != 24*60*60 {
+		t.Errorf("template = %+v, want USD at 500 bps for a day", tmpl)
+	}
+	if len(tmpl.Items) != 1 || tmpl.Items[0].Amount != 3000 {
+		t.Errorf("template items = %+v, want seat of 3000", tmpl.Items)
+	}
+}
+
+func TestScheduleBill_InvalidTemplate(t *testing.T) {
+	// the schedule client is never reached, so a bare mock fails the test if it is
+	svc := &Service{temporalClient: mocks.NewClient(t)}
+	item := AddItemRequest{ID: "seat", Name: "Seat", Amount: 1000}
+	tests := []struct {
+		name string
+		req  ScheduleBillRequest
+	}{
+		{"short interval", ScheduleBillRequest{Bill: CreateBillRequest{Currency: "USD"}, Items: []AddItemRequest{item}, IntervalSeconds: 60}},
+		{"unknown currency", ScheduleBillRequest{Bill: CreateBillRequest{Currency: "XYZ"}, Items: []AddItemRequest{item}, IntervalSeconds: 3600}},
+		{"period end set", ScheduleBillRequest{Bill: CreateBillRequest{Currency: "USD", PeriodEnd: "2030-01-01T00:00:00Z"}, Items: []AddItemRequest{item}, IntervalSeconds: 3600}},
+		{"unknown product", ScheduleBillRequest{Bill: CreateBillRequest{Currency: "USD", CatalogOnly: true}, Items: []AddItemRequest{{ID: "x", Name: "Mystery box", Amount: 1000}}, IntervalSeconds: 3600}},
+		{"request ID set", ScheduleBillRequest{Bill: CreateBillRequest{Currency: "USD", RequestID: "order-42"}, Items: []AddItemRequest{item}, IntervalSeconds: 3600}},
+		{"no items", ScheduleBillRequest{Bill: CreateBillRequest{Currency: "USD"}, IntervalSeconds: 3600}},
+		{"duplicate item", ScheduleBillRequest{Bill: CreateBillRequest{Currency: "USD"}, Items: []AddItemRequest{item, item}, IntervalSeconds: 3600}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := svc.ScheduleBill(context.Background(), tc.req)
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+				t.Errorf("expected InvalidArgument error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteBillSchedule_ForeignID(t *testing.T) {
+	svc := &Service{temporalClient: mocks.NewClient(t)}
+	err := svc.DeleteBillSchedule(context.Background(), "someone-elses-schedule")
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.NotFound {
+		t.Errorf("expected NotFound error, got %v", err)
+	}
+}
+
+func TestCreateBill_TaskQueue(t *testing.T) {
+	tests := []struct {
+		name      string
+		priority  bool
+		wantQueue string
+	}{
+		{"standard", false, standardTaskQueue},
+		{"priority", true, priorityTaskQueue},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := mocks.NewClient(t)
+			var queue string
+			c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+				Run(func(args mock.Arguments) {
+					queue = args.Get(1).(client.StartWorkflowOptions).TaskQueue
+				}).
+				Return(mocks.NewWorkflowRun(t), nil)
+
+			svc := &Service{temporalClient: c}
+			if _, err := svc.CreateBill(context.Background(), CreateBillRequest{Currency: "USD", Priority: tc.priority}); err != nil {
+				t.Fatalf("CreateBill returned error: %v", err)
+			}
+			if queue != tc.wantQueue {
+				t.Errorf("started on %q, want %q", queue, tc.wantQueue)
+			}
+		})
+	}
+}
+
+func TestCreateBill_CorrelationMemo(t *testing.T) {
+	c := mocks.NewClient(t)
+	var memos []map[string]interface{}
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			memos = append(memos, args.Get(1).(client.StartWorkflowOptions).Memo)
+		}).
+		Return(mocks.NewWorkflowRun(t), nil)
+
+	svc := &Service{temporalClient: c}
+	for i := 0; i < 2; i++ {
+		if _, err := svc.CreateBill(context.Background(), CreateBillRequest{Currency: "USD"}); err != nil {
+			t.Fatalf("CreateBill returned error: %v", err)
+		}
+	}
+
+	first, _ := memos[0][correlationMemoKey].(string)
+	second, _ := memos[1][correlationMemoKey].(string)
+	if first == "" || second == "" {
+		t.Fatalf("memos = %v, want a correlation ID on every start", memos)
+	}
+	// outside of a traced request every call gets its own
+	if first == second {
+		t.Errorf("both bills got correlation ID %q, want one per request", first)
+	}
+}
+
+func TestCreateBill_OpenBillLimit(t *testing.T) {
+	c := mocks.NewClient(t)
+	var queries []string
+	open := int64(1)
+	c.On("CountWorkflow", mock.Anything, mock.Anything).
+		Return(func(_ context.Context, req *workflowservice.CountWorkflowExecutionsRequest) (*workflowservice.CountWorkflowExecutionsResponse, error) {
+			queries = append(queries, req.GetQuery())
+			return &workflowservice.CountWorkflowExecutionsResponse{Count: open}, nil
+		})
+	var account string
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			account, _ = args.Get(1).(client.StartWorkflowOptions).TypedSearchAttributes.GetKeyword(billAccountKey)
+		}).
+		Return(mocks.NewWorkflowRun(t), nil).Once()
+
+	svc := &Service{temporalClient: c, maxOpenBills: 2}
+	ctx := context.Background()
+	if _, err := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD", AccountID: "acc-limit"}); err != nil {
+		t.Fatalf("CreateBill under the limit returned error: %v", err)
+	}
+	if account != "acc-limit" {
+		t.Errorf("bill started with account %q, want acc-limit", account)
+	}
+	if !strings.Contains(queries[0], "BillAccount = 'acc-limit'") {
+		t.Errorf("count query %q doesn't filter on the account", queries[0])
+	}
+
+	// the second open bill reaches the limit, the mock fails the test if another workflow starts
+	open = 2
+	_, err := svc.CreateBill(ctx, CreateBillRequest{Currency: "USD", AccountID: "acc-limit", RequestID: "req-over"})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if d, ok := e.Details.(ErrorDetails); !ok || d.Reason != ReasonTooManyOpenBills || d.AccountID != "acc-limit" || d.Limit != 2 {
+		t.Errorf("details = %+v, want TOO_MANY_OPEN_BILLS for acc-limit with limit 2", e.Details)
+	}
+	// a retry doesn't count the bill its first attempt created
+	if want := fmt.Sprintf("WorkflowId != '%s'", requestBillID("acc-limit", "req-over")); !strings.Contains(queries[1], want) {
+		t.Errorf("count query %q doesn't leave out %s", queries[1], want)
+	}
+}
+
+func TestReassignBill_OpenBillLimit(t *testing.T) {
+	c := mocks.NewClient(t)
+	v := mocks.NewEncodedValue(t)
+	v.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*Bill) = Bill{ID: "b1", Status: BillOpen, Currency: currency.USD, AccountID: "acc-1", AccountCurrency: currency.USD}
+	}).Return(nil)
+	c.On("QueryWorkflow", mock.Anything, "b1", "", QueryBill).Return(v, nil)
+	var query string
+	c.On("CountWorkflow", mock.Anything, mock.Anything).
+		Return(func(_ context.Context, req *workflowservice.CountWorkflowExecutionsRequest) (*workflowservice.CountWorkflowExecutionsResponse, error) {
+			query = req.GetQuery()
+			return &workflowservice.CountWorkflowExecutionsResponse{Count: 2}, nil
+		})
+
+	// the new account is at the limit, the mock fails the test if the bill is signaled
+	svc := &Service{temporalClient: c, maxOpenBills: 2}
+	_, err := svc.ReassignBill(context.Background(), "b1", ReassignBillRequest{AccountID: "acc-full"})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if d, ok := e.Details.(ErrorDetails); !ok || d.Reason != ReasonTooManyOpenBills || d.AccountID != "acc-full" {
+		t.Errorf("details = %+v, want TOO_MANY_OPEN_BILLS for acc-full", e.Details)
+	}
+	if !strings.Contains(query, "BillAccount = 'acc-full'") {
+		t.Errorf("count query %q doesn't filter on the new account", query)
+	}
+
+	_, err = svc.ReassignBill(context.Background(), "b1", ReassignBillRequest{AccountID: "acc'; DROP"})
+	if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an account ID with quotes, got %v", err)
+	}
+}
+
+func TestCreateBillFromTemplate(t *testing.T) {
+	c := mocks.NewClient(t)
+	var cur currency.Currency
+	var opts BillOptions
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			cur = args.Get(4).(currency.Currency)
+			opts = args.Get(6).(BillOptions)
+		}).
+		Return(mocks.NewWorkflowRun(t), nil).Once()
+
+	svc := &Service{temporalClient: c}
+	if _, err := svc.CreateBillFromTemplate(context.Background(), "support-monthly", CreateBillRequest{TaxRateBps: 500}); err != nil {
+		t.Fatalf("CreateBillFromTemplate returned error: %v", err)
+	}
+	if cur != currency.USD || opts.TaxRateBps != 500 {
+		t.Errorf("started a %s bill with %+v, want the template's USD and the request's options", cur, opts)
+	}
+	if len(opts.Items) != 2 || opts.Items[0].ID != "support" || opts.Items[1].ID != "seat" ||
+		opts.Items[0].Amount != 4900 || opts.Items[0].Status != ItemPending {
+		t.Errorf("initial items = %+v, want the template's pending support and seat items", opts.Items)
+	}
+}
+
+func TestCreateBillFromTemplate_Rejected(t *testing.T) {
+	// nothing is started, the mock fails the test on any call
+	svc := &Service{temporalClient: mocks.NewClient(t)}
+	tests := []struct {
+		name       string
+		templateID string
+		req        CreateBillRequest
+		wantCode   errs.ErrCode
+		wantReason ErrorReason
+	}{
+		{"missing template", "missing", CreateBillRequest{}, errs.NotFound, ReasonTemplateNotFound},
+		{"other currency", "support-monthly", CreateBillRequest{Currency: "eur"}, errs.InvalidArgument, ReasonInvalidArgument},
+		{"invalid option", "stationery", CreateBillRequest{TaxRateBps: -1}, errs.InvalidArgument, ReasonInvalidArgument},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := svc.CreateBillFromTemplate(context.Background(), tc.templateID, tc.req)
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != tc.wantCode {
+				t.Fatalf("expected %s error, got %v", tc.wantCode, err)
+			}
+			if d, ok := e.Details.(ErrorDetails); !ok || d.Reason != tc.wantReason {
+				t.Errorf("details = %+v, want reason %s", e.Details, tc.wantReason)
+			}
+		})
+	}
+}
+
+// a client whose bill b1 runs on the priority queue with the given options, queries return the bill as it is then
+func splitClient(t *testing.T, parent *Bill, opts BillOptions, open int64) *mocks.Client {
+	c := mocks.NewClient(t)
+	c.On("DescribeWorkflowExecution", mock.Anything, "b1", "").Return(&workflowservice.DescribeWorkflowExecutionResponse{
+		WorkflowExecutionInfo: &workflowpb.WorkflowExecutionInfo{TaskQueue: priorityTaskQueue},
+	}, nil)
+	c.On("QueryWorkflow", mock.Anything, "b1", "", QueryBill).Return(func(context.Context, string, string, string, ...interface{}) (converter.EncodedValue, error) {
+		v := mocks.NewEncodedValue(t)
+		v.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+			*args.Get(0).(*Bill) = parent.snapshot()
+		}).Return(nil)
+		return v, nil
+	})
+	optsVal := mocks.NewEncodedValue(t)
+	optsVal.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*BillOptions) = opts
+	}).Return(nil)
+	c.On("QueryWorkflow", mock.Anything, "b1", "", QueryOptions).Return(optsVal, nil)
+	c.On("CountWorkflow", mock.Anything, mock.Anything).Return(&workflowservice.CountWorkflowExecutionsResponse{Count: open}, nil).Maybe()
+	return c
+}
+
+func TestSplitBill(t *testing.T) {
+	opts := BillOptions{AccountID: "acc-1", TaxRateBps: 500, Labels: map[string]string{"team": "ops"},
+		MaxChargeAttempts: 2, ChargeStrategy: ChargeLargestFirst, StopOnFailure: true, CatalogOnly: true, GracePeriodSeconds: 600}
+	parent := newBill("b1", currency.USD, opts)
+	for _, li := range []LineItem{
+		{ID: "a", Name: "Seat", Amount: 1500},
+		{ID: "b", Name: "Support", Amount: 4900},
+		{ID: "c", Name: "Pen", Amount: 250},
+		{ID: "d", Name: "Promo", Amount: 500, Kind: KindDiscount},
+	} {
+		if err := parent.AddItem(li); err != nil {
+			t.Fatalf("AddItem failed: %v", err)
+		}
+	}
+	groups := map[string]string{"a": "eng", "b": "sales", "c": "eng", "d": "sales"}
+
+	// two open bills of the account and the two new ones reach the limit of 4, the split bill isn't counted
+	c := splitClient(t, parent, opts, 2)
+	// the workflow splits its bill the way the update handler would, only once
+	c.On("UpdateWorkflow", mock.Anything, mock.Anything).Return(
+		func(_ context.Context, o client.UpdateWorkflowOptions) (client.WorkflowUpdateHandle, error) {
+			cmd := o.Args[0].(Command)
+			if err := parent.apply(cmd); err != nil {
+				return nil, err
+			}
+			h := mocks.NewWorkflowUpdateHandle(t)
+			h.On("Get", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				*args.Get(1).(*CommandResult) = CommandResult{Bill: parent.snapshot()}
+			}).Return(nil)
+			return h, nil
+		}).Once()
+	// the first call fails to start the second bill, the retry finds the first one started
+	started := make(map[string]BillOptions)
+	starts := 0
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(func(_ context.Context, o client.StartWorkflowOptions, _ interface{}, args ...interface{}) (client.WorkflowRun, error) {
+			starts++
+			if o.TaskQueue != priorityTaskQueue {
+				t.Errorf("split bill started on %s, want the bill's %s", o.TaskQueue, priorityTaskQueue)
+			}
+			if starts == 2 {
+				return nil, errors.New("temporal unavailable")
+			}
+			if _, ok := started[o.ID]; ok {
+				return nil, serviceerror.NewWorkflowExecutionAlreadyStarted("already started", "", "")
+			}
+			started[o.ID] = args[3].(BillOptions)
+			return mocks.NewWorkflowRun(t), nil
+		})
+
+	svc := &Service{temporalClient: c, maxOpenBills: 4}
+	if _, err := svc.SplitBill(context.Background(), "b1", SplitBillRequest{Groups: groups}); err == nil {
+		t.Fatal("expected the failed start to fail the split")
+	}
+	if parent.Status != BillCanceled || len(started) != 1 {
+		t.Fatalf("bill is %s with %d bills started, want it split with one bill started", parent.Status, len(started))
+	}
+
+	resp, err := svc.SplitBill(context.Background(), "b1", SplitBillRequest{Groups: groups})
+	if err != nil {
+		t.Fatalf("retried SplitBill returned error: %v", err)
+	}
+	if len(resp.Children) != 2 || resp.Children[0].Group != "eng" || resp.Children[1].Group != "sales" {
+		t.Fatalf("children = %+v, want eng and sales", resp.Children)
+	}
+	if resp.Children[0].Total != 1750 || resp.Children[1].Total != 4400 {
+		t.Errorf("totals = %d and %d, want 1750 and 4400", resp.Children[0].Total, resp.Children[1].Total)
+	}
+	if parent.CancelReason != splitCancelReason || len(parent.SplitInto) != 2 {
+		t.Errorf("split bill is %s (%q) into %v, want canceled for the split", parent.Status, parent.CancelReason, parent.SplitInto)
+	}
+	for _, ch := range resp.Children {
+		got, ok := started[ch.BillID]
+		if !ok || parent.SplitInto[ch.Group] != ch.BillID || ch.BillID != splitBillID("b1", ch.Group) {
+			t.Fatalf("bill %s of group %s wasn't started or recorded", ch.BillID, ch.Group)
+		}
+		// every option of the bill is carried over
+		want := opts
+		want.SplitFrom, want.Items = "b1", got.Items
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("group %s started with %+v, want the bill's options %+v", ch.Group, got, want)
+		}
+		for _, li := range got.Items {
+			if groups[li.ID] != ch.Group || li.Status != ItemPending {
+				t.Errorf("group %s got %s item %s", ch.Group, li.Status, li.ID)
+			}
+		}
+	}
+
+	// other groups don't take over a split bill
+	other := map[string]string{"a": "eng", "b": "eng", "c": "sales", "d": "sales"}
+	_, err = svc.SplitBill(context.Background(), "b1", SplitBillRequest{Groups: other})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for other groups, got %v", err)
+	}
+}
+
+func TestSplitBill_OpenBillLimit(t *testing.T) {
+	parent := newBill("b1", currency.USD, BillOptions{AccountID: "acc-1"})
+	for _, li := range []LineItem{{ID: "a", Name: "Seat", Amount: 1500}, {ID: "b", Name: "Pen", Amount: 250}} {
+		if err := parent.AddItem(li); err != nil {
+			t.Fatalf("AddItem failed: %v", err)
+		}
+	}
+	// the split bill and two others are open, two new bills would make 4. nothing is split or started
+	svc := &Service{temporalClient: splitClient(t, parent, BillOptions{AccountID: "acc-1"}, 2), maxOpenBills: 3}
+	_, err := svc.SplitBill(context.Background(), "b1", SplitBillRequest{Groups: map[string]string{"a": "eng", "b": "sales"}})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if parent.Status != BillOpen {
+		t.Errorf("bill is %s, want it left open", parent.Status)
+	}
+}
+
+func TestSplitBill_Rejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups map[string]string
+	}{
+		{"no groups", nil},
+		{"empty group key", map[string]string{"a": "eng", "b": " "}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// nothing is described or split, the mock fails the test on any call
+			svc := &Service{temporalClient: mocks.NewClient(t)}
+			_, err := svc.SplitBill(context.Background(), "b1", SplitBillRequest{Groups: tc.groups})
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+				t.Fatalf("expected InvalidArgument error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateBill_RetriesCollidingID(t *testing.T) {
+	collision := serviceerror.NewWorkflowExecutionAlreadyStarted("already started", "", "")
+	tests := []struct {
+		name       string
+		collisions int
+		wantCode   errs.ErrCode
+	}{
+		{"first ID collides", 1, errs.OK},
+		{"every ID collides", billIDAttempts, errs.Internal},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := mocks.NewClient(t)
+			var ids []string
+			call := c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything,
+				mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+				Run(func(args mock.Arguments) {
+					opts := args.Get(1).(client.StartWorkflowOptions)
+					ids = append(ids, opts.ID)
+					if !opts.WorkflowExecutionErrorWhenAlreadyStarted {
+						t.Error("expected the start to fail on an existing workflow ID")
+					}
+				})
+			call.Return(func(context.Context, client.StartWorkflowOptions, interface{}, ...interface{}) (client.WorkflowRun, error) {
+				if len(ids) <= tc.collisions {
+					return nil, collision
+				}
+				return mocks.NewWorkflowRun(t), nil
+			})
+
+			svc := &Service{temporalClient: c}
+			resp, err := svc.CreateBill(context.Background(), CreateBillRequest{Currency: "USD"})
+			if tc.wantCode != errs.OK {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != tc.wantCode {
+					t.Fatalf("expected %s error, got %v", tc.wantCode, err)
+				}
+				if len(ids) != billIDAttempts {
+					t.Errorf("tried %d IDs, want %d", len(ids), billIDAttempts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateBill returned error: %v", err)
+			}
+			if len(ids) != tc.collisions+1 || ids[0] == ids[1] || resp.BillID != ids[len(ids)-1] {
+				t.Errorf("tried IDs %v and returned %q, want a fresh ID after the collision", ids, resp.BillID)
+			}
+		})
+	}
+}
+
+func TestCreateBill_RequestID(t *testing.T) {
+	c := mocks.NewClient(t)
+	started := map[string]bool{}
+	call := c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	call.Return(func(_ context.Context, opts client.StartWorkflowOptions, _ interface{}, _ ...interface{}) (client.WorkflowRun, error) {
+		if started[opts.ID] {
+			return nil, serviceerror.NewWorkflowExecutionAlreadyStarted("already started", "", "")
+		}
+		started[opts.ID] = true
+		return mocks.NewWorkflowRun(t), nil
+	})
+	svc := &Service{temporalClient: c}
+
+	create := func(accountID, requestID string) string {
+		t.Helper()
+		resp, err := svc.CreateBill(context.Background(), CreateBillRequest{Currency: "USD", AccountID: accountID, RequestID: requestID})
+		if err != nil {
+			t.Fatalf("CreateBill(%q) returned error: %v", requestID, err)
+		}
+		return resp.BillID
+	}
+	first := create("", "order-42")
+	if retried := create("", "order-42"); retried != first {
+		t.Errorf("retry created bill %q, want the first bill %q", retried, first)
+	}
+	if other := create("", "order-43"); other == first {
+		t.Errorf("another request ID got the same bill %q", other)
+	}
+	// another account sending the same request ID gets a bill of its own
+	if other := create("acc-other", "order-42"); other == first {
+		t.Errorf("another account got the first bill %q", other)
+	}
+	if len(started) != 3 {
+		t.Errorf("started %d bills, want one per account and request ID", len(started))
+	}
+
+	_, err := svc.CreateBill(context.Background(), CreateBillRequest{Currency: "USD", RequestID: strings.Repeat("r", maxRequestIDLen+1)})
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a long request ID, got %v", err)
+	}
+}
+
+func TestCancelBillRequest_Reason(t *testing.T) {
+	long := strings.Repeat("é", maxReasonLen+10)
+	tests := []struct {
+		name     string
+		reason   string
+		want     string
+		wantCode errs.ErrCode
+	}{
+		{"kept", "duplicate order", "duplicate order", errs.OK},
+		{"trimmed", "  duplicate order\n", "duplicate order", errs.OK},
+		{"truncated", long, long[:maxReasonLen*len("é")], errs.OK},
+		{"empty", "", "", errs.InvalidArgument},
+		{"blank", "   ", "", errs.InvalidArgument},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := CancelBillRequest{Reason: tc.reason}.reason()
+			if tc.wantCode != errs.OK {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != tc.wantCode {
+					t.Fatalf("expected %s error, got %v", tc.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("reason = %q (%d chars), want %q", got, len([]rune(got)), tc.want)
+			}
+		})
+	}
+}
+
+func TestAdjustBill(t *testing.T) {
+	settled := Bill{ID: "b1", Status: BillSettled, Currency: currency.USD, SettledAmount: 1500}
+	// a bill an earlier attempt with key k1 adjusted
+	adjusted := settled
+	adjusted.Adjustments = []Adjustment{{ID: adjustmentID("b1", "k1"), Amount: -1500, Reason: "goodwill credit"}}
+	tests := []struct {
+		name       string
+		bill       Bill
+		req        AdjustBillRequest
+		wantCode   errs.ErrCode
+		wantSignal bool
+	}{
+		{"charge", settled, AdjustBillRequest{Amount: 300, Reason: "late delivery fee"}, errs.OK, true},
+		{"credit", settled, AdjustBillRequest{Amount: -500, Reason: " goodwill credit "}, errs.OK, true},
+		{"credit above the net total", settled, AdjustBillRequest{Amount: -1501, Reason: "too generous"}, errs.FailedPrecondition, false},
+		{"open bill", Bill{ID: "b1", Status: BillOpen}, AdjustBillRequest{Amount: 300, Reason: "fee"}, errs.FailedPrecondition, false},
+		{"zero amount", settled, AdjustBillRequest{Reason: "nothing"}, errs.InvalidArgument, false},
+		{"no reason", settled, AdjustBillRequest{Amount: 300, Reason: "  "}, errs.InvalidArgument, false},
+		{"idempotency key", settled, AdjustBillRequest{Amount: -1500, Reason: "goodwill credit", IdempotencyKey: "k1"}, errs.OK, true},
+		// the whole net total was credited, checking the retry again would fail it
+		{"retried key", adjusted, AdjustBillRequest{Amount: -1500, Reason: "goodwill credit", IdempotencyKey: "k1"}, errs.OK, false},
+		{"key reused for another amount", adjusted, AdjustBillRequest{Amount: -100, Reason: "goodwill credit", IdempotencyKey: "k1"}, errs.InvalidArgument, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := mocks.NewClient(t)
+			v := mocks.NewEncodedValue(t)
+			v.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+				*args.Get(0).(*Bill) = tc.bill
+			}).Return(nil).Maybe()
+			c.On("QueryWorkflow", mock.Anything, "b1", "", QueryBill).Return(v, nil).Maybe()
+			var sent Adjustment
+			if tc.wantSignal {
+				c.On("SignalWorkflow", mock.Anything, "b1", "", SignalAdjust, mock.Anything).Run(func(args mock.Arguments) {
+					sent = args.Get(4).(Adjustment)
+				}).Return(nil).Once()
+			}
+			svc := &Service{temporalClient: c}
+
+			resp, err := svc.AdjustBill(context.Background(), "b1", tc.req)
+
+			if tc.wantCode != errs.OK {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != tc.wantCode {
+					t.Fatalf("expected %s error, got %v", tc.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AdjustBill returned error: %v", err)
+			}
+			if tc.req.IdempotencyKey != "" && resp.AdjustmentID != adjustmentID("b1", tc.req.IdempotencyKey) {
+				t.Errorf("adjustment ID = %s, want the one derived from the key", resp.AdjustmentID)
+			}
+			if !tc.wantSignal {
+				return
+			}
+			if sent.ID == "" || sent.ID != resp.AdjustmentID || sent.Amount != tc.req.Amount || sent.Reason != strings.TrimSpace(tc.req.Reason) {
+				t.Errorf("signaled %+v, want adjustment %s of %d", sent, resp.AdjustmentID, tc.req.Amount)
+			}
+		})
+	}
+}
+
+func TestListItems(t *testing.T) {
+	bill := Bill{ID: "b1", Status: BillOpen, Currency: currency.USD, Items: []LineItem{
+		{ID: "a1", Status: ItemCharged},
+		{ID: "b2", Status: ItemPending},
+		{ID: "c3", Status: ItemPending},
+		{ID: "d4", Status: ItemCharged},
+		{ID: "e5", Status: ItemPending},
+	}}
+	tests := []struct {
+		name      string
+		params    ListItemsParams
+		wantIDs   []string
+		wantTotal int
+		wantField string
+	}{
+		{"all", ListItemsParams{}, []string{"a1", "b2", "c3", "d4", "e5"}, 5, ""},
+		{"pending", ListItemsParams{Status: "pending"}, []string{"b2", "c3", "e5"}, 3, ""},
+		{"charged", ListItemsParams{Status: "CHARGED"}, []string{"a1", "d4"}, 2, ""},
+		{"pending second page", ListItemsParams{Status: "PENDING", Limit: 2, Offset: 2}, []string{"e5"}, 3, ""},
+		{"offset past the end", ListItemsParams{Offset: 5}, []string{}, 5, ""},
+		{"no match", ListItemsParams{Status: "REFUNDED"}, []string{}, 0, ""},
+		{"unknown status", ListItemsParams{Status: "PAID"}, nil, 0, "status"},
+		{"limit too large", ListItemsParams{Limit: maxItemsLimit + 1}, nil, 0, "limit"},
+		{"negative offset", ListItemsParams{Offset: -1}, nil, 0, "offset"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := mocks.NewClient(t)
+			v := mocks.NewEncodedValue(t)
+			v.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+				*args.Get(0).(*Bill) = bill
+			}).Return(nil).Maybe()
+			c.On("QueryWorkflow", mock.Anything, "b1", "", QueryBill).Return(v, nil).Maybe()
+			svc := &Service{temporalClient: c}
+
+			resp, err := svc.ListItems(context.Background(), "b1", tc.params)
+			if tc.wantField != "" {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+					t.Fatalf("expected InvalidArgument, got %v", err)
+				}
+				if d, ok := e.Details.(ErrorDetails); !ok || d.Field != tc.wantField {
+					t.Errorf("details = %+v, want field %s", e.Details, tc.wantField)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ListItems returned error: %v", err)
+			}
+			ids := []string{}
+			for _, it := range resp.Items {
+				ids = append(ids, it.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tc.wantIDs, ",") || resp.Total != tc.wantTotal {
+				t.Errorf("got %v of %d, want %v of %d", ids, resp.Total, tc.wantIDs, tc.wantTotal)
+			}
+		})
+	}
+}
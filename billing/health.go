@@ -0,0 +1,36 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"go.temporal.io/sdk/client"
+)
+
+// how long the health check waits for the temporal frontend to answer
+const healthCheckTimeout = 5 * time.Second
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	// workers polling the billing task queues
+	Workers int `json:"workers"`
+}
+
+// reports whether the service can run bills: the temporal frontend answers and a worker is running
+// for every task queue. otherwise it fails with Unavailable, so it can back a liveness or readiness probe
+//
+//encore:api public method=GET path=/health
+func (s *Service) Health(ctx context.Context) (*HealthResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if _, err := s.temporalClient.CheckHealth(ctx, &client.CheckHealthRequest{}); err != nil {
+		return nil, errUnavailable("temporal unreachable", err)
+	}
+	if s.stopping.Load() {
+		return nil, errUnavailable("billing workers are stopping", nil)
+	}
+	if len(s.temporalWorkers) < len(taskQueues) {
+		return nil, errUnavailable("billing workers not running", nil)
+	}
+	return &HealthResponse{Status: "ok", Workers: len(s.temporalWorkers)}, nil
+}
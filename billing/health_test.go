@@ -0,0 +1,62 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"encore.dev/beta/errs"
+
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/mocks"
+	"go.temporal.io/sdk/worker"
+)
+
+func TestHealth(t *testing.T) {
+	// one per task queue
+	running := make([]worker.Worker, len(taskQueues))
+	for i := range running {
+		running[i] = &drainingWorker{}
+	}
+	tests := []struct {
+		name     string
+		checkErr error
+		workers  []worker.Worker
+		stopping bool
+		wantCode errs.ErrCode
+	}{
+		{"healthy", nil, running, false, errs.OK},
+		{"temporal down", serviceerror.NewUnavailable("connection refused"), running, false, errs.Unavailable},
+		{"workers not started", nil, nil, false, errs.Unavailable},
+		{"shutting down", nil, running, true, errs.Unavailable},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := mocks.NewClient(t)
+			c.On("CheckHealth", mock.Anything, mock.Anything).Return(&client.CheckHealthResponse{}, tc.checkErr)
+			svc := &Service{temporalClient: c, temporalWorkers: tc.workers}
+			svc.stopping.Store(tc.stopping)
+
+			resp, err := svc.Health(context.Background())
+
+			if tc.wantCode != errs.OK {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != tc.wantCode {
+					t.Fatalf("expected %s error, got %v", tc.wantCode, err)
+				}
+				if d, ok := e.Details.(ErrorDetails); !ok || d.Reason != ReasonUnavailable {
+					t.Errorf("details = %+v, want reason %s", e.Details, ReasonUnavailable)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Health returned error: %v", err)
+			}
+			if resp.Status != "ok" || resp.Workers != len(taskQueues) {
+				t.Errorf("health = %+v, want ok with %d workers", resp, len(taskQueues))
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package billing
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// limits on a bill's labels, they are indexed in visibility so they are kept short and query safe
+const (
+	maxLabels        = 10
+	maxLabelValueLen = 63
+)
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// checks the labels given when the bill is created, keys are lowercase identifiers and values
+// can't hold quotes or the ':' that separates them from the key in the BillLabels search attribute
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels", maxLabels)
+	}
+	for k, v := range labels {
+		if err := validateLabel(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLabel(k, v string) error {
+	if !labelKeyPattern.MatchString(k) {
+		return fmt.Errorf("label key %q must start with a lowercase letter and hold at most 32 lowercase letters, digits, '_' or '-'", k)
+	}
+	if len(v) > maxLabelValueLen || !labelValuePattern.MatchString(v) {
+		return fmt.Errorf("value of label %s must be 1 to %d letters, digits, '_', '.' or '-'", k, maxLabelValueLen)
+	}
+	return nil
+}
+
+// parses a "key:value" label filter
+func parseLabel(s string) (string, string, error) {
+	k, v, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return "", "", fmt.Errorf("label %q must be given as key:value", s)
+	}
+	if err := validateLabel(k, v); err != nil {
+		return "", "", err
+	}
+	return k, v, nil
+}
+
+// the labels as "key:value" entries of the BillLabels keyword list, sorted so upserts are deterministic
+func labelEntries(labels map[string]string) []string {
+	entries := make([]string, 0, len(labels))
+	for k, v := range labels {
+		entries = append(entries, k+":"+v)
+	}
+	slices.Sort(entries)
+	return entries
+}
+
+// the labels back from their BillLabels entries, malformed entries are skipped
+func labelsFromEntries(entries []string) map[string]string {
+	if len(entries) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if k, v, ok := strings.Cut(e, ":"); ok {
+			labels[k] = v
+		}
+	}
+	return labels
+}
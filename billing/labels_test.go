@@ -0,0 +1,51 @@
+package billing
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLabels(t *testing.T) {
+	tooMany := map[string]string{}
+	for _, k := range strings.Split("a b c d e f g h i j k", " ") {
+		tooMany[k] = "x"
+	}
+
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"cost center and project", map[string]string{"cost-center": "CC-1042", "project": "checkout_v2"}, false},
+		{"too many", tooMany, true},
+		{"uppercase key", map[string]string{"Team": "payments"}, true},
+		{"key with a colon", map[string]string{"team:a": "payments"}, true},
+		{"key too long", map[string]string{strings.Repeat("k", 33): "payments"}, true},
+		{"empty value", map[string]string{"team": ""}, true},
+		{"value with a quote", map[string]string{"team": "pay'ments"}, true},
+		{"value with a colon", map[string]string{"team": "pay:ments"}, true},
+		{"value too long", map[string]string{"team": strings.Repeat("v", maxLabelValueLen+1)}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validateLabels(tc.labels); (err != nil) != tc.wantErr {
+				t.Errorf("validateLabels() error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLabelEntries_RoundTrip(t *testing.T) {
+	labels := map[string]string{"team": "payments", "cost-center": "CC-1042"}
+
+	entries := labelEntries(labels)
+
+	if got := strings.Join(entries, ","); got != "cost-center:CC-1042,team:payments" {
+		t.Errorf("entries = %s, want them sorted as key:value", got)
+	}
+	back := labelsFromEntries(entries)
+	if len(back) != len(labels) || back["team"] != "payments" || back["cost-center"] != "CC-1042" {
+		t.Errorf("labels back = %v, want %v", back, labels)
+	}
+}
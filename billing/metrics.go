@@ -0,0 +1,71 @@
+package billing
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/metrics"
+)
+
+// labels of the bill outcome counter, one counter per currency and terminal status
+type OutcomeLabels struct {
+	Currency string
+	Outcome  string
+}
+
+var billOutcomes = metrics.NewCounterGroup[OutcomeLabels, uint64]("bill_outcomes", metrics.CounterConfig{})
+
+// encore metrics can't be read back, so the counts served by the stats endpoint are kept alongside them
+var (
+	outcomesMu    sync.Mutex
+	outcomeCounts = make(map[OutcomeLabels]uint64)
+)
+
+// counts a bill reaching a terminal status, it runs as an activity because workflow code has to stay deterministic
+func RecordOutcomeActivity(_ context.Context, cur currency.Currency, outcome BillStatus) error {
+	labels := OutcomeLabels{Currency: string(cur), Outcome: string(outcome)}
+	billOutcomes.With(labels).Increment()
+
+	outcomesMu.Lock()
+	defer outcomesMu.Unlock()
+	outcomeCounts[labels]++
+	return nil
+}
+
+type OutcomeCount struct {
+	Currency currency.Currency `json:"currency"`
+	Outcome  BillStatus        `json:"outcome"`
+	Count    uint64            `json:"count"`
+}
+
+type BillStatsResponse struct {
+	Outcomes []OutcomeCount `json:"outcomes"`
+}
+
+// counts of bills per currency and terminal status since the service started
+//
+//encore:api public method=GET path=/bills/stats
+func (s *Service) GetBillStats(ctx context.Context) (*BillStatsResponse, error) {
+	return &BillStatsResponse{Outcomes: outcomeStats()}, nil
+}
+
+// snapshot of the outcome counts ordered by currency, then outcome
+func outcomeStats() []OutcomeCount {
+	outcomesMu.Lock()
+	defer outcomesMu.Unlock()
+
+	out := make([]OutcomeCount, 0, len(outcomeCounts))
+	for l, n := range outcomeCounts {
+		out = append(out, OutcomeCount{Currency: currency.Currency(l.Currency), Outcome: BillStatus(l.Outcome), Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Currency != out[j].Currency {
+			return out[i].Currency < out[j].Currency
+		}
+		return out[i].Outcome < out[j].Outcome
+	})
+	return out
+}
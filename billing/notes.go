@@ -0,0 +1,61 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// limits on a bill's notes, they live in the workflow state so they are kept short
+const (
+	maxNotes         = 100
+	maxNoteLen       = 2000
+	maxNoteAuthorLen = 100
+)
+
+var (
+	ErrBillFinal    = errors.New("bill already has an outcome")
+	ErrTooManyNotes = fmt.Errorf("a bill takes at most %d notes", maxNotes)
+)
+
+// free text a support agent attached to the bill for context, At is stamped by the workflow
+type Note struct {
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+	At     time.Time `json:"at"`
+}
+
+// checks the author and text of a note, both are required and the text is at most maxNoteLen characters.
+// returns the field that failed along with the error
+func validateNote(author, text string) (string, error) {
+	if strings.TrimSpace(author) == "" {
+		return "author", errors.New("'author' is required")
+	}
+	if utf8.RuneCountInString(author) > maxNoteAuthorLen {
+		return "author", fmt.Errorf("'author' must be at most %d characters", maxNoteAuthorLen)
+	}
+	if strings.TrimSpace(text) == "" {
+		return "text", errors.New("'text' is required")
+	}
+	if utf8.RuneCountInString(text) > maxNoteLen {
+		return "text", fmt.Errorf("'text' must be at most %d characters", maxNoteLen)
+	}
+	return "", nil
+}
+
+// attaches a note to a bill that has no outcome yet, notes are kept in the order they were added
+func (b *Bill) AddNote(n Note) error {
+	if b.Status.Terminal() {
+		return ErrBillFinal
+	}
+	if _, err := validateNote(n.Author, n.Text); err != nil {
+		return err
+	}
+	if len(b.Notes) >= maxNotes {
+		return ErrTooManyNotes
+	}
+	b.Notes = append(b.Notes, n)
+	return nil
+}
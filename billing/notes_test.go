@@ -0,0 +1,74 @@
+package billing
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateNote(t *testing.T) {
+	tests := []struct {
+		name      string
+		author    string
+		text      string
+		wantField string
+	}{
+		{"note", "agent-7", "customer asked for a paper copy", ""},
+		{"at the limit", "agent-7", strings.Repeat("é", maxNoteLen), ""},
+		{"no author", "  ", "customer asked for a paper copy", "author"},
+		{"author too long", strings.Repeat("a", maxNoteAuthorLen+1), "customer asked for a paper copy", "author"},
+		{"no text", "agent-7", "", "text"},
+		{"text too long", "agent-7", strings.Repeat("é", maxNoteLen+1), "text"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			field, err := validateNote(tc.author, tc.text)
+			if field != tc.wantField || (err != nil) != (tc.wantField != "") {
+				t.Errorf("validateNote() = %q, %v; want field %q", field, err, tc.wantField)
+			}
+		})
+	}
+}
+
+func TestAddNote(t *testing.T) {
+	tests := []struct {
+		status  BillStatus
+		wantErr error
+	}{
+		{BillOpen, nil},
+		{BillGrace, nil},
+		{BillCharging, nil},
+		{BillSettled, ErrBillFinal},
+		{BillCanceled, ErrBillFinal},
+		{BillExpired, ErrBillFinal},
+		{BillFailed, ErrBillFinal},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.status), func(t *testing.T) {
+			b := &Bill{Status: tc.status}
+			err := b.AddNote(Note{Author: "agent-7", Text: "called the customer"})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("AddNote() error = %v; want %v", err, tc.wantErr)
+			}
+			wantNotes := 1
+			if tc.wantErr != nil {
+				wantNotes = 0
+			}
+			if len(b.Notes) != wantNotes {
+				t.Errorf("bill has %d notes; want %d", len(b.Notes), wantNotes)
+			}
+		})
+	}
+}
+
+func TestAddNote_Limit(t *testing.T) {
+	b := &Bill{Status: BillOpen}
+	for i := 0; i < maxNotes; i++ {
+		if err := b.AddNote(Note{Author: "agent-7", Text: "follow-up"}); err != nil {
+			t.Fatalf("note %d: %v", i+1, err)
+		}
+	}
+	if err := b.AddNote(Note{Author: "agent-7", Text: "one too many"}); !errors.Is(err, ErrTooManyNotes) {
+		t.Errorf("AddNote() error = %v; want %v", err, ErrTooManyNotes)
+	}
+}
@@ -0,0 +1,127 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"pave-fees-api/internal/currency"
+)
+
+// a line of a receipt, amounts are rendered in the bill currency
+type ReceiptLine struct {
+	ID         string         `json:"id"`
+	Name       string         `json:"name"`
+	Kind       LineItemKind   `json:"kind,omitempty"`
+	Status     LineItemStatus `json:"status"`
+	Quantity   int64          `json:"quantity,omitempty"`
+	UnitAmount string         `json:"unit_amount,omitempty"`
+	Amount     string         `json:"amount"`
+	// the item's metadata, as it was added
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// invoice of a bill with an outcome. the totals only count what was charged, lines that
+// failed or were canceled are listed with their status but don't add up
+type Receipt struct {
+	BillID   string            `json:"bill_id"`
+	Status   BillStatus        `json:"status"`
+	Currency currency.Currency `json:"currency"`
+	Lines    []ReceiptLine     `json:"lines"`
+	// charged items before discounts and tax
+	Subtotal  string `json:"subtotal"`
+	Discounts string `json:"discounts"`
+	Tax       string `json:"tax"`
+	// only set when the bill was charged with a tip
+	Tip   string `json:"tip,omitempty"`
+	Total string `json:"total"`
+	// refunded after settlement, not deducted from the total
+	Refunded string `json:"refunded,omitempty"`
+	// when a settled or partially settled bill settled
+	SettledAt *time.Time `json:"settled_at,omitempty"`
+	// notes support agents attached to the bill, oldest first
+	Notes []Note `json:"notes,omitempty"`
+}
+
+// the receipt of a bill with an outcome, conflicts while the bill is still open or charging
+//
+//encore:api public method=GET path=/bills/:id/receipt
+func (s *Service) GetReceipt(ctx context.Context, id string) (*Receipt, error) {
+	qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+	if err != nil {
+		return nil, errNotFound(id)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		return nil, errInternal("failed to query bill", err)
+	}
+	if !bill.Status.Terminal() {
+		return nil, errBillNotFinal(bill.Status)
+	}
+
+	// the settlement time is the bill's last status change
+	qr, err = s.temporalClient.QueryWorkflow(ctx, id, "", QueryEvents)
+	if err != nil {
+		return nil, errInternal("failed to query bill events", err)
+	}
+	var events []BillEvent
+	if err := qr.Get(&events); err != nil {
+		return nil, errInternal("failed to query bill events", err)
+	}
+	r := newReceipt(bill, events)
+	return &r, nil
+}
+
+func newReceipt(bill Bill, events []BillEvent) Receipt {
+	cur := bill.Currency
+	r := Receipt{BillID: bill.ID, Status: bill.Status, Currency: cur, Lines: make([]ReceiptLine, 0, len(bill.Items))}
+	var subtotal, discounts, tax, tip int64
+	for _, it := range bill.Items {
+		line := ReceiptLine{ID: it.ID, Name: it.Name, Kind: it.Kind, Status: it.Status, Quantity: it.Quantity, Amount: cur.Format(it.Amount), Metadata: it.Metadata}
+		if it.Quantity > 1 {
+			line.UnitAmount = cur.Format(it.UnitAmount)
+		}
+		r.Lines = append(r.Lines, line)
+
+		// items refunded after settlement were charged, the refund is listed on its own
+		if it.Status != ItemCharged && it.Status != ItemRefunded {
+			continue
+		}
+		switch {
+		case it.IsDiscount():
+			discounts += it.Amount
+		case it.ID == TaxItemID:
+			tax += it.Amount
+		case it.ID == TipItemID:
+			tip += it.Amount
+		default:
+			subtotal += it.Amount
+		}
+	}
+	r.Subtotal = cur.Format(subtotal)
+	r.Discounts = cur.Format(discounts)
+	r.Tax = cur.Format(tax)
+	if tip > 0 {
+		r.Tip = cur.Format(tip)
+	}
+	r.Total = cur.Format(subtotal - discounts + tax + tip)
+	if bill.RefundedTotal > 0 {
+		r.Refunded = cur.Format(bill.RefundedTotal)
+	}
+	r.Notes = append([]Note(nil), bill.Notes...)
+
+	switch {
+	case bill.SettledAt != nil:
+		at := *bill.SettledAt
+		r.SettledAt = &at
+	// bills started before they kept their settlement time, it is their last status change
+	case bill.Status == BillSettled || bill.Status == BillPartiallySettled:
+		for i := len(events) - 1; i >= 0; i-- {
+			if e := events[i]; e.Type == EventStatusChanged && e.Detail == string(bill.Status) {
+				at := e.At
+				r.SettledAt = &at
+				break
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,99 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/mocks"
+)
+
+// a client whose workflow answers the bill and events queries with the given values
+func receiptClient(t *testing.T, bill Bill, events []BillEvent) *mocks.Client {
+	c := mocks.NewClient(t)
+	billVal := mocks.NewEncodedValue(t)
+	billVal.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*Bill) = bill
+	}).Return(nil)
+	c.On("QueryWorkflow", mock.Anything, "b1", "", QueryBill).Return(billVal, nil)
+
+	eventsVal := mocks.NewEncodedValue(t)
+	eventsVal.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*[]BillEvent) = events
+	}).Return(nil).Maybe()
+	c.On("QueryWorkflow", mock.Anything, "b1", "", QueryEvents).Return(eventsVal, nil).Maybe()
+	return c
+}
+
+func TestGetReceipt_Settled(t *testing.T) {
+	settledAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	bill := Bill{ID: "b1", Status: BillSettled, Currency: currency.USD, Items: []LineItem{
+		{ID: "a1", Name: "Book", Amount: 3000, Quantity: 2, UnitAmount: 1500, Status: ItemCharged, Metadata: map[string]string{"sku": "BK-1"}},
+		{ID: "b2", Name: "Pen", Amount: 500, Quantity: 1, UnitAmount: 500, Status: ItemRefunded},
+		{ID: "promo", Name: "Promo", Amount: 300, Kind: KindDiscount, Status: ItemCharged},
+		{ID: TaxItemID, Name: "Tax", Amount: 320, Status: ItemCharged},
+	}, RefundedTotal: 500, Notes: []Note{{Author: "agent-1", Text: "customer asked for a paper copy", At: settledAt.Add(-time.Minute)}}}
+	events := []BillEvent{
+		{Type: EventCreated, At: settledAt.Add(-time.Hour)},
+		{Type: EventStatusChanged, Detail: string(BillSettled), At: settledAt},
+		{Type: EventItemRefunded, Detail: "b2", At: settledAt.Add(time.Hour)},
+	}
+	svc := &Service{temporalClient: receiptClient(t, bill, events)}
+
+	r, err := svc.GetReceipt(context.Background(), "b1")
+	if err != nil {
+		t.Fatalf("GetReceipt returned error: %v", err)
+	}
+	if r.Subtotal != "$35.00" || r.Discounts != "$3.00" || r.Tax != "$3.20" || r.Total != "$35.20" || r.Refunded != "$5.00" {
+		t.Errorf("totals = %s - %s + %s = %s, refunded %s; want $35.00 - $3.00 + $3.20 = $35.20, refunded $5.00",
+			r.Subtotal, r.Discounts, r.Tax, r.Total, r.Refunded)
+	}
+	if len(r.Lines) != 4 || r.Lines[0].Amount != "$30.00" || r.Lines[0].UnitAmount != "$15.00" || r.Lines[1].UnitAmount != "" {
+		t.Errorf("lines = %+v, want 4 with the quantity line priced per unit", r.Lines)
+	}
+	if r.Lines[0].Metadata["sku"] != "BK-1" {
+		t.Errorf("line metadata = %v, want the item's sku", r.Lines[0].Metadata)
+	}
+	if r.SettledAt == nil || !r.SettledAt.Equal(settledAt) {
+		t.Errorf("settled at = %v, want %v", r.SettledAt, settledAt)
+	}
+	if len(r.Notes) != 1 || r.Notes[0].Author != "agent-1" {
+		t.Errorf("notes = %+v, want the bill's note", r.Notes)
+	}
+}
+
+func TestGetReceipt_OpenBillRejected(t *testing.T) {
+	bill := Bill{ID: "b1", Status: BillOpen, Currency: currency.USD, Items: []LineItem{
+		{ID: "a1", Name: "Book", Amount: 1500, Status: ItemPending},
+	}}
+	svc := &Service{temporalClient: receiptClient(t, bill, nil)}
+
+	_, err := svc.GetReceipt(context.Background(), "b1")
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.Aborted {
+		t.Fatalf("expected Aborted error, got %v", err)
+	}
+	if d, ok := e.Details.(ErrorDetails); !ok || d.Reason != ReasonBillNotFinal || d.Status != BillOpen {
+		t.Errorf("details = %+v, want BILL_NOT_FINAL for an OPEN bill", e.Details)
+	}
+}
+
+func TestNewReceipt_BillSettledAt(t *testing.T) {
+	settledAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	bill := Bill{ID: "b1", Status: BillRefunded, Currency: currency.USD, SettledAt: &settledAt, Items: []LineItem{
+		{ID: "a1", Name: "Book", Amount: 1500, Status: ItemRefunded},
+	}, RefundedTotal: 1500}
+	// the refund is the last status change, the bill's own settlement time wins
+	events := []BillEvent{{Type: EventStatusChanged, Detail: string(BillRefunded), At: settledAt.Add(time.Hour)}}
+
+	r := newReceipt(bill, events)
+	if r.SettledAt == nil || !r.SettledAt.Equal(settledAt) {
+		t.Errorf("settled at = %v, want %v", r.SettledAt, settledAt)
+	}
+}
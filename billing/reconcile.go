@@ -0,0 +1,195 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"pave-fees-api/account"
+	"pave-fees-api/internal/currency"
+
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/api/workflowservice/v1"
+)
+
+type ReconcileParams struct {
+	Currency string `query:"currency"`
+	// the account whose ledger is compared, defaults to DefaultAccountID
+	AccountID string `query:"account_id"`
+}
+
+// a bill whose net total doesn't match what the ledger moved for it, amounts in minor units of the account currency
+type Discrepancy struct {
+	BillID string     `json:"bill_id"`
+	Status BillStatus `json:"status"`
+	Billed int64      `json:"billed"`
+	Ledger int64      `json:"ledger"`
+}
+
+type ReconcileResponse struct {
+	Currency  currency.Currency `json:"currency"`
+	AccountID string            `json:"account_id"`
+	// the account's balance, it also holds top-ups and withdrawals that no bill made
+	Balance int64 `json:"balance"`
+	// bills compared, the sum of their net totals and the net debits the ledger holds for them
+	Bills       int   `json:"bills"`
+	BilledTotal int64 `json:"billed_total"`
+	LedgerTotal int64 `json:"ledger_total"`
+	// LedgerTotal - BilledTotal, zero when the books match
+	Difference    int64         `json:"difference"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	// bills left out because their funds are still moving, they were converted from another currency
+	// or they couldn't be queried
+	Skipped []string `json:"skipped"`
+}
+
+// statuses of bills whose funds were taken from the account
+var reconciledStatuses = []BillStatus{BillSettled, BillPartiallySettled, BillRefunded, BillSettledCreditPending}
+
+// compares the net totals of the bills that debited an account in a currency with the ledger entries they left.
+// visibility lags behind the workflows, so bills are taken from both the visibility listing and the refs of the
+// ledger, and each of them is queried for its current state. read-only
+//
+//encore:api public method=GET path=/reconcile
+func (s *Service) Reconcile(ctx context.Context, p ReconcileParams) (*ReconcileResponse, error) {
+	cur, err := currency.Parse(p.Currency)
+	if err != nil {
+		return nil, errInvalid("currency", err.Error())
+	}
+	accountID := strings.TrimSpace(p.AccountID)
+	if accountID == "" {
+		accountID = DefaultAccountID
+	}
+
+	// net debits per ref, debits count up and credits down
+	txns, err := account.GetTransactions(ctx, string(cur), &account.TransactionsParams{AccountID: accountID})
+	if err != nil {
+		return nil, errInternal("failed to read the ledger", err)
+	}
+	ledger := make(map[string]int64)
+	for _, txn := range txns.Transactions {
+		if txn.Ref == "" {
+			continue
+		}
+		if txn.Kind == account.TxnDebit {
+			ledger[txn.Ref] += txn.Amount
+		} else {
+			ledger[txn.Ref] -= txn.Amount
+		}
+	}
+	bal, err := account.GetBalance(ctx, string(cur), &account.BalanceParams{AccountID: accountID})
+	if err != nil {
+		return nil, errInternal("failed to read the balance", err)
+	}
+
+	listed, err := s.listReconciledBills(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(listed)+len(ledger))
+	var ids []string
+	for _, id := range listed {
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	for ref := range ledger {
+		if !seen[ref] {
+			ids = append(ids, ref)
+		}
+	}
+	slices.Sort(ids)
+
+	resp := &ReconcileResponse{
+		Currency:      cur,
+		AccountID:     accountID,
+		Balance:       bal.Balance,
+		Discrepancies: []Discrepancy{},
+		Skipped:       []string{},
+	}
+	for _, id := range ids {
+		_, moved := ledger[id]
+		qr, err := s.temporalClient.QueryWorkflow(ctx, id, "", QueryBill)
+		var bill Bill
+		if err == nil {
+			err = qr.Get(&bill)
+		}
+		if err != nil {
+			// refs of entries no bill made, e.g. sweeps, don't name a workflow
+			var notFound *serviceerror.NotFound
+			if !errors.As(err, &notFound) {
+				resp.Skipped = append(resp.Skipped, id)
+			}
+			continue
+		}
+		if bill.AccountID != accountID {
+			continue
+		}
+		billed, ok := reconciledAmount(&bill, cur)
+		if !ok {
+			resp.Skipped = append(resp.Skipped, id)
+			continue
+		}
+		if billed == 0 && !moved {
+			continue
+		}
+		resp.Bills++
+		resp.BilledTotal += billed
+		resp.LedgerTotal += ledger[id]
+		if billed != ledger[id] {
+			resp.Discrepancies = append(resp.Discrepancies, Discrepancy{BillID: id, Status: bill.Status, Billed: billed, Ledger: ledger[id]})
+		}
+	}
+	resp.Difference = resp.LedgerTotal - resp.BilledTotal
+	return resp, nil
+}
+
+// IDs of the bills visibility lists as having taken funds, in any currency since it isn't indexed
+func (s *Service) listReconciledBills(ctx context.Context) ([]string, error) {
+	statuses := make([]string, len(reconciledStatuses))
+	for i, st := range reconciledStatuses {
+		statuses[i] = "'" + string(st) + "'"
+	}
+	// not filtered by task queue, bills from before the queues were split run on the legacy one
+	query := fmt.Sprintf("WorkflowType IN ('BillWorkflow', 'ScheduledBillWorkflow') AND %s IN (%s)",
+		billStatusKey.GetName(), strings.Join(statuses, ", "))
+
+	var ids []string
+	var pageToken []byte
+	for {
+		resp, err := s.temporalClient.ListWorkflow(ctx, &workflowservice.ListWorkflowExecutionsRequest{
+			Query:         query,
+			NextPageToken: pageToken,
+		})
+		if err != nil {
+			return nil, errInternal("failed to list bills", err)
+		}
+		for _, exec := range resp.GetExecutions() {
+			ids = append(ids, exec.GetExecution().GetWorkflowId())
+		}
+		pageToken = resp.GetNextPageToken()
+		if len(pageToken) == 0 {
+			return ids, nil
+		}
+	}
+}
+
+// what the bill says the account paid in cur. false when it can't be compared: the bill is still charging or
+// crediting a refund, or it was converted from another currency and each conversion rounded on its own
+func reconciledAmount(bill *Bill, cur currency.Currency) (int64, bool) {
+	if bill.AccountCurrency != cur {
+		// debits another currency, so nothing should be in this ledger
+		return 0, true
+	}
+	switch bill.Status {
+	case BillCharging, BillSettledCreditPending:
+		return 0, false
+	case BillSettled, BillPartiallySettled, BillRefunded:
+		if bill.Currency != bill.AccountCurrency {
+			return 0, false
+		}
+		return bill.NetTotal, true
+	}
+	return 0, true
+}
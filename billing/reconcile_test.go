@@ -0,0 +1,148 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"pave-fees-api/account"
+	"pave-fees-api/internal/currency"
+
+	"encore.dev/beta/errs"
+
+	"github.com/stretchr/testify/mock"
+	commonpb "go.temporal.io/api/common/v1"
+	"go.temporal.io/api/serviceerror"
+	workflowpb "go.temporal.io/api/workflow/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/mocks"
+)
+
+// a client whose visibility lists the listed bills and whose queries return bills, unknown IDs aren't found
+func reconcileClient(t *testing.T, listed []string, bills map[string]Bill) *mocks.Client {
+	c := mocks.NewClient(t)
+	var execs []*workflowpb.WorkflowExecutionInfo
+	for _, id := range listed {
+		execs = append(execs, &workflowpb.WorkflowExecutionInfo{Execution: &commonpb.WorkflowExecution{WorkflowId: id}})
+	}
+	c.On("ListWorkflow", mock.Anything, mock.Anything).Return(&workflowservice.ListWorkflowExecutionsResponse{Executions: execs}, nil)
+	c.On("QueryWorkflow", mock.Anything, mock.Anything, "", QueryBill).Return(func(_ context.Context, id, _, _ string, _ ...interface{}) (converter.EncodedValue, error) {
+		bill, ok := bills[id]
+		if !ok {
+			return nil, serviceerror.NewNotFound("workflow not found")
+		}
+		val := mocks.NewEncodedValue(t)
+		val.On("Get", mock.Anything).Run(func(args mock.Arguments) {
+			*args.Get(0).(*Bill) = bill
+		}).Return(nil)
+		return val, nil
+	}).Maybe()
+	return c
+}
+
+func TestReconcile_SettledBillsMatchBalance(t *testing.T) {
+	ctx := context.Background()
+	const acc = "reconcile-match"
+	if err := account.AddBalance(ctx, &account.AddBalanceParams{AccountID: acc, Currency: currency.USD, Amount: 10000}); err != nil {
+		t.Fatalf("AddBalance failed: %v", err)
+	}
+	for ref, amount := range map[string]int64{"rc-1": 1500, "rc-2": 2500, "rc-3": 700} {
+		if err := account.Deduct(ctx, &account.DeductParams{AccountID: acc, Currency: currency.USD, Amount: amount, Ref: ref}); err != nil {
+			t.Fatalf("Deduct failed: %v", err)
+		}
+	}
+	// a withdrawal isn't a bill
+	if err := account.Deduct(ctx, &account.DeductParams{AccountID: acc, Currency: currency.USD, Amount: 300, Ref: "payout"}); err != nil {
+		t.Fatalf("Deduct failed: %v", err)
+	}
+
+	settled := func(id string, status BillStatus, net int64) Bill {
+		return Bill{ID: id, Status: status, Currency: currency.USD, AccountID: acc, AccountCurrency: currency.USD, NetTotal: net}
+	}
+	bills := map[string]Bill{
+		"rc-1": settled("rc-1", BillSettled, 1500),
+		"rc-2": settled("rc-2", BillPartiallySettled, 2500),
+		// settled after visibility was last updated, so only the ledger knows it
+		"rc-3":     settled("rc-3", BillSettled, 700),
+		"rc-other": {ID: "rc-other", Status: BillSettled, Currency: currency.USD, AccountID: "someone-else", AccountCurrency: currency.USD, NetTotal: 900},
+	}
+	svc := &Service{temporalClient: reconcileClient(t, []string{"rc-1", "rc-2", "rc-other"}, bills)}
+
+	resp, err := svc.Reconcile(ctx, ReconcileParams{Currency: "usd", AccountID: acc})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if resp.Bills != 3 || resp.BilledTotal != 4700 || resp.LedgerTotal != 4700 || resp.Difference != 0 {
+		t.Errorf("reconciled %d bills, billed %d, ledger %d, difference %d; want 3 bills of 4700 and no difference",
+			resp.Bills, resp.BilledTotal, resp.LedgerTotal, resp.Difference)
+	}
+	if len(resp.Discrepancies) != 0 || len(resp.Skipped) != 0 {
+		t.Errorf("discrepancies = %+v, skipped = %v, want none", resp.Discrepancies, resp.Skipped)
+	}
+	// everything that left the account apart from the payout was billed
+	if resp.Balance != 10000-300-resp.BilledTotal {
+		t.Errorf("balance = %d, want %d", resp.Balance, 10000-300-resp.BilledTotal)
+	}
+}
+
+func TestReconcile_ReportsDiscrepancies(t *testing.T) {
+	ctx := context.Background()
+	const acc = "reconcile-mismatch"
+	if err := account.AddBalance(ctx, &account.AddBalanceParams{AccountID: acc, Currency: currency.USD, Amount: 10000}); err != nil {
+		t.Fatalf("AddBalance failed: %v", err)
+	}
+	// debited twice for the same bill
+	for range 2 {
+		if err := account.Deduct(ctx, &account.DeductParams{AccountID: acc, Currency: currency.USD, Amount: 1000, Ref: "rd-1"}); err != nil {
+			t.Fatalf("Deduct failed: %v", err)
+		}
+	}
+	// a refund credit that never reached the ledger
+	if err := account.Deduct(ctx, &account.DeductParams{AccountID: acc, Currency: currency.USD, Amount: 500, Ref: "rd-2"}); err != nil {
+		t.Fatalf("Deduct failed: %v", err)
+	}
+
+	bill := func(id string, status BillStatus, cur currency.Currency, net int64) Bill {
+		return Bill{ID: id, Status: status, Currency: cur, AccountID: acc, AccountCurrency: currency.USD, NetTotal: net}
+	}
+	bills := map[string]Bill{
+		"rd-1": bill("rd-1", BillSettled, currency.USD, 1000),
+		"rd-2": bill("rd-2", BillRefunded, currency.USD, 0),
+		// funds still moving or converted, so they can't be compared
+		"rd-3": bill("rd-3", BillSettledCreditPending, currency.USD, 400),
+		"rd-4": bill("rd-4", BillSettled, currency.EUR, 800),
+	}
+	svc := &Service{temporalClient: reconcileClient(t, []string{"rd-1", "rd-2", "rd-3", "rd-4"}, bills)}
+
+	resp, err := svc.Reconcile(ctx, ReconcileParams{Currency: "USD", AccountID: acc})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if resp.Bills != 2 || resp.BilledTotal != 1000 || resp.LedgerTotal != 2500 || resp.Difference != 1500 {
+		t.Errorf("reconciled %d bills, billed %d, ledger %d, difference %d; want 2 bills off by 1500",
+			resp.Bills, resp.BilledTotal, resp.LedgerTotal, resp.Difference)
+	}
+	want := []Discrepancy{
+		{BillID: "rd-1", Status: BillSettled, Billed: 1000, Ledger: 2000},
+		{BillID: "rd-2", Status: BillRefunded, Billed: 0, Ledger: 500},
+	}
+	if !slices.Equal(resp.Discrepancies, want) {
+		t.Errorf("discrepancies = %+v, want %+v", resp.Discrepancies, want)
+	}
+	if !slices.Equal(resp.Skipped, []string{"rd-3", "rd-4"}) {
+		t.Errorf("skipped = %v, want rd-3 and rd-4", resp.Skipped)
+	}
+}
+
+func TestReconcile_InvalidCurrency(t *testing.T) {
+	svc := &Service{temporalClient: mocks.NewClient(t)}
+	for _, cur := range []string{"", "XYZ"} {
+		_, err := svc.Reconcile(context.Background(), ReconcileParams{Currency: cur})
+		var e *errs.Error
+		if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+			t.Errorf("currency %q: expected InvalidArgument, got %v", cur, err)
+		}
+	}
+}
@@ -1,30 +1,236 @@
 package billing
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 	"time"
 
 	"pave-fees-api/internal/currency"
+	"pave-fees-api/internal/data"
 
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/converter"
 	"go.temporal.io/sdk/log"
 	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
-// query and signal types/names for the bill workflow
+// query and signal types/names for the bill workflow, see UpdateCommand for the update
 const (
-	SignalAddLineItem = "AddLineItem"
-	SignalChargeBill  = "ChargeBill"
-	SignalCancelBill  = "CancelBill"
-	QueryBill         = "QueryBill"
+	SignalAddLineItem    = "AddLineItem"
+	SignalRemoveLineItem = "RemoveLineItem"
+	SignalVoidItem       = "VoidItem"
+	SignalUpdateLineItem = "UpdateLineItem"
+	SignalChargeBill     = "ChargeBill"
+	SignalChargePartial  = "ChargePartial"
+	SignalCancelBill     = "CancelBill"
+	SignalCloseBill      = "CloseBill"
+	SignalRetryFailed    = "RetryFailed"
+	SignalExtendPeriod   = "ExtendPeriod"
+	SignalReopen         = "Reopen"
+	SignalRefundItem     = "RefundItem"
+	SignalRefundAll      = "RefundAll"
+	SignalForceExpire    = "ForceExpire"
+	SignalAdjust         = "Adjust"
+	SignalReassign       = "ReassignAccount"
+	SignalAddNote        = "AddNote"
+	QueryBill            = "QueryBill"
+	QueryItem            = "QueryItem"
+	QueryEvents          = "QueryEvents"
+	QueryStatus          = "QueryStatus"
+	QueryProgress        = "QueryProgress"
+	QueryRejectedItems   = "QueryRejectedItems"
+	QueryOptions         = "QueryOptions"
 )
 
-func BillWorkflow(ctx workflow.Context, billID string, cur currency.Currency, periodEnd time.Time) error {
+// how long a failed or compensated bill waits for a retry of its failed items before the workflow completes
+const retryWindow = 7 * 24 * time.Hour
+
+// how long after settlement charged items can be refunded
+const refundWindow = 30 * 24 * time.Hour
+
+// how long a refund credit that failed after its activity's retries waits before it is tried again,
+// doubled after every failed attempt up to the maximum
+const (
+	creditRetryInterval    = time.Minute
+	maxCreditRetryInterval = time.Hour
+)
+
+// a charge attempt that hasn't heartbeated for this long is considered stuck and retried
+const chargeHeartbeatTimeout = 10 * time.Second
+
+// how many items of a bill are charged at once unless the bill sets its own limit
+const defaultMaxConcurrentCharges = 20
+
+// the order a bill's items are charged in. parallel charges them all at once, the others one at a time
+// sorted by amount, so an account that can't cover every item pays for the largest or smallest ones first
+type ChargeStrategy string
+
+const (
+	ChargeParallel      ChargeStrategy = "PARALLEL"
+	ChargeLargestFirst  ChargeStrategy = "LARGEST_FIRST"
+	ChargeSmallestFirst ChargeStrategy = "SMALLEST_FIRST"
+)
+
+// reports whether s is one of the known charge strategies
+func (s ChargeStrategy) Valid() bool {
+	switch s {
+	case ChargeParallel, ChargeLargestFirst, ChargeSmallestFirst:
+		return true
+	default:
+		return false
+	}
+}
+
+// how the bill's items are charged, taken from its options
+type chargeConfig struct {
+	maxConcurrent int
+	strategy      ChargeStrategy
+	stopOnFailure bool
+}
+
+func newChargeConfig(opts BillOptions) chargeConfig {
+	cfg := chargeConfig{maxConcurrent: defaultMaxConcurrentCharges, strategy: ChargeParallel, stopOnFailure: opts.StopOnFailure}
+	if opts.MaxConcurrentCharges > 0 {
+		cfg.maxConcurrent = opts.MaxConcurrentCharges
+	}
+	if opts.ChargeStrategy != "" {
+		cfg.strategy = opts.ChargeStrategy
+	}
+	return cfg
+}
+
+// how long an expired bill can be reopened unless the bill sets its own grace period
+const defaultReopenGrace = 24 * time.Hour
+
+// cancel reason of bills auto-canceled for never getting an item
+const emptyCancelReason = "empty"
+
+// change IDs for workflow.GetVersion. each guards a change to the commands the bill workflow issues,
+// so histories recorded before the change replay the way they ran
+const (
+	versionRefundUnsettled      = "refund-unsettled-charges"
+	versionWakeOnItemExpiry     = "wake-on-item-expiry"
+	versionCheckedPartialSettle = "checked-partial-settle"
+	versionCheckAccountOnStart  = "check-account-on-start"
+	versionCatalogInValidator   = "catalog-in-validator"
+)
+
+// search attributes holding the bill status, total, account and whether it is archived, they have to be registered
+// in the temporal namespace (see registerSearchAttributes) so bills can be listed and filtered through visibility
+var (
+	billStatusKey   = temporal.NewSearchAttributeKeyKeyword("BillStatus")
+	billTotalKey    = temporal.NewSearchAttributeKeyInt64("BillTotal")
+	billArchivedKey = temporal.NewSearchAttributeKeyBool("BillArchived")
+	billAccountKey  = temporal.NewSearchAttributeKeyKeyword("BillAccount")
+	// "key:value" entries of the bill's labels
+	billLabelsKey = temporal.NewSearchAttributeKeyKeywordList("BillLabels")
+)
+
+// account debited by bills created without an account ID
+const DefaultAccountID = "default"
+
+// per-bill settings passed to the workflow at start, zero values keep the defaults
+type BillOptions struct {
+	// tax rate in basis points applied to the subtotal when charging begins
+	TaxRateBps float64 `json:"tax_rate_bps,omitempty"`
+	// the debited account, defaults to DefaultAccountID
+	AccountID string `json:"account_id,omitempty"`
+	// currency of the debited account, defaults to the bill currency
+	AccountCurrency currency.Currency `json:"account_currency,omitempty"`
+	// optional URL the final bill is POSTed to whenever the bill reaches a terminal status
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// attempts and per-attempt timeout of the bill's activities, default to 5 attempts and a minute
+	MaxChargeAttempts    int32 `json:"max_charge_attempts,omitempty"`
+	ChargeTimeoutSeconds int   `json:"charge_timeout_seconds,omitempty"`
+	// how many item charges run at once, defaults to defaultMaxConcurrentCharges
+	MaxConcurrentCharges int `json:"max_concurrent_charges,omitempty"`
+	// the order items are charged in, defaults to ChargeParallel
+	ChargeStrategy ChargeStrategy `json:"charge_strategy,omitempty"`
+	// with a sequential strategy, the items after the first failed one fail without being charged
+	StopOnFailure bool `json:"stop_on_failure,omitempty"`
+	// how long after expiry the bill can be reopened, defaults to a day
+	ReopenGraceSeconds int `json:"reopen_grace_seconds,omitempty"`
+	// cancels the bill if it still has no items this long after it started, zero never does
+	AutoCancelEmptySeconds int `json:"auto_cancel_empty_seconds,omitempty"`
+	// keeps the bill in BillGrace this long after the period end before it expires, zero expires it right away
+	GracePeriodSeconds int `json:"grace_period_seconds,omitempty"`
+	// overrides the currency's cap on what the bill can charge
+	MaxTotal int64 `json:"max_total,omitempty"`
+	// stored on the bill and indexed for grouping, see validateLabels
+	Labels map[string]string `json:"labels,omitempty"`
+	// items are checked against the product catalog before they are added, see ValidateItemActivity
+	CatalogOnly bool `json:"catalog_only,omitempty"`
+	// the expiry timer begins the charge instead, the bill goes into grace or expires only when it can't be charged
+	AutoChargeOnExpiry bool `json:"auto_charge_on_expiry,omitempty"`
+	// how amounts converted to the account currency are rounded, defaults to half up
+	RoundingMode currency.RoundingMode `json:"rounding_mode,omitempty"`
+	// items the bill starts with, added before any signal is handled. they aren't passed on to continued runs,
+	// which carry them on the bill
+	Items []LineItem `json:"items,omitempty"`
+	// the bill whose items this one took over, see Bill.Split
+	SplitFrom string `json:"split_from,omitempty"`
+}
+
+// result of the QueryStatus query, what a poller of the bill needs without its items
+type BillStatusResult struct {
+	Status       BillStatus `json:"status"`
+	Total        int64      `json:"total"`
+	PendingCount int        `json:"pending_count"`
+}
+
+// result of the QueryItem query, Found is false when the bill has no item with the requested ID
+type ItemQueryResult struct {
+	Item  LineItem `json:"item"`
+	Found bool     `json:"found"`
+}
+
+// an open bill with no items yet
+func newBill(billID string, cur currency.Currency, opts BillOptions) *Bill {
+	return &Bill{ID: billID, Status: BillOpen, Currency: cur, TaxRateBps: opts.TaxRateBps, AccountID: opts.AccountID, AccountCurrency: opts.AccountCurrency, WebhookURL: opts.WebhookURL, MaxTotal: opts.MaxTotal, Labels: maps.Clone(opts.Labels), RoundingMode: opts.RoundingMode, SplitFrom: opts.SplitFrom}
+}
+
+// what every bill of a schedule starts from
+type BillTemplate struct {
+	Currency currency.Currency `json:"currency"`
+	Items    []LineItem        `json:"items"`
+	Options  BillOptions       `json:"options"`
+	// each bill's period end is this far from its start
+	PeriodSeconds int `json:"period_seconds"`
+}
+
+// ScheduledBillWorkflow is the action of bill schedules. schedules start every run with the same arguments,
+// so the bill takes the workflow ID temporal gives the run and its period end from the run's start time
+func ScheduledBillWorkflow(ctx workflow.Context, tmpl BillTemplate) error {
+	billID := workflow.GetInfo(ctx).WorkflowExecution.ID
+	bill := newBill(billID, tmpl.Currency, tmpl.Options)
+	for _, li := range tmpl.Items {
+		if err := bill.AddItem(li); err != nil {
+			return temporal.NewNonRetryableApplicationError("invalid bill template", ErrTypeInvalidTemplate, err)
+		}
+	}
+	periodEnd := workflow.Now(ctx).Add(time.Duration(tmpl.PeriodSeconds) * time.Second)
+	return BillWorkflow(ctx, billID, tmpl.Currency, periodEnd, tmpl.Options, bill)
+}
+
+// carried is the bill state handed over by a previous run through continue-as-new, nil on a fresh start
+func BillWorkflow(ctx workflow.Context, billID string, cur currency.Currency, periodEnd time.Time, opts BillOptions, carried *Bill) error {
 	logger := log.With(
 		workflow.GetLogger(ctx),
 		"bill_id", billID,
 		"currency", cur,
 	)
+	// set by CreateBill, so the bill's logs match the request that created it
+	if p, ok := workflow.GetInfo(ctx).Memo.GetFields()[correlationMemoKey]; ok {
+		var corrID string
+		if err := converter.GetDefaultDataConverter().FromPayload(p, &corrID); err == nil {
+			logger = log.With(logger, "correlation_id", corrID)
+		}
+	}
 
 	logger.Info("workflow started")
 
@@ -37,172 +243,1369 @@ func BillWorkflow(ctx workflow.Context, billID string, cur currency.Currency, pe
 			MaximumAttempts:    5,
 		},
 	}
+	if opts.MaxChargeAttempts > 0 {
+		ao.RetryPolicy.MaximumAttempts = opts.MaxChargeAttempts
+	}
+	if opts.ChargeTimeoutSeconds > 0 {
+		ao.StartToCloseTimeout = time.Duration(opts.ChargeTimeoutSeconds) * time.Second
+	}
 	ctx = workflow.WithActivityOptions(ctx, ao)
+	charging := newChargeConfig(opts)
 
-	bill := &Bill{ID: billID, Status: BillOpen, Currency: cur}
+	bill := newBill(billID, cur, opts)
+	if carried != nil {
+		bill = carried
+		// the item index isn't carried over, build it before the first signal looks an item up
+		bill.reindexItems()
+		logger.Info("resumed from previous run", "items", len(bill.Items), "total", bill.Currency.Format(bill.Total))
+	}
+	// a scheduled bill is carried into its first run too, only continued runs keep their creation time
+	if bill.CreatedAt.IsZero() {
+		bill.CreatedAt = workflow.Now(ctx).UTC()
+		bill.LastModifiedAt = bill.CreatedAt
+	}
+	if carried == nil {
+		recordEvent(ctx, bill, EventCreated, fmt.Sprintf("%s bill, period ends %s", cur, periodEnd.Format(time.RFC3339)))
+		for _, li := range opts.Items {
+			if err := bill.AddItem(li); err != nil {
+				return temporal.NewNonRetryableApplicationError("invalid initial items", ErrTypeInvalidTemplate, err)
+			}
+			recordEvent(ctx, bill, EventItemAdded, fmt.Sprintf("%s for %s", li.ID, cur.Format(li.Amount)))
+		}
+	}
+	opts.Items = nil
+	if bill.AccountID == "" {
+		bill.AccountID = DefaultAccountID
+	}
+	if bill.AccountCurrency == "" {
+		bill.AccountCurrency = cur
+	}
+	// the handlers validate the account too, but workflows can be started by other means.
+	// a run continued from a previous one was checked when the bill started
+	if workflow.GetInfo(ctx).ContinuedExecutionRunID == "" &&
+		workflow.GetVersion(ctx, versionCheckAccountOnStart, workflow.DefaultVersion, 1) == 1 {
+		if err := workflow.ExecuteActivity(ctx, CheckAccountActivity, bill.AccountID, bill.AccountCurrency).Get(ctx, nil); err != nil {
+			logger.Error("account check failed", "account_id", bill.AccountID, "err", err)
+			return err
+		}
+	}
+	upsertStatus(ctx, logger, bill)
 
 	// set a query handler to handle workflow queries
 	err := workflow.SetQueryHandler(ctx, QueryBill, func() (Bill, error) {
-		snapshot := append([]LineItem(nil), bill.Items...)
-		return Bill{
-			ID:       bill.ID,
-			Status:   bill.Status,
-			Currency: bill.Currency,
-			Total:    bill.Total,
-			Items:    snapshot,
-		}, nil
+		return bill.snapshot(), nil
+	})
+	if err != nil {
+		logger.Error("failed to register query handler", "err", err)
+		return err
+	}
+
+	// the item is returned as a copy, so charge coroutines can't mutate it after the query returns
+	// looked up through the item index, so polling an item doesn't scan a bill with thousands of them
+	err = workflow.SetQueryHandler(ctx, QueryItem, func(itemID string) (ItemQueryResult, error) {
+		i := bill.itemIndex(itemID)
+		if i < 0 {
+			return ItemQueryResult{}, nil
+		}
+		return ItemQueryResult{Item: bill.Items[i].clone(), Found: true}, nil
 	})
 	if err != nil {
 		logger.Error("failed to register query handler", "err", err)
 		return err
 	}
 
+	// answered from the bill in place, unlike QueryBill nothing is copied
+	err = workflow.SetQueryHandler(ctx, QueryStatus, func() (BillStatusResult, error) {
+		return BillStatusResult{Status: bill.Status, Total: bill.Total, PendingCount: bill.PendingCount()}, nil
+	})
+	if err != nil {
+		logger.Error("failed to register query handler", "err", err)
+		return err
+	}
+
+	// queries run on the workflow thread between coroutine steps, so charge coroutines can't
+	// change an item while the statuses are counted
+	err = workflow.SetQueryHandler(ctx, QueryProgress, func() (ChargeProgress, error) {
+		return bill.progress(), nil
+	})
+	if err != nil {
+		logger.Error("failed to register query handler", "err", err)
+		return err
+	}
+
+	err = workflow.SetQueryHandler(ctx, QueryEvents, func() ([]BillEvent, error) {
+		return append([]BillEvent{}, bill.Events...), nil
+	})
+	if err != nil {
+		logger.Error("failed to register query handler", "err", err)
+		return err
+	}
+
+	err = workflow.SetQueryHandler(ctx, QueryRejectedItems, func() ([]RejectedItem, error) {
+		return append([]RejectedItem{}, bill.RejectedItems...), nil
+	})
+	if err != nil {
+		logger.Error("failed to register query handler", "err", err)
+		return err
+	}
+
+	// the options the bill was started with, for bills that take over its items, see Service.SplitBill
+	err = workflow.SetQueryHandler(ctx, QueryOptions, func() (BillOptions, error) {
+		cp := opts
+		cp.Labels = maps.Clone(opts.Labels)
+		cp.Items = nil
+		return cp, nil
+	})
+	if err != nil {
+		logger.Error("failed to register query handler", "err", err)
+		return err
+	}
+
+	// the expiry timer, only ever derived from the absolute period end. with a grace period it first fires
+	// at the period end to move the bill into grace, then again once the grace period is over
+	gracePeriod := time.Duration(opts.GracePeriodSeconds) * time.Second
+	expiresAt := periodEnd
+	if bill.Status == BillGrace {
+		expiresAt = periodEnd.Add(gracePeriod)
+	}
+	timer, cancelTimer := expiryTimer(ctx, expiresAt)
+
+	// a bill that opts in is canceled when it is still empty after a while, the first item stops the timer
+	var emptyTimer workflow.Future
+	cancelEmptyTimer := func() {}
+	if opts.AutoCancelEmptySeconds > 0 && len(bill.Items) == 0 {
+		var emptyCtx workflow.Context
+		emptyCtx, cancelEmptyTimer = workflow.WithCancel(ctx)
+		emptyTimer = workflow.NewTimer(emptyCtx, time.Duration(opts.AutoCancelEmptySeconds)*time.Second)
+	}
+
+	// pending items with an expiry of their own are canceled by a timer at the earliest of them,
+	// it is replaced whenever that changes
+	var itemTimer workflow.Future
+	var itemTimerAt time.Time
+	cancelItemTimer := func() {}
+	// the Command update sends on it after adding an item with an expiry, so the selector re-arms the item timer
+	itemsChangedCh := workflow.NewBufferedChannel(ctx, 1)
+
+	// add, charge and cancel are shared by their signals and the Command update,
+	// each changes an open bill and fails without touching it otherwise
+	addItem := func(li LineItem) error {
+		if bill.Status == BillCharging {
+			if err := bill.StageItem(li); err != nil {
+				return err
+			}
+			recordEvent(ctx, bill, EventItemStaged, fmt.Sprintf("%s for %s", li.ID, cur.Format(li.Amount)))
+			logger.Info("item staged while charging", "item_id", li.ID, "amount", cur.Format(li.Amount))
+			return nil
+		}
+		if err := bill.AddItem(li); err != nil {
+			return err
+		}
+		// a resolved timer would make every later select return at once
+		cancelEmptyTimer()
+		emptyTimer = nil
+		recordEvent(ctx, bill, EventItemAdded, fmt.Sprintf("%s for %s", li.ID, cur.Format(li.Amount)))
+		logger.Info("item added", "item_id", li.ID, "amount", cur.Format(li.Amount), "new_total", cur.Format(bill.Total))
+		return nil
+	}
+	beginCharge := func(tipBps float64) error {
+		if err := bill.BeginChargeWithTip(tipBps); err != nil {
+			return err
+		}
+		cancelTimer()
+		recordEvent(ctx, bill, EventChargeStarted, "all pending items")
+		logger.Info("charge started")
+		return nil
+	}
+	cancelBill := func(reason string) error {
+		if err := bill.Cancel(reason); err != nil {
+			return err
+		}
+		cancelTimer()
+		logger.Info("bill canceled", "reason", reason)
+		return nil
+	}
+
+	// the split bills are started by the caller, the bill only gives up its items and records where they went
+	splitBill := func(groups, children map[string]string) error {
+		if _, err := bill.Split(groups, children); err != nil {
+			return err
+		}
+		cancelTimer()
+		into := make([]string, 0, len(children))
+		for _, g := range slices.Sorted(maps.Keys(children)) {
+			into = append(into, fmt.Sprintf("%s as %s", g, children[g]))
+		}
+		recordEvent(ctx, bill, EventSplit, strings.Join(into, ", "))
+		logger.Info("bill split", "bills", len(children))
+		return nil
+	}
+
+	// the validator rejects a command the bill can't take before it is written to history,
+	// a charge blocks until it settles so the caller gets back the final bill instead of an in-flight snapshot
+	err = workflow.SetUpdateHandlerWithOptions(ctx, UpdateCommand,
+		func(ctx workflow.Context, cmd Command) (CommandResult, error) {
+			var err error
+			switch cmd.Type {
+			case CommandAddItem:
+				// the validator checks the catalog, histories from before it did ran the check here
+				if opts.CatalogOnly && workflow.GetVersion(ctx, versionCatalogInValidator, workflow.DefaultVersion, 1) == workflow.DefaultVersion {
+					if err := checkCatalog(workflow.WithActivityOptions(ctx, ao), logger, bill, cmd.Item); err != nil {
+						if errors.Is(err, ErrUnknownProduct) {
+							return CommandResult{}, commandRejected(err.Error(), ErrorDetails{Reason: ReasonUnknownProduct, ItemID: cmd.Item.ID})
+						}
+						return CommandResult{}, err
+					}
+				}
+				err = addItem(cmd.Item)
+			case CommandCharge:
+				err = beginCharge(cmd.TipBps)
+			case CommandCancel:
+				err = cancelBill(cmd.Reason)
+			case CommandSplit:
+				err = splitBill(cmd.Groups, cmd.Children)
+			default:
+				err = fmt.Errorf("unknown command %q", cmd.Type)
+			}
+			// another update may have changed the bill since the validator passed this one
+			if err != nil {
+				return CommandResult{}, bill.rejectCommand(cmd, err)
+			}
+			// the selector only re-arms the item timer between signals, wake it for an item that expires
+			if cmd.Type == CommandAddItem && cmd.Item.ExpiresAt != nil &&
+				workflow.GetVersion(ctx, versionWakeOnItemExpiry, workflow.DefaultVersion, 1) == 1 {
+				itemsChangedCh.SendAsync(nil)
+			}
+
+			if cmd.Type == CommandCharge {
+				if err := workflow.Await(ctx, func() bool { return bill.Status != BillCharging }); err != nil {
+					return CommandResult{}, err
+				}
+			}
+			return CommandResult{Status: bill.Status, Bill: bill.snapshot()}, nil
+		},
+		workflow.UpdateHandlerOptions{
+			Validator: func(cmd Command) error {
+				if err := bill.validateCommand(cmd); err != nil {
+					return err
+				}
+				// looked up locally rather than by the activity signals go through, an activity would let other
+				// updates and signals change the bill between this check and the item being added
+				if cmd.Type == CommandAddItem && opts.CatalogOnly && !cmd.Item.IsDiscount() {
+					if _, ok := data.LookupProduct(cmd.Item.Name); !ok {
+						return commandRejected(ErrUnknownProduct.Error(), ErrorDetails{Reason: ReasonUnknownProduct, ItemID: cmd.Item.ID})
+					}
+				}
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		logger.Error("failed to register update handler", "err", err)
+		return err
+	}
+
 	// register signal channels to send data to running workflow
 	addCh := workflow.GetSignalChannel(ctx, SignalAddLineItem)
+	removeCh := workflow.GetSignalChannel(ctx, SignalRemoveLineItem)
+	voidCh := workflow.GetSignalChannel(ctx, SignalVoidItem)
+	updateCh := workflow.GetSignalChannel(ctx, SignalUpdateLineItem)
 	chargeCh := workflow.GetSignalChannel(ctx, SignalChargeBill)
+	partialCh := workflow.GetSignalChannel(ctx, SignalChargePartial)
 	cancelCh := workflow.GetSignalChannel(ctx, SignalCancelBill)
-
-	// create a timer ctx and set the timer for the workflow
-	timerCtx, cancelTimer := workflow.WithCancel(ctx)
-	timer := workflow.NewTimer(timerCtx, periodEnd.Sub(workflow.Now(ctx)))
+	closeCh := workflow.GetSignalChannel(ctx, SignalCloseBill)
+	retryCh := workflow.GetSignalChannel(ctx, SignalRetryFailed)
+	reopenCh := workflow.GetSignalChannel(ctx, SignalReopen)
+	refundCh := workflow.GetSignalChannel(ctx, SignalRefundItem)
+	refundAllCh := workflow.GetSignalChannel(ctx, SignalRefundAll)
+	extendCh := workflow.GetSignalChannel(ctx, SignalExtendPeriod)
+	forceExpireCh := workflow.GetSignalChannel(ctx, SignalForceExpire)
+	adjustCh := workflow.GetSignalChannel(ctx, SignalAdjust)
+	reassignCh := workflow.GetSignalChannel(ctx, SignalReassign)
+	noteCh := workflow.GetSignalChannel(ctx, SignalAddNote)
 
 	selector := workflow.NewSelector(ctx)
+	// set when the bill is closed, charged items are then kept even if others fail
+	closing := false
 
 	// register callback funcs for the channels and timer for an open bill
-	for bill.Status == BillOpen {
+	for bill.Status.Active() {
 		selector.
 			AddReceive(addCh, func(c workflow.ReceiveChannel, _ bool) {
 				var li LineItem
 				c.Receive(ctx, &li)
-				if err := bill.AddItem(li); err != nil {
-					logger.Warn("add-item ignored", "err", err)
+				if opts.CatalogOnly {
+					if err := checkCatalog(ctx, logger, bill, li); err != nil {
+						if !errors.Is(err, ErrUnknownProduct) {
+							rejectItem(ctx, logger, bill, li, err)
+						}
+						return
+					}
+				}
+				if err := addItem(li); err != nil {
+					rejectItem(ctx, logger, bill, li, err)
+				}
+			}).
+			AddReceive(removeCh, func(c workflow.ReceiveChannel, _ bool) {
+				var itemID string
+				c.Receive(ctx, &itemID)
+				if err := bill.RemoveItem(itemID); err != nil {
+					logger.Warn("remove-item ignored", "err", err)
 					return
 				}
-				logger.Info("item added", "item_id", li.ID, "amount", li.Amount, "new_total", bill.Total)
+				recordEvent(ctx, bill, EventItemRemoved, itemID)
+				logger.Info("item removed", "item_id", itemID, "new_total", cur.Format(bill.Total))
+			}).
+			AddReceive(voidCh, func(c workflow.ReceiveChannel, _ bool) {
+				var itemID string
+				c.Receive(ctx, &itemID)
+				if err := bill.VoidItem(itemID); err != nil {
+					logger.Warn("void-item ignored", "err", err)
+					return
+				}
+				recordEvent(ctx, bill, EventItemVoided, itemID)
+				logger.Info("item voided", "item_id", itemID, "new_total", cur.Format(bill.Total))
+			}).
+			AddReceive(updateCh, func(c workflow.ReceiveChannel, _ bool) {
+				var li LineItem
+				c.Receive(ctx, &li)
+				if err := bill.UpdateItem(li.ID, li.Amount, li.Name); err != nil {
+					logger.Warn("update-item ignored", "err", err)
+					return
+				}
+				recordEvent(ctx, bill, EventItemUpdated, fmt.Sprintf("%s to %s", li.ID, cur.Format(li.Amount)))
+				logger.Info("item updated", "item_id", li.ID, "amount", cur.Format(li.Amount), "new_total", cur.Format(bill.Total))
 			}).
 			AddReceive(chargeCh, func(c workflow.ReceiveChannel, _ bool) {
 				c.Receive(ctx, nil)
-				if err := bill.BeginCharge(); err != nil {
+				if err := beginCharge(0); err != nil {
 					logger.Warn("charge ignored", "err", err)
+				}
+			}).
+			AddReceive(partialCh, func(c workflow.ReceiveChannel, _ bool) {
+				var ids []string
+				c.Receive(ctx, &ids)
+				if err := bill.BeginPartialCharge(ids); err != nil {
+					logger.Warn("partial charge ignored", "err", err)
 					return
 				}
+				recordEvent(ctx, bill, EventChargeStarted, "items "+strings.Join(ids, ", "))
+				logger.Info("partial charge signal received", "item_ids", ids)
+				workflow.Go(ctx, func(c workflow.Context) {
+					chargeItems(c, logger, bill, ids, charging)
+					// nothing left to charge separately -> settle the bill the normal way, with the same checks as a charge
+					if bill.Status.Active() && bill.PendingCount() == 0 && bill.countItems(ItemCharging) == 0 {
+						// bills that got here before the checks were added moved to charging unchecked
+						if workflow.GetVersion(c, versionCheckedPartialSettle, workflow.DefaultVersion, 1) == workflow.DefaultVersion {
+							bill.ApplyTax()
+							bill.Status = BillCharging
+						} else if err := bill.BeginCharge(); err != nil {
+							logger.Warn("settle after partial charges skipped", "err", err)
+							return
+						}
+						cancelTimer()
+						recordEvent(ctx, bill, EventChargeStarted, "nothing left pending after partial charges")
+					}
+				})
+			}).
+			AddReceive(closeCh, func(c workflow.ReceiveChannel, _ bool) {
+				c.Receive(ctx, nil)
+				if err := bill.BeginCharge(); err != nil {
+					logger.Warn("close ignored", "err", err)
+					return
+				}
+				closing = true
 				cancelTimer()
-				logger.Info("charge signal received")
+				recordEvent(ctx, bill, EventChargeStarted, "bill closed")
+				logger.Info("close signal received")
 			}).
 			AddReceive(cancelCh, func(c workflow.ReceiveChannel, _ bool) {
-				c.Receive(ctx, nil)
-				if err := bill.Cancel(); err != nil {
+				var reason string
+				c.Receive(ctx, &reason)
+				if err := cancelBill(reason); err != nil {
 					logger.Warn("cancel ignored", "err", err)
+				}
+			}).
+			AddReceive(extendCh, func(c workflow.ReceiveChannel, _ bool) {
+				var raw string
+				c.Receive(ctx, &raw)
+				newEnd, err := time.Parse(time.RFC3339, raw)
+				if err != nil {
+					logger.Warn("extend ignored", "err", err)
 					return
 				}
+				if !newEnd.After(workflow.Now(ctx)) || !newEnd.After(periodEnd) {
+					logger.Warn("extend ignored, period end must be in the future and after the current one",
+						"period_end", periodEnd, "requested", newEnd)
+					return
+				}
+				// replace the expiry timer, the canceled one resolves with an error and is ignored below
+				cancelTimer()
+				periodEnd = newEnd.UTC()
+				timer, cancelTimer = expiryTimer(ctx, periodEnd)
+				recordEvent(ctx, bill, EventPeriodExtended, "period ends "+periodEnd.Format(time.RFC3339))
+				logger.Info("period extended", "period_end", periodEnd)
+				// the new period end is in the future, so a bill in grace is open again
+				if bill.Status == BillGrace {
+					bill.Status = BillOpen
+					upsertStatus(ctx, logger, bill)
+					recordEvent(ctx, bill, EventStatusChanged, string(BillOpen))
+				}
+			}).
+			AddReceive(reassignCh, func(c workflow.ReceiveChannel, _ bool) {
+				var accountID string
+				c.Receive(ctx, &accountID)
+				reassignAccount(ctx, logger, bill, accountID)
+			}).
+			AddReceive(noteCh, func(c workflow.ReceiveChannel, _ bool) {
+				var n Note
+				c.Receive(ctx, &n)
+				addNote(ctx, logger, bill, n)
+			}).
+			AddReceive(itemsChangedCh, func(c workflow.ReceiveChannel, _ bool) {
+				// nothing to do, the item timer is re-armed below before the next select
+				c.Receive(ctx, nil)
+			}).
+			AddReceive(forceExpireCh, func(c workflow.ReceiveChannel, _ bool) {
+				c.Receive(ctx, nil)
+				bill.Expire()
 				cancelTimer()
-				logger.Info("cancel signal received")
+				logger.Info("bill force-expired")
 			}).
-			AddFuture(timer, func(_ workflow.Future) {
+			AddFuture(timer, func(f workflow.Future) {
+				// the timer is canceled when a charge or cancel moves the bill out of the open state.
+				// the selector keeps the cases of earlier iterations, so a timer replaced by the grace timer fires here again
+				if err := f.Get(ctx, nil); err != nil || f != timer {
+					return
+				}
+				if opts.AutoChargeOnExpiry {
+					err := beginCharge(0)
+					if err == nil {
+						logger.Info("bill charged at period end")
+						return
+					}
+					logger.Info("auto-charge skipped", "err", err)
+				}
+				if bill.Status == BillOpen && gracePeriod > 0 {
+					bill.Status = BillGrace
+					timer, cancelTimer = expiryTimer(ctx, periodEnd.Add(gracePeriod))
+					upsertStatus(ctx, logger, bill)
+					recordEvent(ctx, bill, EventStatusChanged, string(BillGrace))
+					logger.Info("bill in grace period", "expires_at", periodEnd.Add(gracePeriod))
+					return
+				}
 				bill.Expire()
 				logger.Info("bill expired")
 			})
+		if emptyTimer != nil {
+			selector.AddFuture(emptyTimer, func(f workflow.Future) {
+				// canceled once the first item was added
+				if err := f.Get(ctx, nil); err != nil || len(bill.Items) > 0 {
+					return
+				}
+				if err := bill.Cancel(emptyCancelReason); err != nil {
+					logger.Warn("auto-cancel ignored", "err", err)
+					return
+				}
+				cancelTimer()
+				logger.Info("empty bill canceled")
+			})
+		}
+
+		if next, ok := bill.nextItemExpiry(); !ok || !next.Equal(itemTimerAt) {
+			cancelItemTimer()
+			itemTimer, itemTimerAt = nil, time.Time{}
+			if ok {
+				var itemCtx workflow.Context
+				itemCtx, cancelItemTimer = workflow.WithCancel(ctx)
+				itemTimer, itemTimerAt = workflow.NewTimer(itemCtx, max(0, next.Sub(workflow.Now(ctx)))), next
+				selector.AddFuture(itemTimer, func(f workflow.Future) {
+					// a replaced timer resolves canceled
+					if err := f.Get(ctx, nil); err != nil || f != itemTimer {
+						return
+					}
+					itemTimer, itemTimerAt = nil, time.Time{}
+					for _, id := range bill.ExpireItems(workflow.Now(ctx)) {
+						recordEvent(ctx, bill, EventItemExpired, id)
+						logger.Info("item expired", "item_id", id, "new_total", cur.Format(bill.Total))
+					}
+				})
+			}
+		}
 
 		selector.Select(ctx)
+
+		// long-lived bills hand their state over to a fresh run before the history grows too large,
+		// in-flight partial charges and updates have to finish first
+		if bill.Status.Active() && workflow.GetInfo(ctx).GetContinueAsNewSuggested() &&
+			bill.countItems(ItemCharging) == 0 && workflow.AllHandlersFinished(ctx) {
+			// process buffered signals so none are lost with this run
+			for selector.HasPending() {
+				selector.Select(ctx)
+			}
+			if bill.Status.Active() && bill.countItems(ItemCharging) == 0 {
+				logger.Info("continuing as new", "items", len(bill.Items), "total", cur.Format(bill.Total))
+				return workflow.NewContinueAsNewError(ctx, BillWorkflow, billID, cur, periodEnd, opts, bill)
+			}
+		}
+	}
+	cancelEmptyTimer()
+	cancelItemTimer()
+	upsertStatus(ctx, logger, bill)
+	if bill.Status != BillCharging {
+		recordEvent(ctx, bill, EventStatusChanged, string(bill.Status))
 	}
 
 	// switch on bill status
 	switch bill.Status {
 	case BillCanceled, BillExpired:
-		// workflow finished
+		// let in-flight partial charges record their outcome before the workflow finishes
+		if err := workflow.Await(ctx, func() bool { return bill.countItems(ItemCharging) == 0 }); err != nil {
+			return err
+		}
+		if bill.Status != BillExpired {
+			refundUnsettled(ctx, logger, bill)
+			reportOutcome(ctx, logger, bill)
+			archive(ctx, logger, bill)
+			return nil
+		}
+		reportOutcome(ctx, logger, bill)
+		grace := defaultReopenGrace
+		if opts.ReopenGraceSeconds > 0 {
+			grace = time.Duration(opts.ReopenGraceSeconds) * time.Second
+		}
+		// a reopened bill continues in a fresh run with the new period end and its expired items pending again
+		if newEnd, ok := awaitReopen(ctx, logger, reopenCh, grace); ok {
+			if err := bill.Reopen(); err != nil {
+				return err
+			}
+			recordEvent(ctx, bill, EventReopened, "period ends "+newEnd.Format(time.RFC3339))
+			logger.Info("bill reopened", "period_end", newEnd, "items", bill.PendingCount())
+			return workflow.NewContinueAsNewError(ctx, BillWorkflow, billID, cur, newEnd, opts, bill)
+		}
+		refundUnsettled(ctx, logger, bill)
+		archive(ctx, logger, bill)
 		return nil
 	case BillCharging:
-		// 1) charge all pending items asynchronously in their own separate coroutines
-		chargeWG := workflow.NewWaitGroup(ctx)
-		for i := range bill.Items {
-			item := &bill.Items[i]
-			if item.Status != ItemPending {
-				// charge only pending items
+		// the open loop no longer reads added items, they are staged while charging and rejected after
+		workflow.Go(ctx, func(ctx workflow.Context) {
+			for {
+				var li LineItem
+				addCh.Receive(ctx, &li)
+				if err := addItem(li); err != nil {
+					rejectItem(ctx, logger, bill, li, err)
+				}
+			}
+		})
+		// notes are taken until the charge has an outcome
+		workflow.Go(ctx, func(ctx workflow.Context) {
+			for {
+				var n Note
+				noteCh.Receive(ctx, &n)
+				addNote(ctx, logger, bill, n)
+			}
+		})
+		err := chargeBill(ctx, logger, bill, closing, charging, forceExpireCh)
+		settleStaged(logger, bill)
+		upsertStatus(ctx, logger, bill)
+		recordEvent(ctx, bill, EventStatusChanged, string(bill.Status))
+		reportOutcome(ctx, logger, bill)
+		// failed and compensated bills can have their failed items retried within the retry window
+		// a bill compensated for a failed debit has no failed items and nothing to retry
+		for (bill.Status == BillFailed || bill.Status == BillCompensated) && bill.countItems(ItemFailed) > 0 && awaitRetry(ctx, retryCh) {
+			if retryErr := bill.BeginRetry(); retryErr != nil {
+				logger.Warn("retry ignored", "err", retryErr)
 				continue
 			}
-			chargeWG.Add(1)
-			workflow.Go(ctx, func(c workflow.Context) {
-				defer chargeWG.Done()
-				err := workflow.ExecuteActivity(c, ChargeLineItemActivity, *item).Get(c, nil)
-
-				if err != nil {
-					item.Status = ItemFailed
-					logger.Warn("item charge failed", "item_id", item.ID, "attempts_exhausted", true, "err", err)
-				} else {
-					item.Status = ItemCharged
-					logger.Info("item charged", "item_id", item.ID, "amount", item.Amount)
+			recordEvent(ctx, bill, EventChargeStarted, fmt.Sprintf("retry of %d failed items", bill.PendingCount()))
+			logger.Info("retry signal received", "items", bill.PendingCount())
+			err = chargeBill(ctx, logger, bill, false, charging, forceExpireCh)
+			settleStaged(logger, bill)
+			upsertStatus(ctx, logger, bill)
+			recordEvent(ctx, bill, EventStatusChanged, string(bill.Status))
+			reportOutcome(ctx, logger, bill)
+		}
+		// a settled bill can have single charged items or the whole bill refunded and be adjusted within the refund window
+		if bill.Status == BillSettled {
+			// drop adjustments and full refunds signalled before the bill settled, they were never valid
+			var early Adjustment
+			for adjustCh.ReceiveAsync(&early) {
+				logger.Warn("adjustment ignored, the bill was not settled yet", "adjustment_id", early.ID)
+			}
+			for refundAllCh.ReceiveAsync(nil) {
+				logger.Warn("full refund ignored, the bill was not settled yet")
+			}
+			refundDeadline := workflow.Now(ctx).Add(refundWindow)
+			for bill.Status == BillSettled {
+				change, ok := awaitSettledChange(ctx, refundCh, refundAllCh, adjustCh, refundDeadline)
+				if !ok {
+					break
 				}
-			})
+				switch {
+				case change.adj != nil:
+					adjustBill(ctx, logger, bill, *change.adj)
+				case change.refundAll:
+					refundAll(ctx, logger, bill)
+				default:
+					refundItem(ctx, logger, bill, change.itemID)
+				}
+			}
 		}
-		chargeWG.Wait(ctx)
+		// let a pending charge command read the final state before the workflow completes
+		if awaitErr := workflow.Await(ctx, func() bool { return workflow.AllHandlersFinished(ctx) }); awaitErr != nil {
+			return awaitErr
+		}
+		archive(ctx, logger, bill)
+		return err
+	default:
+		logger.Error("unexpected status after selector", "status", bill.Status)
+		return temporal.NewNonRetryableApplicationError("invalid state", ErrTypeInvalidState, nil)
+	}
+}
 
-		// 2) count charge failures
-		failedCount := 0
+// a timer firing at periodEnd. the duration is worked out from the workflow clock each time a run starts,
+// so a run continued as new keeps the original expiry instead of restarting a stored duration, and replays
+// see the same duration the first execution recorded. a period end already past fires right away
+func expiryTimer(ctx workflow.Context, periodEnd time.Time) (workflow.Future, workflow.CancelFunc) {
+	timerCtx, cancel := workflow.WithCancel(ctx)
+	return workflow.NewTimer(timerCtx, periodEnd.Sub(workflow.Now(ctx))), cancel
+}
+
+// wait for a reopen signal with a valid period end until the grace period closes,
+// reports whether one was received and the period end it carried
+func awaitReopen(ctx workflow.Context, logger log.Logger, reopenCh workflow.ReceiveChannel, grace time.Duration) (time.Time, bool) {
+	// drop reopens signalled before the bill expired, they were never valid
+	for reopenCh.ReceiveAsync(nil) {
+	}
+
+	timerCtx, cancelTimer := workflow.WithCancel(ctx)
+	defer cancelTimer()
+	graceTimer := workflow.NewTimer(timerCtx, grace)
+
+	for {
+		var (
+			raw     string
+			expired bool
+		)
+		workflow.NewSelector(ctx).
+			AddReceive(reopenCh, func(c workflow.ReceiveChannel, _ bool) {
+				c.Receive(ctx, &raw)
+			}).
+			AddFuture(graceTimer, func(_ workflow.Future) {
+				expired = true
+			}).
+			Select(ctx)
+		if expired {
+			return time.Time{}, false
+		}
+		newEnd, err := time.Parse(time.RFC3339, raw)
+		if err != nil || !newEnd.After(workflow.Now(ctx)) {
+			logger.Warn("reopen ignored, period end must be a future RFC3339 time", "requested", raw)
+			continue
+		}
+		return newEnd.UTC(), true
+	}
+}
+
+// a change requested to a settled bill, the item to refund, a refund of the whole bill or an adjustment
+type settledChange struct {
+	itemID    string
+	refundAll bool
+	adj       *Adjustment
+}
+
+// wait for a refund, full refund or adjust signal until the deadline, reports whether one was received
+func awaitSettledChange(ctx workflow.Context, refundCh, refundAllCh, adjustCh workflow.ReceiveChannel, deadline time.Time) (settledChange, bool) {
+	timerCtx, cancelTimer := workflow.WithCancel(ctx)
+	defer cancelTimer()
+
+	var (
+		change   settledChange
+		received bool
+	)
+	workflow.NewSelector(ctx).
+		AddReceive(refundCh, func(c workflow.ReceiveChannel, _ bool) {
+			c.Receive(ctx, &change.itemID)
+			received = true
+		}).
+		AddReceive(refundAllCh, func(c workflow.ReceiveChannel, _ bool) {
+			c.Receive(ctx, nil)
+			change.refundAll = true
+			received = true
+		}).
+		AddReceive(adjustCh, func(c workflow.ReceiveChannel, _ bool) {
+			change.adj = &Adjustment{}
+			c.Receive(ctx, change.adj)
+			received = true
+		}).
+		AddFuture(workflow.NewTimer(timerCtx, deadline.Sub(workflow.Now(ctx))), func(_ workflow.Future) {}).
+		Select(ctx)
+	return change, received
+}
+
+// refunds a single charged item of a settled bill and credits the account back,
+// the item stays charged when either step fails so the refund can be requested again
+func refundItem(ctx workflow.Context, logger log.Logger, bill *Bill, itemID string) {
+	refund, err := bill.RefundAmount(itemID)
+	if err != nil {
+		logger.Warn("refund ignored", "err", err)
+		return
+	}
+	item := bill.Items[bill.itemIndex(itemID)]
+	ref := refundRef(bill.ID, itemID)
+	if err := workflow.ExecuteActivity(ctx, RefundLineItemActivity, item, ref).Get(ctx, nil); err != nil {
+		logger.Error("item refund failed", "item_id", itemID, "err", err)
+		return
+	}
+	amount := refund
+	if bill.AccountCurrency != bill.Currency {
+		if err := workflow.ExecuteActivity(ctx, ConvertCurrencyActivity, refund, bill.Currency, bill.AccountCurrency, bill.RoundingMode).Get(ctx, &amount); err != nil {
+			logger.Error("currency conversion failed; refund not credited", "item_id", itemID, "err", err)
+			return
+		}
+	}
+	// nothing left to credit when earlier refunds used up the settled amount
+	if amount <= 0 {
+		_ = bill.RefundItem(itemID)
+		recordEvent(ctx, bill, EventItemRefunded, itemID+", nothing left to credit")
+		return
+	}
+	if err := creditRefund(ctx, logger, bill, amount, ref); err != nil {
+		logger.Error("refund credit failed", "item_id", itemID, "account_id", bill.AccountID, "err", err)
+		return
+	}
+	_ = bill.RefundItem(itemID)
+	recordEvent(ctx, bill, EventItemRefunded, fmt.Sprintf("%s for %s", itemID, bill.Currency.Format(refund)))
+	logger.Info("item refunded", "item_id", itemID, "amount", bill.Currency.Format(refund), "refunded_total", bill.Currency.Format(bill.RefundedTotal))
+}
+
+// reverses a whole settled bill, refunds every charged item at the processor and credits the net total back
+// to the account. the bill stays settled when any step fails so the refund can be requested again,
+// the refs keep the items and the credit from being refunded twice
+func refundAll(ctx workflow.Context, logger log.Logger, bill *Bill) {
+	refund, err := bill.RefundAllAmount()
+	if err != nil {
+		logger.Warn("full refund ignored", "err", err)
+		return
+	}
+	var refunds []workflow.Future
+	for _, it := range bill.Items {
+		if it.Status == ItemCharged && !it.IsDiscount() && !it.NonRefundable {
+			refunds = append(refunds, workflow.ExecuteActivity(ctx, RefundLineItemActivity, it, refundRef(bill.ID, it.ID)))
+		}
+	}
+	for _, f := range refunds {
+		if err := f.Get(ctx, nil); err != nil {
+			logger.Error("item refund failed; bill not refunded", "err", err)
+			return
+		}
+	}
+	amount := refund
+	if amount > 0 && bill.AccountCurrency != bill.Currency {
+		if err := workflow.ExecuteActivity(ctx, ConvertCurrencyActivity, refund, bill.Currency, bill.AccountCurrency, bill.RoundingMode).Get(ctx, &amount); err != nil {
+			logger.Error("currency conversion failed; bill not refunded", "err", err)
+			return
+		}
+	}
+	// nothing left to credit when earlier refunds and credits gave back the whole bill
+	if amount > 0 {
+		if err := creditRefund(ctx, logger, bill, amount, refundAllRef(bill.ID)); err != nil {
+			logger.Error("refund credit failed; bill not refunded", "account_id", bill.AccountID, "err", err)
+			return
+		}
+	}
+	_ = bill.RefundAll()
+	upsertStatus(ctx, logger, bill)
+	recordEvent(ctx, bill, EventStatusChanged, string(bill.Status))
+	reportOutcome(ctx, logger, bill)
+	logger.Info("bill refunded", "amount", bill.Currency.Format(refund), "refunded_total", bill.Currency.Format(bill.RefundedTotal))
+}
+
+// credits a refund back to the account. a credit that fails after the activity's retries isn't dropped,
+// the bill is SETTLED_CREDIT_PENDING while a durable timer retries it with backoff until the account takes it.
+// an account held in another currency never will, its error is returned right away
+func creditRefund(ctx workflow.Context, logger log.Logger, bill *Bill, amount int64, ref string) error {
+	credit := func() error {
+		return workflow.ExecuteActivity(ctx, CreditRefundActivity, bill.AccountID, amount, bill.AccountCurrency, bill.ID, ref).Get(ctx, nil)
+	}
+	err := credit()
+	if err == nil || accountMismatched(err) {
+		return err
+	}
+
+	prev := bill.Status
+	bill.Status = BillSettledCreditPending
+	bill.PendingCredit = &PendingCredit{Ref: ref, Amount: amount, Attempts: 1}
+	upsertStatus(ctx, logger, bill)
+	recordEvent(ctx, bill, EventStatusChanged, string(bill.Status))
+	for wait := creditRetryInterval; err != nil; wait = min(2*wait, maxCreditRetryInterval) {
+		logger.Warn("refund credit pending", "ref", ref, "attempts", bill.PendingCredit.Attempts, "retry_in", wait, "err", err)
+		bill.PendingCredit.NextAttemptAt = workflow.Now(ctx).Add(wait).UTC()
+		if sleepErr := workflow.Sleep(ctx, wait); sleepErr != nil {
+			return sleepErr
+		}
+		err = credit()
+		bill.PendingCredit.Attempts++
+	}
+	logger.Info("pending refund credit applied", "ref", ref, "attempts", bill.PendingCredit.Attempts)
+	bill.PendingCredit = nil
+	bill.Status = prev
+	upsertStatus(ctx, logger, bill)
+	recordEvent(ctx, bill, EventStatusChanged, string(bill.Status))
+	return nil
+}
+
+// moves an open bill to another account held in the currency the bill debits, the bill keeps its account
+// when the new one is held in another currency or the bill started charging while the account was checked
+func reassignAccount(ctx workflow.Context, logger log.Logger, bill *Bill, accountID string) {
+	if bill.Status != BillOpen {
+		logger.Warn("reassign ignored", "account_id", accountID, "err", ErrBillNotOpen)
+		return
+	}
+	if err := workflow.ExecuteActivity(ctx, CheckAccountActivity, accountID, bill.AccountCurrency).Get(ctx, nil); err != nil {
+		logger.Warn("reassign rejected", "account_id", accountID, "err", err)
+		return
+	}
+	from := bill.AccountID
+	if err := bill.Reassign(accountID); err != nil {
+		logger.Warn("reassign ignored", "account_id", accountID, "err", err)
+		return
+	}
+	recordEvent(ctx, bill, EventReassigned, fmt.Sprintf("from %s to %s", from, accountID))
+	// the open bill limit counts the bill against its new account from now on, ReassignBill checked it has room
+	upsertStatus(ctx, logger, bill)
+	logger.Info("bill reassigned", "from", from, "account_id", accountID)
+}
+
+// attaches a note stamped with workflow time, a bill with an outcome ignores it
+func addNote(ctx workflow.Context, logger log.Logger, bill *Bill, n Note) {
+	n.At = workflow.Now(ctx).UTC()
+	if err := bill.AddNote(n); err != nil {
+		logger.Warn("note ignored", "author", n.Author, "err", err)
+		return
+	}
+	recordEvent(ctx, bill, EventNoteAdded, "by "+n.Author)
+	logger.Info("note added", "author", n.Author)
+}
+
+// moves the funds of an adjustment to a settled bill and records it, the bill is left as it was when either step fails
+func adjustBill(ctx workflow.Context, logger log.Logger, bill *Bill, adj Adjustment) {
+	// a retried request sends the same ID again, its funds already moved
+	if _, ok := bill.adjustment(adj.ID); ok {
+		logger.Info("adjustment already applied", "adjustment_id", adj.ID)
+		return
+	}
+	if err := bill.CheckAdjustment(adj.Amount); err != nil {
+		logger.Warn("adjustment ignored", "adjustment_id", adj.ID, "err", err)
+		return
+	}
+	amount := adj.Amount
+	if bill.AccountCurrency != bill.Currency {
+		// converted unsigned, so credits and debits round the same way
+		abs := max(amount, -amount)
+		if err := workflow.ExecuteActivity(ctx, ConvertCurrencyActivity, abs, bill.Currency, bill.AccountCurrency, bill.RoundingMode).Get(ctx, &abs); err != nil {
+			logger.Error("currency conversion failed; adjustment not applied", "adjustment_id", adj.ID, "err", err)
+			return
+		}
+		if amount < 0 {
+			abs = -abs
+		}
+		amount = abs
+	}
+	ref := "adjust/" + bill.ID + "/" + adj.ID
+	if err := workflow.ExecuteActivity(ctx, AdjustAccountActivity, bill.AccountID, amount, bill.AccountCurrency, bill.ID, ref).Get(ctx, nil); err != nil {
+		logger.Error("adjustment not applied to the account", "adjustment_id", adj.ID, "account_id", bill.AccountID, "err", err)
+		return
+	}
+	adj.At = workflow.Now(ctx).UTC()
+	_ = bill.Adjust(adj)
+	recordEvent(ctx, bill, EventAdjusted, fmt.Sprintf("%s by %s", adj.ID, bill.Currency.Format(adj.Amount)))
+	logger.Info("bill adjusted", "adjustment_id", adj.ID, "amount", bill.Currency.Format(adj.Amount), "net_total", bill.Currency.Format(bill.netTotal()))
+}
+
+// wait for a retry signal until the retry window closes, reports whether one was received
+func awaitRetry(ctx workflow.Context, retryCh workflow.ReceiveChannel) bool {
+	// drop retries signalled before the bill failed, they were never valid
+	for retryCh.ReceiveAsync(nil) {
+	}
+
+	timerCtx, cancelTimer := workflow.WithCancel(ctx)
+	defer cancelTimer()
+
+	retried := false
+	workflow.NewSelector(ctx).
+		AddReceive(retryCh, func(c workflow.ReceiveChannel, _ bool) {
+			c.Receive(ctx, nil)
+			retried = true
+		}).
+		AddFuture(workflow.NewTimer(timerCtx, retryWindow), func(_ workflow.Future) {}).
+		Select(ctx)
+	return retried
+}
+
+// checks a signalled item against the product catalog before it is added. an unknown product is recorded as
+// rejected and fails with ErrUnknownProduct. the Command update checks in its validator instead,
+// only histories recorded before versionCatalogInValidator replay the check here
+func checkCatalog(ctx workflow.Context, logger log.Logger, bill *Bill, li LineItem) error {
+	err := workflow.ExecuteActivity(ctx, ValidateItemActivity, li).Get(ctx, nil)
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) && appErr.Type() == unknownProductType {
+		rejectItem(ctx, logger, bill, li, ErrUnknownProduct)
+		return ErrUnknownProduct
+	}
+	return err
+}
+
+// records an item the bill refused, so clients that only signalled can reconcile
+func rejectItem(ctx workflow.Context, logger log.Logger, bill *Bill, li LineItem, err error) {
+	bill.recordRejection(RejectedItem{ID: li.ID, Reason: err.Error(), At: workflow.Now(ctx).UTC()})
+	logger.Warn("add-item ignored", "item_id", li.ID, "err", err)
+}
+
+// append an event to the bill timeline, stamped with workflow time so replays produce the same timeline
+func recordEvent(ctx workflow.Context, bill *Bill, typ BillEventType, detail string) {
+	now := workflow.Now(ctx).UTC()
+	bill.Events = append(bill.Events, BillEvent{Type: typ, Detail: detail, At: now})
+	// every change of the bill is recorded, so its events keep the bill's times
+	bill.LastModifiedAt = now
+	if typ == EventStatusChanged && bill.SettledAt == nil && (bill.Status == BillSettled || bill.Status == BillPartiallySettled) {
+		bill.SettledAt = &now
+	}
+}
+
+// publish the current bill status to temporal visibility
+func upsertStatus(ctx workflow.Context, logger log.Logger, bill *Bill) {
+	updates := []temporal.SearchAttributeUpdate{
+		billStatusKey.ValueSet(string(bill.Status)),
+		billTotalKey.ValueSet(bill.Total),
+		billArchivedKey.ValueSet(bill.Archived),
+		billAccountKey.ValueSet(bill.AccountID),
+	}
+	if len(bill.Labels) > 0 {
+		updates = append(updates, billLabelsKey.ValueSet(labelEntries(bill.Labels)))
+	}
+	if err := workflow.UpsertTypedSearchAttributes(ctx, updates...); err != nil {
+		logger.Warn("failed to upsert bill status", "status", bill.Status, "err", err)
+	}
+}
+
+func settleStaged(logger log.Logger, bill *Bill) {
+	if added, rejected := bill.resolveStaged(); added+rejected > 0 {
+		logger.Info("staged items resolved", "status", bill.Status, "added", added, "rejected", rejected)
+	}
+}
+
+// marks a bill that can no longer change, right before its workflow completes. the history is then
+// only kept for the namespace retention, and GET /bills?archived=true lists such bills
+func archive(ctx workflow.Context, logger log.Logger, bill *Bill) {
+	bill.Archived = true
+	recordEvent(ctx, bill, EventArchived, string(bill.Status))
+	upsertStatus(ctx, logger, bill)
+	logger.Info("bill archived", "status", bill.Status)
+}
+
+// count the terminal status the bill reached and notify its webhook,
+// neither can fail the bill so errors are only logged
+func reportOutcome(ctx workflow.Context, logger log.Logger, bill *Bill) {
+	if err := workflow.ExecuteActivity(ctx, RecordOutcomeActivity, bill.Currency, bill.Status).Get(ctx, nil); err != nil {
+		logger.Warn("failed to record bill outcome", "status", bill.Status, "err", err)
+	}
+	notifyWebhook(ctx, logger, bill)
+}
+
+// push the bill to its webhook after it reached a terminal status, a receiver that stays down doesn't affect the bill
+func notifyWebhook(ctx workflow.Context, logger log.Logger, bill *Bill) {
+	if bill.WebhookURL == "" {
+		return
+	}
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: 10 * time.Second,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second * 5,
+			BackoffCoefficient: 2.0,
+			MaximumInterval:    time.Minute * 5,
+			MaximumAttempts:    10,
+		},
+	})
+	if err := workflow.ExecuteActivity(ctx, NotifyWebhookActivity, bill.WebhookURL, bill.snapshot()).Get(ctx, nil); err != nil {
+		logger.Error("webhook notification failed", "status", bill.Status, "err", err)
+		return
+	}
+	logger.Info("webhook notified", "status", bill.Status)
+}
+
+// charge the given items per the bill's strategy and record each outcome, items are looked up by ID
+// once charged because the items slice may change while a partial charge runs
+func chargeItems(ctx workflow.Context, logger log.Logger, bill *Bill, ids []string, cfg chargeConfig) {
+	ctx = workflow.WithHeartbeatTimeout(ctx, chargeHeartbeatTimeout)
+	items := make([]LineItem, 0, len(ids))
+	for _, id := range ids {
+		if i := bill.itemIndex(id); i >= 0 {
+			items = append(items, bill.Items[i])
+		}
+	}
+	if cfg.strategy == ChargeParallel {
+		chargeParallel(ctx, logger, bill, items, cfg.maxConcurrent)
+		return
+	}
+
+	// stable, so items of the same amount are charged in the order they were added
+	slices.SortStableFunc(items, func(a, b LineItem) int {
+		if cfg.strategy == ChargeSmallestFirst {
+			return cmp.Compare(a.Amount, b.Amount)
+		}
+		return cmp.Compare(b.Amount, a.Amount)
+	})
+	failed := false
+	for _, item := range items {
+		if failed && cfg.stopOnFailure {
+			if i := bill.itemIndex(item.ID); i >= 0 {
+				bill.Items[i].Status = ItemFailed
+			}
+			logger.Warn("item not charged after an earlier failure", "item_id", item.ID)
+			continue
+		}
+		if !chargeItem(ctx, logger, bill, item) {
+			failed = true
+		}
+	}
+}
+
+// charge the items asynchronously in their own separate coroutines, at most maxCharges at once.
+// a buffered channel holds a slot per running charge
+func chargeParallel(ctx workflow.Context, logger log.Logger, bill *Bill, items []LineItem, maxCharges int) {
+	chargeWG := workflow.NewWaitGroup(ctx)
+	slots := workflow.NewBufferedChannel(ctx, maxCharges)
+	for _, item := range items {
+		// blocks while all slots are taken
+		slots.Send(ctx, struct{}{})
+		chargeWG.Add(1)
+		workflow.Go(ctx, func(c workflow.Context) {
+			defer chargeWG.Done()
+			defer slots.Receive(c, nil)
+			chargeItem(c, logger, bill, item)
+		})
+	}
+	chargeWG.Wait(ctx)
+}
+
+// charge a single item and record the outcome on the bill, reports whether it was charged
+func chargeItem(ctx workflow.Context, logger log.Logger, bill *Bill, item LineItem) bool {
+	var res ChargeResult
+	err := workflow.ExecuteActivity(ctx, ChargeLineItemActivity, item).Get(ctx, &res)
+
+	i := bill.itemIndex(item.ID)
+	if i < 0 {
+		return err == nil
+	}
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) && appErr.HasDetails() {
+		_ = appErr.Details(&res)
+	}
+	bill.Items[i].Attempts = chargeAttempts(ctx, res, err)
+	switch {
+	case appErr != nil && appErr.Type() == chargeDeclinedType:
+		// declines aren't retried, the ref lets support look the decline up at the processor
+		bill.Items[i].Status = ItemFailed
+		bill.Items[i].ProcessorRef = res.ProcessorRef
+		logger.Warn("item charge declined", "item_id", item.ID, "processor_ref", res.ProcessorRef)
+		return false
+	case err != nil:
+		bill.Items[i].Status = ItemFailed
+		logger.Warn("item charge failed", "item_id", item.ID, "attempts_exhausted", true, "err", err)
+		return false
+	default:
+		bill.Items[i].Status = ItemCharged
+		bill.Items[i].ProcessorRef = res.ProcessorRef
+		logger.Info("item charged", "item_id", item.ID, "amount", bill.Currency.Format(item.Amount), "processor_ref", res.ProcessorRef)
+		return true
+	}
+}
+
+// how many times the charge activity ran, as reported by its last attempt. attempts that didn't report,
+// e.g. because they timed out, ran out of attempts when temporal stopped retrying them for that reason
+func chargeAttempts(ctx workflow.Context, res ChargeResult, err error) int32 {
+	if res.Attempt > 0 {
+		return res.Attempt
+	}
+	var actErr *temporal.ActivityError
+	if errors.As(err, &actErr) && actErr.RetryState() == enums.RETRY_STATE_MAXIMUM_ATTEMPTS_REACHED {
+		if rp := workflow.GetActivityOptions(ctx).RetryPolicy; rp != nil {
+			return rp.MaximumAttempts
+		}
+	}
+	return 0
+}
+
+// charge all pending items of a bill in the charging state and settle, fail or compensate it.
+// a closing bill is partially settled instead of compensated when only some items fail.
+// a force-expire signal takes effect between the steps, in-flight activities always finish first
+func chargeBill(ctx workflow.Context, logger log.Logger, bill *Bill, closing bool, cfg chargeConfig, forceExpireCh workflow.ReceiveChannel) error {
+	forceExpired := func() bool {
+		if !forceExpireCh.ReceiveAsync(nil) {
+			return false
+		}
+		abandonCharge(ctx, logger, bill)
+		return true
+	}
+
+	// 1) wait for in-flight partial charges
+	if err := workflow.Await(ctx, func() bool { return bill.countItems(ItemCharging) == 0 }); err != nil {
+		return err
+	}
+	if forceExpired() {
+		return nil
+	}
+
+	// 2) reserve what the bill settles for in the account, without the funds nothing is charged
+	if err := holdFunds(ctx, logger, bill); err != nil {
+		for i := range bill.Items {
+			if it := &bill.Items[i]; it.Status == ItemPending && !it.IsDiscount() {
+				it.Status = ItemFailed
+			}
+		}
+		// items charged separately before the hold have to be refunded
+		if bill.countItems(ItemCharged) > 0 {
+			return compensate(ctx, logger, bill, ErrTypeHoldFailed, err)
+		}
+		bill.Status = BillFailed
+		return chargeFailure(bill, ErrTypeHoldFailed, fmt.Sprintf("funds not held: %v", err), err)
+	}
+	if forceExpired() {
+		return nil
+	}
+
+	// 3) charge all remaining pending items
+	pendingIDs := make([]string, 0, bill.PendingCount())
+	for _, it := range bill.Items {
+		if it.Status == ItemPending && !it.IsDiscount() {
+			pendingIDs = append(pendingIDs, it.ID)
+		}
+	}
+	chargeItems(ctx, logger, bill, pendingIDs, cfg)
+	if forceExpired() {
+		return nil
+	}
+
+	// 4) count charge failures, discounts are never charged so they don't count
+	failedCount := 0
+	totalItems := 0
+	for _, it := range bill.Items {
+		if it.IsDiscount() {
+			continue
+		}
+		totalItems++
+		if it.Status == ItemFailed {
+			failedCount++
+		}
+	}
+
+	// 5) branch on result
+	switch {
+	case failedCount == totalItems:
+		// all item charges failed -> fail the bill and give the held funds back
+		releaseHold(ctx, logger, bill)
+		bill.Status = BillFailed
+		logger.Error("all items failed; bill failed", "failed_items", failedCount)
+
+		return chargeFailure(bill, ErrTypeChargeFailed, fmt.Sprintf("%d items failed", failedCount), nil)
+	case failedCount == 0:
+		// none failed -> capture the held funds before settling,
+		// items refunded before a retry are not part of the settled amount
+		var settled int64
 		for _, it := range bill.Items {
-			if it.Status == ItemFailed {
-				failedCount++
-			}
-		}
-		totalItems := len(bill.Items)
-
-		// 3) branch on result
-		switch {
-		case failedCount == totalItems:
-			// all item charges failed -> fail the bill
-			if failedCount == totalItems {
-				failedIDs := make([]string, 0, failedCount)
-				for _, it := range bill.Items {
-					failedIDs = append(failedIDs, it.ID)
-				}
-				bill.Status = BillFailed
-				logger.Error("all items failed; bill failed", "failed_items", failedCount)
-
-				return temporal.NewApplicationError(fmt.Sprintf("%d items failed: %v", failedCount, failedIDs), "ChargeFailed", failedIDs)
-			}
-		case failedCount == 0:
-			// none failed -> success -> credit account
-			bill.Status = BillSettled
-			logger.Info("bill settled")
-			// crediting won't fail for demo purposes
-			_ = workflow.ExecuteActivity(ctx, CreditAccountActivity, bill.Total, bill.Currency).Get(ctx, nil)
-			logger.Info("account credited", "currency", bill.Currency, "amount", bill.Total)
-		default:
-			// not all item charges failed -> refund the charged items asynchronously
-			refundWG := workflow.NewWaitGroup(ctx)
-			refundedCount := 0
-			for i := range bill.Items {
-				item := &bill.Items[i]
-				if item.Status == ItemCharged {
-					refundWG.Add(1)
-					workflow.Go(ctx, func(c workflow.Context) {
-						defer refundWG.Done()
-						// the refund does not fail for demo purposes
-						_ = workflow.ExecuteActivity(c, RefundLineItemActivity, *item).Get(c, nil)
-						item.Status = ItemRefunded
-						refundedCount++
-						logger.Info("item refunded", "item_id", item.ID)
-					})
-				}
-			}
-			refundWG.Wait(ctx)
-
-			// mark the bill as compensated due to refunds
-			bill.Status = BillCompensated
-			logger.Error("bill partially failed and refunded items", "refunded_items", refundedCount, "failed_items", failedCount)
-			failedIDs := make([]string, 0, failedCount)
-			for _, it := range bill.Items {
-				if it.Status == ItemFailed {
-					failedIDs = append(failedIDs, it.ID)
-				}
-			}
-
-			return temporal.NewApplicationError(fmt.Sprintf("refunded %d items after %d failures", refundedCount, failedCount), "ChargeCompensated", failedIDs)
+			if it.Status == ItemCharged || (it.IsDiscount() && it.Status == ItemPending) {
+				settled += it.signedAmount()
+			}
+		}
+		bill.SettledAmount = settled
+		// a bill fully discounted away settles at zero with nothing held, the account isn't touched
+		if bill.HoldID != "" {
+			if err := workflow.ExecuteActivity(ctx, CaptureHoldActivity, bill.HoldID, int64(0)).Get(ctx, nil); err != nil {
+				logger.Error("hold capture failed", "hold_id", bill.HoldID, "err", err)
+				releaseHold(ctx, logger, bill)
+				return compensate(ctx, logger, bill, captureFailureType(err), err)
+			}
+			logger.Info("held funds captured", "hold_id", bill.HoldID, "account_id", bill.AccountID, "amount", bill.AccountCurrency.Format(bill.ConvertedAmount))
 		}
 
+		// discounts are applied once the funds are captured
+		for i := range bill.Items {
+			if it := &bill.Items[i]; it.IsDiscount() && it.Status == ItemPending {
+				it.Status = ItemCharged
+			}
+		}
+		bill.Status = BillSettled
+		logger.Info("bill settled")
+	case closing:
+		// some item charges failed on close -> keep the charged items and capture only what they add up to
+		return partiallySettle(ctx, logger, bill, failedCount)
 	default:
-		logger.Error("unexpected status after selector", "status", bill.Status)
-		return temporal.NewNonRetryableApplicationError("invalid state", "", nil)
+		// not all item charges failed -> give the held funds back and refund the charged items
+		releaseHold(ctx, logger, bill)
+		refundedCount := refundCharged(ctx, logger, bill)
+
+		// mark the bill as compensated due to refunds
+		bill.Status = BillCompensated
+		logger.Error("bill partially failed and refunded items", "refunded_items", refundedCount, "failed_items", failedCount)
+
+		return chargeFailure(bill, ErrTypeChargeCompensated, fmt.Sprintf("refunded %d items after %d failures", refundedCount, failedCount), nil)
+	}
+
+	return nil
+}
+
+// settle a closed bill for its charged items, the failed ones stay failed and the rest of the hold goes back to the account
+func partiallySettle(ctx workflow.Context, logger log.Logger, bill *Bill, failedCount int) error {
+	for i := range bill.Items {
+		if it := &bill.Items[i]; it.IsDiscount() && it.Status == ItemPending {
+			it.Status = ItemCharged
+		}
+	}
+	var settled int64
+	for _, it := range bill.Items {
+		if it.Status == ItemCharged {
+			settled += it.signedAmount()
+		}
+	}
+	// discounts can't turn the bill into a payout
+	bill.SettledAmount = max(settled, 0)
+
+	captured := bill.SettledAmount
+	if bill.AccountCurrency != bill.Currency && captured > 0 {
+		if err := workflow.ExecuteActivity(ctx, ConvertCurrencyActivity, captured, bill.Currency, bill.AccountCurrency, bill.RoundingMode).Get(ctx, &captured); err != nil {
+			logger.Error("currency conversion failed; hold released", "from", bill.Currency, "to", bill.AccountCurrency, "err", err)
+			releaseHold(ctx, logger, bill)
+			return compensate(ctx, logger, bill, ErrTypeConversionFailed, err)
+		}
+	}
+	// rounding can't take more than was held
+	captured = min(captured, bill.ConvertedAmount)
+	switch {
+	case bill.HoldID == "":
+	case captured <= 0:
+		releaseHold(ctx, logger, bill)
+	default:
+		if err := workflow.ExecuteActivity(ctx, CaptureHoldActivity, bill.HoldID, captured).Get(ctx, nil); err != nil {
+			logger.Error("hold capture failed", "hold_id", bill.HoldID, "err", err)
+			releaseHold(ctx, logger, bill)
+			return compensate(ctx, logger, bill, captureFailureType(err), err)
+		}
+		bill.ConvertedAmount = captured
+		logger.Info("held funds partially captured", "hold_id", bill.HoldID, "amount", bill.AccountCurrency.Format(captured))
 	}
 
+	bill.Status = BillPartiallySettled
+	logger.Warn("bill closed with failed items; partially settled", "failed_items", failedCount, "settled", bill.Currency.Format(bill.SettledAmount))
+	return nil
+}
+
+// hold the amount the bill settles for if every pending item charges, converted to the account currency.
+// items already charged separately are included, failed and refunded ones are not
+func holdFunds(ctx workflow.Context, logger log.Logger, bill *Bill) error {
+	var amount int64
+	for _, it := range bill.Items {
+		if it.Status == ItemPending || it.Status == ItemCharged {
+			amount += it.signedAmount()
+		}
+	}
+	bill.HoldID = ""
+	bill.ConvertedAmount = amount
+	if bill.AccountCurrency != bill.Currency {
+		if err := workflow.ExecuteActivity(ctx, ConvertCurrencyActivity, amount, bill.Currency, bill.AccountCurrency, bill.RoundingMode).Get(ctx, &bill.ConvertedAmount); err != nil {
+			logger.Error("currency conversion failed; funds not held", "from", bill.Currency, "to", bill.AccountCurrency, "err", err)
+			bill.ConvertedAmount = 0
+			return err
+		}
+		logger.Info("amount converted", "from", bill.Currency, "to", bill.AccountCurrency, "amount", bill.Currency.Format(amount), "converted", bill.AccountCurrency.Format(bill.ConvertedAmount))
+	}
+	if bill.ConvertedAmount <= 0 {
+		return nil
+	}
+	if err := workflow.ExecuteActivity(ctx, HoldFundsActivity, bill.AccountID, bill.ConvertedAmount, bill.AccountCurrency, bill.ID).Get(ctx, &bill.HoldID); err != nil {
+		logger.Error("hold failed", "account_id", bill.AccountID, "amount", bill.AccountCurrency.Format(bill.ConvertedAmount), "err", err)
+		bill.ConvertedAmount = 0
+		return err
+	}
+	logger.Info("funds held", "hold_id", bill.HoldID, "account_id", bill.AccountID, "amount", bill.AccountCurrency.Format(bill.ConvertedAmount))
 	return nil
 }
+
+// release the bill's hold if it has one, releasing won't fail for demo purposes
+func releaseHold(ctx workflow.Context, logger log.Logger, bill *Bill) {
+	if bill.HoldID == "" {
+		return
+	}
+	_ = workflow.ExecuteActivity(ctx, ReleaseHoldActivity, bill.HoldID).Get(ctx, nil)
+	logger.Info("held funds released", "hold_id", bill.HoldID)
+	bill.HoldID = ""
+	bill.ConvertedAmount = 0
+}
+
+// undo the charge of a force-expired bill, the held funds go back, charged items are refunded
+// and the items still pending are canceled like on expiry
+func abandonCharge(ctx workflow.Context, logger log.Logger, bill *Bill) {
+	releaseHold(ctx, logger, bill)
+	refundedCount := refundCharged(ctx, logger, bill)
+	bill.Expire()
+	logger.Info("charging bill force-expired", "refunded_items", refundedCount)
+}
+
+// refund the items a canceled or expired bill charged separately, nothing was held or captured for them
+// so the account never paid. an expired bill keeps them charged while it can still be reopened
+func refundUnsettled(ctx workflow.Context, logger log.Logger, bill *Bill) {
+	if bill.countItems(ItemCharged) == 0 {
+		return
+	}
+	// bills that ended before the refund was added replay without it
+	if workflow.GetVersion(ctx, versionRefundUnsettled, workflow.DefaultVersion, 1) == workflow.DefaultVersion {
+		return
+	}
+	var charged []LineItem
+	for _, it := range bill.Items {
+		if it.Status == ItemCharged && !it.IsDiscount() {
+			charged = append(charged, it)
+		}
+	}
+	refundedCount := refundCharged(ctx, logger, bill)
+	for _, it := range charged {
+		recordEvent(ctx, bill, EventItemRefunded, fmt.Sprintf("%s for %s, the bill was not settled", it.ID, bill.Currency.Format(it.Amount)))
+	}
+	logger.Info("charged items of an unsettled bill refunded", "status", bill.Status, "refunded_items", refundedCount)
+}
+
+// refund all charged items of a fully charged bill that could not be settled and mark it compensated,
+// errType is the type of the returned error
+func compensate(ctx workflow.Context, logger log.Logger, bill *Bill, errType string, cause error) error {
+	refundedCount := refundCharged(ctx, logger, bill)
+	bill.Status = BillCompensated
+	logger.Error("bill not settled; refunded charged items", "reason", errType, "refunded_items", refundedCount)
+
+	return chargeFailure(bill, errType, fmt.Sprintf("refunded %d items: %v", refundedCount, cause), cause)
+}
+
+// refund the charged items asynchronously, reports how many were refunded
+func refundCharged(ctx workflow.Context, logger log.Logger, bill *Bill) int {
+	refundWG := workflow.NewWaitGroup(ctx)
+	refundedCount := 0
+	for i := range bill.Items {
+		item := &bill.Items[i]
+		if item.Status == ItemCharged && !item.IsDiscount() {
+			refundWG.Add(1)
+			workflow.Go(ctx, func(c workflow.Context) {
+				defer refundWG.Done()
+				// an item refunded since it was picked up is never refunded again
+				if item.Status != ItemCharged {
+					return
+				}
+				// the refund does not fail for demo purposes
+				_ = workflow.ExecuteActivity(c, RefundLineItemActivity, *item, refundRef(bill.ID, item.ID)).Get(c, nil)
+				item.Status = ItemRefunded
+				refundedCount++
+				logger.Info("item refunded", "item_id", item.ID)
+			})
+		}
+	}
+	refundWG.Wait(ctx)
+	return refundedCount
+}
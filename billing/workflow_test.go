@@ -1,26 +1,129 @@
 package billing
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"pave-fees-api/internal/currency"
 
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
 	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
 )
 
 type UnitTestSuite struct {
 	testsuite.WorkflowTestSuite
 	env *testsuite.TestWorkflowEnvironment
+	// in-memory stand-in for the account service, which needs the encore runtime
+	balances map[currency.Currency]int64
+	held     map[currency.Currency]int64
+	holds    map[string]testHold
+	// registered accounts and their currency, unregistered ones take any currency
+	accounts map[string]currency.Currency
+	// accounts funds were held for, in order
+	heldAccounts []string
+	// how many refund credit attempts fail before the account takes one
+	creditFailures int
+}
+
+type testHold struct {
+	account string
+	cur     currency.Currency
+	amount  int64
 }
 
 func (s *UnitTestSuite) SetupTest(t *testing.T) {
 	s.env = s.NewTestWorkflowEnvironment()
 	s.env.RegisterActivity(ChargeLineItemActivity)
 	s.env.RegisterActivity(RefundLineItemActivity)
-	s.env.RegisterActivity(CreditAccountActivity)
+	s.env.RegisterActivity(ConvertCurrencyActivity)
+	s.env.RegisterActivity(HoldFundsActivity)
+	s.env.RegisterActivity(CaptureHoldActivity)
+	s.env.RegisterActivity(ReleaseHoldActivity)
+	s.env.RegisterActivity(NotifyWebhookActivity)
+	s.env.RegisterActivity(RecordOutcomeActivity)
+	s.env.RegisterActivity(CreditRefundActivity)
+	s.env.RegisterActivity(AdjustAccountActivity)
+	s.env.RegisterActivity(CheckAccountActivity)
+	s.env.RegisterActivity(ValidateItemActivity)
+
+	s.balances = map[currency.Currency]int64{currency.USD: 1_000_000, currency.EUR: 1_000_000}
+	s.held = make(map[currency.Currency]int64)
+	s.holds = make(map[string]testHold)
+	s.heldAccounts = nil
+	s.accounts = make(map[string]currency.Currency)
+	s.creditFailures = 0
+	s.env.OnActivity(HoldFundsActivity, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, accountID string, amount int64, cur currency.Currency, _ string) (string, error) {
+			s.heldAccounts = append(s.heldAccounts, accountID)
+			if s.balances[cur] < amount {
+				return "", temporal.NewNonRetryableApplicationError("insufficient funds", "failed_precondition", nil)
+			}
+			s.balances[cur] -= amount
+			s.held[cur] += amount
+			id := fmt.Sprintf("hold-%d", len(s.holds)+1)
+			s.holds[id] = testHold{account: accountID, cur: cur, amount: amount}
+			return id, nil
+		})
+	s.env.OnActivity(CaptureHoldActivity, mock.Anything, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, holdID string, amount int64) error {
+			h := s.holds[holdID]
+			if held, ok := s.accounts[h.account]; ok {
+				if err := accountMismatch(h.account, held, h.cur); err != nil {
+					return err
+				}
+			}
+			if amount == 0 {
+				amount = h.amount
+			}
+			s.held[h.cur] -= h.amount
+			s.balances[h.cur] += h.amount - amount
+			delete(s.holds, holdID)
+			return nil
+		})
+	s.env.OnActivity(ReleaseHoldActivity, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, holdID string) error {
+			h := s.holds[holdID]
+			s.held[h.cur] -= h.amount
+			s.balances[h.cur] += h.amount
+			delete(s.holds, holdID)
+			return nil
+		})
+	s.env.OnActivity(CheckAccountActivity, mock.Anything, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, accountID string, cur currency.Currency) error {
+			if held, ok := s.accounts[accountID]; ok {
+				return accountMismatch(accountID, held, cur)
+			}
+			return nil
+		})
+	s.env.OnActivity(CreditRefundActivity, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, _ string, amount int64, cur currency.Currency, _, _ string) error {
+			if s.creditFailures > 0 {
+				s.creditFailures--
+				return errors.New("account service unavailable")
+			}
+			s.balances[cur] += amount
+			return nil
+		})
+	s.env.OnActivity(AdjustAccountActivity, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, _ string, amount int64, cur currency.Currency, _, _ string) error {
+			if s.balances[cur] < amount {
+				return temporal.NewNonRetryableApplicationError("insufficient funds", "failed_precondition", nil)
+			}
+			s.balances[cur] -= amount
+			return nil
+		})
 }
 
 func TestUnitTestSuite(t *testing.T) {
@@ -34,7 +137,86 @@ func TestUnitTestSuite(t *testing.T) {
 		{"BillWorkflow_Canceled", (*UnitTestSuite).Test_BillWorkflow_Canceled},
 		{"BillWorkflow_Expired", (*UnitTestSuite).Test_BillWorkflow_Expired},
 		{"Test_BillWorkflow_ChargeWithNoItems_Expires", (*UnitTestSuite).Test_BillWorkflow_ChargeWithNoItems_Expires},
+		{"Test_BillWorkflow_AutoChargeOnExpiry_Charges", (*UnitTestSuite).Test_BillWorkflow_AutoChargeOnExpiry_Charges},
+		{"Test_BillWorkflow_AutoChargeOnExpiry_EmptyExpires", (*UnitTestSuite).Test_BillWorkflow_AutoChargeOnExpiry_EmptyExpires},
 		{"Test_BillWorkflow_AllItemsFail", (*UnitTestSuite).Test_BillWorkflow_AllItemsFail},
+		{"Test_BillWorkflow_RemoveItem", (*UnitTestSuite).Test_BillWorkflow_RemoveItem},
+		{"Test_BillWorkflow_VoidItem", (*UnitTestSuite).Test_BillWorkflow_VoidItem},
+		{"Test_BillWorkflow_UpdateItem", (*UnitTestSuite).Test_BillWorkflow_UpdateItem},
+		{"Test_BillWorkflow_ChargeUpdate_Settled", (*UnitTestSuite).Test_BillWorkflow_ChargeUpdate_Settled},
+		{"Test_BillWorkflow_ChargeUpdate_Compensated", (*UnitTestSuite).Test_BillWorkflow_ChargeUpdate_Compensated},
+		{"Test_BillWorkflow_ChargeUpdate_RejectedWithNoItems", (*UnitTestSuite).Test_BillWorkflow_ChargeUpdate_RejectedWithNoItems},
+		{"Test_BillWorkflow_QueryItem_MidCharge", (*UnitTestSuite).Test_BillWorkflow_QueryItem_MidCharge},
+		{"Test_BillWorkflow_QueryStatus_MatchesBill", (*UnitTestSuite).Test_BillWorkflow_QueryStatus_MatchesBill},
+		{"Test_BillWorkflow_QueryProgress", (*UnitTestSuite).Test_BillWorkflow_QueryProgress},
+		{"Test_BillWorkflow_RejectedItems", (*UnitTestSuite).Test_BillWorkflow_RejectedItems},
+		{"Test_BillWorkflow_CatalogOnly", (*UnitTestSuite).Test_BillWorkflow_CatalogOnly},
+		{"Test_BillWorkflow_UpsertsStatus", (*UnitTestSuite).Test_BillWorkflow_UpsertsStatus},
+		{"Test_BillWorkflow_PartialCharge_StaysOpen", (*UnitTestSuite).Test_BillWorkflow_PartialCharge_StaysOpen},
+		{"Test_BillWorkflow_PartialCharge_AllItems_Compensated", (*UnitTestSuite).Test_BillWorkflow_PartialCharge_AllItems_Compensated},
+		{"Test_BillWorkflow_PartialThenFullCharge_Settled", (*UnitTestSuite).Test_BillWorkflow_PartialThenFullCharge_Settled},
+		{"Test_BillWorkflow_PartialCharge_Canceled", (*UnitTestSuite).Test_BillWorkflow_PartialCharge_Canceled},
+		{"Test_BillWorkflow_PartialCharge_Expired", (*UnitTestSuite).Test_BillWorkflow_PartialCharge_Expired},
+		{"Test_BillWorkflow_PartialCharge_LastItem_OverMaxTotal", (*UnitTestSuite).Test_BillWorkflow_PartialCharge_LastItem_OverMaxTotal},
+		{"Test_BillWorkflow_RetryFailed_Succeeds", (*UnitTestSuite).Test_BillWorkflow_RetryFailed_Succeeds},
+		{"Test_BillWorkflow_RetryFailed_FailsAgain", (*UnitTestSuite).Test_BillWorkflow_RetryFailed_FailsAgain},
+		{"Test_BillWorkflow_DiscountThenCharge", (*UnitTestSuite).Test_BillWorkflow_DiscountThenCharge},
+		{"Test_BillWorkflow_OverDiscountRejected", (*UnitTestSuite).Test_BillWorkflow_OverDiscountRejected},
+		{"Test_BillWorkflow_FullyDiscountedSettles", (*UnitTestSuite).Test_BillWorkflow_FullyDiscountedSettles},
+		{"Test_BillWorkflow_QueryChargeable", (*UnitTestSuite).Test_BillWorkflow_QueryChargeable},
+		{"Test_BillWorkflow_ChargeDeclined_NotRetried", (*UnitTestSuite).Test_BillWorkflow_ChargeDeclined_NotRetried},
+		{"Test_BillWorkflow_TaxCharged", (*UnitTestSuite).Test_BillWorkflow_TaxCharged},
+		{"Test_BillWorkflow_InitialItems", (*UnitTestSuite).Test_BillWorkflow_InitialItems},
+		{"Test_BillWorkflow_InitialItems_Invalid", (*UnitTestSuite).Test_BillWorkflow_InitialItems_Invalid},
+		{"Test_BillWorkflow_CrossCurrencyDebit", (*UnitTestSuite).Test_BillWorkflow_CrossCurrencyDebit},
+		{"Test_BillWorkflow_CrossCurrencyDebit_RoundingMode", (*UnitTestSuite).Test_BillWorkflow_CrossCurrencyDebit_RoundingMode},
+		{"Test_BillWorkflow_Hold_CapturedOnSettle", (*UnitTestSuite).Test_BillWorkflow_Hold_CapturedOnSettle},
+		{"Test_BillWorkflow_Hold_ReleasedOnCompensation", (*UnitTestSuite).Test_BillWorkflow_Hold_ReleasedOnCompensation},
+		{"Test_BillWorkflow_Hold_InsufficientFunds", (*UnitTestSuite).Test_BillWorkflow_Hold_InsufficientFunds},
+		{"Test_BillWorkflow_MaxChargeAttempts", (*UnitTestSuite).Test_BillWorkflow_MaxChargeAttempts},
+		{"Test_BillWorkflow_ChargeAttemptsRecorded", (*UnitTestSuite).Test_BillWorkflow_ChargeAttemptsRecorded},
+		{"Test_BillWorkflow_MaxConcurrentCharges", (*UnitTestSuite).Test_BillWorkflow_MaxConcurrentCharges},
+		{"Test_BillWorkflow_ChargeStrategy", (*UnitTestSuite).Test_BillWorkflow_ChargeStrategy},
+		{"Test_BillWorkflow_Close_AllSucceed", (*UnitTestSuite).Test_BillWorkflow_Close_AllSucceed},
+		{"Test_BillWorkflow_Close_AllFail", (*UnitTestSuite).Test_BillWorkflow_Close_AllFail},
+		{"Test_BillWorkflow_Close_Mixed_PartiallySettled", (*UnitTestSuite).Test_BillWorkflow_Close_Mixed_PartiallySettled},
+		{"Test_BillWorkflow_Webhook_OncePerTerminalStatus", (*UnitTestSuite).Test_BillWorkflow_Webhook_OncePerTerminalStatus},
+		{"Test_BillWorkflow_Webhook_NotSetNotCalled", (*UnitTestSuite).Test_BillWorkflow_Webhook_NotSetNotCalled},
+		{"Test_BillWorkflow_RecordsOutcome", (*UnitTestSuite).Test_BillWorkflow_RecordsOutcome},
+		{"Test_BillWorkflow_ContinueAsNew_PreservesState", (*UnitTestSuite).Test_BillWorkflow_ContinueAsNew_PreservesState},
+		{"Test_BillWorkflow_ExtendPeriod", (*UnitTestSuite).Test_BillWorkflow_ExtendPeriod},
+		{"Test_BillWorkflow_Reopen", (*UnitTestSuite).Test_BillWorkflow_Reopen},
+		{"Test_BillWorkflow_RefundItem", (*UnitTestSuite).Test_BillWorkflow_RefundItem},
+		{"Test_BillWorkflow_RefundItem_NotCharged", (*UnitTestSuite).Test_BillWorkflow_RefundItem_NotCharged},
+		{"Test_BillWorkflow_RefundAll", (*UnitTestSuite).Test_BillWorkflow_RefundAll},
+		{"Test_BillWorkflow_RefundAll_NotSettled", (*UnitTestSuite).Test_BillWorkflow_RefundAll_NotSettled},
+		{"Test_ScheduledBillWorkflow_StartsFromTemplate", (*UnitTestSuite).Test_ScheduledBillWorkflow_StartsFromTemplate},
+		{"Test_BillWorkflow_EventTimeline", (*UnitTestSuite).Test_BillWorkflow_EventTimeline},
+		{"Test_BillWorkflow_AccountCurrencyMismatch", (*UnitTestSuite).Test_BillWorkflow_AccountCurrencyMismatch},
+		{"Test_BillWorkflow_CaptureAccountMismatch", (*UnitTestSuite).Test_BillWorkflow_CaptureAccountMismatch},
+		{"Test_BillWorkflow_AccountCheck_BeforeVersion", (*UnitTestSuite).Test_BillWorkflow_AccountCheck_BeforeVersion},
+		{"Test_BillWorkflow_Timestamps", (*UnitTestSuite).Test_BillWorkflow_Timestamps},
+		{"Test_BillWorkflow_ReassignAccount", (*UnitTestSuite).Test_BillWorkflow_ReassignAccount},
+		{"Test_BillWorkflow_Notes", (*UnitTestSuite).Test_BillWorkflow_Notes},
+		{"Test_BillWorkflow_RefundCreditPending", (*UnitTestSuite).Test_BillWorkflow_RefundCreditPending},
+		{"Test_BillWorkflow_AutoCancelEmpty", (*UnitTestSuite).Test_BillWorkflow_AutoCancelEmpty},
+		{"Test_BillWorkflow_AutoCancelEmpty_ItemAdded", (*UnitTestSuite).Test_BillWorkflow_AutoCancelEmpty_ItemAdded},
+		{"Test_BillWorkflow_ItemExpiry", (*UnitTestSuite).Test_BillWorkflow_ItemExpiry},
+		{"Test_BillWorkflow_ItemExpiry_Replaced", (*UnitTestSuite).Test_BillWorkflow_ItemExpiry_Replaced},
+		{"Test_BillWorkflow_ItemExpiry_Command", (*UnitTestSuite).Test_BillWorkflow_ItemExpiry_Command},
+		{"Test_BillWorkflow_ForceExpire_Open", (*UnitTestSuite).Test_BillWorkflow_ForceExpire_Open},
+		{"Test_BillWorkflow_ForceExpire_Charging", (*UnitTestSuite).Test_BillWorkflow_ForceExpire_Charging},
+		{"Test_BillWorkflow_Command_ChargeBeatsCancel", (*UnitTestSuite).Test_BillWorkflow_Command_ChargeBeatsCancel},
+		{"Test_BillWorkflow_Command_CancelBeatsCharge", (*UnitTestSuite).Test_BillWorkflow_Command_CancelBeatsCharge},
+		{"Test_BillWorkflow_Command_RejectsDuplicateItem", (*UnitTestSuite).Test_BillWorkflow_Command_RejectsDuplicateItem},
+		{"Test_BillWorkflow_CanceledArchivedPromptly", (*UnitTestSuite).Test_BillWorkflow_CanceledArchivedPromptly},
+		{"Test_BillWorkflow_StagedWhileCharging_RejectedOnSettle", (*UnitTestSuite).Test_BillWorkflow_StagedWhileCharging_RejectedOnSettle},
+		{"Test_BillWorkflow_MetadataRoundTrip", (*UnitTestSuite).Test_BillWorkflow_MetadataRoundTrip},
+		{"Test_BillWorkflow_ResumedRun_KeepsAbsoluteExpiry", (*UnitTestSuite).Test_BillWorkflow_ResumedRun_KeepsAbsoluteExpiry},
+		{"Test_BillWorkflow_GracePeriod_AddsUntilExpiry", (*UnitTestSuite).Test_BillWorkflow_GracePeriod_AddsUntilExpiry},
+		{"Test_BillWorkflow_GracePeriod_ExtendReopens", (*UnitTestSuite).Test_BillWorkflow_GracePeriod_ExtendReopens},
+		{"Test_BillWorkflow_Labels", (*UnitTestSuite).Test_BillWorkflow_Labels},
+		{"Test_BillWorkflow_Adjust", (*UnitTestSuite).Test_BillWorkflow_Adjust},
 	}
 
 	for _, tc := range tests {
@@ -59,6 +241,8 @@ func (s *UnitTestSuite) Test_BillWorkflow_Settled(t *testing.T) {
 		"bill-happy",
 		currency.USD,
 		time.Now().Add(24*time.Hour),
+		BillOptions{},
+		nil,
 	)
 
 	// make sure workflow finished without issues
@@ -83,8 +267,8 @@ func (s *UnitTestSuite) Test_BillWorkflow_Settled(t *testing.T) {
 	if sum.Status != BillSettled {
 		t.Fatalf("expected SETTLED, got %s", sum.Status)
 	}
-	if sum.Total != 2000 {
-		t.Fatalf("expected total 2000, got %d", sum.Total)
+	if sum.Total != 2000 || sum.FormattedTotal != "$20.00" {
+		t.Fatalf("expected total 2000 ($20.00), got %d (%s)", sum.Total, sum.FormattedTotal)
 	}
 	if len(sum.Items) != 2 {
 		t.Fatalf("expected 2 items, got %d", len(sum.Items))
@@ -104,7 +288,7 @@ func (s *UnitTestSuite) Test_BillWorkflow_DuplicateItem(t *testing.T) {
 		s.env.SignalWorkflow(SignalChargeBill, nil)
 	}, 0)
 
-	s.env.ExecuteWorkflow(BillWorkflow, "dup-bill", currency.USD, time.Now().Add(24*time.Hour))
+	s.env.ExecuteWorkflow(BillWorkflow, "dup-bill", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
 	if err := s.env.GetWorkflowError(); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -131,19 +315,22 @@ func (s *UnitTestSuite) Test_BillWorkflow_ChargeFail(t *testing.T) {
 		s.env.SignalWorkflow(SignalChargeBill, nil)
 	}, 0)
 
-	s.env.ExecuteWorkflow(BillWorkflow, "fail-bill", currency.USD, time.Now().Add(24*time.Hour))
+	s.env.ExecuteWorkflow(BillWorkflow, "fail-bill", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
 	err := s.env.GetWorkflowError()
 	if err == nil {
 		t.Fatal("expected error on partial failure compensation")
 	}
 	var appErr *temporal.ApplicationError
-	if !errors.As(err, &appErr) || appErr.Type() != "ChargeCompensated" {
+	if !errors.As(err, &appErr) || appErr.Type() != ErrTypeChargeCompensated {
 		t.Fatalf("expected ApplicationError ChargeCompensated, got %v", err)
 	}
-	var failedIDs []string
-	appErr.Details(&failedIDs)
-	if len(failedIDs) != 1 || failedIDs[0] != "bad" {
-		t.Errorf("expected failedIDs=[\"bad\"], got %v", failedIDs)
+	var d ChargeFailureDetail
+	if err := appErr.Details(&d); err != nil {
+		t.Fatalf("decode details: %v", err)
+	}
+	want := ChargeFailureDetail{Category: FailureCategoryCharge, FailedIDs: []string{"bad"}, RefundedIDs: []string{"ok"}, Total: 150}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("want details %+v, got %+v", want, d)
 	}
 
 	qr, _ := s.env.QueryWorkflow(QueryBill)
@@ -168,7 +355,7 @@ func (s *UnitTestSuite) Test_BillWorkflow_ChargeFail(t *testing.T) {
 func (s *UnitTestSuite) Test_BillWorkflow_Canceled(t *testing.T) {
 	s.env.RegisterDelayedCallback(func() {
 		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "x1", Name: "Book", Amount: 1500})
-		s.env.SignalWorkflow(SignalCancelBill, nil)
+		s.env.SignalWorkflow(SignalCancelBill, "duplicate order")
 	}, 0)
 
 	s.env.ExecuteWorkflow(
@@ -176,6 +363,8 @@ func (s *UnitTestSuite) Test_BillWorkflow_Canceled(t *testing.T) {
 		"bill-cancel",
 		currency.USD,
 		time.Now().Add(24*time.Hour),
+		BillOptions{},
+		nil,
 	)
 
 	if !s.env.IsWorkflowCompleted() {
@@ -203,6 +392,9 @@ func (s *UnitTestSuite) Test_BillWorkflow_Canceled(t *testing.T) {
 	if sum.Items[0].Status != ItemCanceled {
 		t.Fatalf("expected item CANCELED, got %s", sum.Items[0].Status)
 	}
+	if sum.CancelReason != "duplicate order" {
+		t.Errorf("expected cancel reason %q, got %q", "duplicate order", sum.CancelReason)
+	}
 }
 
 func (s *UnitTestSuite) Test_BillWorkflow_Expired(t *testing.T) {
@@ -216,6 +408,8 @@ func (s *UnitTestSuite) Test_BillWorkflow_Expired(t *testing.T) {
 		"bill-expire",
 		currency.USD,
 		time.Now().Add(24*time.Hour),
+		BillOptions{},
+		nil,
 	)
 
 	if !s.env.IsWorkflowCompleted() {
@@ -247,6 +441,65 @@ func (s *UnitTestSuite) Test_BillWorkflow_Expired(t *testing.T) {
 	}
 }
 
+func (s *UnitTestSuite) Test_BillWorkflow_AutoChargeOnExpiry_Charges(t *testing.T) {
+	periodEnd := s.env.Now().Add(24 * time.Hour)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-auto-charge", currency.USD, periodEnd, BillOptions{AutoChargeOnExpiry: true}, nil)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if sum.Status != BillSettled || sum.SettledAmount != 1500 {
+		t.Fatalf("bill %s settled for %d, want SETTLED for 1500", sum.Status, sum.SettledAmount)
+	}
+	for _, it := range sum.Items {
+		if it.Status != ItemCharged {
+			t.Errorf("item %s is %s, want CHARGED", it.ID, it.Status)
+		}
+	}
+	// nothing charged it before the period ended
+	if sum.SettledAt == nil || sum.SettledAt.Before(periodEnd) {
+		t.Errorf("settled at %v, want after the period end %v", sum.SettledAt, periodEnd)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_AutoChargeOnExpiry_EmptyExpires(t *testing.T) {
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-auto-charge-empty", currency.USD, time.Now().Add(24*time.Hour), BillOptions{AutoChargeOnExpiry: true}, nil)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if sum.Status != BillExpired {
+		t.Errorf("got %s; want EXPIRED", sum.Status)
+	}
+}
+
 func (s *UnitTestSuite) Test_BillWorkflow_ChargeWithNoItems_Expires(t *testing.T) {
 	s.env.RegisterDelayedCallback(func() {
 		s.env.SignalWorkflow(SignalChargeBill, nil)
@@ -256,6 +509,8 @@ func (s *UnitTestSuite) Test_BillWorkflow_ChargeWithNoItems_Expires(t *testing.T
 		"no-items-bill",
 		currency.USD,
 		time.Now().Add(24*time.Hour),
+		BillOptions{},
+		nil,
 	)
 	if !s.env.IsWorkflowCompleted() {
 		t.Fatal("workflow still running")
@@ -286,6 +541,8 @@ func (s *UnitTestSuite) Test_BillWorkflow_AllItemsFail(t *testing.T) {
 		"fail-all-bill",
 		currency.USD,
 		time.Now().Add(24*time.Hour),
+		BillOptions{},
+		nil,
 	)
 
 	err := s.env.GetWorkflowError()
@@ -293,13 +550,16 @@ func (s *UnitTestSuite) Test_BillWorkflow_AllItemsFail(t *testing.T) {
 		t.Fatal("expected error on all‑items failure")
 	}
 	var appErr *temporal.ApplicationError
-	if !errors.As(err, &appErr) || appErr.Type() != "ChargeFailed" {
+	if !errors.As(err, &appErr) || appErr.Type() != ErrTypeChargeFailed {
 		t.Fatalf("expected ApplicationError ChargeFailed, got %v", err)
 	}
-	var failedIDs []string
-	appErr.Details(&failedIDs)
-	if len(failedIDs) != 2 {
-		t.Errorf("expected two failed IDs, got %v", failedIDs)
+	var d ChargeFailureDetail
+	if err := appErr.Details(&d); err != nil {
+		t.Fatalf("decode details: %v", err)
+	}
+	want := ChargeFailureDetail{Category: FailureCategoryCharge, FailedIDs: []string{"a1", "b2"}, RefundedIDs: []string{}, Total: 300}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("want details %+v, got %+v", want, d)
 	}
 
 	qr, _ := s.env.QueryWorkflow(QueryBill)
@@ -317,3 +577,3217 @@ func (s *UnitTestSuite) Test_BillWorkflow_AllItemsFail(t *testing.T) {
 		}
 	}
 }
+
+func (s *UnitTestSuite) Test_BillWorkflow_RemoveItem(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalRemoveLineItem, "a1")
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(
+		BillWorkflow,
+		"bill-remove",
+		currency.USD,
+		time.Now().Add(24*time.Hour),
+		BillOptions{},
+		nil,
+	)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+
+	if sum.Status != BillSettled {
+		t.Fatalf("expected SETTLED, got %s", sum.Status)
+	}
+	if sum.Total != 500 {
+		t.Fatalf("expected total 500, got %d", sum.Total)
+	}
+	if len(sum.Items) != 1 || sum.Items[0].ID != "b2" {
+		t.Fatalf("expected only item b2, got %+v", sum.Items)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_VoidItem(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "c3", Name: "Notebook", Amount: 300})
+		s.env.SignalWorkflow(SignalVoidItem, "b2")
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Errorf("query failed: %v", err)
+			return
+		}
+		var open Bill
+		_ = qr.Get(&open)
+		if open.Status != BillOpen || open.Total != 1800 || open.Pending != 2 {
+			t.Errorf("after the void: status %s, total %d, %d pending; want OPEN, 1800 and 2", open.Status, open.Total, open.Pending)
+		}
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, time.Second)
+
+	s.env.ExecuteWorkflow(
+		BillWorkflow,
+		"bill-void",
+		currency.USD,
+		time.Now().Add(24*time.Hour),
+		BillOptions{},
+		nil,
+	)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if sum.Status != BillSettled || sum.Total != 1800 {
+		t.Fatalf("bill %s with total %d, want SETTLED with 1800", sum.Status, sum.Total)
+	}
+	// the voided item stays on the bill and is never charged
+	want := map[string]LineItemStatus{"a1": ItemCharged, "b2": ItemCanceled, "c3": ItemCharged}
+	for _, it := range sum.Items {
+		if it.Status != want[it.ID] {
+			t.Errorf("item %s is %s, want %s", it.ID, it.Status, want[it.ID])
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_UpdateItem(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalUpdateLineItem, LineItem{ID: "a1", Name: "Notebook", Amount: 1200})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(
+		BillWorkflow,
+		"bill-update",
+		currency.USD,
+		time.Now().Add(24*time.Hour),
+		BillOptions{},
+		nil,
+	)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+
+	if sum.Status != BillSettled {
+		t.Fatalf("expected SETTLED, got %s", sum.Status)
+	}
+	if sum.Total != 1700 {
+		t.Fatalf("expected total 1700, got %d", sum.Total)
+	}
+	if sum.Items[0].Name != "Notebook" || sum.Items[0].Amount != 1200 {
+		t.Fatalf("expected updated item, got %+v", sum.Items[0])
+	}
+	for _, it := range sum.Items {
+		if it.Status != ItemCharged {
+			t.Fatalf("item %s not charged", it.ID)
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ChargeUpdate_Settled(t *testing.T) {
+	var result Bill
+	var updateErr error
+	completed := false
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(UpdateCommand, "charge-1", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) { t.Errorf("update rejected: %v", err) },
+			OnComplete: func(res interface{}, err error) {
+				completed = true
+				updateErr = err
+				if err == nil {
+					result = res.(CommandResult).Bill
+				}
+			},
+		}, Command{Type: CommandCharge})
+	}, time.Second)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-update-charge", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if !completed {
+		t.Fatal("charge update did not complete")
+	}
+	if updateErr != nil {
+		t.Fatalf("charge update error: %v", updateErr)
+	}
+	if result.Status != BillSettled {
+		t.Fatalf("expected SETTLED from update, got %s", result.Status)
+	}
+	if result.Total != 2000 {
+		t.Fatalf("expected total 2000, got %d", result.Total)
+	}
+	for _, it := range result.Items {
+		if it.Status != ItemCharged {
+			t.Fatalf("item %s not charged", it.ID)
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ChargeUpdate_Compensated(t *testing.T) {
+	var result Bill
+	completed := false
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "ok", Name: "Book", Amount: 100})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "bad", Name: "FAIL", Amount: 50})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(UpdateCommand, "charge-1", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) { t.Errorf("update rejected: %v", err) },
+			OnComplete: func(res interface{}, err error) {
+				completed = true
+				if err != nil {
+					t.Errorf("charge update error: %v", err)
+					return
+				}
+				result = res.(CommandResult).Bill
+			},
+		}, Command{Type: CommandCharge})
+	}, time.Second)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-update-compensated", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	var appErr *temporal.ApplicationError
+	if err := s.env.GetWorkflowError(); !errors.As(err, &appErr) || appErr.Type() != ErrTypeChargeCompensated {
+		t.Fatalf("expected ApplicationError ChargeCompensated, got %v", err)
+	}
+	if !completed {
+		t.Fatal("charge update did not complete")
+	}
+	if result.Status != BillCompensated {
+		t.Fatalf("expected COMPENSATED from update, got %s", result.Status)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ChargeUpdate_RejectedWithNoItems(t *testing.T) {
+	var rejectErr error
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(UpdateCommand, "charge-1", &testsuite.TestUpdateCallback{
+			OnAccept:   func() { t.Error("update should have been rejected") },
+			OnReject:   func(err error) { rejectErr = err },
+			OnComplete: func(interface{}, error) {},
+		}, Command{Type: CommandCharge})
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-update-empty", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if rejectErr == nil {
+		t.Fatal("expected charge update to be rejected")
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillExpired {
+		t.Errorf("got %s; want EXPIRED", sum.Status)
+	}
+}
+
+// sends both commands in the same instant, the first one is applied and the second one is
+// checked against the bill the first one left behind
+func (s *UnitTestSuite) raceCommands(t *testing.T, first, second Command) (CommandResult, error) {
+	var won CommandResult
+	var lost error
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(UpdateCommand, "first", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) { t.Errorf("first command rejected: %v", err) },
+			OnComplete: func(res interface{}, err error) {
+				if err != nil {
+					t.Errorf("first command failed: %v", err)
+					return
+				}
+				won = res.(CommandResult)
+			},
+		}, first)
+		s.env.UpdateWorkflow(UpdateCommand, "second", &testsuite.TestUpdateCallback{
+			OnAccept:   func() { t.Error("second command should have been rejected") },
+			OnReject:   func(err error) { lost = err },
+			OnComplete: func(interface{}, error) {},
+		}, second)
+	}, time.Second)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-race", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+	return won, lost
+}
+
+// the rejection's reason and details, as the handlers read them
+func rejection(t *testing.T, err error) ErrorDetails {
+	t.Helper()
+	var appErr *temporal.ApplicationError
+	var d ErrorDetails
+	if !errors.As(err, &appErr) || appErr.Details(&d) != nil {
+		t.Fatalf("expected an application error with details, got %v", err)
+	}
+	if appErr.Type() != string(d.Reason) {
+		t.Errorf("error type %s doesn't match reason %s", appErr.Type(), d.Reason)
+	}
+	return d
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Command_ChargeBeatsCancel(t *testing.T) {
+	won, lost := s.raceCommands(t, Command{Type: CommandCharge}, Command{Type: CommandCancel, Reason: "duplicate order"})
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if won.Status != BillSettled {
+		t.Errorf("charge returned %s; want SETTLED", won.Status)
+	}
+	if d := rejection(t, lost); d.Reason != ReasonBillNotOpen || d.Status != BillCharging {
+		t.Errorf("cancel rejected with %+v; want BILL_NOT_OPEN while CHARGING", d)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Command_CancelBeatsCharge(t *testing.T) {
+	won, lost := s.raceCommands(t, Command{Type: CommandCancel, Reason: "duplicate order"}, Command{Type: CommandCharge})
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if won.Status != BillCanceled || won.Bill.CancelReason != "duplicate order" {
+		t.Errorf("cancel returned %s (%q); want CANCELED (duplicate order)", won.Status, won.Bill.CancelReason)
+	}
+	if d := rejection(t, lost); d.Reason != ReasonBillNotOpen || d.Status != BillCanceled {
+		t.Errorf("charge rejected with %+v; want BILL_NOT_OPEN while CANCELED", d)
+	}
+	if len(s.heldAccounts) != 0 {
+		t.Errorf("funds held for %v; a canceled bill must not touch the account", s.heldAccounts)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Command_RejectsDuplicateItem(t *testing.T) {
+	var lost error
+	item := LineItem{ID: "a1", Name: "Book", Amount: 1500}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(UpdateCommand, "add-1", &testsuite.TestUpdateCallback{
+			OnAccept:   func() {},
+			OnReject:   func(err error) { t.Errorf("first add rejected: %v", err) },
+			OnComplete: func(interface{}, error) {},
+		}, Command{Type: CommandAddItem, Item: item})
+		s.env.UpdateWorkflow(UpdateCommand, "add-2", &testsuite.TestUpdateCallback{
+			OnAccept:   func() { t.Error("duplicate add should have been rejected") },
+			OnReject:   func(err error) { lost = err },
+			OnComplete: func(interface{}, error) {},
+		}, Command{Type: CommandAddItem, Item: item})
+	}, time.Second)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-duplicate", currency.USD, time.Now().Add(time.Hour), BillOptions{}, nil)
+
+	if d := rejection(t, lost); d.Reason != ReasonItemExists || d.ItemID != "a1" {
+		t.Errorf("duplicate add rejected with %+v; want ITEM_EXISTS for a1", d)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if len(sum.Items) != 1 || sum.Total != 1500 {
+		t.Errorf("bill has %d items totaling %d; want the item once", len(sum.Items), sum.Total)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_QueryStatus_MatchesBill(t *testing.T) {
+	// the status query against the full bill, compared on the open bill and once it settled
+	compare := func(stage string) {
+		qr, err := s.env.QueryWorkflow(QueryStatus)
+		if err != nil {
+			t.Fatalf("%s: status query failed: %v", stage, err)
+		}
+		var got BillStatusResult
+		qr.Get(&got)
+		qr, _ = s.env.QueryWorkflow(QueryBill)
+		var bill Bill
+		qr.Get(&bill)
+		want := BillStatusResult{Status: bill.Status, Total: bill.Total, PendingCount: bill.PendingCount()}
+		if got != want {
+			t.Errorf("%s: status = %+v; want %+v", stage, got, want)
+		}
+	}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "d1", Name: "Promo", Amount: 200, Kind: KindDiscount})
+	}, 0)
+	var open BillStatusResult
+	s.env.RegisterDelayedCallback(func() {
+		compare("open")
+		qr, _ := s.env.QueryWorkflow(QueryStatus)
+		qr.Get(&open)
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, time.Second)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-status", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if want := (BillStatusResult{Status: BillOpen, Total: 1800, PendingCount: 2}); open != want {
+		t.Errorf("open status = %+v; want %+v", open, want)
+	}
+	compare("settled")
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_QueryProgress(t *testing.T) {
+	progress := func() ChargeProgress {
+		qr, err := s.env.QueryWorkflow(QueryProgress)
+		if err != nil {
+			t.Fatalf("progress query failed: %v", err)
+		}
+		var p ChargeProgress
+		qr.Get(&p)
+		return p
+	}
+	// when the first item starts charging, and once all are charged but the held funds not captured yet
+	var (
+		midCharge, charged ChargeProgress
+		statusCharged      BillStatus
+	)
+	started := 0
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		switch info.ActivityType.Name {
+		case "ChargeLineItemActivity":
+			if started++; started == 1 {
+				midCharge = progress()
+			}
+		case "CaptureHoldActivity":
+			charged = progress()
+			qr, _ := s.env.QueryWorkflow(QueryStatus)
+			var st BillStatusResult
+			qr.Get(&st)
+			statusCharged = st.Status
+		}
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "c3", Name: "Ink", Amount: 250})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "d1", Name: "Promo", Amount: 100, Kind: KindDiscount})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalRefundItem, "b2")
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-progress", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	tests := []struct {
+		name string
+		got  ChargeProgress
+		want ChargeProgress
+	}{
+		{"mid-charge", midCharge, ChargeProgress{Total: 3, Remaining: 3}},
+		{"charged, not settled", charged, ChargeProgress{Total: 3, Charged: 3}},
+		{"settled and refunded", progress(), ChargeProgress{Total: 3, Charged: 2, Refunded: 1}},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("%s progress = %+v; want %+v", tc.name, tc.got, tc.want)
+		}
+	}
+	if statusCharged != BillCharging {
+		t.Errorf("status before capture = %s; want %s", statusCharged, BillCharging)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RejectedItems(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		// signalled directly, so nothing checked it before the workflow got it
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book again", Amount: 900})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "late", Name: "Pen", Amount: 500})
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-rejected", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, err := s.env.QueryWorkflow(QueryRejectedItems)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var rejected []RejectedItem
+	qr.Get(&rejected)
+	if len(rejected) != 2 {
+		t.Fatalf("rejected items = %+v; want the duplicate and the late item", rejected)
+	}
+	for i, want := range []struct{ id, reason string }{{"a1", "already exists"}, {"late", ErrBillNotOpen.Error()}} {
+		if r := rejected[i]; r.ID != want.id || !strings.Contains(r.Reason, want.reason) || r.At.IsZero() {
+			t.Errorf("rejected item %d = %+v; want %s rejected with %q", i, r, want.id, want.reason)
+		}
+	}
+
+	qr, _ = s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if len(sum.Items) != 1 || sum.Items[0].Amount != 1500 {
+		t.Errorf("items = %+v; want only the first a1", sum.Items)
+	}
+	if sum.RejectedItems != nil {
+		t.Errorf("bill query holds rejected items %+v; want them only served by their own query", sum.RejectedItems)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_CatalogOnly(t *testing.T) {
+	var unknownErr error
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "u1", Name: "Mystery box", Amount: 900})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(UpdateCommand, "known", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) { t.Errorf("known product rejected: %v", err) },
+			OnComplete: func(_ interface{}, err error) {
+				if err != nil {
+					t.Errorf("adding a known product failed: %v", err)
+				}
+			},
+		}, Command{Type: CommandAddItem, Item: LineItem{ID: "p1", Name: "pen", Amount: 500}})
+		s.env.UpdateWorkflow(UpdateCommand, "unknown", &testsuite.TestUpdateCallback{
+			OnAccept:   func() {},
+			OnReject:   func(err error) { unknownErr = err },
+			OnComplete: func(_ interface{}, err error) { unknownErr = err },
+		}, Command{Type: CommandAddItem, Item: LineItem{ID: "u2", Name: "Gadget", Amount: 700}})
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, time.Minute)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-catalog", currency.USD, time.Now().Add(24*time.Hour), BillOptions{CatalogOnly: true}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if d := rejection(t, unknownErr); d.Reason != ReasonUnknownProduct || d.ItemID != "u2" {
+		t.Errorf("unknown product rejected with %+v; want %s for u2", d, ReasonUnknownProduct)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || len(sum.Items) != 2 || sum.Items[0].ID != "a1" || sum.Items[1].ID != "p1" {
+		t.Errorf("bill = %s with items %+v; want a1 and p1 settled", sum.Status, sum.Items)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryRejectedItems)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var rejected []RejectedItem
+	qr.Get(&rejected)
+	// the update's caller got its rejection back, only the signalled product is kept
+	if len(rejected) != 1 || rejected[0].ID != "u1" || rejected[0].Reason != "unknown product" {
+		t.Errorf("rejected items = %+v; want u1 rejected as an unknown product", rejected)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_QueryItem_MidCharge(t *testing.T) {
+	var midCharge ItemQueryResult
+	var missing ItemQueryResult
+	queried := false
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name != "ChargeLineItemActivity" || queried {
+			return
+		}
+		queried = true
+		qr, err := s.env.QueryWorkflow(QueryItem, "a1")
+		if err != nil {
+			t.Errorf("query failed: %v", err)
+			return
+		}
+		qr.Get(&midCharge)
+		qr, _ = s.env.QueryWorkflow(QueryItem, "nope")
+		qr.Get(&missing)
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-query-item", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if !queried {
+		t.Fatal("charge activity never started")
+	}
+	if !midCharge.Found || midCharge.Item.ID != "a1" || midCharge.Item.Amount != 1500 {
+		t.Fatalf("unexpected mid-charge item: %+v", midCharge)
+	}
+	if midCharge.Item.Status != ItemPending {
+		t.Errorf("mid-charge status = %s; want %s", midCharge.Item.Status, ItemPending)
+	}
+	if missing.Found {
+		t.Errorf("expected missing item not to be found, got %+v", missing)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryItem, "a1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var final ItemQueryResult
+	qr.Get(&final)
+	if final.Item.Status != ItemCharged {
+		t.Errorf("final status = %s; want %s", final.Item.Status, ItemCharged)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_UpsertsStatus(t *testing.T) {
+	var (
+		statuses []string
+		totals   []int64
+		archived []bool
+		accounts []string
+	)
+	s.env.OnUpsertTypedSearchAttributes(mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		sa := args.Get(0).(temporal.SearchAttributes)
+		status, _ := sa.GetKeyword(billStatusKey)
+		total, _ := sa.GetInt64(billTotalKey)
+		a, _ := sa.GetBool(billArchivedKey)
+		acc, _ := sa.GetKeyword(billAccountKey)
+		statuses = append(statuses, status)
+		totals = append(totals, total)
+		archived = append(archived, a)
+		accounts = append(accounts, acc)
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-upsert", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	// the settled status is upserted again when the bill is archived at the end of its refund window
+	want := []string{string(BillOpen), string(BillCharging), string(BillSettled), string(BillSettled)}
+	if len(statuses) != len(want) {
+		t.Fatalf("upserted statuses = %v; want %v", statuses, want)
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Errorf("upsert[%d] = %s; want %s", i, statuses[i], want[i])
+		}
+	}
+	// the bill starts empty and the total is set once charging begins
+	if wantTotals := []int64{0, 1500, 1500, 1500}; fmt.Sprint(totals) != fmt.Sprint(wantTotals) {
+		t.Errorf("upserted totals = %v; want %v", totals, wantTotals)
+	}
+	if wantArchived := []bool{false, false, false, true}; fmt.Sprint(archived) != fmt.Sprint(wantArchived) {
+		t.Errorf("upserted archived = %v; want %v", archived, wantArchived)
+	}
+	// bills without an account ID are counted against the default account
+	for i, acc := range accounts {
+		if acc != DefaultAccountID {
+			t.Errorf("upsert[%d] account = %q; want %q", i, acc, DefaultAccountID)
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_PartialCharge_StaysOpen(t *testing.T) {
+	var mid Bill
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "ok", Name: "Book", Amount: 100})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "bad", Name: "FAIL", Amount: 50})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "rest", Name: "Pen", Amount: 25})
+		s.env.SignalWorkflow(SignalChargePartial, []string{"ok", "bad"})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Errorf("query failed: %v", err)
+			return
+		}
+		qr.Get(&mid)
+		s.env.SignalWorkflow(SignalCancelBill, nil)
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-partial-open", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	if mid.Status != BillOpen {
+		t.Fatalf("expected bill to stay OPEN after partial charge, got %s", mid.Status)
+	}
+	want := map[string]LineItemStatus{"ok": ItemCharged, "bad": ItemFailed, "rest": ItemPending}
+	for _, it := range mid.Items {
+		if it.Status != want[it.ID] {
+			t.Errorf("item %s status = %s; want %s", it.ID, it.Status, want[it.ID])
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_PartialCharge_AllItems_Compensated(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "ok", Name: "Book", Amount: 100})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "bad", Name: "FAIL", Amount: 50})
+		s.env.SignalWorkflow(SignalChargePartial, []string{"ok", "bad"})
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-partial-all", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	var appErr *temporal.ApplicationError
+	if err := s.env.GetWorkflowError(); !errors.As(err, &appErr) || appErr.Type() != ErrTypeChargeCompensated {
+		t.Fatalf("expected ApplicationError ChargeCompensated, got %v", err)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillCompensated {
+		t.Errorf("want COMPENSATED, got %s", sum.Status)
+	}
+	want := map[string]LineItemStatus{"ok": ItemRefunded, "bad": ItemFailed}
+	for _, it := range sum.Items {
+		if it.Status != want[it.ID] {
+			t.Errorf("item %s status = %s; want %s", it.ID, it.Status, want[it.ID])
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_PartialThenFullCharge_Settled(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalChargePartial, []string{"a1"})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-partial-full", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled {
+		t.Fatalf("expected SETTLED, got %s", sum.Status)
+	}
+	for _, it := range sum.Items {
+		if it.Status != ItemCharged {
+			t.Errorf("item %s status = %s; want %s", it.ID, it.Status, ItemCharged)
+		}
+	}
+}
+
+// partially charges a1 of a 1000 and a 500 item and ends the bill with end an hour later, it never settles
+// so a1 has to be refunded at the processor and the account is left as it was
+func (s *UnitTestSuite) partialChargeUnsettled(t *testing.T, end func(), want BillStatus) {
+	refunded := map[string]int{}
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, args converter.EncodedValues) {
+		if info.ActivityType.Name == "RefundLineItemActivity" {
+			var li LineItem
+			args.Get(&li)
+			refunded[li.ID]++
+		}
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalChargePartial, []string{"a1"})
+	}, 0)
+	s.env.RegisterDelayedCallback(end, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-partial-unsettled", currency.USD, s.env.Now().Add(2*time.Hour), BillOptions{ReopenGraceSeconds: 60}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != want || sum.SettledAmount != 0 {
+		t.Errorf("status %s settled %d; want %s and nothing settled", sum.Status, sum.SettledAmount, want)
+	}
+	wantItems := map[string]LineItemStatus{"a1": ItemRefunded, "a2": ItemCanceled}
+	for _, it := range sum.Items {
+		if it.Status != wantItems[it.ID] {
+			t.Errorf("item %s status = %s; want %s", it.ID, it.Status, wantItems[it.ID])
+		}
+	}
+	if refunded["a1"] != 1 || len(refunded) != 1 {
+		t.Errorf("refunds = %v; want a1 refunded once", refunded)
+	}
+	if s.balances[currency.USD] != 1_000_000 || s.held[currency.USD] != 0 {
+		t.Errorf("balance %d held %d; want the account untouched", s.balances[currency.USD], s.held[currency.USD])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_PartialCharge_Canceled(t *testing.T) {
+	s.partialChargeUnsettled(t, func() {
+		s.env.UpdateWorkflow(UpdateCommand, "cancel", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) { t.Errorf("cancel rejected: %v", err) },
+			OnComplete: func(_ interface{}, err error) {
+				if err != nil {
+					t.Errorf("cancel failed: %v", err)
+				}
+			},
+		}, Command{Type: CommandCancel, Reason: "duplicate order"})
+	}, BillCanceled)
+}
+
+// the period ends with a1 charged, it stays charged while the bill could be reopened and is refunded after
+func (s *UnitTestSuite) Test_BillWorkflow_PartialCharge_Expired(t *testing.T) {
+	s.partialChargeUnsettled(t, func() {}, BillExpired)
+}
+
+// a partial charge that leaves nothing pending settles the bill through the same checks as a charge,
+// a bill over its maximum total stays open instead
+func (s *UnitTestSuite) Test_BillWorkflow_PartialCharge_LastItem_OverMaxTotal(t *testing.T) {
+	var mid Bill
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 800})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a2", Name: "Pen", Amount: 600})
+		s.env.SignalWorkflow(SignalChargePartial, []string{"a1"})
+		s.env.SignalWorkflow(SignalChargePartial, []string{"a2"})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Errorf("query failed: %v", err)
+			return
+		}
+		qr.Get(&mid)
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-partial-over-max", currency.USD, s.env.Now().Add(2*time.Hour), BillOptions{MaxTotal: 1000, ReopenGraceSeconds: 60}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if mid.Status != BillOpen || mid.countItems(ItemCharged) != 2 {
+		t.Errorf("bill is %s with items %+v; want OPEN with both items charged", mid.Status, mid.Items)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryEvents)
+	var events []BillEvent
+	qr.Get(&events)
+	var started []string
+	for _, ev := range events {
+		if ev.Type == EventChargeStarted {
+			started = append(started, ev.Detail)
+		}
+	}
+	if !slices.Equal(started, []string{"items a1", "items a2"}) {
+		t.Errorf("CHARGE_STARTED events %v; want only the partial charges", started)
+	}
+	qr, _ = s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillExpired || sum.SettledAmount != 0 || sum.countItems(ItemRefunded) != 2 {
+		t.Errorf("status %s settled %d items %+v; want EXPIRED with both items refunded", sum.Status, sum.SettledAmount, sum.Items)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RetryFailed_Succeeds(t *testing.T) {
+	processorDown := true
+	s.env.OnActivity(ChargeLineItemActivity, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, li LineItem) (ChargeResult, error) {
+			if processorDown {
+				return ChargeResult{}, fmt.Errorf("processor unavailable for %s", li.ID)
+			}
+			return ChargeResult{Code: ChargeApproved, ProcessorRef: "ch_" + li.ID}, nil
+		})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	var failed Bill
+	s.env.RegisterDelayedCallback(func() {
+		qr, _ := s.env.QueryWorkflow(QueryBill)
+		qr.Get(&failed)
+		processorDown = false
+		s.env.SignalWorkflow(SignalRetryFailed, nil)
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-retry-ok", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("expected retry to clear the workflow error, got %v", err)
+	}
+	if failed.Status != BillFailed {
+		t.Fatalf("expected FAILED before retry, got %s", failed.Status)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled {
+		t.Fatalf("want SETTLED after retry, got %s", sum.Status)
+	}
+	if sum.Items[0].Status != ItemCharged {
+		t.Errorf("item %s status = %s; want %s", sum.Items[0].ID, sum.Items[0].Status, ItemCharged)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RetryFailed_FailsAgain(t *testing.T) {
+	charges := map[string]int{}
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, args converter.EncodedValues) {
+		if info.ActivityType.Name != "ChargeLineItemActivity" || info.Attempt != 1 {
+			return
+		}
+		var li LineItem
+		args.Get(&li)
+		charges[li.ID]++
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "ok", Name: "Book", Amount: 100})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "bad", Name: "FAIL", Amount: 50})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalRetryFailed, nil)
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-retry-fail", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	var appErr *temporal.ApplicationError
+	if err := s.env.GetWorkflowError(); !errors.As(err, &appErr) || appErr.Type() != ErrTypeChargeCompensated {
+		t.Fatalf("expected ApplicationError ChargeCompensated, got %v", err)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillCompensated {
+		t.Errorf("want COMPENSATED, got %s", sum.Status)
+	}
+	want := map[string]LineItemStatus{"ok": ItemRefunded, "bad": ItemFailed}
+	for _, it := range sum.Items {
+		if it.Status != want[it.ID] {
+			t.Errorf("item %s status = %s; want %s", it.ID, it.Status, want[it.ID])
+		}
+	}
+	if charges["ok"] != 1 {
+		t.Errorf("refunded item charged %d times; want 1", charges["ok"])
+	}
+	if charges["bad"] != 2 {
+		t.Errorf("failed item charged %d times; want 2", charges["bad"])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_DiscountThenCharge(t *testing.T) {
+	var charged []string
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, args converter.EncodedValues) {
+		if info.ActivityType.Name != "ChargeLineItemActivity" {
+			return
+		}
+		var li LineItem
+		args.Get(&li)
+		charged = append(charged, li.ID)
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "promo", Name: "Promo", Amount: 300, Kind: KindDiscount})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-discount", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled {
+		t.Fatalf("expected SETTLED, got %s", sum.Status)
+	}
+	if sum.Total != 1200 {
+		t.Fatalf("expected total 1200, got %d", sum.Total)
+	}
+	for _, it := range sum.Items {
+		if it.Status != ItemCharged {
+			t.Errorf("item %s status = %s; want %s", it.ID, it.Status, ItemCharged)
+		}
+	}
+	if len(charged) != 1 || charged[0] != "a1" {
+		t.Errorf("charged items = %v; want [a1]", charged)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_FullyDiscountedSettles(t *testing.T) {
+	var moved []string
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		switch info.ActivityType.Name {
+		case "HoldFundsActivity", "CaptureHoldActivity", "ReleaseHoldActivity":
+			moved = append(moved, info.ActivityType.Name)
+		}
+	})
+	// the item is charged on its own, then the discount left pending settles the bill at zero
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "promo", Name: "Promo", Amount: 1500, Kind: KindDiscount})
+		s.env.SignalWorkflow(SignalChargePartial, []string{"a1"})
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-free", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.Total != 0 || sum.SettledAmount != 0 {
+		t.Fatalf("bill = %s total %d settled %d, want SETTLED at 0", sum.Status, sum.Total, sum.SettledAmount)
+	}
+	// nothing is held or debited from the account for a zero total
+	if len(moved) != 0 {
+		t.Errorf("fund activities = %v, want none", moved)
+	}
+	if s.balances[currency.USD] != 1_000_000 {
+		t.Errorf("USD balance = %d, want 1000000", s.balances[currency.USD])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_OverDiscountRejected(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 100})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "promo", Name: "Promo", Amount: 500, Kind: KindDiscount})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-over-discount", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled {
+		t.Fatalf("expected SETTLED, got %s", sum.Status)
+	}
+	if len(sum.Items) != 1 || sum.Total != 100 {
+		t.Fatalf("expected the discount to be rejected, got %d items and total %d", len(sum.Items), sum.Total)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_TaxCharged(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalRemoveLineItem, "b2")
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-tax", currency.USD, time.Now().Add(24*time.Hour), BillOptions{TaxRateBps: 887.5}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled {
+		t.Fatalf("expected SETTLED, got %s", sum.Status)
+	}
+	// tax is computed on the subtotal at charge time: 1500 * 8.875% = 133.125
+	if sum.Total != 1633 {
+		t.Fatalf("expected total 1633, got %d", sum.Total)
+	}
+	i := sum.itemIndex(TaxItemID)
+	if i < 0 {
+		t.Fatal("expected a tax line")
+	}
+	if sum.Items[i].Amount != 133 || sum.Items[i].Status != ItemCharged {
+		t.Errorf("unexpected tax line %+v", sum.Items[i])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_InitialItems(t *testing.T) {
+	// only the charge is signaled, the items are there from the start
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		var b Bill
+		qr.Get(&b)
+		if len(b.Items) != 2 || b.Total != 6400 {
+			t.Errorf("started with %d items totaling %d, want 2 totaling 6400", len(b.Items), b.Total)
+		}
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, time.Second)
+
+	items := []LineItem{
+		{ID: "support", Name: "Support plan", Amount: 4900, Status: ItemPending},
+		{ID: "seat", Name: "Seat", Amount: 1500, Status: ItemPending},
+	}
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-initial-items", currency.USD, time.Now().Add(24*time.Hour), BillOptions{Items: items, MaxTotal: 100000}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.SettledAmount != 6400 {
+		t.Errorf("status %s settled %d; want SETTLED and 6400", sum.Status, sum.SettledAmount)
+	}
+	qr, _ = s.env.QueryWorkflow(QueryEvents)
+	var events []BillEvent
+	qr.Get(&events)
+	var added int
+	for _, ev := range events {
+		if ev.Type == EventItemAdded {
+			added++
+		}
+	}
+	if added != 2 {
+		t.Errorf("recorded %d ITEM_ADDED events, want 2", added)
+	}
+	// the options are kept for bills split from this one, its items aren't
+	qr, err := s.env.QueryWorkflow(QueryOptions)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var opts BillOptions
+	qr.Get(&opts)
+	if opts.Items != nil || opts.MaxTotal != 100000 {
+		t.Errorf("options = %+v, want the max total without the items", opts)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_InitialItems_Invalid(t *testing.T) {
+	items := []LineItem{
+		{ID: "seat", Name: "Seat", Amount: 1500, Status: ItemPending},
+		{ID: "seat", Name: "Seat", Amount: 1500, Status: ItemPending},
+	}
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-initial-dup", currency.USD, time.Now().Add(24*time.Hour), BillOptions{Items: items}, nil)
+
+	var appErr *temporal.ApplicationError
+	if !errors.As(s.env.GetWorkflowError(), &appErr) || appErr.Type() != ErrTypeInvalidTemplate {
+		t.Fatalf("expected an %s error, got %v", ErrTypeInvalidTemplate, s.env.GetWorkflowError())
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_CrossCurrencyDebit(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 10000})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-convert", currency.USD, time.Now().Add(24*time.Hour), BillOptions{AccountCurrency: currency.EUR}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled {
+		t.Fatalf("expected SETTLED, got %s", sum.Status)
+	}
+	if sum.SettledAmount != 10000 || sum.ConvertedAmount != 9200 {
+		t.Errorf("settled %d converted %d; want 10000 and 9200", sum.SettledAmount, sum.ConvertedAmount)
+	}
+	if got := s.balances[currency.EUR]; got != 1_000_000-9200 {
+		t.Errorf("EUR balance = %d, want %d", got, 1_000_000-9200)
+	}
+	if got := s.balances[currency.USD]; got != 1_000_000 {
+		t.Errorf("USD balance = %d, want untouched", got)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_CrossCurrencyDebit_RoundingMode(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 10001})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	// 10001 * 0.92 = 9200.92, which rounds half up to 9201
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-convert-floor", currency.USD, time.Now().Add(24*time.Hour),
+		BillOptions{AccountCurrency: currency.EUR, RoundingMode: currency.RoundFloor}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.ConvertedAmount != 9200 {
+		t.Errorf("status %s converted %d; want SETTLED and 9200", sum.Status, sum.ConvertedAmount)
+	}
+	if got := s.balances[currency.EUR]; got != 1_000_000-9200 {
+		t.Errorf("EUR balance = %d, want %d", got, 1_000_000-9200)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ContinueAsNew_PreservesState(t *testing.T) {
+	const items = 200
+	s.env.RegisterDelayedCallback(func() {
+		for i := 0; i < items; i++ {
+			s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: fmt.Sprintf("i%d", i), Name: "Item", Amount: 10, IdempotencyKey: fmt.Sprintf("k%d", i)})
+		}
+		s.env.SetContinueAsNewSuggested(true)
+	}, 0)
+
+	periodEnd := time.Now().Add(24 * time.Hour)
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-can", currency.USD, periodEnd, BillOptions{TaxRateBps: 100}, nil)
+
+	var canErr *workflow.ContinueAsNewError
+	if !errors.As(s.env.GetWorkflowError(), &canErr) {
+		t.Fatalf("expected continue-as-new, got %v", s.env.GetWorkflowError())
+	}
+	var (
+		billID  string
+		cur     currency.Currency
+		end     time.Time
+		opts    BillOptions
+		carried *Bill
+	)
+	if err := converter.GetDefaultDataConverter().FromPayloads(canErr.Input, &billID, &cur, &end, &opts, &carried); err != nil {
+		t.Fatalf("decode continue-as-new input: %v", err)
+	}
+	if carried == nil || len(carried.Items) != items || carried.Total != items*10 {
+		t.Fatalf("carried bill = %+v, want %d items totalling %d", carried, items, items*10)
+	}
+	if len(carried.SeenKeys) != items || opts.TaxRateBps != 100 {
+		t.Fatalf("carried %d seen keys and tax rate %v, want %d and 100", len(carried.SeenKeys), opts.TaxRateBps, items)
+	}
+
+	// the next run resumes from the carried state, a repeated key is still recognised
+	s.SetupTest(t)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "i5", Name: "Item", Amount: 10, IdempotencyKey: "k5"})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+	s.env.ExecuteWorkflow(BillWorkflow, billID, cur, end, opts, carried)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled {
+		t.Fatalf("expected SETTLED, got %s", sum.Status)
+	}
+	// the carried items plus a 1% tax line on the 2000 subtotal
+	if len(sum.Items) != items+1 || sum.Total != 2020 {
+		t.Fatalf("got %d items totalling %d, want %d and 2020", len(sum.Items), sum.Total, items+1)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Hold_CapturedOnSettle(t *testing.T) {
+	s.balances[currency.USD] = 2500
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "d1", Name: "Promo", Amount: 500, Kind: KindDiscount})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-hold", currency.USD, time.Now().Add(24*time.Hour), BillOptions{AccountID: "acc-1"}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.SettledAmount != 1000 || sum.HoldID == "" {
+		t.Fatalf("got %s settled %d hold %q, want SETTLED, 1000 and a hold", sum.Status, sum.SettledAmount, sum.HoldID)
+	}
+	if s.balances[currency.USD] != 1500 || s.held[currency.USD] != 0 {
+		t.Errorf("USD balance %d held %d, want 1500 and 0", s.balances[currency.USD], s.held[currency.USD])
+	}
+	if len(s.heldAccounts) != 1 || s.heldAccounts[0] != "acc-1" {
+		t.Errorf("held accounts = %v, want [acc-1]", s.heldAccounts)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Hold_ReleasedOnCompensation(t *testing.T) {
+	s.balances[currency.USD] = 2500
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "FAIL", Amount: 500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-hold-release", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	var appErr *temporal.ApplicationError
+	if !errors.As(s.env.GetWorkflowError(), &appErr) || appErr.Type() != ErrTypeChargeCompensated {
+		t.Fatalf("expected ChargeCompensated error, got %v", s.env.GetWorkflowError())
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillCompensated || sum.HoldID != "" {
+		t.Fatalf("got %s hold %q, want COMPENSATED and no hold", sum.Status, sum.HoldID)
+	}
+	if s.balances[currency.USD] != 2500 || s.held[currency.USD] != 0 {
+		t.Errorf("USD balance %d held %d, want 2500 and 0", s.balances[currency.USD], s.held[currency.USD])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Hold_InsufficientFunds(t *testing.T) {
+	s.balances[currency.USD] = 100
+	var charged int
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "ChargeLineItemActivity" {
+			charged++
+		}
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-hold-short", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	var appErr *temporal.ApplicationError
+	if !errors.As(s.env.GetWorkflowError(), &appErr) || appErr.Type() != ErrTypeHoldFailed {
+		t.Fatalf("expected HoldFailed error, got %v", s.env.GetWorkflowError())
+	}
+	if charged != 0 {
+		t.Errorf("%d items charged, want none without held funds", charged)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillFailed {
+		t.Fatalf("expected FAILED, got %s", sum.Status)
+	}
+	for _, it := range sum.Items {
+		if it.Status != ItemFailed {
+			t.Errorf("item %s = %s, want FAILED", it.ID, it.Status)
+		}
+	}
+	if s.balances[currency.USD] != 100 || s.held[currency.USD] != 0 {
+		t.Errorf("USD balance %d held %d, want 100 and 0", s.balances[currency.USD], s.held[currency.USD])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_MaxChargeAttempts(t *testing.T) {
+	attempts := map[int32]int{}
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "ChargeLineItemActivity" {
+			attempts[info.Attempt]++
+		}
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f1", Name: "FAIL", Amount: 500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-attempts", currency.USD, time.Now().Add(24*time.Hour), BillOptions{MaxChargeAttempts: 2, ChargeTimeoutSeconds: 10}, nil)
+
+	var appErr *temporal.ApplicationError
+	if !errors.As(s.env.GetWorkflowError(), &appErr) || appErr.Type() != ErrTypeChargeFailed {
+		t.Fatalf("expected ChargeFailed error, got %v", s.env.GetWorkflowError())
+	}
+	if len(attempts) != 2 || attempts[1] != 1 || attempts[2] != 1 {
+		t.Errorf("charge attempts = %v, want exactly attempts 1 and 2", attempts)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ChargeAttemptsRecorded(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f1", Name: "FAIL", Amount: 500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "d1", Name: "DECLINE", Amount: 500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-attempts-recorded", currency.USD, time.Now().Add(24*time.Hour), BillOptions{MaxChargeAttempts: 3}, nil)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	// the flaky item used up every attempt, the others were answered on the first one
+	want := map[string]int32{"a1": 1, "f1": 3, "d1": 1}
+	for id, attempts := range want {
+		i := bill.itemIndex(id)
+		if i < 0 {
+			t.Fatalf("item %s missing from the bill", id)
+		}
+		if got := bill.Items[i].Attempts; got != attempts {
+			t.Errorf("item %s attempts = %d, want %d", id, got, attempts)
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_MaxConcurrentCharges(t *testing.T) {
+	const items = 60
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{"one at a time", 1, 1},
+		{"custom limit", 7, 7},
+		{"default limit", 0, defaultMaxConcurrentCharges},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			var mu sync.Mutex
+			running, peak := 0, 0
+			s.env.OnActivity(ChargeLineItemActivity, mock.Anything, mock.Anything).Return(
+				func(_ context.Context, li LineItem) (ChargeResult, error) {
+					mu.Lock()
+					running++
+					peak = max(peak, running)
+					mu.Unlock()
+					time.Sleep(time.Millisecond)
+					mu.Lock()
+					running--
+					mu.Unlock()
+					return ChargeResult{Code: ChargeApproved, ProcessorRef: "ch_" + li.ID}, nil
+				})
+			s.env.RegisterDelayedCallback(func() {
+				for i := range items {
+					s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: fmt.Sprintf("i%d", i), Name: "Seat", Amount: 100})
+				}
+				s.env.SignalWorkflow(SignalChargeBill, nil)
+			}, 0)
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-concurrency", currency.USD, time.Now().Add(24*time.Hour), BillOptions{MaxConcurrentCharges: tc.limit}, nil)
+
+			if err := s.env.GetWorkflowError(); err != nil {
+				t.Fatalf("workflow error: %v", err)
+			}
+			qr, _ := s.env.QueryWorkflow(QueryBill)
+			var sum Bill
+			qr.Get(&sum)
+			if sum.Status != BillSettled || sum.Total != items*100 {
+				t.Fatalf("bill = %s with total %d; want SETTLED with %d", sum.Status, sum.Total, items*100)
+			}
+			for _, it := range sum.Items {
+				if it.Status != ItemCharged || it.ProcessorRef != "ch_"+it.ID {
+					t.Errorf("item %s = %s (%s); want charged", it.ID, it.Status, it.ProcessorRef)
+				}
+			}
+			if peak > tc.want {
+				t.Errorf("%d charges ran at once; want at most %d", peak, tc.want)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ChargeStrategy(t *testing.T) {
+	items := []LineItem{
+		{ID: "b2", Name: "Pen", Amount: 500},
+		{ID: "a1", Name: "Book", Amount: 1500},
+		{ID: "c3", Name: "Ink", Amount: 700},
+	}
+	tests := []struct {
+		name      string
+		opts      BillOptions
+		failing   string
+		wantOrder []string
+		// the items that ended charged and failed
+		wantCharged []string
+		wantFailed  []string
+		wantStatus  BillStatus
+	}{
+		{"largest first", BillOptions{ChargeStrategy: ChargeLargestFirst}, "",
+			[]string{"a1", "c3", "b2"}, []string{"a1", "b2", "c3"}, nil, BillSettled},
+		{"smallest first", BillOptions{ChargeStrategy: ChargeSmallestFirst}, "",
+			[]string{"b2", "c3", "a1"}, []string{"a1", "b2", "c3"}, nil, BillSettled},
+		{"continue after failure", BillOptions{ChargeStrategy: ChargeLargestFirst}, "c3",
+			[]string{"a1", "c3", "b2"}, []string{"a1", "b2"}, []string{"c3"}, BillPartiallySettled},
+		{"stop on failure", BillOptions{ChargeStrategy: ChargeLargestFirst, StopOnFailure: true}, "c3",
+			[]string{"a1", "c3"}, []string{"a1"}, []string{"b2", "c3"}, BillPartiallySettled},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			var order []string
+			s.env.OnActivity(ChargeLineItemActivity, mock.Anything, mock.Anything).Return(
+				func(_ context.Context, li LineItem) (ChargeResult, error) {
+					order = append(order, li.ID)
+					if li.ID == tc.failing {
+						return ChargeResult{}, temporal.NewNonRetryableApplicationError("card declined", chargeDeclinedType, nil, ChargeResult{Code: ChargeDeclined})
+					}
+					return ChargeResult{Code: ChargeApproved, ProcessorRef: "ch_" + li.ID}, nil
+				})
+			s.env.RegisterDelayedCallback(func() {
+				for _, it := range items {
+					s.env.SignalWorkflow(SignalAddLineItem, it)
+				}
+				// closed, so the charged items are kept when others fail
+				s.env.SignalWorkflow(SignalCloseBill, nil)
+			}, 0)
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-strategy", currency.USD, time.Now().Add(24*time.Hour), tc.opts, nil)
+
+			if !reflect.DeepEqual(order, tc.wantOrder) {
+				t.Errorf("charge order = %v; want %v", order, tc.wantOrder)
+			}
+			qr, _ := s.env.QueryWorkflow(QueryBill)
+			var sum Bill
+			qr.Get(&sum)
+			if sum.Status != tc.wantStatus {
+				t.Fatalf("status = %s; want %s", sum.Status, tc.wantStatus)
+			}
+			var charged, failed []string
+			var chargedAmount int64
+			for _, it := range sum.Items {
+				switch it.Status {
+				case ItemCharged:
+					charged = append(charged, it.ID)
+					chargedAmount += it.Amount
+				case ItemFailed:
+					failed = append(failed, it.ID)
+				}
+			}
+			slices.Sort(charged)
+			slices.Sort(failed)
+			if !reflect.DeepEqual(charged, tc.wantCharged) || !reflect.DeepEqual(failed, tc.wantFailed) {
+				t.Errorf("charged %v failed %v; want %v and %v", charged, failed, tc.wantCharged, tc.wantFailed)
+			}
+			// what the items were charged for is what the bill settled and the account paid
+			if sum.SettledAmount != chargedAmount {
+				t.Errorf("settled amount %d; want the charged items' %d", sum.SettledAmount, chargedAmount)
+			}
+			if want := 1_000_000 - chargedAmount; s.balances[currency.USD] != want {
+				t.Errorf("USD balance %d; want %d", s.balances[currency.USD], want)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ChargeDeclined_NotRetried(t *testing.T) {
+	attempts := map[string]int32{}
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, args converter.EncodedValues) {
+		if info.ActivityType.Name != "ChargeLineItemActivity" {
+			return
+		}
+		var li LineItem
+		args.Get(&li)
+		attempts[li.ID] = info.Attempt
+	})
+	// closing keeps the charged item, so both refs end up on the final bill
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "d1", Name: "DECLINE", Amount: 500})
+		s.env.SignalWorkflow(SignalCloseBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-declined", currency.USD, time.Now().Add(24*time.Hour), BillOptions{MaxChargeAttempts: 3}, nil)
+
+	if attempts["d1"] != 1 {
+		t.Errorf("declined item charged %d times, want once", attempts["d1"])
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillPartiallySettled {
+		t.Fatalf("expected PARTIALLY_SETTLED, got %s", sum.Status)
+	}
+	for _, it := range sum.Items {
+		if !strings.HasPrefix(it.ProcessorRef, "ch_") {
+			t.Errorf("item %s (%s) processor ref = %q, want one recorded", it.ID, it.Status, it.ProcessorRef)
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Close_AllSucceed(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalCloseBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-close-ok", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.SettledAmount != 2000 {
+		t.Fatalf("got %s settled %d, want SETTLED and 2000", sum.Status, sum.SettledAmount)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Close_AllFail(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f1", Name: "FAIL", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f2", Name: "FAIL", Amount: 500})
+		s.env.SignalWorkflow(SignalCloseBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-close-fail", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	var appErr *temporal.ApplicationError
+	if !errors.As(s.env.GetWorkflowError(), &appErr) || appErr.Type() != ErrTypeChargeFailed {
+		t.Fatalf("expected ChargeFailed error, got %v", s.env.GetWorkflowError())
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillFailed {
+		t.Fatalf("expected FAILED, got %s", sum.Status)
+	}
+	if s.balances[currency.USD] != 1_000_000 || s.held[currency.USD] != 0 {
+		t.Errorf("USD balance %d held %d, want the hold released", s.balances[currency.USD], s.held[currency.USD])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Close_Mixed_PartiallySettled(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f1", Name: "FAIL", Amount: 500})
+		s.env.SignalWorkflow(SignalCloseBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-close-mixed", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillPartiallySettled || sum.SettledAmount != 1500 {
+		t.Fatalf("got %s settled %d, want PARTIALLY_SETTLED and 1500", sum.Status, sum.SettledAmount)
+	}
+	want := map[string]LineItemStatus{"a1": ItemCharged, "f1": ItemFailed}
+	for _, it := range sum.Items {
+		if it.Status != want[it.ID] {
+			t.Errorf("item %s = %s, want %s", it.ID, it.Status, want[it.ID])
+		}
+	}
+	// only the charged item is taken from the account
+	if s.balances[currency.USD] != 1_000_000-1500 || s.held[currency.USD] != 0 {
+		t.Errorf("USD balance %d held %d, want %d and 0", s.balances[currency.USD], s.held[currency.USD], 1_000_000-1500)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Webhook_OncePerTerminalStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		signals func(env *testsuite.TestWorkflowEnvironment)
+		retry   bool
+		want    []BillStatus
+	}{
+		{"settled", func(env *testsuite.TestWorkflowEnvironment) {
+			env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+			env.SignalWorkflow(SignalChargeBill, nil)
+		}, false, []BillStatus{BillSettled}},
+		{"failed", func(env *testsuite.TestWorkflowEnvironment) {
+			env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f1", Name: "FAIL", Amount: 1500})
+			env.SignalWorkflow(SignalChargeBill, nil)
+		}, false, []BillStatus{BillFailed}},
+		{"compensated", func(env *testsuite.TestWorkflowEnvironment) {
+			env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+			env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f1", Name: "FAIL", Amount: 500})
+			env.SignalWorkflow(SignalChargeBill, nil)
+		}, false, []BillStatus{BillCompensated}},
+		{"failed then retried", func(env *testsuite.TestWorkflowEnvironment) {
+			env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f1", Name: "FAIL", Amount: 1500})
+			env.SignalWorkflow(SignalChargeBill, nil)
+		}, true, []BillStatus{BillFailed, BillSettled}},
+		{"canceled", func(env *testsuite.TestWorkflowEnvironment) {
+			env.SignalWorkflow(SignalCancelBill, "duplicate order")
+		}, false, []BillStatus{BillCanceled}},
+		{"expired", func(env *testsuite.TestWorkflowEnvironment) {}, false, []BillStatus{BillExpired}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			var got []BillStatus
+			s.env.OnActivity(NotifyWebhookActivity, mock.Anything, "https://hooks.example.com/bills", mock.Anything).Return(
+				func(_ context.Context, _ string, payload Bill) error {
+					got = append(got, payload.Status)
+					if payload.Status == BillCanceled && payload.CancelReason != "duplicate order" {
+						t.Errorf("webhook cancel reason = %q, want %q", payload.CancelReason, "duplicate order")
+					}
+					return nil
+				})
+			s.env.RegisterDelayedCallback(func() { tc.signals(s.env) }, 0)
+			if tc.retry {
+				// the failing item succeeds on retry
+				processorDown := true
+				s.env.OnActivity(ChargeLineItemActivity, mock.Anything, mock.Anything).Return(
+					func(_ context.Context, li LineItem) (ChargeResult, error) {
+						if processorDown {
+							return ChargeResult{}, fmt.Errorf("processor unavailable for %s", li.ID)
+						}
+						return ChargeResult{Code: ChargeApproved, ProcessorRef: "ch_" + li.ID}, nil
+					})
+				s.env.RegisterDelayedCallback(func() {
+					processorDown = false
+					s.env.SignalWorkflow(SignalRetryFailed, nil)
+				}, time.Hour)
+			}
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-webhook", currency.USD, time.Now().Add(24*time.Hour), BillOptions{WebhookURL: "https://hooks.example.com/bills"}, nil)
+
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("webhook statuses = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Webhook_NotSetNotCalled(t *testing.T) {
+	var calls int
+	s.env.OnActivity(NotifyWebhookActivity, mock.Anything, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, _ string, _ Bill) error {
+			calls++
+			return nil
+		})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-no-webhook", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if calls != 0 {
+		t.Errorf("webhook called %d times, want 0", calls)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RecordsOutcome(t *testing.T) {
+	tests := []struct {
+		name    string
+		cur     currency.Currency
+		signals func(env *testsuite.TestWorkflowEnvironment)
+		want    BillStatus
+	}{
+		{"settled", currency.USD, func(env *testsuite.TestWorkflowEnvironment) {
+			env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+			env.SignalWorkflow(SignalChargeBill, nil)
+		}, BillSettled},
+		{"compensated", currency.EUR, func(env *testsuite.TestWorkflowEnvironment) {
+			env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+			env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "f1", Name: "FAIL", Amount: 500})
+			env.SignalWorkflow(SignalChargeBill, nil)
+		}, BillCompensated},
+		{"canceled", currency.GEL, func(env *testsuite.TestWorkflowEnvironment) {
+			env.SignalWorkflow(SignalCancelBill, nil)
+		}, BillCanceled},
+		{"expired", currency.USD, func(env *testsuite.TestWorkflowEnvironment) {}, BillExpired},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			type call struct {
+				cur     currency.Currency
+				outcome BillStatus
+			}
+			var calls []call
+			s.env.OnActivity(RecordOutcomeActivity, mock.Anything, mock.Anything, mock.Anything).Return(
+				func(_ context.Context, cur currency.Currency, outcome BillStatus) error {
+					calls = append(calls, call{cur, outcome})
+					return nil
+				})
+			s.env.RegisterDelayedCallback(func() { tc.signals(s.env) }, 0)
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-outcome", tc.cur, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+			if len(calls) != 1 || calls[0] != (call{tc.cur, tc.want}) {
+				t.Errorf("outcome calls = %v, want [{%s %s}]", calls, tc.cur, tc.want)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ExtendPeriod(t *testing.T) {
+	cases := []struct {
+		name     string
+		extendBy time.Duration
+		// how long after the start the bill expires
+		wantExpiry time.Duration
+	}{
+		{"extended", 72 * time.Hour, 72 * time.Hour},
+		{"earlier rejected", 12 * time.Hour, 24 * time.Hour},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			start := s.env.Now()
+			s.env.RegisterDelayedCallback(func() {
+				s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+				s.env.SignalWorkflow(SignalExtendPeriod, start.Add(tc.extendBy).Format(time.RFC3339))
+			}, time.Minute)
+
+			// a second of reopen grace keeps the workflow end close to the expiry
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-extend", currency.USD, start.Add(24*time.Hour), BillOptions{ReopenGraceSeconds: 1}, nil)
+
+			if err := s.env.GetWorkflowError(); err != nil {
+				t.Fatalf("workflow error: %v", err)
+			}
+			qr, _ := s.env.QueryWorkflow(QueryBill)
+			var sum Bill
+			qr.Get(&sum)
+			if sum.Status != BillExpired {
+				t.Fatalf("expected EXPIRED, got %s", sum.Status)
+			}
+			if got := s.env.Now().Sub(start); got.Round(time.Hour) != tc.wantExpiry {
+				t.Errorf("expired %v after the start, want %v", got, tc.wantExpiry)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Reopen(t *testing.T) {
+	cases := []struct {
+		name string
+		// when the reopen signal arrives, the bill expires after a day and has an hour of grace
+		reopenAfter time.Duration
+		wantReopen  bool
+	}{
+		{"within grace", 24*time.Hour + 30*time.Minute, true},
+		{"past grace", 26 * time.Hour, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			start := s.env.Now()
+			newEnd := start.Add(72 * time.Hour).UTC().Truncate(time.Second)
+			s.env.RegisterDelayedCallback(func() {
+				s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+				s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+				s.env.SignalWorkflow(SignalChargePartial, []string{"a1"})
+			}, 0)
+			s.env.RegisterDelayedCallback(func() {
+				s.env.SignalWorkflow(SignalReopen, newEnd.Format(time.RFC3339))
+			}, tc.reopenAfter)
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-reopen", currency.USD, start.Add(24*time.Hour), BillOptions{ReopenGraceSeconds: 3600}, nil)
+
+			var canErr *workflow.ContinueAsNewError
+			if !tc.wantReopen {
+				if err := s.env.GetWorkflowError(); err != nil {
+					t.Fatalf("workflow error: %v", err)
+				}
+				qr, _ := s.env.QueryWorkflow(QueryBill)
+				var sum Bill
+				qr.Get(&sum)
+				if sum.Status != BillExpired {
+					t.Fatalf("expected EXPIRED, got %s", sum.Status)
+				}
+				return
+			}
+			if !errors.As(s.env.GetWorkflowError(), &canErr) {
+				t.Fatalf("expected continue-as-new, got %v", s.env.GetWorkflowError())
+			}
+			var (
+				billID  string
+				cur     currency.Currency
+				end     time.Time
+				opts    BillOptions
+				carried *Bill
+			)
+			if err := converter.GetDefaultDataConverter().FromPayloads(canErr.Input, &billID, &cur, &end, &opts, &carried); err != nil {
+				t.Fatalf("decode continue-as-new input: %v", err)
+			}
+			if !end.Equal(newEnd) || carried == nil || carried.Status != BillOpen {
+				t.Fatalf("continued with period end %v and bill %+v, want %v and an open bill", end, carried, newEnd)
+			}
+			// the item charged before the expiry stays charged
+			if a1, b2 := carried.Items[0], carried.Items[1]; a1.Status != ItemCharged || b2.Status != ItemPending || b2.CanceledByExpiry {
+				t.Fatalf("items = %+v, want a1 charged and b2 pending", carried.Items)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RefundItem(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "c3", Name: "Ink", Amount: 250})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalRefundItem, "b2")
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-refund", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.RefundedTotal != 500 {
+		t.Fatalf("got %s refunded %d, want SETTLED and 500", sum.Status, sum.RefundedTotal)
+	}
+	want := map[string]LineItemStatus{"a1": ItemCharged, "b2": ItemRefunded, "c3": ItemCharged}
+	for _, it := range sum.Items {
+		if it.Status != want[it.ID] {
+			t.Errorf("item %s status %s, want %s", it.ID, it.Status, want[it.ID])
+		}
+	}
+	// the account paid 1750 and got 500 back
+	if s.balances[currency.USD] != 1_000_000-1250 {
+		t.Errorf("USD balance %d, want %d", s.balances[currency.USD], 1_000_000-1250)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RefundAll(t *testing.T) {
+	refunded := map[string]int{}
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, args converter.EncodedValues) {
+		if info.ActivityType.Name == "RefundLineItemActivity" {
+			var li LineItem
+			args.Get(&li)
+			refunded[li.ID]++
+		}
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "d1", Name: "Promo", Amount: 100, Kind: KindDiscount})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalRefundItem, "b2")
+		s.env.SignalWorkflow(SignalAdjust, Adjustment{ID: "adj-1", Amount: 200, Reason: "late delivery fee"})
+		s.env.SignalWorkflow(SignalRefundAll, nil)
+		// nothing left to refund once the bill is refunded
+		s.env.SignalWorkflow(SignalRefundAll, nil)
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-refund-all", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillRefunded || sum.NetTotal != 0 {
+		t.Fatalf("got %s with net total %d, want REFUNDED and 0", sum.Status, sum.NetTotal)
+	}
+	// discounts are never charged at the processor, so they aren't refunded either
+	want := map[string]LineItemStatus{"a1": ItemRefunded, "b2": ItemRefunded, "d1": ItemCharged}
+	for _, it := range sum.Items {
+		if it.Status != want[it.ID] {
+			t.Errorf("item %s status %s, want %s", it.ID, it.Status, want[it.ID])
+		}
+	}
+	if !reflect.DeepEqual(refunded, map[string]int{"a1": 1, "b2": 1}) {
+		t.Errorf("processor refunds = %v, want a1 and b2 once", refunded)
+	}
+	// everything the account paid came back
+	if s.balances[currency.USD] != 1_000_000 {
+		t.Errorf("USD balance %d, want %d", s.balances[currency.USD], 1_000_000)
+	}
+	qr, _ = s.env.QueryWorkflow(QueryEvents)
+	var events []BillEvent
+	qr.Get(&events)
+	if statusChangedAt(events, BillRefunded).IsZero() {
+		t.Error("no STATUS_CHANGED event for REFUNDED")
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RefundAll_NotSettled(t *testing.T) {
+	tests := []struct {
+		name string
+		item LineItem
+		// also signalled once the bill has its outcome
+		late       bool
+		wantStatus BillStatus
+		wantPaid   int64
+	}{
+		// signalled before the bill settled, dropped once it does
+		{"open", LineItem{ID: "a1", Name: "Book", Amount: 1000}, false, BillSettled, 1000},
+		{"failed", LineItem{ID: "a1", Name: "FAIL", Amount: 1000}, true, BillFailed, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			var refunds int
+			s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+				if info.ActivityType.Name == "RefundLineItemActivity" {
+					refunds++
+				}
+			})
+			s.env.RegisterDelayedCallback(func() {
+				s.env.SignalWorkflow(SignalAddLineItem, tc.item)
+				s.env.SignalWorkflow(SignalRefundAll, nil)
+				s.env.SignalWorkflow(SignalChargeBill, nil)
+			}, 0)
+			if tc.late {
+				s.env.RegisterDelayedCallback(func() {
+					s.env.SignalWorkflow(SignalRefundAll, nil)
+				}, time.Hour)
+			}
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-refund-all-"+tc.name, currency.USD, time.Now().Add(24*time.Hour), BillOptions{MaxChargeAttempts: 1}, nil)
+
+			qr, _ := s.env.QueryWorkflow(QueryBill)
+			var sum Bill
+			qr.Get(&sum)
+			if sum.Status != tc.wantStatus || sum.RefundedTotal != 0 {
+				t.Fatalf("got %s refunded %d, want %s and nothing refunded", sum.Status, sum.RefundedTotal, tc.wantStatus)
+			}
+			if refunds != 0 {
+				t.Errorf("%d processor refunds, want none", refunds)
+			}
+			if want := 1_000_000 - tc.wantPaid; s.balances[currency.USD] != want {
+				t.Errorf("USD balance %d, want %d", s.balances[currency.USD], want)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RefundItem_NotCharged(t *testing.T) {
+	var refunds int
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "RefundLineItemActivity" {
+			refunds++
+		}
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "d1", Name: "Promo", Amount: 100, Kind: KindDiscount})
+		// refunds before the bill settles are rejected
+		s.env.SignalWorkflow(SignalRefundItem, "a1")
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalRefundItem, "d1")
+		s.env.SignalWorkflow(SignalRefundItem, "missing")
+		s.env.SignalWorkflow(SignalRefundItem, "a1")
+		s.env.SignalWorkflow(SignalRefundItem, "a1")
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-refund-rejected", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	// only the first refund of a1 goes through, the discount, the unknown item and the repeat are ignored.
+	// the discount lowered the settled amount, so that is what the refund gives back
+	if sum.RefundedTotal != 900 || refunds != 1 {
+		t.Fatalf("refunded %d in %d refunds, want 900 in 1", sum.RefundedTotal, refunds)
+	}
+	if s.balances[currency.USD] != 1_000_000 {
+		t.Errorf("USD balance %d, want it fully restored", s.balances[currency.USD])
+	}
+}
+
+func (s *UnitTestSuite) Test_ScheduledBillWorkflow_StartsFromTemplate(t *testing.T) {
+	start := s.env.Now()
+	var periodEnd time.Time
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		var open Bill
+		if err := qr.Get(&open); err != nil {
+			t.Fatalf("decode query result: %v", err)
+		}
+		if open.Status != BillOpen || len(open.Items) != 2 || open.Total != 2500 {
+			t.Errorf("bill = %s with %d items totaling %d, want OPEN with 2 items totaling 2500", open.Status, len(open.Items), open.Total)
+		}
+	}, time.Minute)
+	s.env.SetOnTimerScheduledListener(func(_ string, d time.Duration) {
+		if periodEnd.IsZero() {
+			periodEnd = s.env.Now().Add(d)
+		}
+	})
+
+	s.env.SetStartWorkflowOptions(client.StartWorkflowOptions{ID: "bill-schedule-x-2026"})
+	s.env.ExecuteWorkflow(ScheduledBillWorkflow, BillTemplate{
+		Currency: currency.USD,
+		Items: []LineItem{
+			{ID: "seat", Name: "Seat", Quantity: 2, UnitAmount: 1000},
+			{ID: "support", Name: "Support", Amount: 500},
+		},
+		Options:       BillOptions{ReopenGraceSeconds: 1},
+		PeriodSeconds: 3600,
+	})
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	// nothing charges it, so the bill runs for the template's period and expires
+	if got := periodEnd.Sub(start); got != time.Hour {
+		t.Errorf("period = %s, want 1h", got)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if sum.Status != BillExpired {
+		t.Errorf("expected EXPIRED, got %s", sum.Status)
+	}
+	if sum.ID != "bill-schedule-x-2026" {
+		t.Errorf("bill ID = %q, want the workflow ID", sum.ID)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_EventTimeline(t *testing.T) {
+	start := s.env.Now().UTC()
+	periodEnd := start.Add(24 * time.Hour)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+	}, time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 2*time.Minute)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-events", currency.USD, periodEnd, BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryEvents)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var events []BillEvent
+	if err := qr.Get(&events); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+
+	want := []struct {
+		typ    BillEventType
+		detail string
+		at     time.Duration
+	}{
+		{EventCreated, "USD bill, period ends " + periodEnd.Format(time.RFC3339), 0},
+		{EventItemAdded, "a1 for $15.00", time.Minute},
+		{EventItemAdded, "b2 for $5.00", 2 * time.Minute},
+		{EventChargeStarted, "all pending items", 2 * time.Minute},
+		{EventStatusChanged, "SETTLED", 2 * time.Minute},
+		// once the refund window closes
+		{EventArchived, "SETTLED", 2*time.Minute + refundWindow},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events %+v, want %d", len(events), events, len(want))
+	}
+	for i, w := range want {
+		got := events[i]
+		if got.Type != w.typ || got.Detail != w.detail {
+			t.Errorf("event %d = %s %q, want %s %q", i, got.Type, got.Detail, w.typ, w.detail)
+		}
+		// charging takes a moment of workflow time, so the outcome may be stamped a little later
+		if d := got.At.Sub(start); d < w.at || d > w.at+time.Minute {
+			t.Errorf("event %d at +%s, want +%s", i, d, w.at)
+		}
+	}
+
+	// the timeline is only served through its own query
+	qr, err = s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if len(sum.Events) != 0 {
+		t.Errorf("bill snapshot has %d events, want none", len(sum.Events))
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_AccountCurrencyMismatch(t *testing.T) {
+	s.accounts["acc-eur-only"] = currency.EUR
+
+	charged := false
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, time.Minute)
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name != "CheckAccountActivity" {
+			charged = true
+		}
+	})
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-mismatch", currency.USD, s.env.Now().Add(24*time.Hour), BillOptions{AccountID: "acc-eur-only"}, nil)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	var appErr *temporal.ApplicationError
+	if err := s.env.GetWorkflowError(); !errors.As(err, &appErr) || appErr.Type() != ErrTypeAccountCurrencyMismatch || !appErr.NonRetryable() {
+		t.Fatalf("expected non-retryable AccountCurrencyMismatch error, got %v", err)
+	}
+	if charged {
+		t.Error("expected no activity besides the account check to run")
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_AccountCheck_BeforeVersion(t *testing.T) {
+	s.accounts["acc-eur-only"] = currency.EUR
+	// a history recorded before the start check replays without it
+	s.env.OnGetVersion(versionCheckAccountOnStart, workflow.DefaultVersion, 1).Return(workflow.DefaultVersion)
+
+	checked := false
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "CheckAccountActivity" {
+			checked = true
+		}
+	})
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-unchecked", currency.USD, s.env.Now().Add(24*time.Hour), BillOptions{AccountID: "acc-eur-only"}, nil)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	var appErr *temporal.ApplicationError
+	if err := s.env.GetWorkflowError(); errors.As(err, &appErr) && appErr.Type() == ErrTypeAccountCurrencyMismatch {
+		t.Fatalf("expected the account not to be checked on start, got %v", err)
+	}
+	if checked {
+		t.Error("expected CheckAccountActivity not to run")
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_CaptureAccountMismatch(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, time.Minute)
+	// the account was unregistered when the bill started and is registered in EUR while the items charge
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "ChargeLineItemActivity" {
+			s.accounts["acc-late"] = currency.EUR
+		}
+	})
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-late-mismatch", currency.USD, s.env.Now().Add(24*time.Hour), BillOptions{AccountID: "acc-late"}, nil)
+
+	if !s.env.IsWorkflowCompleted() {
+		t.Fatal("workflow still running")
+	}
+	var appErr *temporal.ApplicationError
+	if err := s.env.GetWorkflowError(); !errors.As(err, &appErr) || appErr.Type() != ErrTypeAccountCurrencyMismatch {
+		t.Fatalf("expected AccountCurrencyMismatch error, got %v", err)
+	}
+	var d ChargeFailureDetail
+	if err := appErr.Details(&d); err != nil || d.Category != FailureCategoryAccount || len(d.RefundedIDs) != 2 {
+		t.Errorf("details = %+v (%v), want the account category with both items refunded", d, err)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var bill Bill
+	if err := qr.Get(&bill); err != nil {
+		t.Fatalf("failed to decode bill: %v", err)
+	}
+	if bill.Status != BillCompensated {
+		t.Errorf("status = %s, want %s", bill.Status, BillCompensated)
+	}
+	for _, it := range bill.Items {
+		if it.Status != ItemRefunded {
+			t.Errorf("item %s = %s, want %s", it.ID, it.Status, ItemRefunded)
+		}
+	}
+	if s.held[currency.USD] != 0 || s.balances[currency.USD] != 1_000_000 {
+		t.Errorf("held %d, balance %d; want the hold released in full", s.held[currency.USD], s.balances[currency.USD])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Timestamps(t *testing.T) {
+	queryBill := func() Bill {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		var b Bill
+		if err := qr.Get(&b); err != nil {
+			t.Fatalf("failed to decode bill: %v", err)
+		}
+		return b
+	}
+	var open, charging Bill
+	s.env.RegisterDelayedCallback(func() {
+		open = queryBill()
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+	}, time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, time.Hour)
+	// the items are charged but the held funds not captured yet
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "CaptureHoldActivity" {
+			charging = queryBill()
+		}
+	})
+
+	start := s.env.Now().UTC()
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-timestamps", currency.USD, start.Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	settled := queryBill()
+	if settled.Status != BillSettled {
+		t.Fatalf("status = %s, want %s", settled.Status, BillSettled)
+	}
+
+	if !open.CreatedAt.Equal(start) || !open.LastModifiedAt.Equal(start) || open.SettledAt != nil {
+		t.Errorf("open bill created %v, modified %v, settled %v; want created and modified at %v and not settled",
+			open.CreatedAt, open.LastModifiedAt, open.SettledAt, start)
+	}
+	if charging.SettledAt != nil {
+		t.Errorf("charging bill settled at %v, want nil", charging.SettledAt)
+	}
+	if !charging.LastModifiedAt.After(open.LastModifiedAt) {
+		t.Errorf("last modified %v while charging, want after %v", charging.LastModifiedAt, open.LastModifiedAt)
+	}
+	if settled.SettledAt == nil {
+		t.Fatal("settled bill has no settled_at")
+	}
+	if !settled.CreatedAt.Equal(start) || settled.SettledAt.Before(settled.CreatedAt) || settled.LastModifiedAt.Before(*settled.SettledAt) {
+		t.Errorf("created %v, settled %v, modified %v; want created <= settled <= modified",
+			settled.CreatedAt, *settled.SettledAt, settled.LastModifiedAt)
+	}
+	if !settled.SettledAt.Equal(start.Add(time.Hour)) {
+		t.Errorf("settled at %v, want when the charge was signalled at %v", *settled.SettledAt, start.Add(time.Hour))
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Notes(t *testing.T) {
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "HoldFundsActivity" {
+			s.env.SignalWorkflow(SignalAddNote, Note{Author: "agent-2", Text: "charge started on request"})
+		}
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalAddNote, Note{Author: "agent-1", Text: "customer asked for a paper copy"})
+		// signalled directly, so nothing checked it before the workflow got it
+		s.env.SignalWorkflow(SignalAddNote, Note{Author: "", Text: "anonymous"})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddNote, Note{Author: "agent-3", Text: "too late"})
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-notes", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled {
+		t.Fatalf("status = %s; want SETTLED", sum.Status)
+	}
+	if len(sum.Notes) != 2 {
+		t.Fatalf("notes = %+v; want the open and the charging note", sum.Notes)
+	}
+	for i, author := range []string{"agent-1", "agent-2"} {
+		if n := sum.Notes[i]; n.Author != author || n.At.IsZero() {
+			t.Errorf("note %d = %+v; want one by %s stamped with workflow time", i, n, author)
+		}
+	}
+
+	qr, _ = s.env.QueryWorkflow(QueryEvents)
+	var events []BillEvent
+	qr.Get(&events)
+	added := 0
+	for _, e := range events {
+		if e.Type == EventNoteAdded {
+			added++
+		}
+	}
+	if added != 2 {
+		t.Errorf("%d %s events; want 2", added, EventNoteAdded)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ReassignAccount(t *testing.T) {
+	tests := []struct {
+		name        string
+		to          string
+		toCurrency  currency.Currency
+		wantAccount string
+	}{
+		{"same currency", "acc-usd", currency.USD, "acc-usd"},
+		{"another currency", "acc-gel", currency.GEL, DefaultAccountID},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			s.accounts[tc.to] = tc.toCurrency
+			s.env.RegisterDelayedCallback(func() {
+				s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+				s.env.SignalWorkflow(SignalReassign, tc.to)
+			}, time.Minute)
+			s.env.RegisterDelayedCallback(func() {
+				s.env.SignalWorkflow(SignalChargeBill, nil)
+			}, time.Hour)
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-reassign", currency.USD, s.env.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+			if err := s.env.GetWorkflowError(); err != nil {
+				t.Fatalf("workflow error: %v", err)
+			}
+			qr, _ := s.env.QueryWorkflow(QueryBill)
+			var bill Bill
+			qr.Get(&bill)
+			if bill.Status != BillSettled || bill.AccountID != tc.wantAccount {
+				t.Errorf("bill %s on %s, want SETTLED on %s", bill.Status, bill.AccountID, tc.wantAccount)
+			}
+			// the hold is where the bill is debited
+			if len(s.heldAccounts) != 1 || s.heldAccounts[0] != tc.wantAccount {
+				t.Errorf("held on %v, want %s", s.heldAccounts, tc.wantAccount)
+			}
+			qr, _ = s.env.QueryWorkflow(QueryEvents)
+			var events []BillEvent
+			qr.Get(&events)
+			reassigned := slices.ContainsFunc(events, func(e BillEvent) bool { return e.Type == EventReassigned })
+			if reassigned != (tc.wantAccount == tc.to) {
+				t.Errorf("reassigned event recorded = %v, want %v", reassigned, tc.wantAccount == tc.to)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_RefundCreditPending(t *testing.T) {
+	tests := []struct {
+		name string
+		// failed credit attempts, the activity itself tries 5 times before the workflow sees the failure
+		failures    int
+		wantPending bool
+		// activity attempts in all, the account takes the eighth after one timer retry
+		wantCalls int
+	}{
+		{"credited right away", 0, false, 1},
+		{"credited on a timer retry", 7, true, 8},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			s.creditFailures = tc.failures
+			// the bill as the workflow retries the credit on its timer
+			var (
+				pending  Bill
+				attempts int
+			)
+			s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+				if info.ActivityType.Name != "CreditRefundActivity" {
+					return
+				}
+				if attempts++; attempts == 6 {
+					qr, _ := s.env.QueryWorkflow(QueryBill)
+					qr.Get(&pending)
+				}
+			})
+			s.env.RegisterDelayedCallback(func() {
+				s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+				s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+				s.env.SignalWorkflow(SignalChargeBill, nil)
+			}, 0)
+			s.env.RegisterDelayedCallback(func() {
+				s.env.SignalWorkflow(SignalRefundItem, "b2")
+			}, time.Hour)
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-credit-pending", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+			if err := s.env.GetWorkflowError(); err != nil {
+				t.Fatalf("workflow error: %v", err)
+			}
+			if tc.wantPending {
+				if pending.Status != BillSettledCreditPending || pending.PendingCredit == nil {
+					t.Fatalf("bill while retrying = %s with credit %+v, want %s", pending.Status, pending.PendingCredit, BillSettledCreditPending)
+				}
+				if pc := pending.PendingCredit; pc.Amount != 500 || pc.Ref != refundRef("bill-credit-pending", "b2") || pc.Attempts != 1 {
+					t.Errorf("pending credit = %+v, want 500 for b2's refund after 1 attempt", *pc)
+				}
+			}
+			if attempts != tc.wantCalls {
+				t.Errorf("credit attempts = %d, want %d", attempts, tc.wantCalls)
+			}
+
+			qr, _ := s.env.QueryWorkflow(QueryBill)
+			var sum Bill
+			qr.Get(&sum)
+			if sum.Status != BillSettled || sum.PendingCredit != nil || sum.RefundedTotal != 500 {
+				t.Errorf("got %s with credit %+v and %d refunded, want SETTLED with 500 refunded", sum.Status, sum.PendingCredit, sum.RefundedTotal)
+			}
+			if s.balances[currency.USD] != 1_000_000-1000 {
+				t.Errorf("USD balance %d, want %d", s.balances[currency.USD], 1_000_000-1000)
+			}
+
+			qr, _ = s.env.QueryWorkflow(QueryEvents)
+			var events []BillEvent
+			qr.Get(&events)
+			pendingEvents := 0
+			for _, e := range events {
+				if e.Type == EventStatusChanged && e.Detail == string(BillSettledCreditPending) {
+					pendingEvents++
+				}
+			}
+			if (pendingEvents == 1) != tc.wantPending {
+				t.Errorf("%d SETTLED_CREDIT_PENDING events, want pending %v", pendingEvents, tc.wantPending)
+			}
+		})
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_AutoCancelEmpty(t *testing.T) {
+	start := s.env.Now()
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-empty", currency.USD, start.Add(24*time.Hour), BillOptions{AutoCancelEmptySeconds: 3600}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	// canceled bills complete right away, long before the period ends
+	if took := s.env.Now().Sub(start); took != time.Hour {
+		t.Errorf("bill finished after %s, want 1h", took)
+	}
+
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if sum.Status != BillCanceled || sum.CancelReason != "empty" {
+		t.Errorf("bill = %s (%q), want CANCELED (\"empty\")", sum.Status, sum.CancelReason)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_AutoCancelEmpty_ItemAdded(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+	}, 30*time.Minute)
+	// an item removed again doesn't bring the auto-cancel back
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalRemoveLineItem, "a1")
+	}, 45*time.Minute)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-empty-item", currency.USD, s.env.Now().Add(24*time.Hour),
+		BillOptions{AutoCancelEmptySeconds: 3600, ReopenGraceSeconds: 1}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if sum.Status != BillExpired || sum.CancelReason != "" {
+		t.Errorf("bill = %s (%q), want EXPIRED without a cancel reason", sum.Status, sum.CancelReason)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ItemExpiry(t *testing.T) {
+	start := s.env.Now()
+	expiresAt := start.Add(time.Hour)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000, ExpiresAt: &expiresAt})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a2", Name: "Pen", Amount: 250})
+	}, 0)
+	progress := func() ChargeProgress {
+		qr, err := s.env.QueryWorkflow(QueryProgress)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		var p ChargeProgress
+		qr.Get(&p)
+		return p
+	}
+	s.env.RegisterDelayedCallback(func() {
+		if p := progress(); p.NextItemExpiry == nil || !p.NextItemExpiry.Equal(expiresAt) {
+			t.Errorf("next item expiry = %v, want %s", p.NextItemExpiry, expiresAt)
+		}
+	}, 30*time.Minute)
+	// past the item's expiry, the bill is still open with the other item pending
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		var b Bill
+		qr.Get(&b)
+		if b.Status != BillOpen || b.Total != 250 {
+			t.Errorf("bill is %s with total %d, want OPEN with 250", b.Status, b.Total)
+		}
+		if len(b.Items) != 2 || b.Items[0].Status != ItemCanceled || !b.Items[0].Expired || b.Items[1].Status != ItemPending {
+			t.Errorf("items = %+v, want a1 expired and a2 pending", b.Items)
+		}
+		if p := progress(); p.NextItemExpiry != nil || p.Remaining != 1 {
+			t.Errorf("progress = %+v, want 1 remaining and no expiry", p)
+		}
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 2*time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-item-expiry", currency.USD, start.Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.SettledAmount != 250 {
+		t.Errorf("status %s settled %d; want SETTLED and 250", sum.Status, sum.SettledAmount)
+	}
+	qr, _ = s.env.QueryWorkflow(QueryEvents)
+	var events []BillEvent
+	qr.Get(&events)
+	var expired []string
+	for _, ev := range events {
+		if ev.Type == EventItemExpired {
+			expired = append(expired, ev.Detail)
+		}
+	}
+	if !slices.Equal(expired, []string{"a1"}) {
+		t.Errorf("ITEM_EXPIRED events for %v, want a1", expired)
+	}
+}
+
+// a later item expiring sooner replaces the timer, the items expire in their own order
+func (s *UnitTestSuite) Test_BillWorkflow_ItemExpiry_Replaced(t *testing.T) {
+	start := s.env.Now()
+	late, early := start.Add(3*time.Hour), start.Add(time.Hour)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "late", Name: "Book", Amount: 1000, ExpiresAt: &late})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "kept", Name: "Pen", Amount: 250})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "early", Name: "Mug", Amount: 700, ExpiresAt: &early})
+	}, time.Minute)
+	pending := func() []string {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		var b Bill
+		qr.Get(&b)
+		var ids []string
+		for _, it := range b.Items {
+			if it.Status == ItemPending {
+				ids = append(ids, it.ID)
+			}
+		}
+		return ids
+	}
+	s.env.RegisterDelayedCallback(func() {
+		if got := pending(); !slices.Equal(got, []string{"late", "kept"}) {
+			t.Errorf("pending after 2h = %v, want late and kept", got)
+		}
+	}, 2*time.Hour)
+	s.env.RegisterDelayedCallback(func() {
+		if got := pending(); !slices.Equal(got, []string{"kept"}) {
+			t.Errorf("pending after 4h = %v, want kept", got)
+		}
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 4*time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-item-expiry-replaced", currency.USD, start.Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.SettledAmount != 250 {
+		t.Errorf("status %s settled %d; want SETTLED and 250", sum.Status, sum.SettledAmount)
+	}
+}
+
+// an item the Command update adds runs outside the selector, its expiry still has to arm the item timer
+func (s *UnitTestSuite) Test_BillWorkflow_ItemExpiry_Command(t *testing.T) {
+	start := s.env.Now()
+	expiresAt := start.Add(time.Hour)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "kept", Name: "Pen", Amount: 250})
+		s.env.UpdateWorkflow(UpdateCommand, "add", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) { t.Errorf("add rejected: %v", err) },
+			OnComplete: func(_ interface{}, err error) {
+				if err != nil {
+					t.Errorf("add failed: %v", err)
+				}
+			},
+		}, Command{Type: CommandAddItem, Item: LineItem{ID: "quote", Name: "Book", Amount: 1000, ExpiresAt: &expiresAt}})
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		var b Bill
+		qr.Get(&b)
+		if b.Status != BillOpen || b.Total != 250 {
+			t.Errorf("bill is %s with total %d, want OPEN with 250", b.Status, b.Total)
+		}
+		if i := b.itemIndex("quote"); i < 0 || b.Items[i].Status != ItemCanceled || !b.Items[i].Expired {
+			t.Errorf("items = %+v, want quote expired", b.Items)
+		}
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 2*time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-item-expiry-command", currency.USD, start.Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.SettledAmount != 250 {
+		t.Errorf("status %s settled %d; want SETTLED and 250", sum.Status, sum.SettledAmount)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ForceExpire_Open(t *testing.T) {
+	start := s.env.Now()
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalForceExpire, nil)
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-force-open", currency.USD, start.Add(24*time.Hour),
+		BillOptions{ReopenGraceSeconds: 1}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	// the bill expires when forced, not at the end of its period
+	if took := s.env.Now().Sub(start); took > 2*time.Hour {
+		t.Errorf("bill finished after %s, want about 1h", took)
+	}
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if sum.Status != BillExpired {
+		t.Fatalf("expected EXPIRED, got %s", sum.Status)
+	}
+	if it := sum.Items[0]; it.Status != ItemCanceled || !it.CanceledByExpiry {
+		t.Errorf("item %s = %s (by expiry %v), want CANCELED by expiry", it.ID, it.Status, it.CanceledByExpiry)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_ForceExpire_Charging(t *testing.T) {
+	// the operator force-expires the bill while its funds are being held
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "HoldFundsActivity" {
+			s.env.SignalWorkflow(SignalForceExpire, nil)
+		}
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-force-charging", currency.USD, s.env.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, err := s.env.QueryWorkflow(QueryBill)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var sum Bill
+	if err := qr.Get(&sum); err != nil {
+		t.Fatalf("decode query result: %v", err)
+	}
+	if sum.Status != BillExpired {
+		t.Fatalf("expected EXPIRED, got %s", sum.Status)
+	}
+	for _, it := range sum.Items {
+		if it.Status != ItemCanceled {
+			t.Errorf("item %s = %s, want CANCELED", it.ID, it.Status)
+		}
+	}
+	// nothing was charged and the held funds went back
+	if s.balances[currency.USD] != 1_000_000 || s.held[currency.USD] != 0 {
+		t.Errorf("USD balance %d held %d, want 1000000 and 0", s.balances[currency.USD], s.held[currency.USD])
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_QueryChargeable(t *testing.T) {
+	type state struct {
+		status     BillStatus
+		pending    int
+		chargeable bool
+	}
+	got := map[string]state{}
+	snapshot := func(name string) {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Errorf("%s: query failed: %v", name, err)
+			return
+		}
+		var sum Bill
+		qr.Get(&sum)
+		got[name] = state{sum.Status, sum.Pending, sum.Chargeable}
+	}
+	s.env.RegisterDelayedCallback(func() {
+		snapshot("empty")
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "promo", Name: "Promo", Amount: 100, Kind: KindDiscount})
+	}, time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		snapshot("open")
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 2*time.Minute)
+	// items stay pending while the funds are held, but the bill can't be charged again
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name == "HoldFundsActivity" {
+			snapshot("charging")
+		}
+	})
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-chargeable", currency.USD, s.env.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	snapshot("settled")
+	want := map[string]state{
+		"empty":    {BillOpen, 0, false},
+		"open":     {BillOpen, 1, true},
+		"charging": {BillCharging, 1, false},
+		"settled":  {BillSettled, 0, false},
+	}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("%s: got %+v, want %+v", name, got[name], w)
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_CanceledArchivedPromptly(t *testing.T) {
+	archived := false
+	s.env.OnUpsertTypedSearchAttributes(mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		archived, _ = args.Get(0).(temporal.SearchAttributes).GetBool(billArchivedKey)
+	})
+	start := s.env.Now()
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalCancelBill, "duplicate order")
+	}, time.Minute)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-archived", currency.USD, start.Add(30*24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	// the workflow completes with the cancel instead of idling until the period ends
+	if took := s.env.Now().Sub(start); took > time.Hour {
+		t.Errorf("workflow completed %s after start; want right after the cancel", took)
+	}
+	if !archived {
+		t.Error("expected the last upsert to mark the bill archived")
+	}
+	qr, _ := s.env.QueryWorkflow(QueryEvents)
+	var events []BillEvent
+	qr.Get(&events)
+	if last := events[len(events)-1]; last.Type != EventArchived || last.Detail != string(BillCanceled) {
+		t.Errorf("last event = %+v; want ARCHIVED for CANCELED", last)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_StagedWhileCharging_RejectedOnSettle(t *testing.T) {
+	var staged CommandResult
+	s.env.SetOnActivityStartedListener(func(info *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		if info.ActivityType.Name != "HoldFundsActivity" {
+			return
+		}
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "late", Name: "Mug", Amount: 700})
+		// already on the bill, so not staged
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.UpdateWorkflow(UpdateCommand, "late-cmd", &testsuite.TestUpdateCallback{
+			OnAccept: func() {},
+			OnReject: func(err error) { t.Errorf("add while charging rejected: %v", err) },
+			OnComplete: func(res interface{}, err error) {
+				if err == nil {
+					staged = res.(CommandResult)
+				}
+			},
+		}, Command{Type: CommandAddItem, Item: LineItem{ID: "later", Name: "Cap", Amount: 300}})
+	})
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-staged", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if staged.Status != BillCharging || len(staged.Bill.StagedItems) != 2 || staged.Bill.StagedItems[1].Status != StagedPending {
+		t.Errorf("add while charging returned %s with staged %+v; want CHARGING with the item STAGED", staged.Status, staged.Bill.StagedItems)
+	}
+
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var sum Bill
+	qr.Get(&sum)
+	if sum.Status != BillSettled || sum.Total != 1500 || len(sum.Items) != 1 {
+		t.Fatalf("bill %s with %d items totaling %d; want SETTLED with only a1", sum.Status, len(sum.Items), sum.Total)
+	}
+	want := []string{"late", "later"}
+	if len(sum.StagedItems) != len(want) {
+		t.Fatalf("staged items = %+v; want %v", sum.StagedItems, want)
+	}
+	for i, st := range sum.StagedItems {
+		if st.Item.ID != want[i] || st.Status != StagedRejected || st.Reason != "bill is SETTLED" {
+			t.Errorf("staged[%d] = %s %s %q; want %s REJECTED \"bill is SETTLED\"", i, st.Item.ID, st.Status, st.Reason, want[i])
+		}
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_MetadataRoundTrip(t *testing.T) {
+	md := map[string]string{"order_id": "o-42", "sku": "BK-1"}
+	var item ItemQueryResult
+	var sum Bill
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500, Metadata: md})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryItem, "a1")
+		if err != nil {
+			t.Errorf("item query failed: %v", err)
+			return
+		}
+		qr.Get(&item)
+		qr, err = s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Errorf("bill query failed: %v", err)
+			return
+		}
+		qr.Get(&sum)
+		s.env.SignalWorkflow(SignalCancelBill, "done")
+	}, time.Minute)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-metadata", currency.USD, time.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	if !item.Found || fmt.Sprint(item.Item.Metadata) != fmt.Sprint(md) {
+		t.Errorf("queried item metadata = %v; want %v", item.Item.Metadata, md)
+	}
+	if len(sum.Items) != 1 || fmt.Sprint(sum.Items[0].Metadata) != fmt.Sprint(md) {
+		t.Errorf("queried bill items = %+v; want a1 with metadata %v", sum.Items, md)
+	}
+}
+
+// a run continued as new gets the absolute period end of the run before it, so however late it starts
+// the bill expires when it was always going to
+func (s *UnitTestSuite) Test_BillWorkflow_ResumedRun_KeepsAbsoluteExpiry(t *testing.T) {
+	cases := []struct {
+		name string
+		// period end relative to when the resumed run starts
+		periodEnd time.Duration
+		// how long after the start the bill expires
+		wantExpiry time.Duration
+	}{
+		{"period end ahead", 6 * time.Hour, 6 * time.Hour},
+		{"period end already past", -time.Hour, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetupTest(t)
+			start := s.env.Now()
+			carried := newBill("bill-resumed", currency.USD, BillOptions{})
+			if err := carried.AddItem(LineItem{ID: "a1", Name: "Book", Amount: 1000}); err != nil {
+				t.Fatalf("AddItem() error = %v", err)
+			}
+
+			s.env.ExecuteWorkflow(BillWorkflow, "bill-resumed", currency.USD, start.Add(tc.periodEnd), BillOptions{ReopenGraceSeconds: 1}, carried)
+
+			if err := s.env.GetWorkflowError(); err != nil {
+				t.Fatalf("workflow error: %v", err)
+			}
+			qr, _ := s.env.QueryWorkflow(QueryEvents)
+			var events []BillEvent
+			qr.Get(&events)
+			var expiredAt time.Time
+			for _, e := range events {
+				if e.Type == EventStatusChanged && e.Detail == string(BillExpired) {
+					expiredAt = e.At
+				}
+			}
+			if expiredAt.IsZero() {
+				t.Fatalf("bill never expired, events %+v", events)
+			}
+			if got := expiredAt.Sub(start); got.Round(time.Minute) != tc.wantExpiry {
+				t.Errorf("expired %v after the start, want %v", got, tc.wantExpiry)
+			}
+		})
+	}
+}
+
+// the time the bill's STATUS_CHANGED event to status was recorded, zero when there is none
+func statusChangedAt(events []BillEvent, status BillStatus) time.Time {
+	for _, e := range events {
+		if e.Type == EventStatusChanged && e.Detail == string(status) {
+			return e.At
+		}
+	}
+	return time.Time{}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_GracePeriod_AddsUntilExpiry(t *testing.T) {
+	start := s.env.Now()
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+	}, 0)
+	// past the period end the bill still takes items but won't give them up
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "g1", Name: "Late fee", Amount: 500})
+		s.env.SignalWorkflow(SignalRemoveLineItem, "a1")
+	}, 70*time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		qr, err := s.env.QueryWorkflow(QueryBill)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		var b Bill
+		qr.Get(&b)
+		if b.Status != BillGrace || len(b.Items) != 2 || b.Total != 1500 {
+			t.Errorf("in grace got %s with %d items totaling %d; want GRACE with 2 items totaling 1500",
+				b.Status, len(b.Items), b.Total)
+		}
+	}, 80*time.Minute)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-grace", currency.USD, start.Add(time.Hour),
+		BillOptions{GracePeriodSeconds: 1800, ReopenGraceSeconds: 1}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var b Bill
+	qr.Get(&b)
+	if b.Status != BillExpired {
+		t.Fatalf("bill = %s, want EXPIRED", b.Status)
+	}
+	for _, it := range b.Items {
+		if it.Status != ItemCanceled || !it.CanceledByExpiry {
+			t.Errorf("item %s = %s, want canceled by the expiry", it.ID, it.Status)
+		}
+	}
+	qr, _ = s.env.QueryWorkflow(QueryEvents)
+	var events []BillEvent
+	qr.Get(&events)
+	if got := statusChangedAt(events, BillGrace).Sub(start).Round(time.Minute); got != time.Hour {
+		t.Errorf("grace started %v after the start, want 1h", got)
+	}
+	if got := statusChangedAt(events, BillExpired).Sub(start).Round(time.Minute); got != 90*time.Minute {
+		t.Errorf("expired %v after the start, want 1h30m", got)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_GracePeriod_ExtendReopens(t *testing.T) {
+	start := s.env.Now()
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1000})
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "b2", Name: "Pen", Amount: 500})
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalExtendPeriod, start.Add(3*time.Hour).Format(time.RFC3339))
+	}, 70*time.Minute)
+	// open again, so items can be removed
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalRemoveLineItem, "b2")
+	}, 80*time.Minute)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-grace-extend", currency.USD, start.Add(time.Hour),
+		BillOptions{GracePeriodSeconds: 1800, ReopenGraceSeconds: 1}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var b Bill
+	qr.Get(&b)
+	if b.Status != BillExpired || len(b.Items) != 1 {
+		t.Fatalf("bill = %s with %d items, want EXPIRED with 1 item", b.Status, len(b.Items))
+	}
+	qr, _ = s.env.QueryWorkflow(QueryEvents)
+	var events []BillEvent
+	qr.Get(&events)
+	// the extended period gets its own grace period
+	if got := statusChangedAt(events, BillExpired).Sub(start).Round(time.Minute); got != 210*time.Minute {
+		t.Errorf("expired %v after the start, want 3h30m", got)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Labels(t *testing.T) {
+	var upserted []string
+	s.env.OnUpsertTypedSearchAttributes(mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		upserted, _ = args.Get(0).(temporal.SearchAttributes).GetKeywordList(billLabelsKey)
+	})
+	labels := map[string]string{"team": "payments", "cost-center": "CC-1042"}
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-labels", currency.USD, s.env.Now().Add(time.Hour),
+		BillOptions{Labels: labels, ReopenGraceSeconds: 1}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var b Bill
+	qr.Get(&b)
+	if !reflect.DeepEqual(b.Labels, labels) {
+		t.Errorf("labels = %v, want %v", b.Labels, labels)
+	}
+	if want := []string{"cost-center:CC-1042", "team:payments"}; !reflect.DeepEqual(upserted, want) {
+		t.Errorf("upserted labels = %v, want %v", upserted, want)
+	}
+}
+
+func (s *UnitTestSuite) Test_BillWorkflow_Adjust(t *testing.T) {
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAddLineItem, LineItem{ID: "a1", Name: "Book", Amount: 1500})
+		// adjustments before the bill settles are ignored
+		s.env.SignalWorkflow(SignalAdjust, Adjustment{ID: "early", Amount: 100, Reason: "too early"})
+		s.env.SignalWorkflow(SignalChargeBill, nil)
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(SignalAdjust, Adjustment{ID: "adj-1", Amount: 300, Reason: "late delivery fee"})
+		s.env.SignalWorkflow(SignalAdjust, Adjustment{ID: "adj-2", Amount: -500, Reason: "goodwill credit"})
+		// a retried request, its funds moved once
+		s.env.SignalWorkflow(SignalAdjust, Adjustment{ID: "adj-1", Amount: 300, Reason: "late delivery fee"})
+		// more than the account paid in the end
+		s.env.SignalWorkflow(SignalAdjust, Adjustment{ID: "adj-3", Amount: -5000, Reason: "too generous"})
+	}, time.Hour)
+
+	s.env.ExecuteWorkflow(BillWorkflow, "bill-adjust", currency.USD, s.env.Now().Add(24*time.Hour), BillOptions{}, nil)
+
+	if err := s.env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow error: %v", err)
+	}
+	qr, _ := s.env.QueryWorkflow(QueryBill)
+	var b Bill
+	qr.Get(&b)
+	if b.Status != BillSettled || b.NetTotal != 1300 {
+		t.Fatalf("got %s with net total %d, want SETTLED and 1300", b.Status, b.NetTotal)
+	}
+	if len(b.Adjustments) != 2 || b.Adjustments[0].ID != "adj-1" || b.Adjustments[1].ID != "adj-2" || b.Adjustments[1].At.IsZero() {
+		t.Errorf("adjustments = %+v, want adj-1 and adj-2 with their time", b.Adjustments)
+	}
+	// the account paid 1500, 300 more and got 500 back
+	if want := int64(1_000_000 - 1300); s.balances[currency.USD] != want {
+		t.Errorf("USD balance %d, want %d", s.balances[currency.USD], want)
+	}
+}
@@ -3,8 +3,11 @@
 package currency
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+
+	"pave-fees-api/internal/data"
 )
 
 type Currency string
@@ -14,22 +17,174 @@ const (
 	USD Currency = "USD"
 	EUR Currency = "EUR"
 	GEL Currency = "GEL"
+	JPY Currency = "JPY"
 )
 
+// the enabled currencies of the data registry,
 // used in account service handler to zero out the balances in the response
-var SupportedCurrencies = []Currency{
-	USD,
-	EUR,
-	GEL,
+var SupportedCurrencies = enabled()
+
+func enabled() []Currency {
+	var out []Currency
+	for _, info := range data.ListCurrencies() {
+		if info.Enabled {
+			out = append(out, Currency(info.Code))
+		}
+	}
+	return out
 }
 
-// ParseCurrency converts the input currency string to a canonical Currency type in a case insensitive way
+// returned by Parse for blank input, so callers can tell a missing currency from an unknown one
+var ErrEmptyCurrency = errors.New("currency is empty")
+
+// ParseCurrency converts the input currency string to a canonical Currency type in a case insensitive way,
+// only currencies enabled in the data registry are accepted
 func Parse(raw string) (Currency, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", ErrEmptyCurrency
+	}
 	s := strings.ToUpper(raw)
-	switch Currency(s) {
-	case USD, EUR, GEL:
+	if info, ok := data.LookupCurrency(s); ok && info.Enabled {
 		return Currency(s), nil
+	}
+	return "", fmt.Errorf("unsupported currency '%s'", raw)
+}
+
+// DecimalPlaces reports the number of minor-unit digits of the currency per ISO 4217,
+// unregistered currencies have 2
+func (c Currency) DecimalPlaces() int {
+	if info, ok := data.LookupCurrency(string(c)); ok {
+		return info.DecimalPlaces
+	}
+	return 2
+}
+
+// MinChargeAmount reports the smallest amount in minor units a charge in the currency can be for,
+// unregistered currencies have no minimum
+func MinChargeAmount(c Currency) int64 {
+	if info, ok := data.LookupCurrency(string(c)); ok {
+		return info.MinChargeAmount
+	}
+	return 0
+}
+
+// MaxBillTotal reports the largest total in minor units a single bill in the currency can charge,
+// zero when there is no cap, like for unregistered currencies
+func MaxBillTotal(c Currency) int64 {
+	if info, ok := data.LookupCurrency(string(c)); ok {
+		return info.MaxBillTotal
+	}
+	return 0
+}
+
+// ValidateAmount checks the amount in minor units of a single line item, it has to be positive
+// and within the currency's item maximum. unregistered currencies have no maximum
+func ValidateAmount(c Currency, amount int64) error {
+	if amount <= 0 {
+		return fmt.Errorf("amount must be greater than 0")
+	}
+	if info, ok := data.LookupCurrency(string(c)); ok && info.MaxItemAmount > 0 && amount > info.MaxItemAmount {
+		return fmt.Errorf("amount %s exceeds the %s maximum of %s per item", c.Format(amount), c, c.Format(info.MaxItemAmount))
+	}
+	return nil
+}
+
+var symbols = map[Currency]string{
+	USD: "$",
+	EUR: "€",
+	GEL: "₾",
+	JPY: "¥",
+}
+
+// Format renders an amount in minor units with the currency symbol, e.g. 1234 USD as "$12.34" and 1234 JPY as "¥1234",
+// unknown currencies are prefixed with their code instead
+func (c Currency) Format(minor int64) string {
+	sign := ""
+	// negate in uint64 so the minimum int64 doesn't overflow
+	abs := uint64(minor)
+	if minor < 0 {
+		sign = "-"
+		abs = -abs
+	}
+	sym, ok := symbols[c]
+	if !ok {
+		sym = string(c) + " "
+	}
+
+	places := c.DecimalPlaces()
+	if places == 0 {
+		return fmt.Sprintf("%s%s%d", sign, sym, abs)
+	}
+	unit := uint64(1)
+	for i := 0; i < places; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%s%d.%0*d", sign, sym, abs/unit, places, abs%unit)
+}
+
+// SetRate configures the conversion rate from one currency to another in the data registry, in millionths
+func SetRate(from, to Currency, micros int64) {
+	data.SetRate(string(from), string(to), micros)
+}
+
+// RoundingMode decides how a converted amount that falls between two minor units is rounded
+type RoundingMode string
+
+const (
+	// rounds halves away from zero, the default
+	RoundHalfUp RoundingMode = "HALF_UP"
+	// rounds halves to the even neighbour, aka bankers' rounding
+	RoundHalfEven RoundingMode = "HALF_EVEN"
+	// rounds down to the next lower minor unit, negative amounts away from zero
+	RoundFloor RoundingMode = "FLOOR"
+)
+
+// Valid reports whether the mode is known, the empty mode rounds half up
+func (m RoundingMode) Valid() bool {
+	switch m {
+	case "", RoundHalfUp, RoundHalfEven, RoundFloor:
+		return true
+	}
+	return false
+}
+
+// Convert converts an amount in minor units between currencies, rounded to the target minor unit by mode.
+// the empty mode rounds half up
+func Convert(amount int64, from, to Currency, mode RoundingMode) (int64, error) {
+	if from == to {
+		return amount, nil
+	}
+	if !mode.Valid() {
+		return 0, fmt.Errorf("unknown rounding mode '%s'", mode)
+	}
+	rate, ok := data.Rate(string(from), string(to))
+	if !ok {
+		return 0, fmt.Errorf("no conversion rate from %s to %s", from, to)
+	}
+
+	neg := amount < 0
+	if neg {
+		amount = -amount
+	}
+	// whole minor units and the remainder in millionths of one
+	converted, rem := amount*rate/1_000_000, amount*rate%1_000_000
+	switch mode {
+	case RoundHalfEven:
+		if rem > 500_000 || (rem == 500_000 && converted%2 == 1) {
+			converted++
+		}
+	case RoundFloor:
+		// a negative amount rounds down by growing its magnitude
+		if neg && rem > 0 {
+			converted++
+		}
 	default:
-		return "", fmt.Errorf("unsupported currency '%s'", raw)
+		if rem >= 500_000 {
+			converted++
+		}
+	}
+	if neg {
+		converted = -converted
 	}
+	return converted, nil
 }
@@ -0,0 +1,190 @@
+package currency
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		raw       string
+		want      Currency
+		wantErr   bool
+		wantEmpty bool
+	}{
+		{"USD", USD, false, false},
+		{"jpy", JPY, false, false},
+		{"eur", EUR, false, false},
+		{"GBP", "", true, false}, // registered but disabled
+		{"XXX", "", true, false},
+		{"", "", true, true},
+		{"  \t", "", true, true},
+	}
+
+	for _, tc := range cases {
+		got, err := Parse(tc.raw)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("Parse(%q) = %q, %v, want %q and error %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+		if errors.Is(err, ErrEmptyCurrency) != tc.wantEmpty {
+			t.Errorf("Parse(%q) error = %v, want ErrEmptyCurrency %v", tc.raw, err, tc.wantEmpty)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	cases := []struct {
+		name    string
+		amount  int64
+		from    Currency
+		to      Currency
+		want    int64
+		wantErr bool
+	}{
+		{"same currency", 1234, USD, USD, 1234, false},
+		{"usd to eur", 10000, USD, EUR, 9200, false},
+		{"exact half rounds up", 5, USD, GEL, 14, false}, // 13.5
+		{"negative amount", -10000, USD, EUR, -9200, false},
+		{"unsupported pair", 100, USD, Currency("JPY"), 0, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Convert(tc.amount, tc.from, tc.to, "")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Convert(%d, %s, %s) = %d; want %d", tc.amount, tc.from, tc.to, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConvert_RoundingModes(t *testing.T) {
+	// USD to GEL is 2.7, so 5 and 15 cents land exactly on half a tetri: 13.5 and 40.5
+	cases := []struct {
+		mode   RoundingMode
+		amount int64
+		want   int64
+	}{
+		{"", 15, 41},
+		{RoundHalfUp, 5, 14},
+		{RoundHalfUp, 15, 41},
+		{RoundHalfUp, -15, -41},
+		{RoundHalfEven, 5, 14},
+		{RoundHalfEven, 15, 40},
+		{RoundHalfEven, -15, -40},
+		{RoundFloor, 5, 13},
+		{RoundFloor, 15, 40},
+		{RoundFloor, -15, -41},
+		// amounts that convert exactly aren't rounded by any mode
+		{RoundFloor, 10, 27},
+		{RoundHalfEven, 10, 27},
+	}
+	for _, tc := range cases {
+		got, err := Convert(tc.amount, USD, GEL, tc.mode)
+		if err != nil {
+			t.Fatalf("Convert(%d, %q) failed: %v", tc.amount, tc.mode, err)
+		}
+		if got != tc.want {
+			t.Errorf("Convert(%d, %q) = %d; want %d", tc.amount, tc.mode, got, tc.want)
+		}
+	}
+
+	if _, err := Convert(15, USD, GEL, "HALF_DOWN"); err == nil {
+		t.Error("expected an unknown rounding mode to be rejected")
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	SetRate(GEL, Currency("JPY"), 55_000_000)
+	got, err := Convert(100, GEL, Currency("JPY"), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != 5500 {
+		t.Errorf("Convert = %d; want 5500", got)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		cur   Currency
+		minor int64
+		want  string
+	}{
+		{"usd", USD, 1234, "$12.34"},
+		{"usd pads cents", USD, 5, "$0.05"},
+		{"usd negative", USD, -1234, "-$12.34"},
+		{"eur", EUR, 100000, "€1000.00"},
+		{"jpy has no decimals", JPY, 1234, "¥1234"},
+		{"jpy negative", JPY, -50, "-¥50"},
+		{"zero", GEL, 0, "₾0.00"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.cur.Format(tc.minor); got != tc.want {
+				t.Errorf("Format(%d) = %q, want %q", tc.minor, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecimalPlaces(t *testing.T) {
+	for cur, want := range map[Currency]int{USD: 2, EUR: 2, GEL: 2, JPY: 0} {
+		if got := cur.DecimalPlaces(); got != want {
+			t.Errorf("%s.DecimalPlaces() = %d, want %d", cur, got, want)
+		}
+	}
+}
+
+func TestMinChargeAmount(t *testing.T) {
+	cases := map[Currency]int64{USD: 50, GEL: 100, JPY: 50, Currency("XXX"): 0}
+	for cur, want := range cases {
+		if got := MinChargeAmount(cur); got != want {
+			t.Errorf("MinChargeAmount(%s) = %d, want %d", cur, got, want)
+		}
+	}
+}
+
+func TestMaxBillTotal(t *testing.T) {
+	cases := map[Currency]int64{USD: 10_000_000, EUR: 10_000_000, JPY: 15_000_000, Currency("XXX"): 0}
+	for cur, want := range cases {
+		if got := MaxBillTotal(cur); got != want {
+			t.Errorf("MaxBillTotal(%s) = %d, want %d", cur, got, want)
+		}
+	}
+}
+
+func TestValidateAmount(t *testing.T) {
+	cases := []struct {
+		name    string
+		cur     Currency
+		amount  int64
+		wantErr bool
+	}{
+		{"valid", USD, 1500, false},
+		{"at the maximum", USD, 5_000_000, false},
+		{"over the maximum", USD, 5_000_001, true},
+		{"zero decimal currency at the maximum", JPY, 7_500_000, false},
+		{"zero decimal currency over the maximum", JPY, 7_500_001, true},
+		{"zero", USD, 0, true},
+		{"negative", USD, -100, true},
+		{"unregistered currency has no maximum", Currency("XXX"), 1 << 40, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateAmount(tc.cur, tc.amount); (err != nil) != tc.wantErr {
+				t.Errorf("ValidateAmount(%s, %d) = %v, want error %v", tc.cur, tc.amount, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Package data holds the reference data of the billing system, the registered currencies, their conversion rates,
+// the product catalog and the bill templates.
+//
+// Like the account ledger it is kept in memory for demonstration purposes, we'd load it from a DB in a real app
+package data
+
+import (
+	"strings"
+	"sync"
+)
+
+// a registered currency, only enabled ones are accepted by the API
+type CurrencyInfo struct {
+	Code          string `json:"code"`
+	DecimalPlaces int    `json:"decimal_places"`
+	Enabled       bool   `json:"enabled"`
+	// smallest amount in minor units processors accept for a charge
+	MinChargeAmount int64 `json:"min_charge_amount"`
+	// largest total in minor units a single bill can charge, set by risk
+	MaxBillTotal int64 `json:"max_bill_total"`
+	// largest amount in minor units of a single line item
+	MaxItemAmount int64 `json:"max_item_amount"`
+}
+
+type pair struct{ from, to string }
+
+// a product of the catalog, bills that only take catalog items check item names against it
+type Product struct {
+	SKU  string `json:"sku"`
+	Name string `json:"name"`
+}
+
+// the product catalog, it doesn't change at runtime so it isn't guarded by mu
+var products = []Product{
+	{SKU: "BK-1", Name: "Book"},
+	{SKU: "PN-1", Name: "Pen"},
+	{SKU: "NB-1", Name: "Notebook"},
+	{SKU: "ST-1", Name: "Seat"},
+	{SKU: "SP-1", Name: "Support plan"},
+}
+
+// an item of a bill template, amounts are in minor units of the template currency
+type TemplateItem struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Amount int64  `json:"amount"`
+}
+
+// the items a recurring bill starts with, e.g. a monthly plan
+type Template struct {
+	ID       string         `json:"id"`
+	Currency string         `json:"currency"`
+	Items    []TemplateItem `json:"items"`
+}
+
+// the bill templates, they don't change at runtime so they aren't guarded by mu
+var templates = []Template{
+	{ID: "support-monthly", Currency: "USD", Items: []TemplateItem{
+		{ID: "support", Name: "Support plan", Amount: 4900},
+		{ID: "seat", Name: "Seat", Amount: 1500},
+	}},
+	{ID: "stationery", Currency: "EUR", Items: []TemplateItem{
+		{ID: "notebook", Name: "Notebook", Amount: 850},
+		{ID: "pen", Name: "Pen", Amount: 250},
+	}},
+}
+
+// registered currencies in listing order and conversion rates in millionths of a target minor unit per source minor unit,
+// both protected by mu
+var (
+	mu         sync.RWMutex
+	currencies = []CurrencyInfo{
+		{Code: "USD", DecimalPlaces: 2, Enabled: true, MinChargeAmount: 50, MaxBillTotal: 10_000_000, MaxItemAmount: 5_000_000},
+		{Code: "EUR", DecimalPlaces: 2, Enabled: true, MinChargeAmount: 50, MaxBillTotal: 10_000_000, MaxItemAmount: 5_000_000},
+		{Code: "GEL", DecimalPlaces: 2, Enabled: true, MinChargeAmount: 100, MaxBillTotal: 25_000_000, MaxItemAmount: 12_500_000},
+		{Code: "JPY", DecimalPlaces: 0, Enabled: true, MinChargeAmount: 50, MaxBillTotal: 15_000_000, MaxItemAmount: 7_500_000},
+		// registered ahead of being offered
+		{Code: "GBP", DecimalPlaces: 2, Enabled: false, MinChargeAmount: 30, MaxBillTotal: 8_000_000, MaxItemAmount: 4_000_000},
+	}
+	rates = map[pair]int64{
+		{"USD", "EUR"}: 920_000,
+		{"EUR", "USD"}: 1_087_000,
+		{"USD", "GEL"}: 2_700_000,
+		{"GEL", "USD"}: 370_000,
+		{"EUR", "GEL"}: 2_930_000,
+		{"GEL", "EUR"}: 341_000,
+	}
+)
+
+// ListCurrencies returns every registered currency, enabled or not, in listing order
+func ListCurrencies() []CurrencyInfo {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]CurrencyInfo(nil), currencies...)
+}
+
+// LookupCurrency returns the registered currency with the code, the code is matched exactly
+func LookupCurrency(code string) (CurrencyInfo, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, c := range currencies {
+		if c.Code == code {
+			return c, true
+		}
+	}
+	return CurrencyInfo{}, false
+}
+
+// Rate returns the conversion rate from one currency to another in millionths, false when there is none
+func Rate(from, to string) (int64, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	rate, ok := rates[pair{from, to}]
+	return rate, ok
+}
+
+// SetRate configures the conversion rate from one currency to another, in millionths
+func SetRate(from, to string, micros int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	rates[pair{from, to}] = micros
+}
+
+// LookupProduct returns the catalog product with the name, matched case-insensitively and ignoring surrounding spaces
+func LookupProduct(name string) (Product, bool) {
+	name = strings.TrimSpace(name)
+	for _, p := range products {
+		if strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return Product{}, false
+}
+
+// LookupTemplate returns the bill template with the ID, its items are a copy the caller can change
+func LookupTemplate(id string) (Template, bool) {
+	for _, t := range templates {
+		if t.ID == id {
+			t.Items = append([]TemplateItem(nil), t.Items...)
+			return t, true
+		}
+	}
+	return Template{}, false
+}
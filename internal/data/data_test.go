@@ -0,0 +1,72 @@
+package data
+
+import "testing"
+
+func TestRate(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to string
+		want     int64
+		wantOK   bool
+	}{
+		{"registered pair", "USD", "EUR", 920_000, true},
+		{"reverse pair", "EUR", "USD", 1_087_000, true},
+		{"missing pair", "USD", "JPY", 0, false},
+		{"unregistered currency", "USD", "XXX", 0, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := Rate(tc.from, tc.to)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("Rate(%s, %s) = %d, %v, want %d, %v", tc.from, tc.to, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestLookupCurrency(t *testing.T) {
+	if info, ok := LookupCurrency("JPY"); !ok || info.DecimalPlaces != 0 || !info.Enabled {
+		t.Errorf("LookupCurrency(JPY) = %+v, %v, want an enabled currency with 0 decimal places", info, ok)
+	}
+	if info, ok := LookupCurrency("GBP"); !ok || info.Enabled {
+		t.Errorf("LookupCurrency(GBP) = %+v, %v, want a registered disabled currency", info, ok)
+	}
+	if _, ok := LookupCurrency("usd"); ok {
+		t.Error("LookupCurrency(usd) found a currency, want codes matched exactly")
+	}
+}
+
+func TestLookupProduct(t *testing.T) {
+	cases := []struct {
+		name    string
+		wantSKU string
+		wantOK  bool
+	}{
+		{"Book", "BK-1", true},
+		{"  support PLAN ", "SP-1", true},
+		{"Bookmark", "", false},
+		{"", "", false},
+	}
+
+	for _, tc := range cases {
+		got, ok := LookupProduct(tc.name)
+		if got.SKU != tc.wantSKU || ok != tc.wantOK {
+			t.Errorf("LookupProduct(%q) = %+v, %v, want %s, %v", tc.name, got, ok, tc.wantSKU, tc.wantOK)
+		}
+	}
+}
+
+func TestLookupTemplate(t *testing.T) {
+	tmpl, ok := LookupTemplate("support-monthly")
+	if !ok || tmpl.Currency != "USD" || len(tmpl.Items) != 2 {
+		t.Fatalf("LookupTemplate(support-monthly) = %+v, %v, want a USD template with 2 items", tmpl, ok)
+	}
+	tmpl.Items[0].Amount = 1
+	if again, _ := LookupTemplate("support-monthly"); again.Items[0].Amount != 4900 {
+		t.Errorf("changing a looked up template changed the registry, amount is %d", again.Items[0].Amount)
+	}
+	if _, ok := LookupTemplate("missing"); ok {
+		t.Error("LookupTemplate(missing) found a template")
+	}
+}